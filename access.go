@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// accessDir - directory in default disk shadow where access entities are stored, so it's uploaded with data
+const accessDir = "access"
+
+// accessFiles - files with statements in order they are replayed, roles must exist before users and grants
+var accessFiles = []string{"roles.sql", "users.sql", "grants.sql", "row_policies.sql"}
+
+// createAccessRe - CREATE statement of access entity without IF NOT EXISTS
+var createAccessRe = regexp.MustCompile("(?i)^CREATE\\s+(USER|ROLE|ROW\\s+POLICY|POLICY)\\s+")
+
+// quoteIdentifier - quote name of access entity for SHOW queries
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "\\`", -1) + "`"
+}
+
+// showStatements - run SHOW query and return its statements
+func (ch *ClickHouse) showStatements(query string) ([]string, error) {
+	var statements []string
+	if err := ch.selectQuery(&statements, query); err != nil {
+		return nil, fmt.Errorf("can't execute '%s' with: %v", query, err)
+	}
+	return statements, nil
+}
+
+// GetAccessStatements - CREATE statements and grants of users, roles and row policies by file name,
+// users from skipUsers and users defined in users.xml are skipped
+func (ch *ClickHouse) GetAccessStatements(skipUsers []string) (map[string][]string, error) {
+	result := make(map[string][]string)
+	skip := make(map[string]bool)
+	for _, name := range skipUsers {
+		skip[name] = true
+	}
+	var roles []string
+	if err := ch.selectQuery(&roles, "SELECT name FROM system.roles WHERE storage != 'users.xml' ORDER BY name"); err != nil {
+		return nil, fmt.Errorf("can't get roles with: %v", err)
+	}
+	var users []string
+	if err := ch.selectQuery(&users, "SELECT name FROM system.users WHERE storage != 'users.xml' ORDER BY name"); err != nil {
+		return nil, fmt.Errorf("can't get users with: %v", err)
+	}
+	for _, role := range roles {
+		statements, err := ch.showStatements("SHOW CREATE ROLE " + quoteIdentifier(role))
+		if err != nil {
+			return nil, err
+		}
+		result["roles.sql"] = append(result["roles.sql"], statements...)
+		if statements, err = ch.showStatements("SHOW GRANTS FOR " + quoteIdentifier(role)); err != nil {
+			return nil, err
+		}
+		result["grants.sql"] = append(result["grants.sql"], statements...)
+	}
+	for _, user := range users {
+		if skip[user] {
+			logger.WithField("user", user).Info("skip access of user")
+			continue
+		}
+		statements, err := ch.showStatements("SHOW CREATE USER " + quoteIdentifier(user))
+		if err != nil {
+			return nil, err
+		}
+		result["users.sql"] = append(result["users.sql"], statements...)
+		if statements, err = ch.showStatements("SHOW GRANTS FOR " + quoteIdentifier(user)); err != nil {
+			return nil, err
+		}
+		result["grants.sql"] = append(result["grants.sql"], statements...)
+	}
+	var policies []struct {
+		Name     string `db:"short_name"`
+		Database string `db:"database"`
+		Table    string `db:"table"`
+	}
+	if err := ch.selectQuery(&policies, "SELECT short_name, database, table FROM system.row_policies WHERE storage != 'users.xml' ORDER BY database, table, short_name"); err != nil {
+		return nil, fmt.Errorf("can't get row policies with: %v", err)
+	}
+	for _, policy := range policies {
+		statements, err := ch.showStatements(fmt.Sprintf("SHOW CREATE ROW POLICY %s ON %s.%s", quoteIdentifier(policy.Name), quoteIdentifier(policy.Database), quoteIdentifier(policy.Table)))
+		if err != nil {
+			return nil, err
+		}
+		result["row_policies.sql"] = append(result["row_policies.sql"], statements...)
+	}
+	return result, nil
+}
+
+// freezeAccess - write access statements to access directory of shadow, one statement per line
+func freezeAccess(ch *ClickHouse, shadowPath string, skipUsers []string) error {
+	statements, err := ch.GetAccessStatements(skipUsers)
+	if err != nil {
+		return err
+	}
+	dir := path.Join(shadowPath, accessDir)
+	if ch.DryRun {
+		for _, file := range accessFiles {
+			logger.WithField("path", path.Join(dir, file)).Infof("DRY-RUN: write %d statements", len(statements[file]))
+		}
+		return nil
+	}
+	// shadow is created before freeze, so it must belong to clickhouse
+	for _, name := range []string{shadowPath, dir} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Mkdir(name, 0750); err != nil {
+			return fmt.Errorf("can't create '%s' with: %v", name, err)
+		}
+		if err := ch.Chown(name); err != nil {
+			return fmt.Errorf("can't change owner of '%s' with: %v", name, err)
+		}
+	}
+	for _, file := range accessFiles {
+		var content strings.Builder
+		for _, statement := range statements[file] {
+			content.WriteString(strings.Replace(statement, "\n", " ", -1))
+			content.WriteString("\n")
+		}
+		// statements contain password hashes
+		if err := ioutil.WriteFile(path.Join(dir, file), []byte(content.String()), 0600); err != nil {
+			return fmt.Errorf("can't write access statements with: %v", err)
+		}
+		if err := ch.Chown(path.Join(dir, file)); err != nil {
+			return fmt.Errorf("can't change owner of '%s' with: %v", file, err)
+		}
+	}
+	logger.WithFields(Fields{"dir": dir, "roles": len(statements["roles.sql"]), "users": len(statements["users.sql"]), "row_policies": len(statements["row_policies.sql"])}).Info("access is saved")
+	return nil
+}
+
+// ifNotExists - add IF NOT EXISTS to CREATE statement, so existing entities are kept
+func ifNotExists(statement string) string {
+	if match := createAccessRe.FindStringIndex(statement); match != nil {
+		return statement[:match[1]] + "IF NOT EXISTS " + statement[match[1]:]
+	}
+	return statement
+}
+
+// restoreAccess - replay access statements from downloaded backup, existing users, roles and row policies aren't changed
+// but grants are added to them
+func restoreAccess(config Config, dryRun bool) error {
+	ch := &ClickHouse{
+		DryRun: dryRun,
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return connectionError(fmt.Errorf("can't connect to clickouse with: %v", err))
+	}
+	defer ch.Close()
+	dataPath, err := ch.GetDataPath()
+	if err != nil {
+		return err
+	}
+	dir := path.Join(dataPath, config.ClickHouse.BackupDir, "shadow", accessDir)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return fmt.Errorf("%s doesn't exist, backup was made without access or isn't downloaded", dir)
+	}
+	for _, file := range accessFiles {
+		statements, err := readStatements(path.Join(dir, file))
+		if err != nil {
+			return err
+		}
+		for _, statement := range statements {
+			query := ifNotExists(statement)
+			if dryRun {
+				logger.WithField("file", file).Infof("DRY-RUN: %s", query)
+				continue
+			}
+			if err := ch.execQuery(query, ch.Config.QueryTimeout); err != nil {
+				return fmt.Errorf("can't restore access from %s with: %v", file, err)
+			}
+		}
+		logger.WithField("file", file).Infof("%d statements are restored", len(statements))
+	}
+	return nil
+}
+
+// readStatements - read not empty lines of file, missing file has no statements
+func readStatements(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var statements []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			statements = append(statements, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read '%s' with: %v", name, err)
+	}
+	return statements, nil
+}
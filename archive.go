@@ -2,22 +2,43 @@ package main
 
 import (
 	tarArchive "archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	// tarMagic - magic of ustar, pax and gnu formats at tarMagicOffset of the first header
+	tarMagic       = []byte("ustar")
+	tarMagicOffset = 257
 )
 
 // TarDirs - add bunch of directories to tarball
-func TarDirs(w io.Writer, dirs ...string) error {
-	tw := tarArchive.NewWriter(w)
+func TarDirs(ctx context.Context, w io.Writer, dirs ...string) error {
+	tw := newTarWriter(w)
 	defer tw.Close()
 	for _, dir := range dirs {
-		if err := TarDir(tw, dir); err != nil {
+		if err := TarDir(ctx, tw, dir); err != nil {
 			return err
 		}
 	}
@@ -25,8 +46,13 @@ func TarDirs(w io.Writer, dirs ...string) error {
 }
 
 // TarDir - add directory to tarball
-func TarDir(tw *tarArchive.Writer, dir string) error {
-	return tarDir(tw, dir)
+func TarDir(ctx context.Context, tw *tarWriter, dir string) error {
+	return tarDir(ctx, tw, dir, filepath.Base(dir), false)
+}
+
+// TarDirAs - add directory to tarball with name instead of base name of directory, symlinks are skipped if skipSymlinks is set
+func TarDirAs(ctx context.Context, tw *tarWriter, dir string, name string, skipSymlinks bool) error {
+	return tarDir(ctx, tw, dir, name, skipSymlinks)
 }
 
 type devino struct {
@@ -34,16 +60,164 @@ type devino struct {
 	Ino uint64
 }
 
-func tarDir(tw *tarArchive.Writer, dir string) (err error) {
+// tarChecksumsName - the last entry of tarball with sha256 of every file in it, files are checked against it
+// on extraction and it isn't extracted
+const tarChecksumsName = "checksums.txt"
+
+// freezeDirRe - directory of freeze in name of file of shadow, it's named by freeze name or by increment of clickhouse
+var freezeDirRe = regexp.MustCompile(`^((?:disks/[^/]+/)?shadow)/[^/]+/((?:data|store)/)`)
+
+// checksumKey - name of file in tarball without directory of freeze, so checksums of the same data frozen
+// under different names are the same
+func checksumKey(name string) string {
+	return freezeDirRe.ReplaceAllString(name, "$1/$2")
+}
+
+// tarWriter - tar writer which is shared by tarDir calls, directories can be added from several goroutines,
+// every entry is written under lock and hard links are detected across all added directories
+type tarWriter struct {
+	mu    sync.Mutex
+	tw    *tarArchive.Writer
+	seen  map[devino]string
+	names *ownerNames
+	// sums - sha256 of files by checksumKey of name in tarball, it is calculated while files are copied to tarball
+	sums   Checksums
+	digest string
+}
+
+func newTarWriter(w io.Writer) *tarWriter {
+	return &tarWriter{
+		tw:    tarArchive.NewWriter(w),
+		seen:  make(map[devino]string),
+		names: newOwnerNames(),
+		sums:  make(Checksums),
+	}
+}
+
+// Close - write checksums of files as the last entry and tar footer, it must be called after all directories are added
+func (t *tarWriter) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	content := t.sums.Marshal()
+	header := &tarArchive.Header{
+		Name:     tarChecksumsName,
+		Typeflag: tarArchive.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(content)),
+		// constant time keeps tarballs of identical directories identical
+		ModTime: time.Unix(0, 0),
+	}
+	if err := t.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := t.tw.Write(content); err != nil {
+		return err
+	}
+	t.digest = fmt.Sprintf("%x", sha256.Sum256(content))
+	return t.tw.Close()
+}
+
+// Digest - sha256 of checksums of all files in tarball, it's the same for tarballs with the same files,
+// it's known after Close
+func (t *tarWriter) Digest() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.digest
+}
+
+// tarEntry - type of entry which is written by addFile
+type tarEntry int
+
+const (
+	tarEntrySkipped tarEntry = iota
+	tarEntryFile
+	tarEntryHardLink
+	tarEntrySymlink
+)
+
+// addFile - write header and content of file as filename, file which is already in tarball is written as hard link
+func (t *tarWriter) addFile(ctx context.Context, file string, fi os.FileInfo, filename string, linkTarget string) (tarEntry, error) {
+	header, err := tarArchive.FileInfoHeader(fi, linkTarget)
+	if err != nil {
+		return tarEntrySkipped, err
+	}
+	header.Name = filename
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := fi.Sys().(*syscall.Stat_t)
+	header.Mode = int64(st.Mode & 07777)
+	header.Uid = int(st.Uid)
+	header.Gid = int(st.Gid)
+	header.Uname = t.names.user(st.Uid)
+	header.Gname = t.names.group(st.Gid)
+	if header.Typeflag == tarArchive.TypeSymlink {
+		return tarEntrySymlink, t.tw.WriteHeader(header)
+	}
+	di := devino{
+		Dev: st.Dev,
+		Ino: st.Ino,
+	}
+	if orig, ok := t.seen[di]; ok {
+		header.Typeflag = tarArchive.TypeLink
+		header.Linkname = orig
+		header.Size = 0
+		t.sums[checksumKey(filename)] = t.sums[checksumKey(orig)]
+		return tarEntryHardLink, t.tw.WriteHeader(header)
+	}
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		logger.WithField("path", file).Warn("skip vanished file")
+		return tarEntrySkipped, nil
+	}
+	if err != nil {
+		return tarEntrySkipped, err
+	}
+	defer f.Close()
+	// size could be changed since walk, header must have size of data which is copied
+	if fi, err = f.Stat(); err != nil {
+		return tarEntrySkipped, err
+	}
+	header.Size = fi.Size()
+
+	if err := t.tw.WriteHeader(header); err != nil {
+		return tarEntrySkipped, err
+	}
+	// checksum is calculated by the same read, so file is never read twice
+	sum := sha256.New()
+	n, err := io.CopyN(io.MultiWriter(t.tw, sum), &contextReader{ctx: ctx, r: f}, header.Size)
+	if err == io.EOF {
+		return tarEntrySkipped, fmt.Errorf("%s was truncated while it was archived, copied %d of %d bytes", file, n, header.Size)
+	}
+	if err != nil {
+		return tarEntrySkipped, err
+	}
+	t.seen[di] = filename
+	t.sums[checksumKey(filename)] = fmt.Sprintf("%x", sum.Sum(nil))
+	return tarEntryFile, nil
+}
+
+// tarFile - file of directory which is added to tarball as name
+type tarFile struct {
+	path       string
+	info       os.FileInfo
+	name       string
+	linkTarget string
+}
+
+// tarDir - add files of dir to tarball under name, symlinks are stored as symlinks and never followed
+func tarDir(ctx context.Context, tw *tarWriter, dir string, name string, skipSymlinks bool) (err error) {
 	t0 := time.Now()
 	nFiles := 0
 	hLinks := 0
+	symLinks := 0
 	defer func() {
 		td := time.Since(t0)
 		if err == nil {
-			log.Printf("added to tarball with: %d files, %d hard links (%v)", nFiles, hLinks, td)
+			logger.WithFields(Fields{"dir": dir, "files": nFiles, "hard_links": hLinks, "symlinks": symLinks, "duration": td}).Info("added to tarball")
 		} else {
-			log.Printf("error adding to tarball after %d files, %d hard links, %v: %v", nFiles, hLinks, td, err)
+			logger.WithFields(Fields{"dir": dir, "files": nFiles, "hard_links": hLinks, "symlinks": symLinks, "duration": td}).Errorf("error adding to tarball: %v", err)
 		}
 	}()
 
@@ -55,82 +229,310 @@ func tarDir(tw *tarArchive.Writer, dir string) (err error) {
 		return fmt.Errorf("data path is not a directory - %s", dir)
 	}
 
-	seen := make(map[devino]string)
-
-	return filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
-
+	// all files are collected before they are written and are written in order of their names in tarball,
+	// so identical directories produce identical tarballs and the first of hard links is always the same
+	var files []tarFile
+	if err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// parts in shadow can be removed by clean while they are archived
+			logger.WithField("path", file).Warn("skip vanished file")
+			return nil
+		}
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		if fi.IsDir() {
 			return nil
 		}
 
-		header, err := tarArchive.FileInfoHeader(fi, "")
+		linkTarget := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if skipSymlinks {
+				logger.WithField("path", file).Info("skip symlink")
+				return nil
+			}
+			if linkTarget, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+
+		files = append(files, tarFile{
+			path:       file,
+			info:       fi,
+			name:       strings.TrimPrefix(strings.Replace(file, dir, name, -1), string(filepath.Separator)),
+			linkTarget: linkTarget,
+		})
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entry, err := tw.addFile(ctx, file.path, file.info, file.name, file.linkTarget)
 		if err != nil {
 			return err
 		}
+		switch entry {
+		case tarEntryFile:
+			nFiles++
+		case tarEntryHardLink:
+			hLinks++
+		case tarEntrySymlink:
+			symLinks++
+		}
+	}
+	return nil
+}
+
+// ownerNames - cache of user and group names by id for tar headers
+type ownerNames struct {
+	users  map[uint32]string
+	groups map[uint32]string
+}
 
-		filename := strings.TrimPrefix(strings.Replace(file, dir, filepath.Base(dir), -1), string(filepath.Separator))
-		header.Name = filename
+func newOwnerNames() *ownerNames {
+	return &ownerNames{
+		users:  make(map[uint32]string),
+		groups: make(map[uint32]string),
+	}
+}
 
-		st := fi.Sys().(*syscall.Stat_t)
-		di := devino{
-			Dev: st.Dev,
-			Ino: st.Ino,
+func (n *ownerNames) user(uid uint32) string {
+	name, ok := n.users[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.Itoa(int(uid))); err == nil {
+			name = u.Username
 		}
-		orig, ok := seen[di]
-		if ok {
-			header.Typeflag = tarArchive.TypeLink
-			header.Linkname = orig
-			header.Size = 0
+		n.users[uid] = name
+	}
+	return name
+}
 
-			err = tw.WriteHeader(header)
-			if err != nil {
-				return err
-			}
+func (n *ownerNames) group(gid uint32) string {
+	name, ok := n.groups[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.Itoa(int(gid))); err == nil {
+			name = g.Name
+		}
+		n.groups[gid] = name
+	}
+	return name
+}
 
-			hLinks++
-			return nil
+// fileOwner - owner of extracted files
+type fileOwner struct {
+	Uid int
+	Gid int
+}
+
+// parseOwner - parse "user:group" with names or numeric ids
+func parseOwner(value string) (*fileOwner, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("'%s' should be in user:group format", value)
+	}
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		u, err := user.Lookup(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("can't find user '%s': %v", parts[0], err)
 		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	gid, err := strconv.Atoi(parts[1])
+	if err != nil {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("can't find group '%s': %v", parts[1], err)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return &fileOwner{Uid: uid, Gid: gid}, nil
+}
 
-		if err := tw.WriteHeader(header); err != nil {
-			return err
+// headerOwner - owner of file from tar header, names are preferred over ids like GNU tar does
+func headerOwner(h *tarArchive.Header) fileOwner {
+	owner := fileOwner{Uid: h.Uid, Gid: h.Gid}
+	if h.Uname != "" {
+		if u, err := user.Lookup(h.Uname); err == nil {
+			owner.Uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if h.Gname != "" {
+		if g, err := user.LookupGroup(h.Gname); err == nil {
+			owner.Gid, _ = strconv.Atoi(g.Gid)
 		}
+	}
+	return owner
+}
 
-		f, err := os.Open(file)
+// archivePartName - name of numbered part of archive which is split by backup.max_archive_size
+func archivePartName(name string, n int) string {
+	return fmt.Sprintf("%s.%03d", name, n)
+}
+
+// chunkWriter - write archive to file and roll it into numbered parts path.001, path.002, ... when maxSize is reached,
+// archive is split by bytes so concatenated parts are the same tarball and hard links can span parts
+type chunkWriter struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	written int64
+	hash    hash.Hash
+	parts   []string
+	sums    []string
+	// total - sha256 of the whole archive
+	total hash.Hash
+}
+
+func newChunkWriter(file *os.File, maxSize int64) *chunkWriter {
+	return &chunkWriter{path: file.Name(), maxSize: maxSize, file: file, hash: sha256.New(), total: sha256.New()}
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if w.maxSize > 0 && w.written == w.maxSize {
+			if err := w.next(); err != nil {
+				return total, err
+			}
+		}
+		chunk := p
+		if w.maxSize > 0 && int64(len(chunk)) > w.maxSize-w.written {
+			chunk = chunk[:w.maxSize-w.written]
+		}
+		n, err := w.file.Write(chunk)
+		w.hash.Write(chunk[:n])
+		w.total.Write(chunk[:n])
+		total += n
+		w.written += int64(n)
+		p = p[n:]
 		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// next - close current part and create the next one, the first file is renamed to path.001
+func (w *chunkWriter) next() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if len(w.parts) == 0 {
+		first := archivePartName(w.path, 1)
+		if err := os.Rename(w.path, first); err != nil {
 			return err
 		}
-		defer f.Close()
+		w.parts = []string{first}
+	}
+	w.sums = append(w.sums, fmt.Sprintf("%x", w.hash.Sum(nil)))
+	name := archivePartName(w.path, len(w.parts)+1)
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.written = 0
+	w.hash = sha256.New()
+	w.parts = append(w.parts, name)
+	return nil
+}
 
-		io.Copy(tw, f)
+// Close - close the last part and return paths of all parts with their sha256,
+// archive which doesn't reach maxSize is stored in a single file at path
+func (w *chunkWriter) Close() ([]string, []string, error) {
+	if err := w.file.Close(); err != nil {
+		return nil, nil, err
+	}
+	sums := append(w.sums, fmt.Sprintf("%x", w.hash.Sum(nil)))
+	if len(w.parts) == 0 {
+		return []string{w.path}, sums, nil
+	}
+	return w.parts, sums, nil
+}
 
-		seen[di] = filename
-		nFiles++
+// Sum - sha256 of the whole archive which is written
+func (w *chunkWriter) Sum() string {
+	return fmt.Sprintf("%x", w.total.Sum(nil))
+}
 
-		return nil
-	})
+// Remove - remove all parts which are written
+func (w *chunkWriter) Remove() {
+	w.file.Close()
+	os.Remove(w.path)
+	for _, part := range w.parts {
+		os.Remove(part)
+	}
 }
 
-// Untar - extract contents of tarball to specified destination
-func Untar(r io.Reader, extractDir string) (err error) {
+// decompressArchive - detect compression of archive by magic bytes and return reader of tarball,
+// gzip and zstd are supported, uncompressed tarball is returned as is
+func decompressArchive(r io.Reader, name string) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(tarMagicOffset + len(tarMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("can't read header of '%s': %v", name, err)
+	}
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("can't read gzip archive '%s': %v", name, err)
+		}
+		return gr, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("can't read zstd archive '%s': %v", name, err)
+		}
+		return zr.IOReadCloser(), nil
+	case len(header) == tarMagicOffset+len(tarMagic) && bytes.Equal(header[tarMagicOffset:], tarMagic):
+		return ioutil.NopCloser(br), nil
+	}
+	return nil, fmt.Errorf("'%s' is not a tarball, gzip or zstd archive", name)
+}
+
+// Untar - extract contents of tarball to specified destination, files and directories get mode from tarball
+// and owner passed in chown or from tarball if process can change owner. Parent directories
+// which aren't in tarball are created with dirMode. Extracted files are checked against checksums
+// embedded into tarball, tarballs without them aren't checked unless requireChecksums is set, so tarball
+// truncated at boundary of entry isn't extracted silently
+func Untar(ctx context.Context, r io.Reader, extractDir string, chown *fileOwner, dirMode os.FileMode, requireChecksums bool) (err error) {
 	t0 := time.Now()
 	nFiles := 0
 	madeDir := map[string]bool{}
 	defer func() {
 		td := time.Since(t0)
 		if err == nil {
-			log.Printf("extracted tarball into %s: %d files, %d dirs (%v)", extractDir, nFiles, len(madeDir), td)
+			logger.WithFields(Fields{"dir": extractDir, "files": nFiles, "dirs": len(madeDir), "duration": td}).Info("extracted tarball")
 		} else {
-			log.Printf("error extracting tarball into %s after %d files, %d dirs, %v: %v", extractDir, nFiles, len(madeDir), td, err)
+			logger.WithFields(Fields{"dir": extractDir, "files": nFiles, "dirs": len(madeDir), "duration": td}).Errorf("error extracting tarball: %v", err)
 		}
 	}()
-	tr := tarArchive.NewReader(r)
+	tr := tarArchive.NewReader(&contextReader{ctx: ctx, r: r})
 	loggedChtimesError := false
+	preserveOwner := chown == nil && os.Geteuid() == 0
 
 	seen := make(map[string]string)
+	// mode of directories from tarball is set at the end, so files can be created in read-only directories
+	dirModes := make(map[string]os.FileMode)
+	// sha256 of extracted files and hard links by checksumKey of name in tarball
+	extracted := make(Checksums)
+	links := make(map[string]string)
+	// symlinks which are created by extraction, entries can't be written through them
+	symlinks := make(map[string]bool)
+	var embedded Checksums
 
 	for {
 		f, err := tr.Next()
@@ -138,18 +540,32 @@ func Untar(r io.Reader, extractDir string) (err error) {
 			break
 		}
 		if err != nil {
-			log.Printf("tar reading error: %v", err)
+			logger.Errorf("tar reading error: %v", err)
 			return fmt.Errorf("tar error: %v", err)
 		}
 		if !validRelPath(f.Name) {
 			return fmt.Errorf("tar contained invalid name error %q", f.Name)
 		}
-
-		rel := filepath.FromSlash(f.Name)
-		abs := filepath.Join(extractDir, rel)
+		abs, err := extractPath(extractDir, extractDir, f.Name, symlinks)
+		if err != nil {
+			return fmt.Errorf("tar entry %q: %v", f.Name, err)
+		}
+		if symlinks[abs] && f.Typeflag != tarArchive.TypeSymlink {
+			return fmt.Errorf("tar entry %q would be written through symlink", f.Name)
+		}
 
 		fi := f.FileInfo()
 		mode := fi.Mode()
+		if f.Name == tarChecksumsName && mode.IsRegular() {
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return fmt.Errorf("can't read %s of tarball: %v", tarChecksumsName, err)
+			}
+			if embedded, err = ParseChecksums(content); err != nil {
+				return fmt.Errorf("can't parse %s of tarball: %v", tarChecksumsName, err)
+			}
+			continue
+		}
 		switch {
 		case mode.IsRegular():
 			// Make the directory. This is redundant because it should
@@ -158,7 +574,7 @@ func Untar(r io.Reader, extractDir string) (err error) {
 			// write will fail with the same error.
 			dir := filepath.Dir(abs)
 			if !madeDir[dir] {
-				if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+				if err := mkdirAllMode(dir, dirMode); err != nil {
 					return err
 				}
 				madeDir[dir] = true
@@ -166,7 +582,12 @@ func Untar(r io.Reader, extractDir string) (err error) {
 
 			if f.Size == 0 && f.Linkname != "" {
 				// this is a hard link for another file. save it and create at the end
-				seen[abs] = filepath.Join(extractDir, f.Linkname)
+				target, err := extractPath(extractDir, extractDir, f.Linkname, symlinks)
+				if err != nil {
+					return fmt.Errorf("tar entry %q link: %v", f.Name, err)
+				}
+				seen[abs] = target
+				links[checksumKey(f.Name)] = checksumKey(f.Linkname)
 				continue
 			}
 
@@ -174,7 +595,8 @@ func Untar(r io.Reader, extractDir string) (err error) {
 			if err != nil {
 				return err
 			}
-			n, err := io.Copy(wf, tr)
+			sum := sha256.New()
+			n, err := io.Copy(io.MultiWriter(wf, sum), tr)
 			if closeErr := wf.Close(); closeErr != nil && err == nil {
 				err = closeErr
 			}
@@ -184,6 +606,21 @@ func Untar(r io.Reader, extractDir string) (err error) {
 			if n != f.Size {
 				return fmt.Errorf("only wrote %d bytes to %s; expected %d", n, abs, f.Size)
 			}
+			extracted[checksumKey(f.Name)] = fmt.Sprintf("%x", sum.Sum(nil))
+			// mode of OpenFile is limited by umask
+			if err := os.Chmod(abs, mode.Perm()); err != nil {
+				return err
+			}
+			if chown != nil {
+				if err := os.Lchown(abs, chown.Uid, chown.Gid); err != nil {
+					return err
+				}
+			} else if preserveOwner {
+				owner := headerOwner(f)
+				if err := os.Lchown(abs, owner.Uid, owner.Gid); err != nil {
+					return err
+				}
+			}
 			modTime := f.ModTime
 			if modTime.After(t0) {
 				// Clamp modtimes at system time. See
@@ -199,29 +636,145 @@ func Untar(r io.Reader, extractDir string) (err error) {
 					// on it anywhere (the gomote push command relies
 					// on digests only), so this is a little pointless
 					// for now.
-					log.Printf("error changing modtime: %v (further Chtimes errors suppressed)", err)
+					logger.Infof("error changing modtime: %v (further Chtimes errors suppressed)", err)
 					loggedChtimesError = true // once is enough
 				}
 			}
 			nFiles++
 		case mode.IsDir():
-			if err := os.MkdirAll(abs, 0755); err != nil {
+			if err := mkdirAllMode(abs, dirMode); err != nil {
 				return err
 			}
 			madeDir[abs] = true
+			dirModes[abs] = mode.Perm()
+		case mode&os.ModeSymlink != 0:
+			dir := filepath.Dir(abs)
+			base := dir
+			if filepath.IsAbs(f.Linkname) {
+				base = "/"
+			}
+			if _, err := extractPath(extractDir, base, f.Linkname, symlinks); err != nil {
+				return fmt.Errorf("tar entry %q: symlink target: %v", f.Name, err)
+			}
+			if !madeDir[dir] {
+				if err := mkdirAllMode(dir, dirMode); err != nil {
+					return err
+				}
+				madeDir[dir] = true
+			}
+			if err := os.Remove(abs); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(f.Linkname, abs); err != nil {
+				return err
+			}
+			symlinks[abs] = true
+			if chown != nil {
+				if err := os.Lchown(abs, chown.Uid, chown.Gid); err != nil {
+					return err
+				}
+			} else if preserveOwner {
+				owner := headerOwner(f)
+				if err := os.Lchown(abs, owner.Uid, owner.Gid); err != nil {
+					return err
+				}
+			}
 		default:
 			return fmt.Errorf("tar file entry %s contained unsupported file type %v", f.Name, mode)
 		}
 	}
 
 	for abs, target := range seen {
+		// symlinks extracted after the hard link could replace parents of its paths
+		if throughSymlink(extractDir, abs, symlinks) || throughSymlink(extractDir, target, symlinks) {
+			return fmt.Errorf("hard link %s to %s goes through symlink", abs, target)
+		}
 		if err := os.Link(target, abs); err != nil {
 			return fmt.Errorf("failed to create hard link from %s to %s: %v", abs, target, err)
 		}
 	}
+	if embedded == nil && requireChecksums {
+		return fmt.Errorf("tarball doesn't have %s, it's truncated", tarChecksumsName)
+	}
+	if embedded != nil {
+		for name, target := range links {
+			extracted[name] = extracted[target]
+		}
+		if mismatched := embedded.Mismatched(extracted); len(mismatched) > 0 {
+			return fmt.Errorf("%d files don't match checksums of tarball: %s", len(mismatched), strings.Join(mismatched, ", "))
+		}
+	}
+	for dir, mode := range dirModes {
+		if err := os.Chmod(dir, mode); err != nil {
+			return err
+		}
+	}
+	if chown != nil {
+		// directories are created implicitly, so chown all of them up to extractDir
+		chowned := make(map[string]bool)
+		for dir := range madeDir {
+			for ; dir != extractDir && strings.HasPrefix(dir, extractDir) && !chowned[dir]; dir = filepath.Dir(dir) {
+				if err := os.Lchown(dir, chown.Uid, chown.Gid); err != nil {
+					return err
+				}
+				chowned[dir] = true
+			}
+		}
+	}
 	return nil
 }
 
+// extractPath - resolve name of tar entry or link target relative to base step by step, return error if some step
+// leaves extractDir or goes through symlink created by extraction. So the path is the same after symlinks are
+// resolved by filesystem, x/.. can't point to parent of extractDir when x is symlink to '.'.
+// Absolute link target is resolved from root and must stay inside of extractDir since it gets there
+func extractPath(extractDir string, base string, name string, symlinks map[string]bool) (string, error) {
+	path := filepath.Clean(base)
+	inside := withinDir(extractDir, path)
+	for _, element := range strings.Split(filepath.ToSlash(name), "/") {
+		if element == "" || element == "." {
+			continue
+		}
+		if symlinks[path] {
+			return "", fmt.Errorf("path %q goes through symlink %s", name, path)
+		}
+		if element == ".." {
+			path = filepath.Dir(path)
+		} else {
+			path = filepath.Join(path, element)
+		}
+		if withinDir(extractDir, path) {
+			inside = true
+		} else if inside {
+			return "", fmt.Errorf("path %q is outside of %s", name, extractDir)
+		}
+	}
+	if !inside {
+		return "", fmt.Errorf("path %q is outside of %s", name, extractDir)
+	}
+	return path, nil
+}
+
+// throughSymlink - check if some parent of path inside of extractDir is symlink created by extraction
+func throughSymlink(extractDir string, path string, symlinks map[string]bool) bool {
+	root := filepath.Clean(extractDir)
+	for dir := filepath.Dir(path); dir != root && withinDir(root, dir); dir = filepath.Dir(dir) {
+		if symlinks[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// withinDir - check if cleaned path is dir or is inside of it
+func withinDir(dir string, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 func validRelPath(p string) bool {
 	if p == "" || strings.Contains(p, `\`) || strings.HasPrefix(p, "/") || strings.Contains(p, "../") {
 		return false
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTarPreservesModeAndOwner(t *testing.T) {
+	src, err := ioutil.TempDir("", "tar-src")
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "tar-dst")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dst)
+
+	shadow := filepath.Join(src, "shadow")
+	assert.NoError(t, os.MkdirAll(filepath.Join(shadow, "1", "data"), 0755))
+	files := map[string]os.FileMode{
+		"1/data/checksums.txt": 0600,
+		"1/data/columns.txt":   0751,
+	}
+	for name, mode := range files {
+		file := filepath.Join(shadow, name)
+		assert.NoError(t, ioutil.WriteFile(file, []byte(name), mode))
+		assert.NoError(t, os.Chmod(file, mode))
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, TarDirs(context.Background(), &buf, shadow))
+	owner := &fileOwner{Uid: os.Getuid(), Gid: os.Getgid()}
+	assert.NoError(t, Untar(context.Background(), &buf, dst, owner, 0755, false))
+
+	for name, mode := range files {
+		info, err := os.Stat(filepath.Join(dst, "shadow", name))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, mode, info.Mode().Perm(), name)
+		st := info.Sys().(*syscall.Stat_t)
+		assert.Equal(t, owner.Uid, int(st.Uid), name)
+		assert.Equal(t, owner.Gid, int(st.Gid), name)
+	}
+}
+
+func TestParseOwner(t *testing.T) {
+	owner, err := parseOwner("101:102")
+	assert.NoError(t, err)
+	assert.Equal(t, &fileOwner{Uid: 101, Gid: 102}, owner)
+	_, err = parseOwner("clickhouse")
+	assert.Error(t, err)
+	_, err = parseOwner("no-such-user-for-test:0")
+	assert.Error(t, err)
+}
+
+func TestTarSymlink(t *testing.T) {
+	src, err := ioutil.TempDir("", "tar-src")
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "tar-dst")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dst)
+
+	shadow := filepath.Join(src, "shadow")
+	assert.NoError(t, os.MkdirAll(shadow, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(shadow, "data.bin"), []byte("data"), 0644))
+	assert.NoError(t, os.Symlink("data.bin", filepath.Join(shadow, "link.bin")))
+
+	var buf bytes.Buffer
+	assert.NoError(t, TarDirs(context.Background(), &buf, shadow))
+	assert.NoError(t, Untar(context.Background(), &buf, dst, nil, 0755, false))
+
+	target, err := os.Readlink(filepath.Join(dst, "shadow", "link.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data.bin", target)
+}
+
+func TestUntarSetsModesRegardlessOfUmask(t *testing.T) {
+	dst, err := ioutil.TempDir("", "tar-dst")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dst)
+	umask := syscall.Umask(0077)
+	defer syscall.Umask(umask)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "shadow/", Typeflag: tar.TypeDir, Mode: 0750}))
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "shadow/1/data/checksums.txt", Typeflag: tar.TypeReg, Mode: 0640, Size: 4}))
+	_, err = tw.Write([]byte("data"))
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, Untar(context.Background(), &buf, dst, nil, 0751, false))
+
+	modes := map[string]os.FileMode{
+		"shadow":                      0750,
+		"shadow/1":                    0751,
+		"shadow/1/data":               0751,
+		"shadow/1/data/checksums.txt": 0640,
+	}
+	for name, mode := range modes {
+		info, err := os.Stat(filepath.Join(dst, name))
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, mode, info.Mode().Perm(), name)
+		}
+	}
+}
+
+func TestUntarRefusesPathTraversal(t *testing.T) {
+	testCases := map[string]*tar.Header{
+		"file":         {Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		"dir":          {Name: "..", Typeflag: tar.TypeDir, Mode: 0755},
+		"symlink":      {Name: "shadow/evil", Typeflag: tar.TypeSymlink, Linkname: "../../evil", Mode: 0777},
+		"abs symlink":  {Name: "shadow/evil", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd", Mode: 0777},
+		"hard link":    {Name: "shadow/evil", Typeflag: tar.TypeReg, Linkname: "../evil", Mode: 0644},
+		"nested file":  {Name: "shadow/../../evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		"absolute dir": {Name: "/evil", Typeflag: tar.TypeDir, Mode: 0755},
+	}
+	for name, header := range testCases {
+		root, err := ioutil.TempDir("", "tar-slip")
+		assert.NoError(t, err)
+		dst := filepath.Join(root, "dst")
+		assert.NoError(t, os.Mkdir(dst, 0755))
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		assert.NoError(t, tw.WriteHeader(header))
+		if header.Size > 0 {
+			_, err = tw.Write([]byte("evil"))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, tw.Close())
+
+		assert.Error(t, Untar(context.Background(), &buf, dst, nil, 0755, false), name)
+		_, err = os.Lstat(filepath.Join(root, "evil"))
+		assert.True(t, os.IsNotExist(err), name)
+		os.RemoveAll(root)
+	}
+}
+
+func TestUntarRefusesPathThroughSymlinks(t *testing.T) {
+	testCases := map[string][]*tar.Header{
+		"symlink chain": {
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+			{Name: "x/y", Typeflag: tar.TypeSymlink, Linkname: "..", Mode: 0777},
+			{Name: "y/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		},
+		"symlink to parent of symlink": {
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+			{Name: "y", Typeflag: tar.TypeSymlink, Linkname: "x/..", Mode: 0777},
+			{Name: "y/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		},
+		"file through symlink": {
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+			{Name: "x/../evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		},
+		"hard link through symlink": {
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+			{Name: "shadow/data.bin", Typeflag: tar.TypeReg, Linkname: "x/../evil", Mode: 0644},
+		},
+		"symlink replaces parent of hard link": {
+			{Name: "shadow/data.bin", Typeflag: tar.TypeReg, Linkname: "y/evil", Mode: 0644},
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+			{Name: "y", Typeflag: tar.TypeSymlink, Linkname: "x", Mode: 0777},
+		},
+		"file replaces symlink": {
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+			{Name: "x", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		},
+	}
+	for name, headers := range testCases {
+		root, err := ioutil.TempDir("", "tar-slip")
+		assert.NoError(t, err)
+		dst := filepath.Join(root, "dst")
+		assert.NoError(t, os.Mkdir(dst, 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "evil"), []byte("safe"), 0644))
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, header := range headers {
+			assert.NoError(t, tw.WriteHeader(header))
+			if header.Size > 0 {
+				_, err = tw.Write([]byte("evil"))
+				assert.NoError(t, err)
+			}
+		}
+		assert.NoError(t, tw.Close())
+
+		assert.Error(t, Untar(context.Background(), &buf, dst, nil, 0755, false), name)
+		content, err := ioutil.ReadFile(filepath.Join(root, "evil"))
+		assert.NoError(t, err, name)
+		assert.Equal(t, "safe", string(content), name)
+		info, err := os.Stat(filepath.Join(root, "evil"))
+		assert.NoError(t, err, name)
+		assert.Equal(t, uint64(1), info.Sys().(*syscall.Stat_t).Nlink, name)
+		os.RemoveAll(root)
+	}
+}
+
+func TestDecompressArchive(t *testing.T) {
+	src, err := ioutil.TempDir("", "tar-src")
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "file"), []byte("content"), 0644))
+	var plain bytes.Buffer
+	assert.NoError(t, TarDirs(context.Background(), &plain, src))
+
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	_, err = gw.Write(plain.Bytes())
+	assert.NoError(t, err)
+	assert.NoError(t, gw.Close())
+
+	for name, data := range map[string][]byte{"backup.tar": plain.Bytes(), "backup.tar.gz": compressed.Bytes()} {
+		r, err := decompressArchive(bytes.NewReader(data), name)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		content, err := ioutil.ReadAll(r)
+		assert.NoError(t, err, name)
+		assert.Equal(t, plain.Bytes(), content, name)
+		assert.NoError(t, r.Close(), name)
+	}
+
+	_, err = decompressArchive(bytes.NewReader([]byte("not an archive")), "backup.tar")
+	assert.Error(t, err)
+}
+
+func TestChunkWriterKeepsHardLinksAcrossParts(t *testing.T) {
+	src, err := ioutil.TempDir("", "tar-src")
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "tar-dst")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dst)
+
+	content := bytes.Repeat([]byte("0123456789"), 500)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "a"), content, 0644))
+	assert.NoError(t, os.Link(filepath.Join(src, "a"), filepath.Join(src, "b")))
+
+	file, err := ioutil.TempFile(dst, "*.tar")
+	assert.NoError(t, err)
+	cw := newChunkWriter(file, 1024)
+	tw := newTarWriter(cw)
+	assert.NoError(t, TarDirAs(context.Background(), tw, src, "shadow", false))
+	assert.NoError(t, tw.Close())
+	paths, sums, err := cw.Close()
+	assert.NoError(t, err)
+	assert.True(t, len(paths) > 1)
+	assert.Equal(t, len(paths), len(sums))
+	assert.Equal(t, archivePartName(file.Name(), 1), paths[0])
+
+	var archive bytes.Buffer
+	for i, part := range paths {
+		data, err := ioutil.ReadFile(part)
+		assert.NoError(t, err)
+		assert.True(t, len(data) <= 1024)
+		checksum, err := checksumFile(part)
+		assert.NoError(t, err)
+		assert.Equal(t, checksum, sums[i])
+		archive.Write(data)
+	}
+	assert.Equal(t, "x.tar", archiveNameOfParts([]string{"/tmp/x.tar.001", "/tmp/x.tar.002"}))
+
+	extractDir := filepath.Join(dst, "extract")
+	assert.NoError(t, Untar(context.Background(), &archive, extractDir, nil, 0755, false))
+	for _, name := range []string{"a", "b"} {
+		data, err := ioutil.ReadFile(filepath.Join(extractDir, "shadow", name))
+		assert.NoError(t, err, name)
+		assert.Equal(t, content, data, name)
+	}
+}
+
+func TestTarDirsConcurrentlySharesHardLinks(t *testing.T) {
+	src, err := ioutil.TempDir("", "tar-src")
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "tar-dst")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dst)
+
+	dirs := []string{filepath.Join(src, "shadow"), filepath.Join(src, "backup")}
+	for _, dir := range dirs {
+		assert.NoError(t, os.MkdirAll(dir, 0755))
+	}
+	const files = 20
+	for i := 0; i < files; i++ {
+		name := fmt.Sprintf("part_%d.bin", i)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dirs[0], name), []byte(name), 0644))
+		assert.NoError(t, os.Link(filepath.Join(dirs[0], name), filepath.Join(dirs[1], name)))
+	}
+
+	var buf bytes.Buffer
+	tw := newTarWriter(&buf)
+	errs := make(chan error, len(dirs))
+	for _, dir := range dirs {
+		go func(dir string) {
+			errs <- TarDir(context.Background(), tw, dir)
+		}(dir)
+	}
+	for range dirs {
+		assert.NoError(t, <-errs)
+	}
+	assert.NoError(t, tw.Close())
+
+	regular, links := 0, 0
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		switch {
+		case header.Name == tarChecksumsName:
+		case header.Typeflag == tar.TypeReg:
+			regular++
+		case header.Typeflag == tar.TypeLink:
+			links++
+		}
+	}
+	assert.Equal(t, files, regular)
+	assert.Equal(t, files, links)
+
+	assert.NoError(t, Untar(context.Background(), &buf, dst, nil, 0755, false))
+	for _, dir := range []string{"shadow", "backup"} {
+		for i := 0; i < files; i++ {
+			name := fmt.Sprintf("part_%d.bin", i)
+			data, err := ioutil.ReadFile(filepath.Join(dst, dir, name))
+			assert.NoError(t, err, name)
+			assert.Equal(t, name, string(data), name)
+		}
+	}
+}
+
+func TestTarIsDeterministic(t *testing.T) {
+	src, err := ioutil.TempDir("", "tar-src")
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	for _, name := range []string{"a/c.bin", "a/b/d.bin", "a.bin", "z/e.bin"} {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644))
+	}
+	// the first of hard links in order of names in tarball is stored as file
+	assert.NoError(t, os.Link(filepath.Join(src, "z", "e.bin"), filepath.Join(src, "a", "e.bin")))
+
+	archives := make([][]byte, 2)
+	for i := range archives {
+		var buf bytes.Buffer
+		tw := newTarWriter(&buf)
+		assert.NoError(t, TarDirAs(context.Background(), tw, src, "shadow", false))
+		assert.NoError(t, tw.Close())
+		archives[i] = buf.Bytes()
+	}
+	assert.Equal(t, archives[0], archives[1])
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(archives[0]))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, header.Name)
+		if header.Name == "shadow/z/e.bin" {
+			assert.Equal(t, byte(tar.TypeLink), header.Typeflag)
+			assert.Equal(t, "shadow/a/e.bin", header.Linkname)
+		}
+	}
+	assert.Equal(t, []string{"shadow/a.bin", "shadow/a/b/d.bin", "shadow/a/c.bin", "shadow/a/e.bin", "shadow/z/e.bin", tarChecksumsName}, names)
+}
+
+func TestUntarChecksEmbeddedChecksums(t *testing.T) {
+	src, err := ioutil.TempDir("", "tar-src")
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "tar-dst")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dst)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "data.bin"), []byte("payload"), 0644))
+	assert.NoError(t, os.Link(filepath.Join(src, "data.bin"), filepath.Join(src, "link.bin")))
+	var buf bytes.Buffer
+	tw := newTarWriter(&buf)
+	assert.NoError(t, TarDirAs(context.Background(), tw, src, "shadow", false))
+	assert.NoError(t, tw.Close())
+	sum := "239f59ed55e737c77147cf55ad0c1b030b6d7ee748a7426952f9b852d5a935e5"
+	checksums := Checksums{"shadow/data.bin": sum, "shadow/link.bin": sum}
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(checksums.Marshal())), tw.Digest())
+
+	archive := buf.Bytes()
+	assert.NoError(t, Untar(context.Background(), bytes.NewReader(archive), dst, nil, 0755, true))
+	_, err = os.Stat(filepath.Join(dst, tarChecksumsName))
+	assert.True(t, os.IsNotExist(err))
+
+	// content of file is corrupted in place, so tar headers stay valid
+	corrupted := bytes.Replace(archive, []byte("payload"), []byte("pay1oad"), 1)
+	assert.NoError(t, os.RemoveAll(dst))
+	err = Untar(context.Background(), bytes.NewReader(corrupted), dst, nil, 0755, true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "shadow/data.bin, shadow/link.bin")
+	}
+
+	// archive is truncated at boundary of entry before checksums, so it's valid tar stream
+	var truncated bytes.Buffer
+	tarWriter := tar.NewWriter(&truncated)
+	assert.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: "shadow/data.bin", Typeflag: tar.TypeReg, Mode: 0644, Size: 7}))
+	_, err = tarWriter.Write([]byte("payload"))
+	assert.NoError(t, err)
+	assert.NoError(t, tarWriter.Flush())
+	assert.NoError(t, os.RemoveAll(dst))
+	assert.NoError(t, Untar(context.Background(), bytes.NewReader(truncated.Bytes()), dst, nil, 0755, false))
+	assert.NoError(t, os.RemoveAll(dst))
+	err = Untar(context.Background(), bytes.NewReader(truncated.Bytes()), dst, nil, 0755, true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), tarChecksumsName)
+	}
+}
+
+func TestTarDigestDoesNotDependOnFreezeName(t *testing.T) {
+	var digests []string
+	for _, freezeName := range []string{"20200101T000000", "20200102T000000"} {
+		src, err := ioutil.TempDir("", "tar-src")
+		assert.NoError(t, err)
+		defer os.RemoveAll(src)
+		dst, err := ioutil.TempDir("", "tar-dst")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dst)
+		partPath := filepath.Join(src, freezeName, "data", "db", "table", "all_1_1_0")
+		assert.NoError(t, os.MkdirAll(partPath, 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(partPath, "data.bin"), []byte("payload"), 0644))
+		assert.NoError(t, os.Link(filepath.Join(partPath, "data.bin"), filepath.Join(partPath, "data.mrk")))
+
+		var buf bytes.Buffer
+		tw := newTarWriter(&buf)
+		assert.NoError(t, TarDirAs(context.Background(), tw, src, "shadow", false))
+		assert.NoError(t, tw.Close())
+		digests = append(digests, tw.Digest())
+		assert.NoError(t, Untar(context.Background(), &buf, dst, nil, 0755, true))
+		content, err := ioutil.ReadFile(filepath.Join(dst, "shadow", freezeName, "data", "db", "table", "all_1_1_0", "data.mrk"))
+		assert.NoError(t, err)
+		assert.Equal(t, "payload", string(content))
+	}
+	assert.Equal(t, digests[0], digests[1])
+	assert.Equal(t, "disks/s3/shadow/data/db/table/all_1_1_0/data.bin", checksumKey("disks/s3/shadow/1/data/db/table/all_1_1_0/data.bin"))
+	assert.Equal(t, "shadow/access/users.list", checksumKey("shadow/access/users.list"))
+}
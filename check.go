@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// configCheck - check required settings and connections to clickhouse and s3, nothing is changed,
+// every check is printed with PASS or FAIL and error is returned if any of them fails
+func configCheck(ctx context.Context, config Config) error {
+	failed := 0
+	report := func(name string, err error) bool {
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+			return false
+		}
+		fmt.Printf("PASS  %s\n", name)
+		return true
+	}
+
+	report("backup settings", checkBackupSettings(config))
+
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if report("clickhouse connection", ch.Connect()) {
+		_, name, err := ch.GetVersion()
+		report("clickhouse version "+name, err)
+		_, err = ch.GetDisks()
+		report("clickhouse disks", err)
+		ch.Close()
+	}
+
+	s3Settings := checkS3Settings(config.S3)
+	report("s3 settings", s3Settings)
+	if s3Settings == nil {
+		remote := &S3{
+			Config: &config.S3,
+		}
+		if report("s3 session", remote.Connect()) && report("s3 bucket", remote.headBucket(ctx)) {
+			report("s3 list objects", remote.listOne(ctx))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// checkBackupSettings - check settings which are used only by some commands and aren't validated on load
+func checkBackupSettings(config Config) error {
+	switch config.Backup.Strategy {
+	case "tree", "archive":
+	default:
+		return fmt.Errorf("unknown backup.strategy '%s' it can be 'tree', 'archive'", config.Backup.Strategy)
+	}
+	if config.Backup.Strategy == "archive" {
+		if err := checkTmpDir(config.Backup.TempDir()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkS3Settings - check settings which are required to connect to s3
+func checkS3Settings(config S3Config) error {
+	var missing []string
+	for _, setting := range []struct {
+		name  string
+		value string
+	}{
+		{"s3.bucket", config.Bucket},
+	} {
+		if setting.value == "" {
+			missing = append(missing, setting.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s must be set", strings.Join(missing, ", "))
+	}
+	if (config.AccessKey == "") != (config.SecretKey == "") {
+		return fmt.Errorf("s3.access_key and s3.secret_key must be set together, leave both empty to use default aws credentials")
+	}
+	if config.Region == "" && config.Endpoint == "" {
+		return fmt.Errorf("s3.region or s3.endpoint must be set")
+	}
+	return nil
+}
+
+// headBucket - check that bucket exists and is accessible
+func (s *S3) headBucket(ctx context.Context) error {
+	_, err := s3.New(s.session).HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.Config.Bucket),
+	})
+	return err
+}
+
+// listOne - check that objects under s3.path can be listed
+func (s *S3) listOne(ctx context.Context) error {
+	params := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.Config.Bucket),
+		MaxKeys: aws.Int64(1),
+	}
+	if s.Config.Path != "" && s.Config.Path != "/" {
+		params.Prefix = aws.String(s.Config.Path)
+	}
+	_, err := s3.New(s.session).ListObjectsV2WithContext(ctx, params)
+	return err
+}
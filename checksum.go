@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	checksumsName   = "checksums.txt"
+	checksumsSuffix = ".checksums.txt"
+)
+
+// Checksums - sha256 of backup files by key, stored in sha256sum format
+type Checksums map[string]string
+
+// ParseChecksums - read checksums from sha256sum format
+func ParseChecksums(content []byte) (Checksums, error) {
+	checksums := make(Checksums)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid checksum line %q", line)
+		}
+		checksums[fields[1]] = fields[0]
+	}
+	return checksums, scanner.Err()
+}
+
+// Marshal - encode checksums to sha256sum format sorted by key
+func (c Checksums) Marshal() []byte {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%s  %s\n", c[key], key)
+	}
+	return buf.Bytes()
+}
+
+// Mismatched - sorted keys which checksums differ from actual ones or which are only in one of them
+func (c Checksums) Mismatched(actual Checksums) []string {
+	var keys []string
+	for key, sum := range c {
+		if actual[key] != sum {
+			keys = append(keys, key)
+		}
+	}
+	for key := range actual {
+		if _, ok := c[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// AddDir - calculate checksums for all files in localPath, keys are relative to localPath and prefixed with prefix
+func (c Checksums) AddDir(localPath string, prefix string) error {
+	return c.AddDirFiltered(localPath, prefix, nil)
+}
+
+// AddDirFiltered - calculate checksums for files in localPath except files which keys relative to localPath
+// are skipped by skip
+func (c Checksums) AddDirFiltered(localPath string, prefix string, skip func(key string) bool) error {
+	return filepath.Walk(localPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		filePath = filepath.ToSlash(filePath) // fix fucking Windows slashes
+		if skip != nil && skip(strings.Trim(strings.TrimPrefix(filePath, localPath), "/")) {
+			return nil
+		}
+		checksum, err := checksumFile(filePath)
+		if err != nil {
+			return err
+		}
+		c[path.Join(prefix, strings.TrimPrefix(filePath, localPath))] = checksum
+		return nil
+	})
+}
+
+func checksumFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return checksumReader(f)
+}
+
+func checksumReader(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
@@ -1,28 +1,60 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/kshvakov/clickhouse"
+	"github.com/kshvakov/clickhouse"
 )
 
 // ClickHouse - provide info and freeze tables
 type ClickHouse struct {
 	DryRun bool
-	Config *ClickHouseConfig
-	conn   *sqlx.DB
-	uid    *int
-	gid    *int
+	// ZeroCopy - parts on remote disks are written to detached directly, they contain only references
+	// to objects which are already in object storage of disk, so restore staging isn't used for them
+	ZeroCopy bool
+	Config   *ClickHouseConfig
+	conn     *sqlx.DB
+	uid      *int
+	gid      *int
+	// http - client of HTTP interface, it is used instead of conn for protocol http
+	http *httpClient
+	// singleAttach - server doesn't support several ATTACH PARTITION in one query
+	singleAttach bool
+	// freezeWithoutName - server doesn't support FREEZE WITH NAME
+	freezeWithoutName bool
+	mu                sync.Mutex
+	// version - version of server detected on connect as major*1000000+minor*1000+patch, 0 if it's unknown
+	version     int
+	versionName string
 }
 
+const (
+	// minVersionFreezeWithName - the first version which supports FREEZE WITH NAME
+	minVersionFreezeWithName = 19001005
+	// minVersionBatchAttach - the first version which supports several ATTACH PARTITION in one ALTER query
+	minVersionBatchAttach = 19001000
+	// minVersionStoragePolicy - the first version which supports storage policies and system.disks
+	minVersionStoragePolicy = 19015000
+	// minVersionDiskType - the first version which has remote disks and type of disk in system.disks
+	minVersionDiskType = 20006000
+)
+
 // Table - Clickhouse table struct
 type Table struct {
 	Database     string `db:"database"`
@@ -30,12 +62,14 @@ type Table struct {
 	DataPath     string `db:"data_path"`
 	MetadataPath string `db:"metadata_path"`
 	IsTemporary  bool   `db:"is_temporary"`
+	Engine       string `db:"engine"`
 }
 
 // BackupPartition - struct representing Clickhouse partition
 type BackupPartition struct {
 	Name string
 	Path string
+	Disk string
 }
 
 // BackupTable - struct to store additional information on partitions
@@ -50,18 +84,28 @@ type BackupTable struct {
 // RestoreTable - struct to store information needed during restore
 type RestoreTable struct {
 	Database string
-	Query    string
+	// Name - database.table for messages, it is empty if it's not known
+	Name  string
+	Query string
 }
 
+// tlsConfigName - name of TLS config registered in driver when CA or client certificate is set
+const tlsConfigName = "clickhouse-backup"
+
 // Connect - connect to clickhouse
 func (ch *ClickHouse) Connect() error {
+	if ch.Config.Protocol == "http" {
+		if err := ch.openHTTP(""); err != nil {
+			return err
+		}
+		return ch.detectVersion()
+	}
 	connectionString := fmt.Sprintf("tcp://%v:%v?username=%v&password=%v&compress=true",
 		ch.Config.Host, ch.Config.Port, ch.Config.Username, ch.Config.Password)
-	var err error
-	if ch.conn, err = sqlx.Open("clickhouse", connectionString); err != nil {
+	if err := ch.open(connectionString); err != nil {
 		return err
 	}
-	return ch.conn.Ping()
+	return ch.detectVersion()
 }
 
 // ConnectDatabase - connect to clickhouse to specified database
@@ -69,13 +113,199 @@ func (ch *ClickHouse) ConnectDatabase(database string) error {
 	if database == "" {
 		database = "default"
 	}
+	if ch.Config.Protocol == "http" {
+		if err := ch.openHTTP(database); err != nil {
+			return err
+		}
+		return ch.detectVersion()
+	}
 	connectionString := fmt.Sprintf("tcp://%v:%v?username=%v&password=%v&database=%v&compress=true",
 		ch.Config.Host, ch.Config.Port, ch.Config.Username, ch.Config.Password, database)
+	if err := ch.open(connectionString); err != nil {
+		return err
+	}
+	return ch.detectVersion()
+}
+
+// GetVersion - version of server as major*1000000+minor*1000+patch and as it's returned by server
+func (ch *ClickHouse) GetVersion() (int, string, error) {
+	var result []string
+	if err := ch.selectQuery(&result, "SELECT version()"); err != nil {
+		return 0, "", fmt.Errorf("can't get version of clickhouse with: %v", err)
+	}
+	if len(result) == 0 {
+		return 0, "", fmt.Errorf("can't get version of clickhouse: empty result")
+	}
+	version, err := parseVersion(result[0])
+	if err != nil {
+		return 0, "", err
+	}
+	return version, result[0], nil
+}
+
+// detectVersion - save version of server on the first connect, features which depend on version
+// are tried anyway if version can't be detected
+func (ch *ClickHouse) detectVersion() error {
+	if ch.version > 0 {
+		return nil
+	}
+	version, name, err := ch.GetVersion()
+	if err != nil {
+		logger.Warnf("%v, features will be detected by errors of queries", err)
+		return nil
+	}
+	ch.version, ch.versionName = version, name
+	logger.WithField("version", name).Info("Found clickhouse version")
+	return nil
+}
+
+// parseVersion - convert version like 19.15.3.6 to 19015003
+func parseVersion(name string) (int, error) {
+	parts := strings.SplitN(name, ".", 4)
+	if len(parts) < 3 {
+		return 0, fmt.Errorf("can't parse version of clickhouse '%s'", name)
+	}
+	version := 0
+	for _, part := range parts[:3] {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 999 {
+			return 0, fmt.Errorf("can't parse version of clickhouse '%s'", name)
+		}
+		version = version*1000 + n
+	}
+	return version, nil
+}
+
+// olderThan - check that version of server is detected and it's older than version
+func (ch *ClickHouse) olderThan(version int) bool {
+	return ch.version > 0 && ch.version < version
+}
+
+// open - open connection with TLS settings from config and check it
+func (ch *ClickHouse) open(connectionString string) error {
+	if ch.Config.Secure {
+		connectionString += "&secure=true"
+		if ch.Config.SkipVerify {
+			connectionString += "&skip_verify=true"
+		}
+		if ch.Config.TLSCA != "" || ch.Config.TLSCert != "" {
+			tlsConfig, err := ch.tlsConfig()
+			if err != nil {
+				return err
+			}
+			if err := clickhouse.RegisterTLSConfig(tlsConfigName, tlsConfig); err != nil {
+				return fmt.Errorf("can't register TLS config with: %v", err)
+			}
+			connectionString += "&tls_config=" + tlsConfigName
+		}
+	}
+	if ch.Config.ConnectTimeout > 0 {
+		connectionString += fmt.Sprintf("&timeout=%d", ch.Config.ConnectTimeout)
+	}
+	connectionString += fmt.Sprintf("&read_timeout=%d", ch.readTimeout())
 	var err error
 	if ch.conn, err = sqlx.Open("clickhouse", connectionString); err != nil {
 		return err
 	}
-	return ch.conn.Ping()
+	ctx, cancel := timeoutContext(ch.Config.ConnectTimeout)
+	defer cancel()
+	if err := ch.conn.PingContext(ctx); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("connect to %s:%d timed out after %ds", ch.Config.Host, ch.Config.Port, ch.Config.ConnectTimeout)
+		}
+		if ch.Config.Secure && isTLSError(err) {
+			return fmt.Errorf("TLS handshake with %s:%d failed, check clickhouse.tls_ca, tls_cert, tls_key and skip_verify: %v", ch.Config.Host, ch.Config.Port, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// unlimitedReadTimeout - read timeout in seconds of connection when query_timeout or freeze_timeout is disabled,
+// driver can't disable read timeout and its default one breaks long queries
+const unlimitedReadTimeout = 30 * 24 * 3600
+
+// readTimeout - socket timeout in seconds, it must not break queries which are still in their own timeout
+func (ch *ClickHouse) readTimeout() int {
+	if ch.Config.QueryTimeout <= 0 || ch.Config.FreezeTimeout <= 0 {
+		return unlimitedReadTimeout
+	}
+	if ch.Config.FreezeTimeout > ch.Config.QueryTimeout {
+		return ch.Config.FreezeTimeout
+	}
+	return ch.Config.QueryTimeout
+}
+
+// timeoutContext - context with timeout in seconds, 0 means no timeout
+func timeoutContext(seconds int) (context.Context, context.CancelFunc) {
+	if seconds > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(seconds)*time.Second)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// timeoutError - add description of timed out query to error
+func timeoutError(ctx context.Context, query string, seconds int, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("query \"%s\" timed out after %ds", strings.TrimSpace(query), seconds)
+	}
+	return err
+}
+
+// selectQuery - run select query with clickhouse.query_timeout
+func (ch *ClickHouse) selectQuery(dest interface{}, query string) error {
+	ctx, cancel := timeoutContext(ch.Config.QueryTimeout)
+	defer cancel()
+	if ch.http != nil {
+		return timeoutError(ctx, query, ch.Config.QueryTimeout, ch.http.selectInto(ctx, dest, query))
+	}
+	return timeoutError(ctx, query, ch.Config.QueryTimeout, ch.conn.SelectContext(ctx, dest, query))
+}
+
+// execQuery - run query with timeout in seconds
+func (ch *ClickHouse) execQuery(query string, timeout int) error {
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	if ch.http != nil {
+		return timeoutError(ctx, query, timeout, ch.http.exec(ctx, query))
+	}
+	_, err := ch.conn.ExecContext(ctx, query)
+	return timeoutError(ctx, query, timeout, err)
+}
+
+// tlsConfig - TLS config with CA and client certificate from config
+func (ch *ClickHouse) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: ch.Config.SkipVerify,
+	}
+	if ch.Config.TLSCA != "" {
+		ca, err := ioutil.ReadFile(ch.Config.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("can't read clickhouse.tls_ca with: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("there are no certificates in %s", ch.Config.TLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if ch.Config.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(ch.Config.TLSCert, ch.Config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("can't load clickhouse.tls_cert and tls_key with: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// isTLSError - check if error happened during TLS handshake or certificate verification
+func isTLSError(err error) bool {
+	switch err.(type) {
+	case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError, tls.RecordHeaderError:
+		return true
+	}
+	return strings.Contains(err.Error(), "tls:") || strings.Contains(err.Error(), "x509:")
 }
 
 // GetDataPath - return clickhouse data_path
@@ -86,7 +316,7 @@ func (ch *ClickHouse) GetDataPath() (string, error) {
 	var result []struct {
 		MetadataPath string `db:"metadata_path"`
 	}
-	if err := ch.conn.Select(&result, "SELECT metadata_path FROM system.tables WHERE database == 'system' LIMIT 1;"); err != nil {
+	if err := ch.selectQuery(&result, "SELECT metadata_path FROM system.tables WHERE database == 'system' LIMIT 1;"); err != nil {
 		return "/var/lib/clickhouse", err
 	}
 	metadataPath := result[0].MetadataPath
@@ -97,59 +327,292 @@ func (ch *ClickHouse) GetDataPath() (string, error) {
 
 // Close - close connection to clickhouse
 func (ch *ClickHouse) Close() error {
+	if ch.http != nil {
+		return nil
+	}
 	return ch.conn.Close()
 }
 
-// GetTables - get all tables info
+// GetTables - get info of tables except tables of clickhouse.skip_databases
 func (ch *ClickHouse) GetTables() ([]Table, error) {
+	query := "SELECT database, name, is_temporary, data_path, metadata_path, engine FROM system.tables"
+	if len(ch.Config.SkipDatabases) > 0 {
+		databases := make([]string, len(ch.Config.SkipDatabases))
+		for i, name := range ch.Config.SkipDatabases {
+			databases[i] = "'" + strings.Replace(name, "'", "\\'", -1) + "'"
+		}
+		query += fmt.Sprintf(" WHERE database NOT IN (%s)", strings.Join(databases, ", "))
+	}
+	var tables []Table
+	if err := ch.selectQuery(&tables, query+";"); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// GetAllTables - get info of all tables including tables of clickhouse.skip_databases
+func (ch *ClickHouse) GetAllTables() ([]Table, error) {
 	var tables []Table
-	if err := ch.conn.Select(&tables, "SELECT database, name, is_temporary, data_path, metadata_path FROM system.tables WHERE database != 'system';"); err != nil {
+	if err := ch.selectQuery(&tables, "SELECT database, name, is_temporary, data_path, metadata_path, engine FROM system.tables;"); err != nil {
 		return nil, err
 	}
 	return tables, nil
 }
 
-// FreezeTable - freeze all partitions for table
-func (ch *ClickHouse) FreezeTable(table Table) error {
+// GetTableEngine - return engine of table, empty string means that table does not exist
+func (ch *ClickHouse) GetTableEngine(database string, name string) (string, error) {
+	var result []struct {
+		Engine string `db:"engine"`
+	}
+	q := fmt.Sprintf("SELECT engine FROM system.tables WHERE database='%v' AND name='%v'", database, name)
+	if err := ch.selectQuery(&result, q); err != nil {
+		return "", fmt.Errorf("can't get engine of \"%s.%s\" with %v", database, name, err)
+	}
+	if len(result) == 0 {
+		return "", nil
+	}
+	return result[0].Engine, nil
+}
+
+// IsRestoreReplica - check that data of table is restored on this server, parts attached to replicated table
+// are fetched by other replicas, so they are attached only on active replica which name is the first in ZooKeeper.
+// It returns name of that replica, data of not replicated tables is always restored
+func (ch *ClickHouse) IsRestoreReplica(database string, name string) (bool, string, error) {
+	var replicas []struct {
+		ZookeeperPath string `db:"zookeeper_path"`
+		ReplicaName   string `db:"replica_name"`
+	}
+	q := fmt.Sprintf("SELECT zookeeper_path, replica_name FROM system.replicas WHERE database='%v' AND table='%v'", database, name)
+	if err := ch.selectQuery(&replicas, q); err != nil {
+		return false, "", fmt.Errorf("can't get replica of \"%s.%s\" with %v", database, name, err)
+	}
+	if len(replicas) == 0 {
+		return true, "", nil
+	}
+	replicasPath := strings.TrimSuffix(replicas[0].ZookeeperPath, "/") + "/replicas"
+	var names []string
+	q = fmt.Sprintf("SELECT name FROM system.zookeeper WHERE path='%v' ORDER BY name", replicasPath)
+	if err := ch.selectQuery(&names, q); err != nil {
+		return false, "", fmt.Errorf("can't get replicas of \"%s.%s\" from zookeeper with %v", database, name, err)
+	}
+	for _, replica := range names {
+		// replica which is down or lost can't be elected, it wouldn't restore data
+		var active []string
+		q = fmt.Sprintf("SELECT name FROM system.zookeeper WHERE path='%v/%v' AND name='is_active'", replicasPath, replica)
+		if err := ch.selectQuery(&active, q); err != nil {
+			return false, "", fmt.Errorf("can't check that replica %s of \"%s.%s\" is active with %v", replica, database, name, err)
+		}
+		if len(active) > 0 {
+			return replica == replicas[0].ReplicaName, replica, nil
+		}
+	}
+	return true, replicas[0].ReplicaName, nil
+}
+
+// CheckRestoreTarget - check that table exists and its engine is compatible with backupEngine,
+// empty backupEngine skips compatibility check
+func (ch *ClickHouse) CheckRestoreTarget(table BackupTable, backupEngine string) error {
+	engine, err := ch.GetTableEngine(table.Database, table.Name)
+	if err != nil {
+		return err
+	}
+	if engine == "" {
+		return fmt.Errorf("table %s.%s doesn't exist, create it with 'create-tables' command or by migrations before restore", table.Database, table.Name)
+	}
+	if !strings.HasSuffix(engine, "MergeTree") {
+		return fmt.Errorf("table %s.%s has engine %s, partitions can be attached only to MergeTree family tables", table.Database, table.Name, engine)
+	}
+	if backupEngine != "" && strings.TrimPrefix(engine, "Replicated") != strings.TrimPrefix(backupEngine, "Replicated") {
+		return fmt.Errorf("table %s.%s has engine %s which is incompatible with %s in backup", table.Database, table.Name, engine, backupEngine)
+	}
+	return nil
+}
+
+// GetTableSize - return summary size of active parts of table
+func (ch *ClickHouse) GetTableSize(table Table) (int64, error) {
+	var result []struct {
+		Size int64 `db:"size"`
+	}
+	q := fmt.Sprintf("SELECT toInt64(sum(bytes)) AS size FROM system.parts WHERE active AND database='%v' AND table='%v'", table.Database, table.Name)
+	if err := ch.selectQuery(&result, q); err != nil {
+		return 0, fmt.Errorf("can't get size of \"%s.%s\" with %v", table.Database, table.Name, err)
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return result[0].Size, nil
+}
+
+// GetTableSizes - return size of active parts of all tables by database.name
+func (ch *ClickHouse) GetTableSizes() (map[string]int64, error) {
+	var result []struct {
+		Database string `db:"database"`
+		Table    string `db:"table"`
+		Size     int64  `db:"size"`
+	}
+	if err := ch.selectQuery(&result, "SELECT database, table, toInt64(sum(bytes)) AS size FROM system.parts WHERE active GROUP BY database, table"); err != nil {
+		return nil, fmt.Errorf("can't get size of tables with %v", err)
+	}
+	sizes := make(map[string]int64, len(result))
+	for _, item := range result {
+		sizes[item.Database+"."+item.Table] = item.Size
+	}
+	return sizes, nil
+}
+
+// GetPartitions - return IDs of partitions of table which have active parts
+func (ch *ClickHouse) GetPartitions(table Table) ([]string, error) {
 	var partitions []struct {
 		PartitionID string `db:"partition_id"`
 	}
-	q := fmt.Sprintf("SELECT DISTINCT partition_id FROM system.parts WHERE database='%v' AND table='%v'", table.Database, table.Name)
-	if err := ch.conn.Select(&partitions, q); err != nil {
-		return fmt.Errorf("can't get partitions for \"%s.%s\" with %v", table.Database, table.Name, err)
+	q := fmt.Sprintf("SELECT DISTINCT partition_id FROM system.parts WHERE database='%v' AND table='%v' AND active", table.Database, table.Name)
+	if err := ch.selectQuery(&partitions, q); err != nil {
+		return nil, fmt.Errorf("can't get partitions for \"%s.%s\" with %v", table.Database, table.Name, err)
+	}
+	result := make([]string, len(partitions))
+	for i, item := range partitions {
+		result[i] = item.PartitionID
+	}
+	return result, nil
+}
+
+// GetPartRows - return rows count of every part of table by part name, inactive parts are included
+// because frozen parts can be merged right after freeze
+func (ch *ClickHouse) GetPartRows(table Table) (map[string]uint64, error) {
+	var parts []struct {
+		Name string `db:"name"`
+		Rows uint64 `db:"rows"`
+	}
+	q := fmt.Sprintf("SELECT name, rows FROM system.parts WHERE database='%v' AND table='%v'", table.Database, table.Name)
+	if err := ch.selectQuery(&parts, q); err != nil {
+		return nil, fmt.Errorf("can't get rows of parts for \"%s.%s\" with %v", table.Database, table.Name, err)
+	}
+	result := make(map[string]uint64, len(parts))
+	for _, part := range parts {
+		result[part.Name] = part.Rows
+	}
+	return result, nil
+}
+
+// GetRowCount - return count of rows in table
+func (ch *ClickHouse) GetRowCount(database string, name string) (uint64, error) {
+	var result []struct {
+		Count uint64 `db:"count"`
+	}
+	q := fmt.Sprintf("SELECT count() AS count FROM `%s`.`%s`", database, name)
+	if err := ch.selectQuery(&result, q); err != nil {
+		return 0, fmt.Errorf("can't count rows of \"%s.%s\" with %v", database, name, err)
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return result[0].Count, nil
+}
+
+// FreezeTable - freeze specified partitions of table, all partitions are frozen if partitions is empty,
+// parts are stored to shadow/<name>, shadow/<increment> is used if name is empty or server doesn't support FREEZE WITH NAME
+func (ch *ClickHouse) FreezeTable(table Table, partitions []string, name string) error {
+	if len(partitions) == 0 {
+		var err error
+		if partitions, err = ch.GetPartitions(table); err != nil {
+			return err
+		}
 	}
 	log.Printf("Freeze '%v.%v'", table.Database, table.Name)
-	for _, item := range partitions {
+	stop := heartbeat("freeze", table.Database+"."+table.Name, ch.Config.HeartbeatInterval)
+	defer stop()
+	var deadline time.Time
+	if ch.Config.FreezeTableTimeout > 0 {
+		deadline = time.Now().Add(time.Duration(ch.Config.FreezeTableTimeout) * time.Second)
+	}
+	for _, partitionID := range partitions {
 		if ch.DryRun {
-			log.Printf("  partition '%v'   ...skip because dry-run", item.PartitionID)
+			log.Printf("  partition '%v'   ...skip because dry-run", partitionID)
 			continue
 		}
-		log.Printf("  partition '%v'", item.PartitionID)
+		log.Printf("  partition '%v'", partitionID)
 		query := fmt.Sprintf(
 			"ALTER TABLE %v.%v FREEZE PARTITION ID '%v';",
 			table.Database,
 			table.Name,
-			item.PartitionID)
-		if item.PartitionID == "all" {
+			partitionID)
+		if partitionID == "all" {
 			query = fmt.Sprintf(
 				"ALTER TABLE %v.%v FREEZE PARTITION tuple();",
 				table.Database,
 				table.Name)
 		}
-		if _, err := ch.conn.Exec(query); err != nil {
-			return fmt.Errorf("can't freeze partition '%s' on '%s.%s' with: %v", item.PartitionID, table.Database, table.Name, err)
+		timeout := ch.Config.FreezeTimeout
+		if !deadline.IsZero() {
+			// query of partition is cancelled when time of the whole table is over
+			remaining := int(math.Ceil(time.Until(deadline).Seconds()))
+			if remaining <= 0 {
+				return fmt.Errorf("freeze of '%s.%s' timed out after %ds of clickhouse.freeze_table_timeout", table.Database, table.Name, ch.Config.FreezeTableTimeout)
+			}
+			if timeout == 0 || remaining < timeout {
+				timeout = remaining
+			}
+		}
+		if err := ch.freeze(query, name, timeout); err != nil {
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				return fmt.Errorf("freeze of '%s.%s' timed out after %ds of clickhouse.freeze_table_timeout on partition '%s': %v", table.Database, table.Name, ch.Config.FreezeTableTimeout, partitionID, err)
+			}
+			return fmt.Errorf("can't freeze partition '%s' on '%s.%s' with: %v", partitionID, table.Database, table.Name, err)
 		}
 	}
 	return nil
 }
 
+// freeze - execute FREEZE query WITH NAME, query is executed without name if server rejects syntax of WITH NAME,
+// other errors are returned, so tables aren't frozen twice with different layouts of shadow
+func (ch *ClickHouse) freeze(query string, name string, timeout int) error {
+	ch.mu.Lock()
+	withoutName := ch.freezeWithoutName || ch.olderThan(minVersionFreezeWithName)
+	ch.mu.Unlock()
+	if name != "" && !withoutName {
+		err := ch.execQuery(fmt.Sprintf("%s WITH NAME '%s';", strings.TrimSuffix(query, ";"), strings.Replace(name, "'", "\\'", -1)), timeout)
+		if !isSyntaxError(err) {
+			return err
+		}
+		logger.Warnf("can't freeze with name, shadow increments will be used: %v", err)
+		ch.mu.Lock()
+		ch.freezeWithoutName = true
+		ch.mu.Unlock()
+	}
+	return ch.execQuery(query, timeout)
+}
+
+// unknownTableRe - code of UNKNOWN_TABLE or UNKNOWN_DATABASE exception in error of native or HTTP interface
+var unknownTableRe = regexp.MustCompile(`(?i)\bcode: (60|81)\b`)
+
+// isUnknownTableError - check that query failed because table or its database doesn't exist
+func isUnknownTableError(err error) bool {
+	return err != nil && unknownTableRe.MatchString(err.Error())
+}
+
+// syntaxErrorRe - code of SYNTAX_ERROR exception in error of native or HTTP interface
+var syntaxErrorRe = regexp.MustCompile(`(?i)\bcode: 62\b`)
+
+// isSyntaxError - check that query failed because server doesn't support its syntax
+func isSyntaxError(err error) bool {
+	return err != nil && syntaxErrorRe.MatchString(err.Error())
+}
+
 // GetBackupTables - return list of backups of tables that can be restored
 func (ch *ClickHouse) GetBackupTables() (map[string]BackupTable, error) {
 	dataPath, err := ch.GetDataPath()
 	if err != nil {
 		return nil, err
 	}
-	backupShadowPath := filepath.Join(dataPath, "backup", "shadow")
+	shadows, err := backupShadows(filepath.Join(dataPath, ch.Config.BackupDir))
+	if err != nil {
+		return nil, fmt.Errorf("can't read disks of backup: %v", err)
+	}
+	return getDisksBackupTables(shadows)
+}
+
+// getBackupTables - parse frozen partitions of tables from shadow directory of disk
+func getBackupTables(backupShadowPath string, disk string) (map[string]BackupTable, error) {
 	result := make(map[string]BackupTable)
 	if err := filepath.Walk(backupShadowPath, func(filePath string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -165,10 +628,12 @@ func (ch *ClickHouse) GetBackupTables() (map[string]BackupTable, error) {
 			partition := BackupPartition{
 				Name: parts[4],
 				Path: filePath,
+				Disk: disk,
 			}
+			// shadow/<name> of FREEZE WITH NAME has only one freeze of every table
 			increment, err := strconv.Atoi(parts[0])
 			if err != nil {
-				return nil
+				increment = 0
 			}
 			table := BackupTable{
 				Increment:  increment,
@@ -198,12 +663,15 @@ func (ch *ClickHouse) Chown(name string) error {
 		dataPath string
 		err      error
 	)
+	ch.mu.Lock()
 	if ch.uid == nil || ch.gid == nil {
 		if dataPath, err = ch.GetDataPath(); err != nil {
+			ch.mu.Unlock()
 			return err
 		}
 		info, err := os.Stat(path.Join(dataPath, "data"))
 		if err != nil {
+			ch.mu.Unlock()
 			return err
 		}
 		stat := info.Sys().(*syscall.Stat_t)
@@ -212,39 +680,113 @@ func (ch *ClickHouse) Chown(name string) error {
 		ch.uid = &uid
 		ch.gid = &gid
 	}
-	return os.Chown(name, *ch.uid, *ch.gid)
+	uid, gid := *ch.uid, *ch.gid
+	ch.mu.Unlock()
+	return os.Chown(name, uid, gid)
 }
 
-// CopyData - copy partitions for specific table to detached folder
-func (ch *ClickHouse) CopyData(table BackupTable, move bool) error {
-	if ch.DryRun {
-		log.Printf("copy %s.%s increment %d  ...skip dry-run", table.Database, table.Name, table.Increment)
-		return nil
+// restoreStagingDir - directory in backup directory of disk where parts are copied by restore,
+// they are renamed into detached just before ATTACH so crash never leaves half-copied parts in detached
+const restoreStagingDir = "restore_staging"
+
+// stagingPath - directory of part copied by restore on disk
+func stagingPath(disk Disk, database string, table string, part string) string {
+	return filepath.Join(disk.backupPath(), restoreStagingDir, database, table, part)
+}
+
+// CleanRestoreStaging - remove parts which were copied by failed restore but weren't attached
+func (ch *ClickHouse) CleanRestoreStaging() error {
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return err
 	}
+	for _, disk := range disks {
+		stagingDir := filepath.Join(disk.backupPath(), restoreStagingDir)
+		if _, err := os.Stat(stagingDir); os.IsNotExist(err) {
+			continue
+		}
+		// staging has directory of every table which parts are copied to
+		tableDirs, err := filepath.Glob(filepath.Join(stagingDir, "*", "*"))
+		if err != nil {
+			return err
+		}
+		for _, tableDir := range tableDirs {
+			tableLog := logger.WithFields(Fields{"disk": disk.Name, "table": filepath.Base(filepath.Dir(tableDir)) + "." + filepath.Base(tableDir)})
+			if ch.DryRun {
+				tableLog.Infof("DRY-RUN: remove stale restore staging %s", tableDir)
+			} else {
+				tableLog.Infof("Remove stale restore staging %s", tableDir)
+			}
+		}
+		if ch.DryRun {
+			continue
+		}
+		if err := os.RemoveAll(stagingDir); err != nil {
+			return fmt.Errorf("can't remove stale restore staging with: %v", err)
+		}
+	}
+	return nil
+}
+
+// CopyData - copy partitions for specific table to restore staging, they are moved to detached folder by AttachPatritions,
+// with move flag files are moved to detached folder directly,
+// on dry-run filesystem operations are only logged with "DRY-RUN:" prefix, table must be checked by CheckRestoreTarget
+func (ch *ClickHouse) CopyData(table BackupTable, move bool) error {
 	log.Printf("copy %s.%s increment %d", table.Database, table.Name, table.Increment)
-	dataPath, err := ch.GetDataPath()
+	stop := heartbeat("copy", table.Database+"."+table.Name, ch.Config.HeartbeatInterval)
+	defer stop()
+	disks, err := ch.GetDisks()
 	if err != nil {
 		return err
 	}
-
-	detachedParentDir := filepath.Join(dataPath, "data", table.Database, table.Name, "detached")
-	os.MkdirAll(detachedParentDir, 0750)
-	ch.Chown(detachedParentDir)
+	disksByName := make(map[string]Disk)
+	for _, disk := range disks {
+		disksByName[disk.Name] = disk
+	}
 
 	for _, partition := range table.Partitions {
+		disk, ok := disksByName[partition.Disk]
+		if !ok {
+			return fmt.Errorf("disk '%s' of %s.%s is not found in clickhouse", partition.Disk, table.Database, table.Name)
+		}
+		diskPath := disk.Path
+		zeroCopy := ch.ZeroCopy && disk.IsRemote()
+		detachedParentDir := filepath.Join(diskPath, "data", table.Database, table.Name, "detached")
 		detachedPath := filepath.Join(detachedParentDir, partition.Name)
-		info, err := os.Stat(detachedPath)
+		if ch.DryRun {
+			if err := dryRunCopyPartition(table.Database+"."+table.Name, partition.Path, detachedPath, move); err != nil {
+				return err
+			}
+			continue
+		}
+		os.MkdirAll(detachedParentDir, 0750)
+		ch.Chown(detachedParentDir)
+		dstPath := detachedPath
+		if zeroCopy {
+			log.Printf("zero-copy: write references of part %s to detached of %s disk '%s'", partition.Name, disk.Type, disk.Name)
+			// part left in detached by failed restore is replaced
+			if err := os.RemoveAll(dstPath); err != nil {
+				return err
+			}
+		} else if !move {
+			// part of stale staging is removed, so copy always starts from scratch
+			dstPath = stagingPath(disk, table.Database, table.Name, partition.Name)
+			if err := os.RemoveAll(dstPath); err != nil {
+				return err
+			}
+		}
+		info, err := os.Stat(dstPath)
 		if err != nil {
 			if os.IsNotExist(err) {
 				// partition dir does not exist, creating
-				os.MkdirAll(detachedPath, 0750)
+				os.MkdirAll(dstPath, 0750)
 			} else {
 				return err
 			}
 		} else if !info.IsDir() {
-			return fmt.Errorf("'%s' should be directory or absent", detachedPath)
+			return fmt.Errorf("'%s' should be directory or absent", dstPath)
 		}
-		ch.Chown(detachedPath)
+		ch.Chown(dstPath)
 
 		log.Printf("Walking through partition %s", partition.Path)
 		if err := filepath.Walk(partition.Path, func(filePath string, info os.FileInfo, err error) error {
@@ -253,7 +795,7 @@ func (ch *ClickHouse) CopyData(table BackupTable, move bool) error {
 			}
 			filePath = filepath.ToSlash(filePath) // fix Windows slashes
 			filename := strings.Trim(strings.TrimPrefix(filePath, partition.Path), "/")
-			dstFilePath := filepath.Join(detachedPath, filename)
+			dstFilePath := filepath.Join(dstPath, filename)
 			if info.IsDir() {
 				log.Printf("Creating directory %s", dstFilePath)
 				os.MkdirAll(dstFilePath, 0750)
@@ -282,6 +824,44 @@ func (ch *ClickHouse) CopyData(table BackupTable, move bool) error {
 	return nil
 }
 
+// dryRunCopyPartition - log operations which CopyData would do with partition of table
+func dryRunCopyPartition(table string, partitionPath string, detachedPath string, move bool) error {
+	tableLog := logger.WithField("table", table)
+	tableLog.Infof("DRY-RUN: mkdir %s", detachedPath)
+	operation := "copy"
+	if move {
+		operation = "move"
+	}
+	return filepath.Walk(partitionPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		filename := strings.Trim(strings.TrimPrefix(filepath.ToSlash(filePath), partitionPath), "/")
+		if filename == "" {
+			return nil
+		}
+		dstFilePath := filepath.Join(detachedPath, filename)
+		if info.IsDir() {
+			tableLog.Infof("DRY-RUN: mkdir %s", dstFilePath)
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			tableLog.Infof("DRY-RUN: %s %s %s", operation, filePath, dstFilePath)
+		}
+		return nil
+	})
+}
+
+// partitionID - ID of partition which part belongs to, it is the same as partition_id in system.parts
+func partitionID(partName string) string {
+	parts := strings.Split(partName, "_")
+	if len(parts) == 5 && len(parts[0]) == 8 && len(parts[1]) == 8 {
+		// legacy part name with min and max dates of month: 20181001_20181031_1_1_0
+		return parts[0][:6]
+	}
+	return parts[0]
+}
+
 func convertPartition(detachedTableFolder string) string {
 	parts := strings.Split(detachedTableFolder, "_")
 	if parts[0] == "all" {
@@ -301,30 +881,181 @@ func convertPartition(detachedTableFolder string) string {
 	return fmt.Sprintf("ID '%s'", parts[0])
 }
 
-// AttachPatritions - execute ATTACH command for specific table
+// AttachPatritions - execute ATTACH command for every partition of specific table,
+// clickhouse attaches parts from detached folders of all disks, table must be checked by CheckRestoreTarget
 func (ch *ClickHouse) AttachPatritions(table BackupTable) error {
+	log.Printf("Attach partitions for %s.%s increment %d:", table.Database, table.Name, table.Increment)
+	if err := ch.commitStaging(table); err != nil {
+		return err
+	}
+	attached := make(map[string]bool)
+	var partitions []string
+	for _, partition := range table.Partitions {
+		partitionID := convertPartition(partition.Name)
+		if attached[partitionID] {
+			continue
+		}
+		attached[partitionID] = true
+		partitions = append(partitions, partitionID)
+	}
+	for start := 0; start < len(partitions); start += attachBatchSize {
+		end := start + attachBatchSize
+		if end > len(partitions) {
+			end = len(partitions)
+		}
+		if err := ch.attachBatch(table, partitions[start:end]); err != nil {
+			return err
+		}
+	}
+	if !ch.DryRun {
+		log.Printf("Attached %d partitions to %s.%s", len(partitions), table.Database, table.Name)
+	}
+	return nil
+}
+
+// commitStaging - rename parts copied to restore staging into detached folder,
+// part with the same name which is left in detached by failed restore is replaced
+func (ch *ClickHouse) commitStaging(table BackupTable) error {
 	if ch.DryRun {
-		log.Printf("Attach partition '%s' for %s.%s increment %d ...skip dry-run", table.Partitions[0].Name, table.Database, table.Name, table.Increment)
 		return nil
 	}
-	log.Printf("Attach partitions for %s.%s increment %d:", table.Database, table.Name, table.Increment)
-	query := fmt.Sprintf("ALTER TABLE %v.%v ATTACH PARTITION %s", table.Database, table.Name, convertPartition(table.Partitions[0].Name))
-	log.Printf(query)
-	if _, err := ch.conn.Exec(query); err != nil {
+	disks, err := ch.GetDisks()
+	if err != nil {
 		return err
 	}
+	disksByName := make(map[string]Disk)
+	for _, disk := range disks {
+		disksByName[disk.Name] = disk
+	}
+	for _, partition := range table.Partitions {
+		disk := disksByName[partition.Disk]
+		stagedPath := stagingPath(disk, table.Database, table.Name, partition.Name)
+		if _, err := os.Stat(stagedPath); os.IsNotExist(err) {
+			// partition was moved to detached directly
+			continue
+		}
+		detachedPath := filepath.Join(disk.Path, "data", table.Database, table.Name, "detached", partition.Name)
+		if err := os.RemoveAll(detachedPath); err != nil {
+			return err
+		}
+		if err := os.Rename(stagedPath, detachedPath); err != nil {
+			return fmt.Errorf("can't move %s to detached with: %v", stagedPath, err)
+		}
+		os.Remove(filepath.Dir(stagedPath))
+	}
+	return nil
+}
+
+// attachBatchSize - max number of ATTACH PARTITION commands in single ALTER query
+const attachBatchSize = 100
+
+// attachBatch - attach partitions by single ALTER query, every partition is attached by own query
+// if server doesn't support several commands in one ALTER, attaching already attached partition is no-op
+func (ch *ClickHouse) attachBatch(table BackupTable, partitions []string) error {
+	ch.mu.Lock()
+	singleAttach := ch.singleAttach || ch.olderThan(minVersionBatchAttach)
+	ch.mu.Unlock()
+	tableLog := logger.WithField("table", table.Database+"."+table.Name)
+	if len(partitions) > 1 && !singleAttach {
+		commands := make([]string, len(partitions))
+		for i, partitionID := range partitions {
+			commands[i] = "ATTACH PARTITION " + partitionID
+		}
+		query := fmt.Sprintf("ALTER TABLE %v.%v %s", table.Database, table.Name, strings.Join(commands, ", "))
+		if ch.DryRun {
+			tableLog.Infof("DRY-RUN: %s", query)
+			return nil
+		}
+		tableLog.Info(query)
+		err := ch.execQuery(query, ch.Config.QueryTimeout)
+		if err == nil {
+			return nil
+		}
+		tableLog.Warnf("can't attach partitions by one query, attach them one by one: %v", err)
+		ch.mu.Lock()
+		ch.singleAttach = true
+		ch.mu.Unlock()
+	}
+	for _, partitionID := range partitions {
+		query := fmt.Sprintf("ALTER TABLE %v.%v ATTACH PARTITION %s", table.Database, table.Name, partitionID)
+		if ch.DryRun {
+			tableLog.Infof("DRY-RUN: %s", query)
+			continue
+		}
+		tableLog.Info(query)
+		if err := ch.execQuery(query, ch.Config.QueryTimeout); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// engineRe - engine name in create query from metadata
+var engineRe = regexp.MustCompile(`ENGINE\s*=\s*(\w+)`)
+
+// GetBackupEngine - return engine of table from backup metadata, empty string if metadata is absent
+func GetBackupEngine(metadataPath string, database string, name string) (string, error) {
+	query, err := ioutil.ReadFile(filepath.Join(metadataPath, database, name+".sql"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if match := engineRe.FindSubmatch(query); match != nil {
+		return string(match[1]), nil
+	}
+	return "", nil
+}
+
+// createObjectRe - beginning of create query, database and name of created table, view or dictionary
+var createObjectRe = regexp.MustCompile("(?is)^(\\s*CREATE\\s+(?:TABLE|(?:MATERIALIZED\\s+)?VIEW|DICTIONARY)\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?)" +
+	"(`[^`]+`|\"[^\"]+\"|\\w+)(?:\\.(`[^`]+`|\"[^\"]+\"|\\w+))?")
+
+// addOnCluster - add ON CLUSTER clause right after name of created object so TO clause of materialized view
+// stays after it, name is qualified by database because query is executed on other nodes
+func addOnCluster(query string, database string, cluster string) string {
+	match := createObjectRe.FindStringSubmatchIndex(query)
+	if match == nil {
+		return query
+	}
+	name := query[match[4]:match[1]]
+	if match[6] < 0 {
+		name = fmt.Sprintf("`%s`.%s", database, name)
+	}
+	return query[:match[4]] + name + fmt.Sprintf(" ON CLUSTER '%s'", cluster) + query[match[1]:]
+}
+
+// storagePolicyRe - storage_policy setting in create query
+var storagePolicyRe = regexp.MustCompile(`(?i)(\s*SETTINGS\s+storage_policy\s*=\s*'[^']*'(\s*,\s*)?|\s*,\s*storage_policy\s*=\s*'[^']*')`)
+
+// AdaptCreateQuery - remove from create query settings which aren't supported by version of server,
+// table is created with storage_policy only if server supports storage policies
+func (ch *ClickHouse) AdaptCreateQuery(query string) string {
+	if !ch.olderThan(minVersionStoragePolicy) {
+		return query
+	}
+	return storagePolicyRe.ReplaceAllStringFunc(query, func(setting string) string {
+		if strings.HasSuffix(strings.TrimSpace(setting), ",") {
+			// other settings follow storage_policy
+			return " SETTINGS "
+		}
+		return ""
+	})
+}
+
 // CreateDatabase - create specific database from metadata in backup folder
 func (ch *ClickHouse) CreateDatabase(database string) error {
 	createQuery := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", database)
+	if ch.Config.Cluster != "" {
+		createQuery += fmt.Sprintf(" ON CLUSTER '%s'", ch.Config.Cluster)
+	}
 	if ch.DryRun {
 		log.Printf("DRY-RUN: creating database with query: %s", createQuery)
 		return nil
 	}
 	log.Printf("Creating database %s", database)
-	if _, err := ch.conn.Exec(createQuery); err != nil {
+	if err := ch.execQuery(createQuery, ch.Config.QueryTimeout); err != nil {
 		return fmt.Errorf("can't create database: %v", err)
 	}
 	return nil
@@ -332,13 +1063,16 @@ func (ch *ClickHouse) CreateDatabase(database string) error {
 
 // CreateTable - create specific table from metadata in backup folder
 func (ch *ClickHouse) CreateTable(table RestoreTable) error {
+	if ch.Config.Cluster != "" {
+		table.Query = addOnCluster(table.Query, table.Database, ch.Config.Cluster)
+	}
 	if ch.DryRun {
 		log.Printf("DRY-RUN: creating table with query: %s", table.Query)
 		return nil
 	}
 	ch.ConnectDatabase(table.Database)
 	log.Printf("Creating table:\n%s", table.Query)
-	if _, err := ch.conn.Exec(table.Query); err != nil {
+	if err := ch.execQuery(table.Query, ch.Config.QueryTimeout); err != nil {
 		return fmt.Errorf("can't create table: %v", err)
 	}
 	return nil
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// httpClient - client of clickhouse HTTP interface
+type httpClient struct {
+	client   *http.Client
+	url      string
+	username string
+	password string
+}
+
+// openHTTP - create client of HTTP interface with TLS and timeout settings from config and check it
+func (ch *ClickHouse) openHTTP(database string) error {
+	scheme := "http"
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: time.Duration(ch.Config.ConnectTimeout) * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: time.Duration(ch.Config.ConnectTimeout) * time.Second,
+	}
+	if ch.Config.Secure {
+		scheme = "https"
+		tlsConfig, err := ch.tlsConfig()
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	params := url.Values{}
+	// 64-bit integers are written as numbers instead of strings to be decoded to Go integers
+	params.Set("output_format_json_quote_64bit_integers", "0")
+	if database != "" {
+		params.Set("database", database)
+	}
+	ch.http = &httpClient{
+		client:   &http.Client{Transport: transport},
+		url:      fmt.Sprintf("%s://%s:%d/?%s", scheme, ch.Config.Host, ch.Config.Port, params.Encode()),
+		username: ch.Config.Username,
+		password: ch.Config.Password,
+	}
+	ctx, cancel := timeoutContext(ch.Config.ConnectTimeout)
+	defer cancel()
+	body, err := ch.http.query(ctx, "SELECT 1")
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("connect to %s:%d timed out after %ds", ch.Config.Host, ch.Config.Port, ch.Config.ConnectTimeout)
+		}
+		if ch.Config.Secure && isTLSError(err) {
+			return fmt.Errorf("TLS handshake with %s:%d failed, check clickhouse.tls_ca, tls_cert, tls_key and skip_verify: %v", ch.Config.Host, ch.Config.Port, err)
+		}
+		return err
+	}
+	return body.Close()
+}
+
+// query - send query in body of POST request and return body of response
+func (c *httpClient) query(ctx context.Context, query string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodPost, c.url, strings.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-ClickHouse-User", c.username)
+	req.Header.Set("X-ClickHouse-Key", c.password)
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp.Body, nil
+}
+
+// exec - run query and discard its result
+func (c *httpClient) exec(ctx context.Context, query string) error {
+	body, err := c.query(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(ioutil.Discard, body)
+	return err
+}
+
+// selectInto - run query with JSONEachRow format and decode rows into dest,
+// dest is pointer to slice of structs with db tags or slice of scalars for single column
+func (c *httpClient) selectInto(ctx context.Context, dest interface{}, query string) error {
+	slice := reflect.ValueOf(dest)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("destination must be pointer to slice, got %T", dest)
+	}
+	slice = slice.Elem()
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";") + " FORMAT JSONEachRow"
+	body, err := c.query(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	elemType := slice.Type().Elem()
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var row map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return fmt.Errorf("can't decode row with: %v", err)
+		}
+		elem := reflect.New(elemType).Elem()
+		if err := decodeRow(row, elem); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, elem))
+	}
+	return scanner.Err()
+}
+
+// decodeRow - set fields of struct by db tags or scalar by the only column of row
+func decodeRow(row map[string]json.RawMessage, elem reflect.Value) error {
+	if elem.Kind() != reflect.Struct {
+		if len(row) != 1 {
+			return fmt.Errorf("expected one column, got %d", len(row))
+		}
+		for name, value := range row {
+			if err := decodeValue(value, elem); err != nil {
+				return fmt.Errorf("can't decode column '%s' with: %v", name, err)
+			}
+		}
+		return nil
+	}
+	for i := 0; i < elem.NumField(); i++ {
+		name := elem.Type().Field(i).Tag.Get("db")
+		value, ok := row[name]
+		if name == "" || !ok {
+			continue
+		}
+		if err := decodeValue(value, elem.Field(i)); err != nil {
+			return fmt.Errorf("can't decode column '%s' with: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// decodeValue - decode JSON value of column, UInt8 is decoded to bool as native driver does
+func decodeValue(value json.RawMessage, field reflect.Value) error {
+	if field.Kind() == reflect.Bool {
+		var n uint8
+		if err := json.Unmarshal(value, &n); err == nil {
+			field.SetBool(n != 0)
+			return nil
+		}
+	}
+	return json.Unmarshal(value, field.Addr().Interface())
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddOnCluster(t *testing.T) {
+	for _, c := range []struct {
+		query    string
+		expected string
+	}{
+		{
+			"CREATE TABLE events (id UInt64) ENGINE = MergeTree ORDER BY id",
+			"CREATE TABLE `db`.events ON CLUSTER 'main' (id UInt64) ENGINE = MergeTree ORDER BY id",
+		},
+		{
+			"CREATE TABLE IF NOT EXISTS other.`events log` (id UInt64) ENGINE = Log",
+			"CREATE TABLE IF NOT EXISTS other.`events log` ON CLUSTER 'main' (id UInt64) ENGINE = Log",
+		},
+		{
+			"CREATE MATERIALIZED VIEW daily_mv TO db.daily AS SELECT * FROM db.events",
+			"CREATE MATERIALIZED VIEW `db`.daily_mv ON CLUSTER 'main' TO db.daily AS SELECT * FROM db.events",
+		},
+		{
+			"INSERT INTO events VALUES (1)",
+			"INSERT INTO events VALUES (1)",
+		},
+	} {
+		assert.Equal(t, c.expected, addOnCluster(c.query, "db", "main"))
+	}
+}
+
+func TestIfNotExists(t *testing.T) {
+	assert.Equal(t, "CREATE USER IF NOT EXISTS alice IDENTIFIED WITH sha256_hash BY 'abc'", ifNotExists("CREATE USER alice IDENTIFIED WITH sha256_hash BY 'abc'"))
+	assert.Equal(t, "CREATE ROLE IF NOT EXISTS reader", ifNotExists("CREATE ROLE reader"))
+	assert.Equal(t, "CREATE ROW POLICY IF NOT EXISTS p ON db.t FOR SELECT USING 1 TO alice", ifNotExists("CREATE ROW POLICY p ON db.t FOR SELECT USING 1 TO alice"))
+	assert.Equal(t, "GRANT SELECT ON db.* TO alice", ifNotExists("GRANT SELECT ON db.* TO alice"))
+}
+
+func TestParseVersion(t *testing.T) {
+	version, err := parseVersion("19.15.3.6")
+	assert.NoError(t, err)
+	assert.Equal(t, 19015003, version)
+	version, err = parseVersion("21.8.10")
+	assert.NoError(t, err)
+	assert.Equal(t, 21008010, version)
+	for _, name := range []string{"", "19.15", "19.x.1", "19.1000.1"} {
+		_, err := parseVersion(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestAdaptCreateQuery(t *testing.T) {
+	ch := &ClickHouse{version: 19014000}
+	query := "CREATE TABLE db.t (d Date) ENGINE = MergeTree ORDER BY d SETTINGS storage_policy = 'hot_cold'"
+	assert.Equal(t, "CREATE TABLE db.t (d Date) ENGINE = MergeTree ORDER BY d", ch.AdaptCreateQuery(query))
+	assert.Equal(t, "CREATE TABLE db.t (d Date) ENGINE = MergeTree ORDER BY d SETTINGS index_granularity = 8192",
+		ch.AdaptCreateQuery("CREATE TABLE db.t (d Date) ENGINE = MergeTree ORDER BY d SETTINGS storage_policy = 'hot_cold', index_granularity = 8192"))
+	assert.Equal(t, "CREATE TABLE db.t (d Date) ENGINE = MergeTree ORDER BY d SETTINGS index_granularity = 8192",
+		ch.AdaptCreateQuery("CREATE TABLE db.t (d Date) ENGINE = MergeTree ORDER BY d SETTINGS index_granularity = 8192, storage_policy = 'hot_cold'"))
+	// unknown and new versions support storage policies
+	for _, version := range []int{0, 19015003} {
+		ch.version = version
+		assert.Equal(t, query, ch.AdaptCreateQuery(query))
+	}
+}
+
+func TestGetBackupTablesWithNamedFreeze(t *testing.T) {
+	shadow, err := ioutil.TempDir("", "shadow")
+	assert.NoError(t, err)
+	defer os.RemoveAll(shadow)
+	for _, dir := range []string{
+		"2020-01-01T00%3A00%3A00Z/data/db/events/201901_1_1_0",
+		"2020-01-01T00%3A00%3A00Z/data/db/events/201902_2_2_0",
+		"3/data/db/logs/all_1_1_0",
+		"3/data/db/logs/all_1_1_0/p.proj",
+		"access",
+	} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(shadow, dir), 0755))
+	}
+	tables, err := getBackupTables(shadow, defaultDiskName)
+	assert.NoError(t, err)
+	assert.Len(t, tables, 2)
+	assert.Equal(t, 0, tables["db.events-0"].Increment)
+	assert.Len(t, tables["db.events-0"].Partitions, 2)
+	assert.Equal(t, 3, tables["db.logs-3"].Increment)
+}
+
+func TestHTTPSelect(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := ioutil.ReadAll(r.Body)
+		queries = append(queries, string(query))
+		assert.Equal(t, "backup", r.Header.Get("X-ClickHouse-User"))
+		assert.Equal(t, "0", r.URL.Query().Get("output_format_json_quote_64bit_integers"))
+		w.Write([]byte("{\"database\":\"db\",\"name\":\"events\",\"is_temporary\":0,\"engine\":\"MergeTree\"}\n"))
+		w.Write([]byte("{\"database\":\"db\",\"name\":\"tmp\",\"is_temporary\":1,\"engine\":\"Memory\"}\n"))
+	}))
+	defer server.Close()
+	client := &httpClient{client: server.Client(), url: server.URL + "/?output_format_json_quote_64bit_integers=0", username: "backup"}
+	ch := &ClickHouse{Config: &ClickHouseConfig{SkipDatabases: []string{"system", "INFORMATION_SCHEMA"}}, http: client}
+	tables, err := ch.GetTables()
+	assert.NoError(t, err)
+	assert.Equal(t, []Table{
+		{Database: "db", Name: "events", Engine: "MergeTree"},
+		{Database: "db", Name: "tmp", IsTemporary: true, Engine: "Memory"},
+	}, tables)
+	assert.Equal(t, []string{"SELECT database, name, is_temporary, data_path, metadata_path, engine FROM system.tables WHERE database NOT IN ('system', 'INFORMATION_SCHEMA') FORMAT JSONEachRow"}, queries)
+}
+
+func TestGetDisksWithType(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := ioutil.ReadAll(r.Body)
+		queries = append(queries, string(query))
+		w.Write([]byte("{\"name\":\"default\",\"path\":\"/var/lib/clickhouse/\",\"type\":\"local\"}\n"))
+		w.Write([]byte("{\"name\":\"s3\",\"path\":\"/var/lib/clickhouse/disks/s3/\",\"type\":\"s3\"}\n"))
+	}))
+	defer server.Close()
+	client := &httpClient{client: server.Client(), url: server.URL + "/?output_format_json_quote_64bit_integers=0"}
+	ch := &ClickHouse{Config: &ClickHouseConfig{DataPath: "/data/clickhouse"}, http: client}
+	disks, err := ch.GetDisks()
+	assert.NoError(t, err)
+	assert.Equal(t, []Disk{
+		{Name: "default", Path: "/data/clickhouse", Type: "local"},
+		{Name: "s3", Path: "/var/lib/clickhouse/disks/s3", Type: "s3"},
+	}, disks)
+	assert.False(t, disks[0].IsRemote())
+	assert.True(t, disks[1].IsRemote())
+	assert.Equal(t, []string{"SELECT name, path, type FROM system.disks FORMAT JSONEachRow"}, queries)
+}
+
+func TestIsUnknownTableError(t *testing.T) {
+	assert.True(t, isUnknownTableError(errors.New("code: 60, message: Table db.events doesn't exist.")))
+	assert.True(t, isUnknownTableError(errors.New("500 Internal Server Error: Code: 81, e.displayText() = DB::Exception: Database db doesn't exist")))
+	assert.False(t, isUnknownTableError(errors.New("code: 497, message: Not enough privileges")))
+	assert.False(t, isUnknownTableError(errors.New("code: 600, message: unknown")))
+	assert.False(t, isUnknownTableError(nil))
+}
+
+func TestIsSyntaxError(t *testing.T) {
+	assert.True(t, isSyntaxError(errors.New("code: 62, message: Syntax error: failed at position 45 ('WITH')")))
+	assert.False(t, isSyntaxError(errors.New("read tcp 127.0.0.1:9000: i/o timeout")))
+	assert.False(t, isSyntaxError(errors.New("code: 620, message: unknown")))
+	assert.False(t, isSyntaxError(nil))
+}
+
+func TestReadTimeout(t *testing.T) {
+	for _, testCase := range []struct {
+		query, freeze, expected int
+	}{
+		{600, 3600, 3600},
+		{600, 60, 600},
+		{0, 3600, unlimitedReadTimeout},
+		{600, 0, unlimitedReadTimeout},
+	} {
+		ch := &ClickHouse{Config: &ClickHouseConfig{QueryTimeout: testCase.query, FreezeTimeout: testCase.freeze}}
+		assert.Equal(t, testCase.expected, ch.readTimeout())
+	}
+}
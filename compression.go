@@ -0,0 +1,143 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// gzipSuffix - suffix of object which is file of tree compressed on upload
+	gzipSuffix = ".gz"
+	// compressionMeta - user metadata of object compressed on upload, object with gzipSuffix without it
+	// is file which name has this suffix
+	compressionMeta = "Clickhouse-Backup-Compression"
+)
+
+// compressedExtensions - files which are already compressed, they aren't compressed again
+var compressedExtensions = map[string]bool{
+	".gz":  true,
+	".tgz": true,
+	".zst": true,
+	".lz4": true,
+	".xz":  true,
+	".bz2": true,
+	".zip": true,
+	".br":  true,
+	".7z":  true,
+}
+
+// shouldCompress - check that file of tree with key and size is compressed on upload according to s3.tree_compression
+func (s *S3) shouldCompress(key string, size int64) bool {
+	return s.Config.TreeCompression == "gzip" && size >= s.Config.TreeCompressionMinSize && !compressedExtensions[strings.ToLower(filepath.Ext(key))]
+}
+
+// isCompressedObject - check user metadata of object which is set on upload of compressed file
+func isCompressedObject(metadata map[string]*string) bool {
+	for key, value := range metadata {
+		if strings.EqualFold(key, compressionMeta) && aws.StringValue(value) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipStream - read r compressed by gzip, header has neither name nor time, so the same content
+// is always compressed to the same bytes and can be compared with ETag of object. Stream must be closed
+func gzipStream(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gw := gzip.NewWriter(pw)
+		_, err := io.Copy(gw, r)
+		if closeErr := gw.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// compressedFileMatches - check that file compressed by gzip has size of object, ETag is compared too if checkEtag is set
+func compressedFileMatches(filePath string, partSize int64, size int64, etag string, checkEtag bool) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	body := gzipStream(file)
+	defer body.Close()
+	h := newEtagHash(partSize)
+	written, err := io.Copy(h, body)
+	if err != nil || written != size {
+		return false
+	}
+	if !checkEtag {
+		return true
+	}
+	match, ok := h.Check(etag)
+	return ok && match
+}
+
+// downloadGzipCandidate - download object with gzipSuffix to localPath, it is decompressed to localPath
+// without suffix if it was compressed on upload
+func (s *S3) downloadGzipCandidate(ctx context.Context, key string, localPath string) error {
+	return withRetry(ctx, s.Config.MaxRetries, key, func() error {
+		resp, err := s3.New(s.session).GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.Config.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return archivedObjectError(key, err)
+		}
+		defer resp.Body.Close()
+		var body io.Reader = resp.Body
+		dstPath := localPath
+		if isCompressedObject(resp.Metadata) {
+			gr, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				return fmt.Errorf("can't decompress '%s' with: %v", key, err)
+			}
+			body = gr
+			dstPath = strings.TrimSuffix(localPath, gzipSuffix)
+		}
+		tmpPath := dstPath + downloadingSuffix
+		f, err := s.createFile(tmpPath)
+		if err != nil {
+			return fmt.Errorf("can't open '%s' with %v", tmpPath, err)
+		}
+		n, err := io.Copy(f, body)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		if err := os.Rename(tmpPath, dstPath); err != nil {
+			return err
+		}
+		metricsFromContext(ctx).addTransfer(1, n)
+		return nil
+	})
+}
+
+// checksumCompressedObject - sha256 of decompressed content of object compressed by gzip
+func checksumCompressedObject(ctx context.Context, s3 *S3, s3Path string) (string, error) {
+	body, err := s3.DownloadStream(ctx, s3Path)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	gr, err := gzip.NewReader(body)
+	if err != nil {
+		return "", fmt.Errorf("can't decompress '%s' with: %v", s3Path, err)
+	}
+	return checksumReader(gr)
+}
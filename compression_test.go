@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressedFileMatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compression")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	content := bytes.Repeat([]byte("clickhouse"), 1000)
+	file := filepath.Join(dir, "data.bin")
+	assert.NoError(t, ioutil.WriteFile(file, content, 0644))
+
+	body := gzipStream(bytes.NewReader(content))
+	compressed, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	body.Close()
+	gr, err := gzip.NewReader(bytes.NewReader(compressed))
+	assert.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(gr)
+	assert.NoError(t, err)
+	assert.Equal(t, content, decompressed)
+
+	// the same content is compressed to the same bytes
+	compressedFile := filepath.Join(dir, "data.bin.gz")
+	assert.NoError(t, ioutil.WriteFile(compressedFile, compressed, 0644))
+	etag := GetEtag(compressedFile, 16)
+	assert.True(t, compressedFileMatches(file, 16, int64(len(compressed)), etag, true))
+	assert.True(t, compressedFileMatches(file, 16, int64(len(compressed)), "", false))
+	assert.False(t, compressedFileMatches(file, 16, int64(len(compressed)+1), etag, true))
+	assert.False(t, compressedFileMatches(file, 16, int64(len(compressed)), GetEtag(file, 16), true))
+}
+
+func TestShouldCompress(t *testing.T) {
+	s := &S3{Config: &S3Config{TreeCompression: "gzip", TreeCompressionMinSize: 1024}}
+	assert.True(t, s.shouldCompress("/db/table.sql", 2048))
+	assert.False(t, s.shouldCompress("/db/table.sql", 100))
+	assert.False(t, s.shouldCompress("/data/dump.ZST", 2048))
+	s.Config.TreeCompression = "none"
+	assert.False(t, s.shouldCompress("/db/table.sql", 2048))
+}
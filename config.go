@@ -4,63 +4,345 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/robfig/cron/v3"
 	yaml "gopkg.in/yaml.v2"
 )
 
+// envPrefix - prefix of environment variables which override config, e.g. CLICKHOUSE_BACKUP_S3_SECRET_KEY
+const envPrefix = "CLICKHOUSE_BACKUP_"
+
+// minPartSize - s3 rejects multipart uploads with smaller parts except the last one
+const minPartSize = 5 * 1024 * 1024
+
 // Config - config file format
 type Config struct {
-	ClickHouse ClickHouseConfig `yaml:"clickhouse"`
-	S3         S3Config         `yaml:"s3"`
-	Backup     BackupConfig     `yaml:"backup"`
+	ClickHouse    ClickHouseConfig    `yaml:"clickhouse"`
+	S3            S3Config            `yaml:"s3"`
+	Backup        BackupConfig        `yaml:"backup"`
+	Notifications NotificationsConfig `yaml:"notifications"`
+	Hooks         HooksConfig         `yaml:"hooks"`
+	Log           LogConfig           `yaml:"log"`
+	Replica       ReplicaConfig       `yaml:"replica"`
 }
 
 // S3Config - s3 settings section
 type S3Config struct {
-	AccessKey          string `yaml:"access_key"`
-	SecretKey          string `yaml:"secret_key"`
-	Bucket             string `yaml:"bucket"`
-	Endpoint           string `yaml:"endpoint"`
-	Region             string `yaml:"region"`
-	ACL                string `yaml:"acl"`
-	ForcePathStyle     bool   `yaml:"force_path_style"`
-	Path               string `yaml:"path"`
-	DisableSSL         bool   `yaml:"disable_ssl"`
-	DisableProgressBar bool   `yaml:"disable_progress_bar"`
-	OverwriteStrategy  string `yaml:"overwrite_strategy"`
-	PartSize           int64  `yaml:"part_size"`
+	AccessKey               string            `yaml:"access_key"`
+	SecretKey               string            `yaml:"secret_key"`
+	Profile                 string            `yaml:"profile"`
+	RoleARN                 string            `yaml:"role_arn"`
+	Bucket                  string            `yaml:"bucket"`
+	Endpoint                string            `yaml:"endpoint"`
+	Region                  string            `yaml:"region"`
+	ACL                     string            `yaml:"acl"`
+	ForcePathStyle          bool              `yaml:"force_path_style"`
+	Path                    string            `yaml:"path"`
+	DisableSSL              bool              `yaml:"disable_ssl"`
+	DisableProgressBar      bool              `yaml:"disable_progress_bar"`
+	OverwriteStrategy       string            `yaml:"overwrite_strategy"`
+	TreeCompression         string            `yaml:"tree_compression"`
+	TreeCompressionMinSize  int64             `yaml:"tree_compression_min_size"`
+	PartSize                int64             `yaml:"part_size"`
+	PartSizeMB              int64             `yaml:"part_size_mb"`
+	Concurrency             int               `yaml:"concurrency"`
+	DownloadConcurrency     int               `yaml:"download_concurrency"`
+	ArchiveConcurrency      int               `yaml:"archive_concurrency"`
+	MaxRetries              int               `yaml:"max_retries"`
+	MaxUploadBytesPerSecond int64             `yaml:"max_upload_bytes_per_second"`
+	StorageClass            string            `yaml:"storage_class"`
+	VerifyUploads           bool              `yaml:"verify_uploads"`
+	Tags                    map[string]string `yaml:"tags"`
+	KeyLayout               string            `yaml:"key_layout"`
+	KeySeparator            string            `yaml:"key_separator"`
+	// PathTemplate - s3.path as it is configured, Path is expanded from it by expandS3Path
+	PathTemplate string `yaml:"-"`
 }
 
 // ClickHouseConfig - clickhouse settings section
 type ClickHouseConfig struct {
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
-	Host     string `yaml:"host"`
-	Port     uint   `yaml:"port"`
-	DataPath string `yaml:"data_path"`
+	Username           string   `yaml:"username"`
+	Password           string   `yaml:"password"`
+	Host               string   `yaml:"host"`
+	Port               uint     `yaml:"port"`
+	Protocol           string   `yaml:"protocol"`
+	DataPath           string   `yaml:"data_path"`
+	FreeSpaceMargin    int      `yaml:"free_space_margin"`
+	FreezeConcurrency  int      `yaml:"freeze_concurrency"`
+	RestoreConcurrency int      `yaml:"restore_concurrency"`
+	Cluster            string   `yaml:"cluster"`
+	Secure             bool     `yaml:"secure"`
+	SkipVerify         bool     `yaml:"skip_verify"`
+	TLSCA              string   `yaml:"tls_ca"`
+	TLSCert            string   `yaml:"tls_cert"`
+	TLSKey             string   `yaml:"tls_key"`
+	ConnectTimeout     int      `yaml:"connect_timeout"`
+	QueryTimeout       int      `yaml:"query_timeout"`
+	FreezeTimeout      int      `yaml:"freeze_timeout"`
+	FreezeTableTimeout int      `yaml:"freeze_table_timeout"`
+	HeartbeatInterval  int      `yaml:"heartbeat_interval"`
+	SkipDatabases      []string `yaml:"skip_databases"`
+	ShadowDir          string   `yaml:"shadow_dir"`
+	MetadataDir        string   `yaml:"metadata_dir"`
+	BackupDir          string   `yaml:"backup_dir"`
 }
 
 // BackupConfig - backup specific settings
 type BackupConfig struct {
-	Strategy      string `yaml:"strategy"`
-	BackupsToKeep int    `yaml:"backups_to_keep"`
+	Strategy           string   `yaml:"strategy"`
+	BackupsToKeep      int      `yaml:"backups_to_keep"`
+	TreeLayout         string   `yaml:"tree_layout"`
+	Schedule           string   `yaml:"schedule"`
+	KeepDays           int      `yaml:"keep_days"`
+	SkipSymlinks       bool     `yaml:"skip_symlinks"`
+	Access             bool     `yaml:"access"`
+	AccessSkipUsers    []string `yaml:"access_skip_users"`
+	TmpDir             string   `yaml:"tmp_dir"`
+	MaxArchiveSize     int64    `yaml:"max_archive_size"`
+	ArchiveGranularity string   `yaml:"archive_granularity"`
+	CleanAfterUpload   bool     `yaml:"clean_after_upload"`
+	HTTPListen         string   `yaml:"http_listen"`
+	HTTPMetrics        bool     `yaml:"http_metrics"`
+	ReadyWindowHours   int      `yaml:"ready_window_hours"`
+	DirMode            string   `yaml:"dir_mode"`
+	FileMode           string   `yaml:"file_mode"`
+}
+
+// TempDir - directory for temporary files, system temp directory is used if tmp_dir is not set
+func (b BackupConfig) TempDir() string {
+	if b.TmpDir == "" {
+		return os.TempDir()
+	}
+	return b.TmpDir
+}
+
+// parseFileMode - parse permissions of setting in octal like 0750
+func parseFileMode(setting string, value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%s must be octal permissions like 0750, got '%s'", setting, value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// checkTmpDir - check that dir exists and files can be created in it
+func checkTmpDir(dir string) error {
+	return checkWritableDir("backup.tmp_dir", dir)
+}
+
+// checkWritableDir - check that dir set by setting exists and files can be created in it
+func checkWritableDir(setting string, dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("%s '%s' is not available: %v", setting, dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s '%s' is not a directory", setting, dir)
+	}
+	file, err := ioutil.TempFile(dir, ".clickhouse-backup-check")
+	if err != nil {
+		return fmt.Errorf("%s '%s' is not writable: %v", setting, dir, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// ReplicaConfig - second bucket which uploaded backups are copied to, it is disabled if bucket is empty
+type ReplicaConfig struct {
+	Bucket           string `yaml:"bucket"`
+	Region           string `yaml:"region"`
+	Endpoint         string `yaml:"endpoint"`
+	AccessKey        string `yaml:"access_key"`
+	SecretKey        string `yaml:"secret_key"`
+	Path             string `yaml:"path"`
+	StorageClass     string `yaml:"storage_class"`
+	RemoveOldBackups bool   `yaml:"remove_old_backups"`
+}
+
+// Enabled - check if replica bucket is set
+func (r ReplicaConfig) Enabled() bool {
+	return r.Bucket != ""
+}
+
+// S3Config - settings of replica bucket, region and endpoint are always taken from replica
+// and other settings are taken from s3 section if they are empty
+func (r ReplicaConfig) S3Config(primary S3Config) S3Config {
+	config := primary
+	config.Bucket = r.Bucket
+	config.Region = r.Region
+	config.Endpoint = r.Endpoint
+	if r.AccessKey != "" || r.SecretKey != "" {
+		config.AccessKey = r.AccessKey
+		config.SecretKey = r.SecretKey
+	}
+	if r.Path != "" {
+		config.Path = r.Path
+	}
+	if r.StorageClass != "" {
+		config.StorageClass = r.StorageClass
+	}
+	return config
+}
+
+// LogConfig - file of log which is rotated by size, log is written to stderr if file is not set
+type LogConfig struct {
+	File       string `yaml:"file"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+// NotificationsConfig - webhooks which are called after upload, download and restore
+type NotificationsConfig struct {
+	WebhookURL      string `yaml:"webhook_url"`
+	SlackWebhookURL string `yaml:"slack_webhook_url"`
+}
+
+// Enabled - check if any of webhooks is set
+func (n NotificationsConfig) Enabled() bool {
+	return n.WebhookURL != "" || n.SlackWebhookURL != ""
+}
+
+// HooksConfig - shell commands which are run before and after backup and restore
+type HooksConfig struct {
+	PreBackupCommand   string `yaml:"pre_backup_command"`
+	PostBackupCommand  string `yaml:"post_backup_command"`
+	PreRestoreCommand  string `yaml:"pre_restore_command"`
+	PostRestoreCommand string `yaml:"post_restore_command"`
+	PostHookFatal      bool   `yaml:"post_hook_fatal"`
+}
+
+// Commands - pre and post hook commands of "backup" or "restore"
+func (h HooksConfig) Commands(command string) (string, string) {
+	switch command {
+	case "backup":
+		return h.PreBackupCommand, h.PostBackupCommand
+	case "restore":
+		return h.PreRestoreCommand, h.PostRestoreCommand
+	}
+	return "", ""
 }
 
 // LoadConfig - load config from file
 func LoadConfig(configLocation string) (*Config, error) {
 	config := defaultConfig()
 	configYaml, err := ioutil.ReadFile(configLocation)
-	if os.IsNotExist(err) {
-		return config, nil
-	}
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("can't read with: %v", err)
 	}
-	err = yaml.Unmarshal(configYaml, &config)
-	if err != nil {
-		return nil, fmt.Errorf("can't parse with: %v", err)
+	if err == nil {
+		if err := yaml.Unmarshal(configYaml, &config); err != nil {
+			return nil, fmt.Errorf("can't parse with: %v", err)
+		}
+	}
+	if err := overrideFromEnv(config, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	if config.S3.PartSizeMB > 0 {
+		config.S3.PartSize = config.S3.PartSizeMB * 1024 * 1024
+	}
+	config.S3.PathTemplate = config.S3.Path
+	if err := expandS3Path(config, time.Now()); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// s3PathPlaceholderRe - placeholder in s3.path which is expanded at runtime
+var s3PathPlaceholderRe = regexp.MustCompile(`\{[^{}]*\}`)
+
+// s3PathPlaceholders - placeholders which can be used in s3.path
+var s3PathPlaceholders = []string{"{hostname}", "{date}", "{cluster}"}
+
+// expandS3Path - set s3.path from s3.path_template, {hostname} is name of host, {date} is UTC date of now
+// and {cluster} is clickhouse.cluster
+func expandS3Path(config *Config, now time.Time) error {
+	var err error
+	config.S3.Path = s3PathPlaceholderRe.ReplaceAllStringFunc(config.S3.PathTemplate, func(placeholder string) string {
+		switch placeholder {
+		case "{hostname}":
+			hostname, hostnameErr := os.Hostname()
+			if hostnameErr != nil {
+				err = fmt.Errorf("can't get hostname for s3.path with: %v", hostnameErr)
+			}
+			return hostname
+		case "{date}":
+			return now.UTC().Format("2006-01-02")
+		case "{cluster}":
+			return config.ClickHouse.Cluster
+		}
+		return placeholder
+	})
+	return err
+}
+
+// overrideFromEnv - set fields of config from CLICKHOUSE_BACKUP_<SECTION>_<KEY> environment variables,
+// they take precedence over config file. Lists are comma separated
+func overrideFromEnv(config *Config, lookupEnv func(string) (string, bool)) error {
+	sections := reflect.ValueOf(config).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionName := sections.Type().Field(i).Tag.Get("yaml")
+		for j := 0; j < section.NumField(); j++ {
+			key := section.Type().Field(j).Tag.Get("yaml")
+			if key == "-" {
+				continue
+			}
+			name := envPrefix + strings.ToUpper(sectionName+"_"+key)
+			value, ok := lookupEnv(name)
+			if !ok {
+				continue
+			}
+			if err := setConfigValue(section.Field(j), value); err != nil {
+				return fmt.Errorf("can't parse %s environment variable which overrides %s.%s with: %v", name, sectionName, key, err)
+			}
+		}
 	}
-	return config, validateConfig(config)
+	return nil
+}
+
+func setConfigValue(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(v)
+	case reflect.Int, reflect.Int64:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(v)
+	case reflect.Uint:
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetUint(v)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
 }
 
 func validateConfig(config *Config) error {
@@ -73,6 +355,148 @@ func validateConfig(config *Config) error {
 	default:
 		return fmt.Errorf("unknown s3.overwrite_strategy it can be 'skip', 'etag', 'always'")
 	}
+	switch config.S3.TreeCompression {
+	case "none", "gzip":
+	default:
+		return fmt.Errorf("unknown s3.tree_compression it can be 'none', 'gzip'")
+	}
+	if config.S3.TreeCompressionMinSize < 0 {
+		return fmt.Errorf("s3.tree_compression_min_size can't be negative")
+	}
+	if _, err := newKeyLayout(config.S3.KeyLayout, config.S3.KeySeparator); err != nil {
+		return fmt.Errorf("bad s3.key_layout: %v", err)
+	}
+	switch config.S3.StorageClass {
+	case
+		"STANDARD",
+		"REDUCED_REDUNDANCY",
+		"STANDARD_IA",
+		"ONEZONE_IA",
+		"INTELLIGENT_TIERING",
+		"GLACIER",
+		"DEEP_ARCHIVE":
+		break
+	default:
+		return fmt.Errorf("unknown s3.storage_class it can be 'STANDARD', 'REDUCED_REDUNDANCY', 'STANDARD_IA', 'ONEZONE_IA', 'INTELLIGENT_TIERING', 'GLACIER', 'DEEP_ARCHIVE'")
+	}
+	if len(config.S3.Tags) > maxObjectTags {
+		return fmt.Errorf("s3.tags can have at most %d tags, %s and %s are set too", maxObjectTags, backupNameTag, backupCreatedTag)
+	}
+	for key := range config.S3.Tags {
+		if key == "" || strings.HasPrefix(key, "aws:") || key == backupNameTag || key == backupCreatedTag {
+			return fmt.Errorf("s3.tags can't have tag '%s'", key)
+		}
+	}
+	switch config.Backup.TreeLayout {
+	case
+		"timestamped",
+		"flat":
+		break
+	default:
+		return fmt.Errorf("unknown backup.tree_layout it can be 'timestamped', 'flat'")
+	}
+	if config.Backup.Schedule != "" {
+		if _, err := cron.ParseStandard(config.Backup.Schedule); err != nil {
+			return fmt.Errorf("can't parse backup.schedule with: %v", err)
+		}
+	}
+	if config.Backup.ReadyWindowHours < 1 {
+		return fmt.Errorf("backup.ready_window_hours must be positive")
+	}
+	if config.Backup.TmpDir != "" {
+		if err := checkTmpDir(config.Backup.TmpDir); err != nil {
+			return err
+		}
+	}
+	if _, err := parseFileMode("backup.dir_mode", config.Backup.DirMode); err != nil {
+		return err
+	}
+	if _, err := parseFileMode("backup.file_mode", config.Backup.FileMode); err != nil {
+		return err
+	}
+	if config.Backup.KeepDays < 0 {
+		return fmt.Errorf("backup.keep_days can't be negative")
+	}
+	if config.Backup.MaxArchiveSize < 0 {
+		return fmt.Errorf("backup.max_archive_size can't be negative")
+	}
+	switch config.Backup.ArchiveGranularity {
+	case "backup", "table":
+	default:
+		return fmt.Errorf("backup.archive_granularity must be 'backup' or 'table', got '%s'", config.Backup.ArchiveGranularity)
+	}
+	if config.Replica.Enabled() && config.Replica.Region == "" && config.Replica.Endpoint == "" {
+		return fmt.Errorf("replica.region or replica.endpoint must be set")
+	}
+	if config.Log.MaxSizeMB < 1 {
+		return fmt.Errorf("log.max_size_mb must be positive")
+	}
+	if config.Log.MaxBackups < 0 {
+		return fmt.Errorf("log.max_backups can't be negative")
+	}
+	for key, name := range map[string]string{
+		"shadow_dir":   config.ClickHouse.ShadowDir,
+		"metadata_dir": config.ClickHouse.MetadataDir,
+		"backup_dir":   config.ClickHouse.BackupDir,
+	} {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("clickhouse.%s must be name of directory without path separators, got '%s'", key, name)
+		}
+	}
+	if config.ClickHouse.Protocol != "native" && config.ClickHouse.Protocol != "http" {
+		return fmt.Errorf("unknown clickhouse.protocol '%s', must be 'native' or 'http'", config.ClickHouse.Protocol)
+	}
+	if (config.ClickHouse.TLSCert == "") != (config.ClickHouse.TLSKey == "") {
+		return fmt.Errorf("clickhouse.tls_cert and clickhouse.tls_key must be set together")
+	}
+	if config.ClickHouse.ConnectTimeout < 0 || config.ClickHouse.QueryTimeout < 0 || config.ClickHouse.FreezeTimeout < 0 || config.ClickHouse.FreezeTableTimeout < 0 {
+		return fmt.Errorf("clickhouse timeouts can't be negative")
+	}
+	if config.ClickHouse.HeartbeatInterval < 0 {
+		return fmt.Errorf("clickhouse.heartbeat_interval can't be negative")
+	}
+	if config.ClickHouse.FreezeConcurrency < 1 {
+		return fmt.Errorf("clickhouse.freeze_concurrency must be positive")
+	}
+	if config.ClickHouse.RestoreConcurrency < 1 {
+		return fmt.Errorf("clickhouse.restore_concurrency must be positive")
+	}
+	if config.ClickHouse.FreeSpaceMargin < 0 {
+		return fmt.Errorf("clickhouse.free_space_margin can't be negative")
+	}
+	for _, placeholder := range s3PathPlaceholderRe.FindAllString(config.S3.Path, -1) {
+		known := false
+		for _, p := range s3PathPlaceholders {
+			known = known || p == placeholder
+		}
+		if !known {
+			return fmt.Errorf("unknown placeholder %s in s3.path, it can be %s", placeholder, strings.Join(s3PathPlaceholders, ", "))
+		}
+		if placeholder == "{cluster}" && config.ClickHouse.Cluster == "" {
+			return fmt.Errorf("s3.path has {cluster} placeholder but clickhouse.cluster is empty")
+		}
+	}
+	if config.S3.PartSizeMB != 0 && config.S3.PartSizeMB < minPartSize/1024/1024 {
+		return fmt.Errorf("s3.part_size_mb must be at least %d, it is minimal part size of s3 multipart upload", minPartSize/1024/1024)
+	}
+	if config.S3.PartSizeMB == 0 && config.S3.PartSize < minPartSize {
+		return fmt.Errorf("s3.part_size must be at least %d bytes, it is minimal part size of s3 multipart upload", minPartSize)
+	}
+	if config.S3.Concurrency < 1 {
+		return fmt.Errorf("s3.concurrency must be positive")
+	}
+	if config.S3.DownloadConcurrency < 1 {
+		return fmt.Errorf("s3.download_concurrency must be positive")
+	}
+	if config.S3.ArchiveConcurrency < 0 {
+		return fmt.Errorf("s3.archive_concurrency can't be negative")
+	}
+	if config.S3.MaxRetries < 0 {
+		return fmt.Errorf("s3.max_retries can't be negative")
+	}
+	if config.S3.MaxUploadBytesPerSecond < 0 {
+		return fmt.Errorf("s3.max_upload_bytes_per_second can't be negative")
+	}
 	return nil
 }
 
@@ -80,27 +504,62 @@ func validateConfig(config *Config) error {
 func PrintDefaultConfig() {
 	c := defaultConfig()
 	d, _ := yaml.Marshal(&c)
+	fmt.Printf("# Every setting can be overridden by %s<SECTION>_<KEY> environment variable, e.g. %sS3_SECRET_KEY\n", envPrefix, envPrefix)
+	fmt.Printf("# Environment variables take precedence over config file, lists are comma separated\n")
+	fmt.Printf("# s3.path can contain %s placeholders which are expanded at runtime with name of host,\n", strings.Join(s3PathPlaceholders, ", "))
+	fmt.Printf("# UTC date as YYYY-MM-DD and clickhouse.cluster, old backups are removed only under expanded path\n")
 	fmt.Print(string(d))
 }
 
 func defaultConfig() *Config {
 	return &Config{
 		ClickHouse: ClickHouseConfig{
-			Username: "default",
-			Password: "",
-			Host:     "localhost",
-			Port:     9000,
+			Username:           "default",
+			Password:           "",
+			Host:               "localhost",
+			Port:               9000,
+			Protocol:           "native",
+			FreeSpaceMargin:    10,
+			FreezeConcurrency:  1,
+			RestoreConcurrency: 1,
+			ConnectTimeout:     10,
+			QueryTimeout:       600,
+			FreezeTimeout:      3600,
+			HeartbeatInterval:  60,
+			SkipDatabases:      []string{"system", "INFORMATION_SCHEMA", "information_schema", "temporary"},
+			ShadowDir:          "shadow",
+			MetadataDir:        "metadata",
+			BackupDir:          "backup",
 		},
 		S3: S3Config{
-			Region:            "us-east-1",
-			DisableSSL:        false,
-			ACL:               "private",
-			OverwriteStrategy: "always",
-			PartSize:          5 * 1024 * 1024,
+			Region:                 "us-east-1",
+			DisableSSL:             false,
+			ACL:                    "private",
+			OverwriteStrategy:      "always",
+			TreeCompression:        "none",
+			TreeCompressionMinSize: 1024,
+			PartSize:               minPartSize,
+			Concurrency:            s3manager.DefaultUploadConcurrency,
+			DownloadConcurrency:    4,
+			MaxRetries:             3,
+			StorageClass:           "STANDARD",
+			VerifyUploads:          true,
+			KeyLayout:              keyLayoutNested,
+			KeySeparator:           "!",
 		},
 		Backup: BackupConfig{
-			Strategy:      "tree",
-			BackupsToKeep: 0,
+			Strategy:           "tree",
+			BackupsToKeep:      0,
+			TreeLayout:         "flat",
+			AccessSkipUsers:    []string{"default"},
+			ReadyWindowHours:   25,
+			ArchiveGranularity: "backup",
+			DirMode:            "0755",
+			FileMode:           "0644",
+		},
+		Log: LogConfig{
+			MaxSizeMB:  100,
+			MaxBackups: 5,
 		},
 	}
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultDiskName - disk where clickhouse keeps metadata, its shadow is stored as "shadow" in backup
+const defaultDiskName = "default"
+
+// dirNames - names of directories in data path of every disk, they are set by clickhouse.shadow_dir,
+// clickhouse.metadata_dir and clickhouse.backup_dir. Layout of backup inside backup directory and on s3 is always the same
+type dirNames struct {
+	Shadow   string
+	Metadata string
+	Backup   string
+}
+
+// newDirNames - directory names from config
+func newDirNames(config ClickHouseConfig) dirNames {
+	return dirNames{
+		Shadow:   config.ShadowDir,
+		Metadata: config.MetadataDir,
+		Backup:   config.BackupDir,
+	}
+}
+
+// Disk - clickhouse disk from system.disks, Type is empty if clickhouse doesn't report it
+type Disk struct {
+	Name string   `db:"name"`
+	Path string   `db:"path"`
+	Type string   `db:"type"`
+	Dirs dirNames `db:"-"`
+}
+
+// shadowPath - shadow directory of disk
+func (d Disk) shadowPath() string {
+	return filepath.Join(d.Path, d.Dirs.Shadow)
+}
+
+// metadataPath - metadata directory of disk, only default disk has it
+func (d Disk) metadataPath() string {
+	return filepath.Join(d.Path, d.Dirs.Metadata)
+}
+
+// backupPath - backup directory of disk
+func (d Disk) backupPath() string {
+	return filepath.Join(d.Path, d.Dirs.Backup)
+}
+
+// remoteDiskTypes - types of disks which keep data in object storage, path of such disk has only
+// references to objects
+var remoteDiskTypes = map[string]bool{
+	"s3":                 true,
+	"hdfs":               true,
+	"azure_blob_storage": true,
+}
+
+// IsRemote - check that data of disk is kept in object storage
+func (d Disk) IsRemote() bool {
+	return remoteDiskTypes[d.Type]
+}
+
+// GetDisks - return all disks of clickhouse, path of default disk is always data path
+func (ch *ClickHouse) GetDisks() ([]Disk, error) {
+	dataPath, err := ch.GetDataPath()
+	if err != nil || dataPath == "" {
+		return nil, fmt.Errorf("can't get data path from clickhouse with: %v\nyou can set data_path in config file", err)
+	}
+	var disks []Disk
+	err = fmt.Errorf("type of disks isn't supported by clickhouse %s", ch.versionName)
+	if !ch.olderThan(minVersionDiskType) {
+		err = ch.selectQuery(&disks, "SELECT name, path, type FROM system.disks;")
+	}
+	if err != nil {
+		disks = nil
+		err = ch.selectQuery(&disks, "SELECT name, path FROM system.disks;")
+	}
+	if err != nil {
+		// system.disks appeared in 19.15, older versions have only one disk
+		logger.Warnf("can't read system.disks, only %s will be used: %v", dataPath, err)
+		return []Disk{{Name: defaultDiskName, Path: dataPath, Dirs: newDirNames(*ch.Config)}}, nil
+	}
+	hasDefault := false
+	for i := range disks {
+		disks[i].Path = strings.TrimSuffix(disks[i].Path, "/")
+		disks[i].Dirs = newDirNames(*ch.Config)
+		if disks[i].Name == defaultDiskName {
+			disks[i].Path = dataPath
+			hasDefault = true
+		}
+	}
+	if !hasDefault {
+		disks = append(disks, Disk{Name: defaultDiskName, Path: dataPath, Dirs: newDirNames(*ch.Config)})
+	}
+	sort.Slice(disks, func(i, j int) bool {
+		return disks[i].Name < disks[j].Name
+	})
+	return disks, nil
+}
+
+// getDisks - return disks of clickhouse, only clickhouse.data_path is used if clickhouse is unavailable
+func getDisks(config Config) ([]Disk, error) {
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		if config.ClickHouse.DataPath != "" {
+			logger.Warnf("can't connect to clickhouse, only %s will be used: %v", config.ClickHouse.DataPath, err)
+			return []Disk{{Name: defaultDiskName, Path: config.ClickHouse.DataPath, Dirs: newDirNames(config.ClickHouse)}}, nil
+		}
+		return nil, connectionError(fmt.Errorf("can't connect to clickhouse to get data path with: %v\nyou can set clickhouse.data_path in config", err))
+	}
+	defer ch.Close()
+	return ch.GetDisks()
+}
+
+// defaultDisk - return default disk, its data path is data path of clickhouse
+func defaultDisk(disks []Disk) Disk {
+	for _, disk := range disks {
+		if disk.Name == defaultDiskName {
+			return disk
+		}
+	}
+	return Disk{}
+}
+
+// diskShadowKey - path to shadow of disk inside backup
+func diskShadowKey(disk string) string {
+	if disk == defaultDiskName {
+		return "shadow"
+	}
+	return path.Join("disks", disk, "shadow")
+}
+
+// diskShadows - return shadow directories of disks by disk name
+func diskShadows(disks []Disk) map[string]string {
+	shadows := make(map[string]string)
+	for _, disk := range disks {
+		shadows[disk.Name] = disk.shadowPath()
+	}
+	return shadows
+}
+
+// backupShadows - return shadow directories of all disks in downloaded backup by disk name
+func backupShadows(backupPath string) (map[string]string, error) {
+	shadows := map[string]string{
+		defaultDiskName: filepath.Join(backupPath, diskShadowKey(defaultDiskName)),
+	}
+	files, err := ioutil.ReadDir(filepath.Join(backupPath, "disks"))
+	if os.IsNotExist(err) {
+		return shadows, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			shadows[file.Name()] = filepath.Join(backupPath, diskShadowKey(file.Name()))
+		}
+	}
+	return shadows, nil
+}
+
+// getDisksBackupTables - merge tables frozen on several disks, shadow of non-default disk may be absent
+func getDisksBackupTables(shadows map[string]string) (map[string]BackupTable, error) {
+	result := make(map[string]BackupTable)
+	for disk, shadowPath := range shadows {
+		if _, err := os.Stat(shadowPath); os.IsNotExist(err) && disk != defaultDiskName {
+			continue
+		}
+		tables, err := getBackupTables(shadowPath, disk)
+		if err != nil {
+			return nil, err
+		}
+		for name, table := range tables {
+			if t, ok := result[name]; ok {
+				t.Partitions = append(t.Partitions, table.Partitions...)
+				result[name] = t
+				continue
+			}
+			result[name] = table
+		}
+	}
+	return result, nil
+}
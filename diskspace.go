@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+)
+
+// freeSpace - bytes available for unprivileged user on filesystem which contains path
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// checkFreeSpace - fail if filesystem of path doesn't have estimated bytes plus marginPercent of them
+func checkFreeSpace(path string, estimated int64, marginPercent int) error {
+	available, err := freeSpace(path)
+	if err != nil {
+		return fmt.Errorf("can't get free space on %s: %v", path, err)
+	}
+	required := estimated + estimated*int64(marginPercent)/100
+	if available < required {
+		return fmt.Errorf("not enough free space on %s: %s is required (%s and %d%% margin), %s is available",
+			path, formatBytes(required), formatBytes(estimated), marginPercent, formatBytes(available))
+	}
+	log.Printf("%s is required on %s, %s is available", formatBytes(required), path, formatBytes(available))
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// downloadStateSuffix - suffix of file with state of interrupted download of archive to file with the same name
+const downloadStateSuffix = ".state"
+
+// downloadState - object which is downloaded and length of its prefix which is written to file without gaps
+type downloadState struct {
+	Key        string `json:"key"`
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size"`
+	Downloaded int64  `json:"downloaded"`
+}
+
+// loadDownloadState - read state of interrupted download of localPath, returns nil if there is no one
+func loadDownloadState(localPath string) (*downloadState, error) {
+	statePath := localPath + downloadStateSuffix
+	data, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state downloadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", statePath, err)
+	}
+	return &state, nil
+}
+
+func (state *downloadState) save(localPath string) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(localPath+downloadStateSuffix, data, 0600)
+}
+
+// removeDownload - remove downloaded file and state of its download
+func removeDownload(localPath string) {
+	os.Remove(localPath)
+	os.Remove(localPath + downloadStateSuffix)
+}
+
+// resumeDownloadState - offset of localPath to resume download of object from, file is truncated to downloaded
+// prefix. Partial file of another object or of object which is changed since it was downloaded is removed
+// and 0 is returned, so object is downloaded again
+func resumeDownloadState(localPath string, object downloadState) (int64, error) {
+	state, err := loadDownloadState(localPath)
+	if err != nil {
+		return 0, fmt.Errorf("can't read download state: %v", err)
+	}
+	if state == nil {
+		removeDownload(localPath)
+		return 0, nil
+	}
+	if state.Key != object.Key || state.Size != object.Size || state.ETag != object.ETag || object.ETag == "" {
+		logger.Warnf("'%s' is changed since partial download to '%s', it's downloaded again", object.Key, localPath)
+		removeDownload(localPath)
+		return 0, nil
+	}
+	info, err := os.Stat(localPath)
+	if err != nil || info.Size() < state.Downloaded {
+		removeDownload(localPath)
+		return 0, nil
+	}
+	if err := os.Truncate(localPath, state.Downloaded); err != nil {
+		return 0, fmt.Errorf("can't truncate '%s' to downloaded %d bytes with: %v", localPath, state.Downloaded, err)
+	}
+	return state.Downloaded, nil
+}
+
+// prefixWriterAt - file which is written by ranges in any order, length of its prefix which is written
+// without gaps is tracked, so download can be resumed from it
+type prefixWriterAt struct {
+	io.WriterAt
+	mu     sync.Mutex
+	prefix int64
+	// ends - end of every written range after prefix by its start
+	ends map[int64]int64
+}
+
+func newPrefixWriterAt(w io.WriterAt, prefix int64) *prefixWriterAt {
+	return &prefixWriterAt{WriterAt: w, prefix: prefix, ends: make(map[int64]int64)}
+}
+
+func (w *prefixWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.WriterAt.WriteAt(p, off)
+	if n == 0 {
+		return n, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end := off + int64(n); end > w.ends[off] {
+		w.ends[off] = end
+	}
+	for {
+		end, ok := w.ends[w.prefix]
+		if !ok {
+			break
+		}
+		delete(w.ends, w.prefix)
+		w.prefix = end
+	}
+	return n, err
+}
+
+// Prefix - length of prefix which is written without gaps
+func (w *prefixWriterAt) Prefix() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.prefix
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeDownloadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	localPath := filepath.Join(dir, "backup.tar")
+	object := downloadState{Key: "backups/backup.tar", ETag: `"etag"`, Size: 10}
+
+	// bytes after downloaded prefix could be written by ranges which aren't complete
+	assert.NoError(t, ioutil.WriteFile(localPath, []byte("0123456"), 0644))
+	partial := object
+	partial.Downloaded = 4
+	assert.NoError(t, partial.save(localPath))
+	offset, err := resumeDownloadState(localPath, object)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), offset)
+	content, err := ioutil.ReadFile(localPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123", string(content))
+
+	// object is replaced since partial download, so it's downloaded again
+	changed := object
+	changed.ETag = `"other"`
+	offset, err = resumeDownloadState(localPath, changed)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), offset)
+	for _, file := range []string{localPath, localPath + downloadStateSuffix} {
+		_, err = os.Stat(file)
+		assert.True(t, os.IsNotExist(err), file)
+	}
+
+	// file without state can't be trusted
+	assert.NoError(t, ioutil.WriteFile(localPath, []byte("0123456"), 0644))
+	offset, err = resumeDownloadState(localPath, object)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), offset)
+	_, err = os.Stat(localPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPrefixWriterAt(t *testing.T) {
+	f, err := ioutil.TempFile("", "download")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := newPrefixWriterAt(f, 0)
+	for _, write := range []struct {
+		data   string
+		off    int64
+		prefix int64
+	}{
+		{"cd", 2, 0},
+		{"gh", 6, 0},
+		{"ab", 0, 4},
+		{"f", 5, 4},
+		{"e", 4, 8},
+	} {
+		n, err := w.WriteAt([]byte(write.data), write.off)
+		assert.NoError(t, err)
+		assert.Equal(t, len(write.data), n)
+		assert.Equal(t, write.prefix, w.Prefix(), write.data)
+	}
+	content, err := ioutil.ReadFile(f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdefgh", string(content))
+}
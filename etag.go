@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// etagHash - calculate both plain MD5 and multipart ETag of data written to it,
+// so result can be compared with ETag of object uploaded by single PUT or by parts
+type etagHash struct {
+	partSize    int64
+	whole       hash.Hash
+	part        hash.Hash
+	partWritten int64
+	partSums    []byte
+	parts       int
+}
+
+func newEtagHash(partSize int64) *etagHash {
+	h := &etagHash{partSize: partSize}
+	h.Reset()
+	return h
+}
+
+// Reset - start calculation from scratch, it is called before every retry of upload
+func (h *etagHash) Reset() {
+	h.whole = md5.New()
+	h.part = md5.New()
+	h.partWritten = 0
+	h.partSums = nil
+	h.parts = 0
+}
+
+func (h *etagHash) Write(p []byte) (int, error) {
+	h.whole.Write(p)
+	written := len(p)
+	for len(p) > 0 {
+		n := int64(len(p))
+		if rest := h.partSize - h.partWritten; n > rest {
+			n = rest
+		}
+		h.part.Write(p[:n])
+		h.partWritten += n
+		p = p[n:]
+		if h.partWritten == h.partSize {
+			h.finishPart()
+		}
+	}
+	return written, nil
+}
+
+func (h *etagHash) finishPart() {
+	h.partSums = h.part.Sum(h.partSums)
+	h.parts++
+	h.part = md5.New()
+	h.partWritten = 0
+}
+
+// Check - compare hash with ETag returned by s3, ok is false if ETag can't be calculated locally
+// because s3 changed part size
+func (h *etagHash) Check(etag string) (match bool, ok bool) {
+	etag = strings.Trim(etag, "\"")
+	dash := strings.Index(etag, "-")
+	if dash < 0 {
+		return etag == hex.EncodeToString(h.whole.Sum(nil)), true
+	}
+	parts, err := strconv.Atoi(etag[dash+1:])
+	if err != nil {
+		return false, false
+	}
+	sums, count := h.partSums, h.parts
+	if h.partWritten > 0 {
+		sums = h.part.Sum(sums)
+		count++
+	}
+	if parts != count {
+		return false, false
+	}
+	return etag == multipartEtag(sums, count), true
+}
+
+// fileMatchesEtag - check if file has the same content as object with etag, files which can't be
+// compared because of another part size don't match
+func fileMatchesEtag(filePath string, partSize int64, etag string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	h := newEtagHash(partSize)
+	if _, err := io.Copy(h, file); err != nil {
+		return false
+	}
+	match, ok := h.Check(etag)
+	return ok && match
+}
+
+// multipartEtag - ETag of object uploaded by parts, md5 of concatenated binary md5 of parts with parts count
+func multipartEtag(partSums []byte, parts int) string {
+	sum := md5.Sum(partSums)
+	return fmt.Sprintf("%x-%d", sum, parts)
+}
+
+// verifyUpload - compare ETag of uploaded object with hash of local data
+func (s *S3) verifyUpload(ctx context.Context, key string, h *etagHash) error {
+	resp, err := s3.New(s.session).HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("can't get ETag of '%s' with: %v", key, err)
+	}
+	return checkEtag(key, h, aws.StringValue(resp.ETag))
+}
+
+// checkEtag - return error if etag doesn't match hash of local data
+func checkEtag(key string, h *etagHash, etag string) error {
+	match, ok := h.Check(etag)
+	if !ok {
+		logger.Warnf("can't verify '%s': ETag %s is not calculated by md5 of %d bytes parts", key, etag, h.partSize)
+		return nil
+	}
+	if !match {
+		return fmt.Errorf("uploaded '%s' is corrupted: ETag %s doesn't match local data", key, etag)
+	}
+	return nil
+}
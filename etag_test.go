@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEtagHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etag")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, size := range []int{0, 10, 16, 17, 50} {
+		content := bytes.Repeat([]byte("x"), size)
+		file := filepath.Join(dir, "data")
+		assert.NoError(t, ioutil.WriteFile(file, content, 0644))
+		h := newEtagHash(16)
+		// write by small chunks to cross part boundaries
+		for i := 0; i < size; i += 3 {
+			end := i + 3
+			if end > size {
+				end = size
+			}
+			h.Write(content[i:end])
+		}
+		match, ok := h.Check(GetEtag(file, 16))
+		assert.True(t, ok, "size %d", size)
+		assert.True(t, match, "size %d", size)
+		match, ok = h.Check(`"d41d8cd98f00b204e9800998ecf8427e-1"`)
+		assert.False(t, match, "size %d", size)
+	}
+	h := newEtagHash(16)
+	h.Write([]byte("data"))
+	match, ok := h.Check(`"8d777f385d3dfec8815d20f7496026dc"`)
+	assert.True(t, ok)
+	assert.True(t, match)
+	match, _ = h.Check(`"00000000000000000000000000000000"`)
+	assert.False(t, match)
+}
+
+func TestFileMatchesEtag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etag")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "data")
+	assert.NoError(t, ioutil.WriteFile(file, bytes.Repeat([]byte("x"), 40), 0644))
+	assert.True(t, fileMatchesEtag(file, 16, GetEtag(file, 16)))
+	// uploaded with another part size
+	assert.False(t, fileMatchesEtag(file, 16, GetEtag(file, 8)))
+	assert.False(t, fileMatchesEtag(filepath.Join(dir, "missing"), 16, GetEtag(file, 16)))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// exit codes of failure classes, exitCodeCanceled is used when operation is interrupted by signal
+// and exitCodeConfig when config can't be loaded before any command is run
+const (
+	exitCodeError       = 1
+	exitCodeConfig      = 2
+	exitCodeConnection  = 3
+	exitCodeNothingToDo = 4
+)
+
+// exitCodesHelp - description of exit codes for --help
+const exitCodesHelp = `Exit codes:
+   0    success
+   1    error
+   2    config can't be loaded or is invalid
+   3    can't connect to clickhouse or s3, including authentication errors
+   4    nothing to do, there are no tables to freeze or restore
+   130  operation is interrupted by SIGINT or SIGTERM`
+
+// exitError - error which is mapped to exit code other than exitCodeError
+type exitError struct {
+	err  error
+	code int
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func connectionError(err error) error {
+	return &exitError{err: err, code: exitCodeConnection}
+}
+
+func nothingToDoError(err error) error {
+	return &exitError{err: err, code: exitCodeNothingToDo}
+}
+
+// exitCode - exit code for error returned by command, exitError is found in chain of wrapped errors
+func exitCode(err error) int {
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return exitCodeError
+}
+
+// isNothingToDo - check if command had nothing to do
+func isNothingToDo(err error) bool {
+	return exitCode(err) == exitCodeNothingToDo
+}
+
+// s3RequestError - mark wrapped error as connection error if s3 can't be reached or rejects credentials
+func s3RequestError(err error, wrapped error) error {
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) && (requestFailure.StatusCode() == 401 || requestFailure.StatusCode() == 403) {
+		return connectionError(wrapped)
+	}
+	var e awserr.Error
+	if errors.As(err, &e) {
+		switch e.Code() {
+		case "RequestError", "NoCredentialProviders", "InvalidAccessKeyId", "SignatureDoesNotMatch", "AccessDenied":
+			return connectionError(wrapped)
+		}
+	}
+	return wrapped
+}
@@ -4,24 +4,28 @@ require (
 	github.com/Azure/go-ansiterm v0.0.0-20170929234023-d6e3b3328b78 // indirect
 	github.com/Microsoft/go-winio v0.4.11 // indirect
 	github.com/Nvveen/Gotty v0.0.0-20120604004816-cd527374f1e5 // indirect
-	github.com/aws/aws-sdk-go v1.15.58
+	github.com/aws/aws-sdk-go v1.25.0
 	github.com/cenkalti/backoff v2.0.0+incompatible // indirect
 	github.com/containerd/continuity v0.0.0-20181003075958-be9bd761db19 // indirect
 	github.com/docker/go-connections v0.4.0 // indirect
 	github.com/docker/go-units v0.3.3 // indirect
 	github.com/jmoiron/sqlx v1.2.0
-	github.com/kshvakov/clickhouse v1.3.4
+	github.com/klauspost/compress v1.10.10
+	github.com/kshvakov/clickhouse v1.3.5
 	github.com/mattn/go-runewidth v0.0.3 // indirect
 	github.com/opencontainers/go-digest v1.0.0-rc1 // indirect
 	github.com/opencontainers/image-spec v1.0.1 // indirect
 	github.com/opencontainers/runc v0.1.1 // indirect
 	github.com/ory/dockertest v3.3.2+incompatible
 	github.com/pkg/errors v0.8.0 // indirect
-	github.com/sirupsen/logrus v1.1.1 // indirect
+	github.com/prometheus/client_golang v0.9.2
+	github.com/robfig/cron/v3 v3.0.1
+	github.com/sirupsen/logrus v1.1.1
 	github.com/stretchr/testify v1.2.2
 	github.com/urfave/cli v1.20.0
 	golang.org/x/net v0.0.0-20181017193950-04a2e542c03f // indirect
 	golang.org/x/sys v0.0.0-20181019084534-8f1d3d21f81b // indirect
 	gopkg.in/cheggaaa/pb.v1 v1.0.26
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	gopkg.in/yaml.v2 v2.2.1
 )
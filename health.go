@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serverState - result of the last backup run of server for health endpoints
+type serverState struct {
+	mu          sync.Mutex
+	started     time.Time
+	lastRun     time.Time
+	lastSuccess time.Time
+	lastErr     error
+	window      time.Duration
+}
+
+func newServerState(window time.Duration) *serverState {
+	return &serverState{
+		started: time.Now(),
+		window:  window,
+	}
+}
+
+// finish - save result of backup run
+func (s *serverState) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRun = time.Now()
+	s.lastErr = err
+	if err == nil {
+		s.lastSuccess = s.lastRun
+	}
+}
+
+// ready - check that the last run succeeded and backup succeeded within window,
+// time of server start is used until the first backup is done
+func (s *serverState) ready(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastErr != nil {
+		return fmt.Errorf("last backup at %s failed: %v", s.lastRun.Format(time.RFC3339), s.lastErr)
+	}
+	since := s.lastSuccess
+	if since.IsZero() {
+		since = s.started
+	}
+	if now.Sub(since) > s.window {
+		return fmt.Errorf("there is no successful backup since %s", since.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// registerMetrics - gauges of server state for /metrics
+func (s *serverState) registerMetrics(registry *prometheus.Registry) {
+	gauge := func(name string, help string, value func() float64) {
+		registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsJob,
+			Name:      name,
+			Help:      help,
+		}, value))
+	}
+	gauge("server_last_success_timestamp_seconds", "Time of the last successful backup of server", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.lastSuccess.IsZero() {
+			return 0
+		}
+		return float64(s.lastSuccess.Unix())
+	})
+	gauge("server_last_run_success", "1 if the last backup of server succeeded, 0 if it failed", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.lastErr != nil {
+			return 0
+		}
+		return 1
+	})
+	gauge("server_ready", "1 if server is ready according to backup.ready_window_hours", func() float64 {
+		if s.ready(time.Now()) != nil {
+			return 0
+		}
+		return 1
+	})
+}
+
+// handler - /healthz, /ready and optionally /metrics endpoints
+func (s *serverState) handler(metrics bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.ready(time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	if metrics {
+		registry := prometheus.NewRegistry()
+		s.registerMetrics(registry)
+		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	}
+	return mux
+}
+
+// serveHealth - serve health endpoints on address until ctx is canceled
+func serveHealth(ctx context.Context, address string, handler http.Handler) error {
+	srv := &http.Server{Addr: address, Handler: handler}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return fmt.Errorf("can't listen on backup.http_listen with: %v", err)
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"time"
+)
+
+// heartbeat - log every interval seconds that operation on table is still in progress with elapsed time,
+// so long freeze or copy isn't taken for hung process. Returned function stops logging, 0 interval disables heartbeat
+func heartbeat(operation string, table string, interval int) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				elapsed := time.Since(start).Round(time.Second)
+				logger.WithFields(Fields{"table": table, "elapsed": elapsed}).Infof("%s of %s is still in progress for %s", operation, table, elapsed)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// withHooks - run pre hook, fn and post hook, failed pre hook aborts fn and failed post hook is only logged
+// unless hooks.post_hook_fatal is set. Hooks are run by shell with name of backup and status in environment
+func withHooks(ctx context.Context, config HooksConfig, command string, backupName string, dryRun bool, fn func(ctx context.Context) error) error {
+	pre, post := config.Commands(command)
+	if pre == "" && post == "" {
+		return fn(ctx)
+	}
+	// name of backup for post hook is set by fn
+	m := metricsFromContext(ctx)
+	if m == nil {
+		m = &runMetrics{command: command, started: time.Now()}
+		ctx = context.WithValue(ctx, runMetricsKey{}, m)
+	}
+	m.setBackup(backupName)
+	if pre != "" {
+		if err := runHook(ctx, "pre_"+command, pre, backupName, nil, dryRun); err != nil {
+			return fmt.Errorf("%s is aborted, pre_%s_command failed with: %v", command, command, err)
+		}
+	}
+	err := fn(ctx)
+	if post == "" {
+		return err
+	}
+	m.mu.Lock()
+	backupName = m.backup
+	m.mu.Unlock()
+	if hookErr := runHook(ctx, "post_"+command, post, backupName, err, dryRun); hookErr != nil {
+		if config.PostHookFatal && err == nil {
+			return fmt.Errorf("post_%s_command failed with: %v", command, hookErr)
+		}
+		logger.Warnf("post_%s_command failed with: %v", command, hookErr)
+	}
+	return err
+}
+
+// runHook - run command by shell and log its stdout and stderr line by line, status of command which
+// hook is run after is passed for post hooks
+func runHook(ctx context.Context, hook string, command string, backupName string, runErr error, dryRun bool) error {
+	hookLog := logger.WithField("hook", hook)
+	if dryRun {
+		hookLog.Infof("Run '%s'  ...skip dry-run", command)
+		return nil
+	}
+	hookLog.Infof("Run '%s'", command)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), "CLICKHOUSE_BACKUP_HOOK="+hook, "CLICKHOUSE_BACKUP_NAME="+backupName)
+	if strings.HasPrefix(hook, "post_") {
+		status := "success"
+		if runErr != nil {
+			status = "failure"
+			cmd.Env = append(cmd.Env, "CLICKHOUSE_BACKUP_ERROR="+runErr.Error())
+		}
+		cmd.Env = append(cmd.Env, "CLICKHOUSE_BACKUP_STATUS="+status)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	for _, output := range []struct {
+		name   string
+		buffer *bytes.Buffer
+	}{{"stdout", &stdout}, {"stderr", &stderr}} {
+		scanner := bufio.NewScanner(output.buffer)
+		for scanner.Scan() {
+			hookLog.WithField("stream", output.name).Info(scanner.Text())
+		}
+	}
+	return err
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// baseStagingDir - directory inside downloaded backup where parts of base backups are downloaded
+// before they are moved to their place in incremental backup
+const baseStagingDir = "base_staging"
+
+// basesName - small object of backup on s3 with names of backups which store its unchanged parts,
+// retention reads it instead of the whole manifest of every kept backup
+const basesName = "bases.json"
+
+// diffBase - parts of backup which incremental backup is uploaded against
+type diffBase struct {
+	Name string
+	// parts - parts of base by diffPartKey, their Base and BasePath point to backup which stores data of part
+	parts map[string]ManifestPart
+}
+
+// diffPartKey - part of the same table on the same disk with the same name and checksum has the same data
+func diffPartKey(database string, table string, part ManifestPart) string {
+	return strings.Join([]string{database, table, part.Disk, part.Name, part.Checksum}, "/")
+}
+
+// loadDiffBase - read parts of backup on s3 from its manifest, name may be unique prefix of backup name
+func loadDiffBase(ctx context.Context, config Config, s3 *S3, name string) (*diffBase, error) {
+	backups, err := getRemoteBackups(config, s3)
+	if err != nil {
+		return nil, s3RequestError(err, fmt.Errorf("can't list backups on s3 with: %v", err))
+	}
+	backup, err := findRemoteBackup(backups, name)
+	if err != nil {
+		return nil, err
+	}
+	content, err := s3.DownloadContent(ctx, path.Join(backup.Name, manifestName))
+	if isNotFoundError(err) {
+		return nil, fmt.Errorf("backup '%s' doesn't have manifest and can't be base of incremental backup", backup.Name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't download manifest of '%s' with: %v", backup.Name, err)
+	}
+	manifest, err := ParseBackupManifest(content)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse manifest of '%s': %v", backup.Name, err)
+	}
+	if manifest.SchemaOnly {
+		return nil, fmt.Errorf("backup '%s' is schema-only and can't be base of incremental backup", backup.Name)
+	}
+	// unchanged parts are downloaded from base with layout of incremental backup
+	if layout, err := newKeyLayout(manifest.KeyLayout, manifest.KeySeparator); err != nil || layout != s3.Layout {
+		return nil, fmt.Errorf("backup '%s' is uploaded with another s3.key_layout and can't be base of incremental backup", backup.Name)
+	}
+	base := &diffBase{
+		Name:  backup.Name,
+		parts: make(map[string]ManifestPart),
+	}
+	for _, table := range manifest.Tables {
+		for _, part := range table.Parts {
+			if part.Checksum == "" {
+				continue
+			}
+			if part.Base == "" {
+				part.Base, part.BasePath = backup.Name, part.Path
+			}
+			base.parts[diffPartKey(table.Database, table.Name, part)] = part
+		}
+	}
+	if len(base.parts) == 0 && len(manifest.Tables) > 0 {
+		return nil, fmt.Errorf("manifest of '%s' doesn't describe parts, backup uploaded by older version can't be base of incremental backup", backup.Name)
+	}
+	return base, nil
+}
+
+// apply - point parts of manifest which are unchanged since base to data stored by base,
+// returns paths of unchanged parts inside backup which aren't uploaded
+func (d *diffBase) apply(manifest *BackupManifest) map[string]bool {
+	manifest.DiffFrom = d.Name
+	unchanged := make(map[string]bool)
+	for i := range manifest.Tables {
+		table := &manifest.Tables[i]
+		for j := range table.Parts {
+			part := &table.Parts[j]
+			if part.Checksum == "" {
+				continue
+			}
+			base, ok := d.parts[diffPartKey(table.Database, table.Name, *part)]
+			if !ok {
+				continue
+			}
+			part.Base, part.BasePath = base.Base, base.BasePath
+			unchanged[part.Path] = true
+		}
+	}
+	return unchanged
+}
+
+// skipParts - skip files of parts by paths of parts inside backup, keys are relative to source stored by sourceKey
+func skipParts(sourceKey string, parts map[string]bool) func(key string) bool {
+	if len(parts) == 0 {
+		return nil
+	}
+	return func(key string) bool {
+		// <increment>/data/<db>/<table>/<part>/<file>
+		keyParts := strings.SplitN(key, "/", 6)
+		return len(keyParts) == 6 && parts[path.Join(sourceKey, path.Join(keyParts[:5]...))]
+	}
+}
+
+// downloadBaseParts - download unchanged parts of incremental backup from backups which store their data,
+// so downloaded backup has the full set of parts of every table
+func downloadBaseParts(ctx context.Context, s3 *S3, backupPath string, manifest *BackupManifest) error {
+	// path of part in base backup to path of part in incremental backup by name of base
+	bases := make(map[string]map[string]string)
+	for _, table := range manifest.Tables {
+		for _, part := range table.Parts {
+			if part.Base == "" {
+				continue
+			}
+			if bases[part.Base] == nil {
+				bases[part.Base] = make(map[string]string)
+			}
+			bases[part.Base][part.BasePath] = part.Path
+		}
+	}
+	names := make([]string, 0, len(bases))
+	for name := range bases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stagingPath := filepath.Join(backupPath, baseStagingDir)
+	for _, name := range names {
+		parts := bases[name]
+		logger.Infof("Download %d unchanged parts from '%s'", len(parts), name)
+		if err := os.RemoveAll(stagingPath); err != nil {
+			return fmt.Errorf("can't clean '%s' with: %v", stagingPath, err)
+		}
+		filter := func(key string) bool {
+			keyParts := strings.Split(strings.Trim(key, "/"), "/")
+			for i := 1; i < len(keyParts); i++ {
+				if _, ok := parts[path.Join(keyParts[:i]...)]; ok {
+					return true
+				}
+			}
+			return false
+		}
+		if err := s3.DownloadTreeFiltered(ctx, name, stagingPath, filter); err != nil {
+			return fmt.Errorf("can't download parts of '%s' from s3 with %v", name, err)
+		}
+		if s3.DryRun {
+			continue
+		}
+		for basePath, partPath := range parts {
+			dst := filepath.Join(backupPath, partPath)
+			if err := os.RemoveAll(dst); err != nil {
+				return fmt.Errorf("can't clean '%s' with: %v", dst, err)
+			}
+			if err := mkdirAllMode(filepath.Dir(dst), s3.dirMode()); err != nil {
+				return fmt.Errorf("can't create '%s' with: %v", filepath.Dir(dst), err)
+			}
+			if err := os.Rename(filepath.Join(stagingPath, basePath), dst); err != nil {
+				return fmt.Errorf("can't move part '%s' of '%s' with: %v", basePath, name, err)
+			}
+		}
+	}
+	if err := os.RemoveAll(stagingPath); err != nil {
+		return fmt.Errorf("can't clean '%s' with: %v", stagingPath, err)
+	}
+	return nil
+}
+
+// remoteBackupBases - names of backups which store unchanged parts of incremental backup on s3, they are read
+// from manifest if backup is uploaded without bases.json. Backup without manifest has no bases
+func remoteBackupBases(ctx context.Context, s3 *S3, name string) ([]string, error) {
+	content, err := s3.DownloadContent(ctx, path.Join(name, basesName))
+	if err == nil {
+		var bases []string
+		if err := json.Unmarshal(content, &bases); err != nil {
+			return nil, fmt.Errorf("can't parse %s of '%s': %v", basesName, name, err)
+		}
+		return bases, nil
+	}
+	if !isNotFoundError(err) {
+		return nil, fmt.Errorf("can't download %s of '%s' with: %v", basesName, name, err)
+	}
+	content, err = s3.DownloadContent(ctx, path.Join(name, manifestName))
+	if isNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't download manifest of '%s' with: %v", name, err)
+	}
+	manifest, err := ParseBackupManifest(content)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse manifest of '%s': %v", name, err)
+	}
+	return manifestBases(manifest), nil
+}
+
+// manifestBases - names of backups which store unchanged parts of incremental backup
+func manifestBases(manifest *BackupManifest) []string {
+	if manifest.DiffFrom == "" {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var bases []string
+	for _, table := range manifest.Tables {
+		for _, part := range table.Parts {
+			if part.Base != "" && !seen[part.Base] {
+				seen[part.Base] = true
+				bases = append(bases, part.Base)
+			}
+		}
+	}
+	sort.Strings(bases)
+	return bases
+}
+
+// uploadBases - save bases of backup next to its manifest, backup without bases has empty list
+func uploadBases(ctx context.Context, s3 *S3, manifest *BackupManifest, backupName string) error {
+	bases := manifestBases(manifest)
+	if bases == nil {
+		bases = []string{}
+	}
+	content, err := json.Marshal(bases)
+	if err != nil {
+		return err
+	}
+	if err := s3.UploadContent(ctx, content, path.Join(backupName, basesName)); err != nil {
+		return fmt.Errorf("can't upload %s: %v", basesName, err)
+	}
+	return nil
+}
+
+// keepBases - remove from expired backups bases of kept incremental backups, unchanged parts of incremental backup
+// are stored only by its bases
+func keepBases(ctx context.Context, s3 *S3, backups []RemoteBackup, expired []RemoteBackup) ([]RemoteBackup, error) {
+	if len(expired) == 0 {
+		return expired, nil
+	}
+	isExpired := make(map[string]bool)
+	for _, backup := range expired {
+		isExpired[backup.Name] = true
+	}
+	// incremental backup which needs base by name of base
+	needed := make(map[string]string)
+	for _, backup := range backups {
+		if isExpired[backup.Name] {
+			continue
+		}
+		bases, err := remoteBackupBases(ctx, s3, backup.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, base := range bases {
+			needed[base] = backup.Name
+		}
+	}
+	var result []RemoteBackup
+	for _, backup := range expired {
+		if incremental, ok := needed[backup.Name]; ok {
+			logger.Infof("Backup '%s' is kept because it is base of incremental backup '%s'", backup.Name, incremental)
+			continue
+		}
+		result = append(result, backup)
+	}
+	return result, nil
+}
@@ -111,6 +111,16 @@ func TestMain(t *testing.T) {
 	}
 	cancel()
 
+	fmt.Println("List backups on minio")
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	out, err = exec.CommandContext(ctx, "docker", "exec", "clickhouse", "clickhouse-backup", "list").CombinedOutput()
+	fmt.Println(string(out))
+	if err != nil {
+		panic(err)
+	}
+	cancel()
+	assert.NotEmpty(t, strings.TrimSpace(string(out)), "uploaded backup must be listed by custom endpoint")
+
 	if err := ch.dropDatabase("testdb"); err != nil {
 		panic(err)
 	}
@@ -146,6 +156,68 @@ func TestMain(t *testing.T) {
 	for i := range testData {
 		assert.NoError(t, ch.checkData(t, testData[i]))
 	}
+
+	if err := ch.dropDatabase("testdb"); err != nil {
+		panic(err)
+	}
+
+	fmt.Println("Create tables for concurrent restore")
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	out, err = exec.CommandContext(ctx, "docker", "exec", "clickhouse", "clickhouse-backup", "create-tables").CombinedOutput()
+	fmt.Println(string(out))
+	if err != nil {
+		panic(err)
+	}
+	cancel()
+
+	fmt.Println("Restore concurrently")
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	// restore_concurrency: 1 must be in integration-test/config.yml, otherwise restore isn't concurrent
+	out, err = exec.CommandContext(ctx, "docker", "exec", "clickhouse", "sh", "-c",
+		"sed 's/restore_concurrency: 1/restore_concurrency: 3/' /etc/clickhouse-backup/config.yml > /tmp/config-concurrent.yml && "+
+			"grep -q 'restore_concurrency: 3' /tmp/config-concurrent.yml && "+
+			"clickhouse-backup restore --config /tmp/config-concurrent.yml").CombinedOutput()
+	fmt.Println(string(out))
+	if err != nil {
+		panic(err)
+	}
+	cancel()
+
+	fmt.Println("Check data after concurrent restore")
+	for i := range testData {
+		assert.NoError(t, ch.checkData(t, testData[i]))
+	}
+
+	// metadata and data of archive strategy are restored only from archive
+	const archiveConfig = "sed 's/strategy: tree/strategy: archive/' /etc/clickhouse-backup/config.yml > /tmp/config-archive.yml && "
+	fmt.Println("Freeze and upload archive")
+	dockerExec(archiveConfig + "clickhouse-backup clean --config /tmp/config-archive.yml")
+	dockerExec(archiveConfig + "clickhouse-backup freeze --config /tmp/config-archive.yml")
+	dockerExec(archiveConfig + "clickhouse-backup upload --config /tmp/config-archive.yml")
+	if err := ch.dropDatabase("testdb"); err != nil {
+		panic(err)
+	}
+	fmt.Println("Download archive, create tables and restore")
+	dockerExec("rm -rf /var/lib/clickhouse/backup/metadata /var/lib/clickhouse/backup/shadow")
+	dockerExec(archiveConfig + "clickhouse-backup download --config /tmp/config-archive.yml")
+	dockerExec(archiveConfig + "clickhouse-backup create-tables --config /tmp/config-archive.yml")
+	dockerExec(archiveConfig + "clickhouse-backup restore --config /tmp/config-archive.yml")
+
+	fmt.Println("Check data after restore from archive")
+	for i := range testData {
+		assert.NoError(t, ch.checkData(t, testData[i]))
+	}
+}
+
+// dockerExec - run shell command in clickhouse container, output is printed
+func dockerExec(command string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "docker", "exec", "clickhouse", "sh", "-c", command).CombinedOutput()
+	fmt.Println(string(out))
+	if err != nil {
+		panic(err)
+	}
 }
 
 func (ch *ClickHouse) createTestData(data TestDataStuct) error {
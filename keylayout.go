@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	keyLayoutNested = "nested"
+	keyLayoutFlat   = "flat"
+)
+
+// keyLayout - how paths of files relative to directory uploaded by tree strategy are mapped to keys of objects,
+// nested keeps path as is, flat joins its elements by Separator so every file is one object in prefix of directory
+type keyLayout struct {
+	Flat      bool
+	Separator string
+}
+
+// newKeyLayout - layout by s3.key_layout or by layout stored in manifest, empty name is nested layout
+// of backups uploaded before key_layout was added
+func newKeyLayout(name string, separator string) (keyLayout, error) {
+	switch name {
+	case "", keyLayoutNested:
+		return keyLayout{}, nil
+	case keyLayoutFlat:
+		if separator == "" || strings.ContainsAny(separator, "/.") {
+			return keyLayout{}, fmt.Errorf("separator of flat key layout must be set and can't contain '/' or '.', got '%s'", separator)
+		}
+		return keyLayout{Flat: true, Separator: separator}, nil
+	}
+	return keyLayout{}, fmt.Errorf("unknown key layout '%s', it can be 'nested' or 'flat'", name)
+}
+
+// Name - name of layout which is stored in manifest
+func (l keyLayout) Name() string {
+	if l.Flat {
+		return keyLayoutFlat
+	}
+	return keyLayoutNested
+}
+
+// encode - key of object relative to prefix of directory by path of file relative to directory, leading slash is kept.
+// File which name contains separator can't be stored by flat layout, its key couldn't be decoded
+func (l keyLayout) encode(key string) (string, error) {
+	if !l.Flat {
+		return key, nil
+	}
+	prefix := ""
+	if strings.HasPrefix(key, "/") {
+		prefix = "/"
+	}
+	elements := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	for _, element := range elements {
+		if strings.Contains(element, l.Separator) {
+			return "", fmt.Errorf("'%s' contains key separator '%s' and can't be uploaded with flat key layout", key, l.Separator)
+		}
+	}
+	return prefix + strings.Join(elements, l.Separator), nil
+}
+
+// decode - path of file relative to directory by key of object relative to prefix of directory
+func (l keyLayout) decode(key string) string {
+	if !l.Flat {
+		return key
+	}
+	return strings.Replace(key, l.Separator, "/", -1)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyLayoutRoundTrip(t *testing.T) {
+	keys := []string{
+		"/1/data/db/table/all_1_1_0/checksums.txt",
+		"/1/data/db/table/all_1_1_0/data.bin.gz",
+		"db/table.sql",
+		"/access.sql",
+	}
+	testCases := map[string]map[string]string{
+		keyLayoutNested: {
+			"/1/data/db/table/all_1_1_0/checksums.txt": "/1/data/db/table/all_1_1_0/checksums.txt",
+			"/1/data/db/table/all_1_1_0/data.bin.gz":   "/1/data/db/table/all_1_1_0/data.bin.gz",
+			"db/table.sql":                             "db/table.sql",
+			"/access.sql":                              "/access.sql",
+		},
+		keyLayoutFlat: {
+			"/1/data/db/table/all_1_1_0/checksums.txt": "/1!data!db!table!all_1_1_0!checksums.txt",
+			"/1/data/db/table/all_1_1_0/data.bin.gz":   "/1!data!db!table!all_1_1_0!data.bin.gz",
+			"db/table.sql":                             "db!table.sql",
+			"/access.sql":                              "/access.sql",
+		},
+	}
+	for name, expected := range testCases {
+		layout, err := newKeyLayout(name, "!")
+		assert.NoError(t, err)
+		assert.Equal(t, name, layout.Name())
+		for _, key := range keys {
+			encoded, err := layout.encode(key)
+			assert.NoError(t, err, key)
+			assert.Equal(t, expected[key], encoded, key)
+			assert.Equal(t, key, layout.decode(encoded), key)
+		}
+	}
+}
+
+func TestKeyLayoutErrors(t *testing.T) {
+	layout, err := newKeyLayout("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, keyLayoutNested, layout.Name())
+
+	for _, separator := range []string{"", "/", ".", "a/b"} {
+		_, err = newKeyLayout(keyLayoutFlat, separator)
+		assert.Error(t, err, separator)
+	}
+	_, err = newKeyLayout("deep", "!")
+	assert.Error(t, err)
+
+	layout, err = newKeyLayout(keyLayoutFlat, "_")
+	assert.NoError(t, err)
+	_, err = layout.encode("/1/data/db/table/all_1_1_0/data.bin")
+	assert.Error(t, err)
+}
+
+// fakeBucket - s3 endpoint which lists objects of one bucket by ListObjectsV2
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string]int64
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	type object struct {
+		Key          string
+		Size         int64
+		ETag         string
+		StorageClass string
+	}
+	type listBucketResult struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []object
+	}
+	if r.Method != http.MethodGet || r.URL.Query().Get("list-type") != "2" {
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	result := listBucketResult{Name: strings.Trim(r.URL.Path, "/"), Prefix: prefix}
+	b.mu.Lock()
+	for key, size := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, object{Key: key, Size: size, ETag: "\"etag\"", StorageClass: "STANDARD"})
+		}
+	}
+	b.mu.Unlock()
+	sort.Slice(result.Contents, func(i, j int) bool {
+		return result.Contents[i].Key < result.Contents[j].Key
+	})
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func TestKeyLayoutSync(t *testing.T) {
+	localPath, err := ioutil.TempDir("", "key-layout")
+	assert.NoError(t, err)
+	defer os.RemoveAll(localPath)
+	files := map[string]string{
+		"/1/data/db/table/all_1_1_0/checksums.txt": "checksums",
+		"/1/data/db/table/all_1_1_0/data.bin":      "data",
+		"/db/table.sql":                            "CREATE TABLE",
+	}
+	for key, content := range files {
+		filePath := filepath.Join(localPath, filepath.FromSlash(key))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		assert.NoError(t, ioutil.WriteFile(filePath, []byte(content), 0644))
+	}
+	for _, name := range []string{keyLayoutNested, keyLayoutFlat} {
+		layout, err := newKeyLayout(name, "!")
+		assert.NoError(t, err)
+		encode := func(key string) string {
+			encoded, err := layout.encode(key)
+			assert.NoError(t, err, key)
+			return "backups/backup1" + encoded
+		}
+		bucket := &fakeBucket{objects: map[string]int64{
+			// the same file is skipped, changed and missing files are uploaded, file which isn't in backup is deleted
+			encode("/1/data/db/table/all_1_1_0/checksums.txt"): int64(len("checksums")),
+			encode("/1/data/db/table/all_1_1_0/data.bin"):      1,
+			encode("/1/data/db/table/all_2_2_0/data.bin"):      1,
+			"backups/backup2/db/table.sql":                     1,
+		}}
+		server := httptest.NewServer(bucket)
+		config := defaultConfig()
+		config.S3.Endpoint = server.URL
+		config.S3.Bucket = "bucket"
+		config.S3.Path = "backups"
+		config.S3.AccessKey = "access"
+		config.S3.SecretKey = "secret"
+		config.S3.ForcePathStyle = true
+		config.S3.DisableSSL = true
+		config.S3.OverwriteStrategy = "skip"
+		s := &S3{Config: &config.S3, Layout: layout}
+		assert.NoError(t, s.Connect(), name)
+
+		iter, extra, err := s.newSyncFolderIterator(localPath, "backup1", nil)
+		assert.NoError(t, err, name)
+		var uploaded []string
+		for iter.Next() {
+			object := iter.UploadObject()
+			uploaded = append(uploaded, *object.Object.Key)
+			if closer, ok := object.Object.Body.(interface{ Close() error }); ok {
+				closer.Close()
+			}
+		}
+		assert.NoError(t, iter.Err(), name)
+		sort.Strings(uploaded)
+		assert.Equal(t, []string{
+			encode("/1/data/db/table/all_1_1_0/data.bin"),
+			encode("/db/table.sql"),
+		}, uploaded, name)
+		var extraKeys []string
+		for _, file := range extra {
+			extraKeys = append(extraKeys, file.key)
+		}
+		assert.Equal(t, []string{encode("/1/data/db/table/all_2_2_0/data.bin")}, extraKeys, name)
+
+		// bucket after upload of changed files and deletion of extra files is downloaded to the same files
+		bucket.mu.Lock()
+		for _, key := range uploaded {
+			bucket.objects[key] = int64(len(files[layout.decode(strings.TrimPrefix(key, "backups/backup1"))]))
+		}
+		for _, key := range extraKeys {
+			delete(bucket.objects, key)
+		}
+		bucket.mu.Unlock()
+		remote, err := s.getS3Files(localPath, "backup1")
+		assert.NoError(t, err, name)
+		assert.Len(t, remote, len(files), name)
+		for key, content := range files {
+			if assert.Contains(t, remote, key, name) {
+				assert.Equal(t, int64(len(content)), remote[key].size, key)
+				assert.Equal(t, encode(key), "backups/backup1"+remote[key].remoteKey, key)
+			}
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// latestName - object with name of the newest archive, download and verify use it if archive isn't passed
+const latestName = "latest"
+
+// LatestPointer - content of latest object
+type LatestPointer struct {
+	Name      string    `json:"name"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// uploadLatest - point latest object to archive which is just uploaded
+func uploadLatest(ctx context.Context, s3 *S3, archiveName string) error {
+	content, err := json.MarshalIndent(LatestPointer{Name: archiveName, Timestamp: time.Now().UTC()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := s3.UploadContent(ctx, content, latestName); err != nil {
+		return fmt.Errorf("can't upload latest pointer with: %v", err)
+	}
+	return nil
+}
+
+// downloadLatest - get latest object, nil if there is no latest object
+func downloadLatest(ctx context.Context, s3 *S3) (*LatestPointer, error) {
+	content, err := s3.DownloadContent(ctx, latestName)
+	if isNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't download latest pointer with: %v", err)
+	}
+	var latest LatestPointer
+	if err := json.Unmarshal(content, &latest); err != nil {
+		return nil, fmt.Errorf("can't parse latest pointer: %v", err)
+	}
+	return &latest, nil
+}
+
+// latestWithSum - name of archive from latest object if its manifest has the same digest of content of archive,
+// empty name if there is no such archive. Digest doesn't depend on tar headers and freeze name, so the same
+// data frozen again is found
+func latestWithSum(ctx context.Context, s3 *S3, contentSum string) (string, error) {
+	latest, err := downloadLatest(ctx, s3)
+	if err != nil || latest == nil {
+		return "", err
+	}
+	content, err := s3.DownloadContent(ctx, latest.Name+manifestSuffix)
+	if isNotFoundError(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("can't download manifest of latest backup with: %v", err)
+	}
+	manifest, err := ParseBackupManifest(content)
+	if err != nil {
+		return "", fmt.Errorf("can't parse manifest of latest backup: %v", err)
+	}
+	if manifest.ContentSHA256 == "" || manifest.ContentSHA256 != contentSum {
+		return "", nil
+	}
+	return latest.Name, nil
+}
+
+// resolveArchive - return passed archive name or archive from latest object, the newest archive on s3
+// is used if there is no latest object or it points to deleted archive. Name without suffix of archive
+// is name of archive set or name passed to upload --name, it is found among backups on s3
+func resolveArchive(ctx context.Context, config Config, s3 *S3, filename string) (string, error) {
+	if filename != "" && hasArchiveSuffix(filename) {
+		return filename, nil
+	}
+	backups, err := getRemoteBackups(config, s3)
+	if err != nil {
+		return "", s3RequestError(err, fmt.Errorf("can't list backups on s3 with: %v", err))
+	}
+	if filename != "" {
+		backup, err := findRemoteBackup(backups, filename)
+		if err != nil {
+			return "", err
+		}
+		return backup.Name, nil
+	}
+	if len(backups) == 0 {
+		return "", fmt.Errorf("there are no backups on s3")
+	}
+	latest, err := downloadLatest(ctx, s3)
+	if err != nil {
+		return "", err
+	}
+	if latest != nil {
+		for _, backup := range backups {
+			if backup.Name == latest.Name {
+				logger.Infof("Use latest backup '%s' uploaded at %s", latest.Name, latest.Timestamp.Format(time.RFC3339))
+				return latest.Name, nil
+			}
+		}
+		logger.Warnf("Latest pointer refers to '%s' which is not found on s3", latest.Name)
+	}
+	logger.Infof("Use the newest backup '%s'", backups[0].Name)
+	return backups[0].Name, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// flatBackupName - name of tree backup stored directly in s3.path
+const flatBackupName = "/"
+
+// RemoteBackup - backup on s3 with all related objects
+type RemoteBackup struct {
+	Name         string
+	Size         int64
+	LastModified time.Time
+	Keys         []string
+}
+
+// getRemoteBackups - list backups on s3 sorted from newest to oldest
+func getRemoteBackups(config Config, s3 *S3) ([]RemoteBackup, error) {
+	objects, err := s3.ListObjects(config.S3.Path)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(config.S3.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	backups := make(map[string]*RemoteBackup)
+	for _, object := range objects {
+		if !strings.HasPrefix(*object.Key, prefix) {
+			continue
+		}
+		name, ok := remoteBackupName(config.Backup.Strategy, strings.TrimPrefix(*object.Key, prefix))
+		if !ok {
+			continue
+		}
+		backup, ok := backups[name]
+		if !ok {
+			backup = &RemoteBackup{Name: name}
+			backups[name] = backup
+		}
+		backup.Keys = append(backup.Keys, *object.Key)
+		backup.Size += *object.Size
+		if object.LastModified.After(backup.LastModified) {
+			backup.LastModified = *object.LastModified
+		}
+	}
+	result := make([]RemoteBackup, 0, len(backups))
+	for _, backup := range backups {
+		result = append(result, *backup)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastModified.After(result[j].LastModified)
+	})
+	return result, nil
+}
+
+// remoteBackupName - name of backup which object with relative key belongs to
+func remoteBackupName(strategy string, key string) (string, bool) {
+	switch strategy {
+	case "tree":
+		parts := strings.SplitN(key, "/", 2)
+		switch parts[0] {
+		case "metadata", "shadow", "disks", manifestName, checksumsName:
+			return flatBackupName, true
+		}
+		if len(parts) == 1 {
+			return "", false
+		}
+		return parts[0], true
+	case "archive":
+		for _, suffix := range []string{manifestSuffix, checksumsSuffix} {
+			if strings.HasSuffix(key, suffix) {
+				key = strings.TrimSuffix(key, suffix)
+				break
+			}
+		}
+		// archives of backup with archive_granularity table are grouped by prefix
+		if parts := strings.SplitN(key, "/", 2); len(parts) == 2 {
+			if strings.Contains(parts[1], "/") || !(parts[1] == manifestName || parts[1] == checksumsName || hasArchiveSuffix(parts[1])) {
+				return "", false
+			}
+			return parts[0], true
+		}
+		key = archivePartRe.ReplaceAllString(key, "")
+		if !hasArchiveSuffix(key) {
+			return "", false
+		}
+		return key, true
+	}
+	return "", false
+}
+
+// hasArchiveSuffix - check that name is name of archive of the whole backup
+func hasArchiveSuffix(name string) bool {
+	return strings.HasSuffix(name, ".tar") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tar.zst")
+}
+
+// complete - check that backup has manifest and checksums, they are uploaded after all data of backup
+func (b RemoteBackup) complete() bool {
+	hasManifest, hasChecksums := false, false
+	for _, key := range b.Keys {
+		name := path.Base(key)
+		hasManifest = hasManifest || name == manifestName || strings.HasSuffix(name, manifestSuffix)
+		hasChecksums = hasChecksums || name == checksumsName || strings.HasSuffix(name, checksumsSuffix)
+	}
+	return hasManifest && hasChecksums
+}
+
+func list(config Config) error {
+	s3 := &S3{
+		Config: &config.S3,
+	}
+	if err := s3.Connect(); err != nil {
+		return connectionError(fmt.Errorf("can't connect to s3 with: %v", err))
+	}
+	backups, err := getRemoteBackups(config, s3)
+	if err != nil {
+		return s3RequestError(err, fmt.Errorf("can't list backups on s3 with: %v", err))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, backup := range backups {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", backup.Name, formatBytes(backup.Size), backup.LastModified.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// findRemoteBackup - find backup by exact name or by unique name prefix
+func findRemoteBackup(backups []RemoteBackup, name string) (RemoteBackup, error) {
+	var candidates []RemoteBackup
+	for _, backup := range backups {
+		if backup.Name == name {
+			return backup, nil
+		}
+		if strings.HasPrefix(backup.Name, name) {
+			candidates = append(candidates, backup)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return RemoteBackup{}, fmt.Errorf("backup '%s' not found on s3", name)
+	case 1:
+		return candidates[0], nil
+	}
+	names := make([]string, len(candidates))
+	for i, backup := range candidates {
+		names[i] = backup.Name
+	}
+	return RemoteBackup{}, fmt.Errorf("'%s' matches several backups, specify one of: %s", name, strings.Join(names, ", "))
+}
+
+func deleteBackup(config Config, args []string, dryRun bool) error {
+	if len(args) != 1 {
+		return fmt.Errorf("backup name needs to be passed to delete")
+	}
+	s3 := &S3{
+		DryRun: dryRun,
+		Config: &config.S3,
+	}
+	if err := s3.Connect(); err != nil {
+		return connectionError(fmt.Errorf("can't connect to s3 with: %v", err))
+	}
+	backups, err := getRemoteBackups(config, s3)
+	if err != nil {
+		return s3RequestError(err, fmt.Errorf("can't list backups on s3 with: %v", err))
+	}
+	backup, err := findRemoteBackup(backups, args[0])
+	if err != nil {
+		return err
+	}
+	if config.Backup.Strategy == "tree" {
+		if err := checkNotBase(s3, backups, backup.Name); err != nil {
+			return err
+		}
+	}
+	if dryRun {
+		for _, key := range backup.Keys {
+			log.Printf("Delete '%s'  ...skip dry-run", key)
+		}
+		return nil
+	}
+	log.Printf("Delete backup '%s' with %d objects from s3", backup.Name, len(backup.Keys))
+	return s3.DeleteObjects(backup.Keys)
+}
+
+// checkNotBase - refuse to delete backup which stores unchanged parts of incremental backup
+func checkNotBase(s3 *S3, backups []RemoteBackup, name string) error {
+	for _, backup := range backups {
+		if backup.Name == name {
+			continue
+		}
+		bases, err := remoteBackupBases(context.Background(), s3, backup.Name)
+		if err != nil {
+			return err
+		}
+		for _, base := range bases {
+			if base == name {
+				return fmt.Errorf("backup '%s' is base of incremental backup '%s', delete '%s' first", name, backup.Name, backup.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// localRowsName - file of backup with rows count of frozen tables, it is added to manifest on upload
+const localRowsName = "rows.json"
+
+// localBackupInfoName - file of backup/<name> of default disk which is written by freeze when local backup
+// is complete, only directories with it are local backups, other directories in backup directory are kept as is
+const localBackupInfoName = "backup.json"
+
+// localBackupInfo - local backup created by freeze
+type localBackupInfo struct {
+	Created time.Time `json:"created"`
+}
+
+// frozenTablesName - file in shadow of default disk which is written when all requested tables are frozen,
+// shadow with it is left by complete freeze and can be reused by freeze --reuse-shadow
+const frozenTablesName = "frozen_tables.json"
+
+// frozenTables - request of complete freeze, tables are sorted [db].[table] names. Name, time of freeze
+// and rows count of tables are given to local backup of reused shadow
+type frozenTables struct {
+	Tables     []string          `json:"tables"`
+	Partitions []string          `json:"partitions,omitempty"`
+	Access     bool              `json:"access,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Frozen     time.Time         `json:"frozen"`
+	Rows       map[string]uint64 `json:"rows,omitempty"`
+}
+
+func newFrozenTables(tables []Table, partitions []string, access bool) frozenTables {
+	frozen := frozenTables{
+		Tables:     make([]string, 0, len(tables)),
+		Partitions: append([]string(nil), partitions...),
+		Access:     access,
+	}
+	for _, table := range tables {
+		frozen.Tables = append(frozen.Tables, table.Database+"."+table.Name)
+	}
+	sort.Strings(frozen.Tables)
+	sort.Strings(frozen.Partitions)
+	return frozen
+}
+
+// match - check that frozen tables are exactly requested ones
+func (f frozenTables) match(requested frozenTables) error {
+	frozen := make(map[string]bool)
+	for _, table := range f.Tables {
+		frozen[table] = true
+	}
+	var missing []string
+	for _, table := range requested.Tables {
+		if !frozen[table] {
+			missing = append(missing, table)
+		}
+		delete(frozen, table)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("shadow doesn't have %s", strings.Join(missing, ", "))
+	}
+	if len(frozen) > 0 {
+		extra := make([]string, 0, len(frozen))
+		for table := range frozen {
+			extra = append(extra, table)
+		}
+		sort.Strings(extra)
+		return fmt.Errorf("shadow has tables which aren't requested: %s", strings.Join(extra, ", "))
+	}
+	if strings.Join(f.Partitions, ",") != strings.Join(requested.Partitions, ",") {
+		return fmt.Errorf("shadow has partitions '%s' instead of '%s'", strings.Join(f.Partitions, ","), strings.Join(requested.Partitions, ","))
+	}
+	if requested.Access && !f.Access {
+		return fmt.Errorf("shadow doesn't have access entities")
+	}
+	return nil
+}
+
+// writeFrozenTables - mark shadow as left by complete freeze of tables
+func writeFrozenTables(disks []Disk, frozen frozenTables, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	data, err := json.MarshalIndent(frozen, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(defaultDisk(disks).shadowPath(), frozenTablesName), data, 0640)
+}
+
+// readFrozenTables - tables of complete freeze which left shadow, nil if shadow isn't left by complete freeze
+func readFrozenTables(disks []Disk) (*frozenTables, error) {
+	data, err := ioutil.ReadFile(path.Join(defaultDisk(disks).shadowPath(), frozenTablesName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var frozen frozenTables
+	if err := json.Unmarshal(data, &frozen); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", frozenTablesName, err)
+	}
+	return &frozen, nil
+}
+
+// removeFrozenTables - remove mark of complete freeze when shadow is moved to local backup
+func removeFrozenTables(disks []Disk, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	err := os.Remove(path.Join(defaultDisk(disks).shadowPath(), frozenTablesName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// localBackup - metadata and shadows which are uploaded, backup created by freeze is stored in backup/<name>
+// directory of every disk, empty name means shadow and metadata directories of clickhouse
+type localBackup struct {
+	Name  string
+	disks []Disk
+}
+
+// path - directory of backup on disk
+func (b localBackup) path(disk Disk) string {
+	return path.Join(disk.backupPath(), b.Name)
+}
+
+// shadows - shadow directories of backup by disk name
+func (b localBackup) shadows() map[string]string {
+	if b.Name == "" {
+		return diskShadows(b.disks)
+	}
+	shadows := make(map[string]string)
+	for _, disk := range b.disks {
+		shadows[disk.Name] = path.Join(b.path(disk), "shadow")
+	}
+	return shadows
+}
+
+// info - local backup written by freeze when it is complete, nil if directory isn't complete local backup
+func (b localBackup) info() (*localBackupInfo, error) {
+	data, err := ioutil.ReadFile(path.Join(b.path(defaultDisk(b.disks)), localBackupInfoName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info localBackupInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", localBackupInfoName, err)
+	}
+	return &info, nil
+}
+
+// created - time of freeze, it is modification time of shadow of default disk if backup isn't created by freeze
+func (b localBackup) created() (time.Time, error) {
+	if b.Name != "" {
+		info, err := b.info()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info != nil {
+			return info.Created, nil
+		}
+	}
+	if created, err := time.Parse(time.RFC3339, b.Name); err == nil {
+		return created, nil
+	}
+	createdPath := defaultDisk(b.disks).shadowPath()
+	if b.Name != "" {
+		createdPath = b.path(defaultDisk(b.disks))
+	}
+	info, err := os.Stat(createdPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// sources - metadata and shadows of all disks which are included into backup
+func (b localBackup) sources(schemaOnly bool) []backupSource {
+	metadataPath := defaultDisk(b.disks).metadataPath()
+	if b.Name != "" {
+		metadataPath = path.Join(b.path(defaultDisk(b.disks)), "metadata")
+	}
+	sources := []backupSource{{Key: "metadata", Path: metadataPath}}
+	if schemaOnly {
+		return sources
+	}
+	shadows := b.shadows()
+	for _, disk := range b.disks {
+		shadowPath := shadows[disk.Name]
+		if _, err := os.Stat(shadowPath); os.IsNotExist(err) && disk.Name != defaultDiskName {
+			continue
+		}
+		sources = append(sources, backupSource{Key: diskShadowKey(disk.Name), Path: shadowPath})
+	}
+	return sources
+}
+
+// rows - rows count of frozen tables by <db>.<table> captured on freeze, nil if it is unknown
+func (b localBackup) rows() (map[string]uint64, error) {
+	if b.Name == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path.Join(b.path(defaultDisk(b.disks)), localRowsName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rows map[string]uint64
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", localRowsName, err)
+	}
+	return rows, nil
+}
+
+// frozenRows - rows count of parts which are frozen to shadows by <db>.<table>, rows of parts are taken from partRows
+// recorded at freeze, because frozen parts can be merged and removed from system.parts after it. Table with part
+// which isn't recorded doesn't have rows count
+func frozenRows(shadows map[string]string, partRows map[string]map[string]uint64) (map[string]uint64, error) {
+	tables, err := getDisksBackupTables(shadows)
+	if err != nil {
+		return nil, fmt.Errorf("can't read frozen tables: %v", err)
+	}
+	rows := make(map[string]uint64)
+	unknown := make(map[string]bool)
+	for _, table := range tables {
+		key := table.Database + "." + table.Name
+		parts := partRows[key]
+		for _, partition := range table.Partitions {
+			count, ok := parts[partition.Name]
+			if !ok {
+				unknown[key] = true
+				continue
+			}
+			rows[key] += count
+		}
+	}
+	for key := range unknown {
+		logger.Warnf("rows of some parts of %s aren't recorded at freeze, rows count of table isn't saved", key)
+		delete(rows, key)
+	}
+	return rows, nil
+}
+
+// writeLocalBackupRows - save rows count of frozen tables to backup
+func writeLocalBackupRows(disks []Disk, name string, rows map[string]uint64, dryRun bool) error {
+	if dryRun || len(rows) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(rows, "", "  ")
+	if err != nil {
+		return err
+	}
+	backup := localBackup{Name: name, disks: disks}
+	return ioutil.WriteFile(path.Join(backup.path(defaultDisk(disks)), localRowsName), data, 0640)
+}
+
+// writeLocalBackupInfo - mark backup/<name> as complete local backup, it's written the last
+func writeLocalBackupInfo(disks []Disk, name string, info localBackupInfo, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	backup := localBackup{Name: name, disks: disks}
+	return ioutil.WriteFile(path.Join(backup.path(defaultDisk(disks)), localBackupInfoName), data, 0640)
+}
+
+// backupNameRe - characters of backup name which are safe for directory and object key
+var backupNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:+-]*$`)
+
+// reservedBackupNames - directories of downloaded backup, restore staging and staging of base parts in backup directory
+var reservedBackupNames = map[string]bool{
+	"metadata":        true,
+	"shadow":          true,
+	"disks":           true,
+	restoreStagingDir: true,
+	baseStagingDir:    true,
+}
+
+// validateBackupName - check name passed by --name, it is directory in backup directory and prefix or name
+// of archive on s3, suffix of archive is added by upload
+func validateBackupName(name string) error {
+	if len(name) > 128 || !backupNameRe.MatchString(name) {
+		return fmt.Errorf("backup name '%s' must be at most 128 letters, digits and '.', '_', ':', '+', '-' starting with letter or digit", name)
+	}
+	if reservedBackupNames[name] || hasArchiveSuffix(name) || archivePartRe.MatchString(name) {
+		return fmt.Errorf("backup name '%s' is reserved", name)
+	}
+	return nil
+}
+
+// isLocalBackupName - check name of local backup passed as argument, backups created by freeze are named
+// by time of creation or by --name
+func isLocalBackupName(name string) bool {
+	return validateBackupName(name) == nil
+}
+
+// getLocalBackups - names of complete backups created by freeze from oldest to newest, directories
+// without backup.json are left by failed freeze or are created by operator and aren't backups
+func getLocalBackups(disks []Disk) ([]string, error) {
+	files, err := ioutil.ReadDir(defaultDisk(disks).backupPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	created := make(map[string]time.Time)
+	for _, file := range files {
+		if !file.IsDir() || !isLocalBackupName(file.Name()) {
+			continue
+		}
+		backup := localBackup{Name: file.Name(), disks: disks}
+		info, err := backup.info()
+		if err != nil {
+			return nil, fmt.Errorf("can't read local backup '%s': %v", file.Name(), err)
+		}
+		if info == nil {
+			continue
+		}
+		names = append(names, file.Name())
+		created[file.Name()] = info.Created
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if created[names[i]].Equal(created[names[j]]) {
+			return names[i] < names[j]
+		}
+		return created[names[i]].Before(created[names[j]])
+	})
+	return names, nil
+}
+
+// selectLocalBackup - backup with name from args or the newest one, shadow and metadata of clickhouse are used
+// if there are no backups created by freeze
+func selectLocalBackup(disks []Disk, args []string) (localBackup, error) {
+	names, err := getLocalBackups(disks)
+	if err != nil {
+		return localBackup{}, fmt.Errorf("can't list local backups with: %v", err)
+	}
+	if len(args) > 0 {
+		for _, name := range names {
+			if name == args[0] {
+				return localBackup{Name: name, disks: disks}, nil
+			}
+		}
+		return localBackup{}, fmt.Errorf("local backup '%s' not found", args[0])
+	}
+	if len(names) == 0 {
+		logger.Infof("There are no local backups, shadow and metadata directories of clickhouse are used")
+		return localBackup{disks: disks}, nil
+	}
+	logger.Infof("Use local backup '%s'", names[len(names)-1])
+	return localBackup{Name: names[len(names)-1], disks: disks}, nil
+}
+
+// createLocalBackup - move contents of shadow of every disk to backup/<name>/shadow and copy metadata
+// to backup/<name>/metadata, so shadow is empty for the next freeze. backup/<name> is removed on failure,
+// so partially moved backup doesn't stay without metadata
+func createLocalBackup(disks []Disk, name string, dryRun bool) (err error) {
+	backup := localBackup{Name: name, disks: disks}
+	defer func() {
+		if err == nil || dryRun {
+			return
+		}
+		if removeErr := removeLocalBackup(disks, name, false); removeErr != nil {
+			logger.Errorf("can't remove incomplete local backup '%s': %v", name, removeErr)
+		}
+	}()
+	shadows := backup.shadows()
+	for _, disk := range disks {
+		srcPath := disk.shadowPath()
+		files, err := ioutil.ReadDir(srcPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("can't read %s directory: %v", srcPath, err)
+		}
+		if len(files) == 0 {
+			continue
+		}
+		dstPath := shadows[disk.Name]
+		if dryRun {
+			logger.Infof("DRY-RUN: move contents of %s to %s", srcPath, dstPath)
+			continue
+		}
+		if err := os.MkdirAll(dstPath, 0750); err != nil {
+			return fmt.Errorf("can't create '%s' with: %v", dstPath, err)
+		}
+		for _, file := range files {
+			if file.Name() == frozenTablesName {
+				continue
+			}
+			if err := os.Rename(path.Join(srcPath, file.Name()), path.Join(dstPath, file.Name())); err != nil {
+				return fmt.Errorf("can't move shadow to backup with: %v", err)
+			}
+		}
+	}
+	metadataPath := defaultDisk(disks).metadataPath()
+	dstPath := path.Join(backup.path(defaultDisk(disks)), "metadata")
+	if dryRun {
+		logger.Infof("DRY-RUN: copy %s to %s", metadataPath, dstPath)
+		return nil
+	}
+	if err := copyTree(metadataPath, dstPath); err != nil {
+		return fmt.Errorf("can't copy metadata to backup with: %v", err)
+	}
+	logger.Infof("Local backup '%s' is created", name)
+	return nil
+}
+
+// removeLocalBackup - remove backup/<name> directory of every disk
+func removeLocalBackup(disks []Disk, name string, dryRun bool) error {
+	backup := localBackup{Name: name, disks: disks}
+	for _, disk := range disks {
+		backupPath := backup.path(disk)
+		if _, err := os.Stat(backupPath); os.IsNotExist(err) {
+			continue
+		}
+		logger.Infof("remove directory %v", backupPath)
+		if dryRun {
+			continue
+		}
+		if err := os.RemoveAll(backupPath); err != nil {
+			return fmt.Errorf("can't remove %s with: %v", backupPath, err)
+		}
+	}
+	return nil
+}
+
+// copyTree - copy files of src to dst, symlinks are followed because metadata of Atomic databases are symlinks
+func copyTree(src string, dst string) error {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0750); err != nil {
+		return err
+	}
+	for _, file := range files {
+		srcFile := path.Join(src, file.Name())
+		dstFile := path.Join(dst, file.Name())
+		info, err := os.Stat(srcFile)
+		if os.IsNotExist(err) {
+			// dangling symlink or table is dropped meanwhile
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if err := copyTree(srcFile, dstFile); err != nil {
+				return err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if err := copyFile(srcFile, dstFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Fields - contextual fields of log event
+type Fields = logrus.Fields
+
+// logger - all events are logged through it, messages of standard log package are redirected to it too
+var logger = &logrus.Logger{
+	Out:       os.Stderr,
+	Formatter: &textFormatter{},
+	Hooks:     make(logrus.LevelHooks),
+	Level:     logrus.InfoLevel,
+}
+
+// setLogFormat - switch format of log to "text" or "json"
+func setLogFormat(format string) error {
+	switch format {
+	case "text":
+		logger.Formatter = &textFormatter{}
+	case "json":
+		logger.Formatter = &logrus.JSONFormatter{
+			FieldMap: logrus.FieldMap{
+				logrus.FieldKeyTime: "timestamp",
+				logrus.FieldKeyMsg:  "message",
+			},
+		}
+	default:
+		return fmt.Errorf("unknown log format '%s' it can be 'text', 'json'", format)
+	}
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer())
+	return nil
+}
+
+// setQuiet - log only warnings and errors, informational messages of logger and standard log package are dropped
+func setQuiet(quiet bool) {
+	if quiet {
+		logger.Level = logrus.WarnLevel
+	}
+}
+
+// setLogFile - write log to file which is rotated when it reaches max_size_mb, log stays in stderr if file is not set
+func setLogFile(config LogConfig) {
+	if config.File == "" {
+		return
+	}
+	logger.Out = &lumberjack.Logger{
+		Filename:   config.File,
+		MaxSize:    config.MaxSizeMB,
+		MaxBackups: config.MaxBackups,
+	}
+}
+
+// textFormatter - human-readable format of standard log package, fields are appended as key=value
+type textFormatter struct{}
+
+// Format - format entry as "2006/01/02 15:04:05 [LEVEL ]message key=value"
+func (f *textFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(entry.Time.Format("2006/01/02 15:04:05 "))
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		b.WriteString("ERROR ")
+	case logrus.WarnLevel:
+		b.WriteString("WARN ")
+	}
+	b.WriteString(entry.Message)
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%v", key, entry.Data[key])
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
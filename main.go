@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/urfave/cli"
 )
@@ -20,11 +29,28 @@ var (
 	buildDate = "unknown"
 )
 
+// errCanceled - returned instead of error of operation which was interrupted by signal
+var errCanceled = errors.New("operation is canceled")
+
+// exitCodeCanceled - exit code when operation is interrupted by SIGINT or SIGTERM
+const exitCodeCanceled = 130
+
 func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Infof("Received %v, cancel current operation", sig)
+		cancel()
+	}()
+
 	cliapp := cli.NewApp()
 	cliapp.Name = "clickhouse-backup"
 	cliapp.Usage = "Backup ClickHouse to s3"
 	cliapp.Version = version
+	cliapp.Description = exitCodesHelp
 
 	cliapp.Flags = []cli.Flag{
 		cli.StringFlag{
@@ -36,6 +62,19 @@ func main() {
 			Name:  "dry-run",
 			Usage: "Only show what should be uploaded or downloaded but don't actually do it. May still perform S3 requests to get bucket listings and other information though (only for file transfer commands)",
 		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Value: "text",
+			Usage: "Format of log, 'text' or 'json' with one object per event",
+		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "Log only warnings and errors, progress bar is disabled too",
+		},
+		cli.StringFlag{
+			Name:  "metrics-push-gateway",
+			Usage: "Push metrics of upload and download to Prometheus Pushgateway `URL`",
+		},
 	}
 	cliapp.CommandNotFound = func(c *cli.Context, command string) {
 		fmt.Printf("Error. Unknown command: '%s'\n\n", command)
@@ -49,10 +88,20 @@ func main() {
 	}
 
 	cliapp.Before = func(c *cli.Context) error {
+		if err := setLogFormat(c.String("log-format")); err != nil {
+			logger.Error(err)
+			os.Exit(exitCodeConfig)
+		}
+		setQuiet(c.Bool("quiet"))
 		var err error
 		config, err = LoadConfig(c.String("config"))
 		if err != nil {
-			log.Fatal(err)
+			logger.Error(err)
+			os.Exit(exitCodeConfig)
+		}
+		setLogFile(config.Log)
+		if c.Bool("quiet") {
+			config.S3.DisableProgressBar = true
 		}
 		return nil
 	}
@@ -62,32 +111,224 @@ func main() {
 			Name:  "tables",
 			Usage: "Print all tables and exit",
 			Action: func(c *cli.Context) error {
-				return getTables(*config, c.Args())
+				return getTables(*config, c.Args(), c.String("output"))
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:  "output",
+					Value: "text",
+					Usage: "Output format, 'text' with [db].[table] per line or 'json' with engine and size of tables",
+				},
+			),
 		},
 		{
 			Name:        "freeze",
 			Usage:       "Freeze all or specific tables. You may use this syntax for specify tables [db].[table]",
 			Description: "Freeze tables",
 			Action: func(c *cli.Context) error {
-				return freeze(*config, c.Args(), c.Bool("dry-run") || c.GlobalBool("dry-run"))
+				return runCommand(ctx, metricsPushGateway(c), config.Notifications, c.Bool("json-summary"), "freeze", func(ctx context.Context) error {
+					return freeze(ctx, *config, newFreezeOptions(c), c.Bool("dry-run") || c.GlobalBool("dry-run"))
+				})
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags,
+				jsonSummaryFlag,
+				cli.StringSliceFlag{
+					Name:  "table",
+					Usage: "Select tables by [db].[table] pattern, the same as argument. Can be repeated and combined with arguments",
+				},
+				cli.BoolFlag{
+					Name:  "regex",
+					Usage: "Treat arguments as regular expressions which must match the whole [db].[table] name instead of glob patterns",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude",
+					Usage: "Skip tables matched by [db].[table] glob pattern even if they are matched by arguments. Can be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "schema-only",
+					Usage: "Don't freeze tables, only metadata will be backed up",
+				},
+				cli.StringSliceFlag{
+					Name:  "partition",
+					Usage: "Freeze only partition with specified ID as in system.parts, tables without it are skipped. Can be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "access",
+					Usage: "Save users, roles, grants and row policies to 'shadow/access', it's enabled by backup.access too",
+				},
+				cli.BoolFlag{
+					Name:  "all-engines",
+					Usage: "Freeze tables of all engines, by default tables of engines other than *MergeTree are skipped with warning",
+				},
+				cli.BoolTFlag{
+					Name:  "cleanup-on-failure",
+					Usage: "Remove partially frozen contents of 'shadow' if freeze fails, so the next freeze isn't blocked. --cleanup-on-failure=false keeps them for investigation",
+				},
+				cli.BoolFlag{
+					Name:  "reuse-shadow",
+					Usage: "Don't freeze again if 'shadow' is left by complete freeze of the same tables, it's moved to local backup as is. Other contents of 'shadow' are an error",
+				},
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "Name of local backup instead of time of freeze, it's used by upload as name of backup on s3",
+				},
+			),
+		},
+		{
+			Name:  "backup",
+			Usage: "Freeze all or specific tables and upload them to s3 in one run, the same as freeze and upload with one summary and notification",
+			Action: func(c *cli.Context) error {
+				dryRun := c.Bool("dry-run") || c.GlobalBool("dry-run")
+				return runCommand(ctx, metricsPushGateway(c), config.Notifications, c.Bool("json-summary"), "backup", func(ctx context.Context) error {
+					return withHooks(ctx, config.Hooks, "backup", c.String("name"), dryRun, func(ctx context.Context) error {
+						return backup(ctx, *config, newFreezeOptions(c), newUploadOptions(c), dryRun)
+					})
+				})
+			},
+			Flags: append(cliapp.Flags,
+				jsonSummaryFlag,
+				cli.StringSliceFlag{
+					Name:  "table",
+					Usage: "Select tables by [db].[table] pattern, the same as argument. Can be repeated and combined with arguments",
+				},
+				cli.BoolFlag{
+					Name:  "regex",
+					Usage: "Treat arguments as regular expressions which must match the whole [db].[table] name instead of glob patterns",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude",
+					Usage: "Skip tables matched by [db].[table] glob pattern even if they are matched by arguments. Can be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "partition",
+					Usage: "Freeze only partition with specified ID as in system.parts, tables without it are skipped. Can be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "access",
+					Usage: "Save users, roles, grants and row policies to 'shadow/access', it's enabled by backup.access too",
+				},
+				cli.BoolFlag{
+					Name:  "all-engines",
+					Usage: "Freeze tables of all engines, by default tables of engines other than *MergeTree are skipped with warning",
+				},
+				cli.BoolTFlag{
+					Name:  "cleanup-on-failure",
+					Usage: "Remove partially frozen contents of 'shadow' if freeze fails, so the next freeze isn't blocked. --cleanup-on-failure=false keeps them for investigation",
+				},
+				cli.BoolFlag{
+					Name:  "reuse-shadow",
+					Usage: "Don't freeze again if 'shadow' is left by complete freeze of the same tables, it's moved to local backup as is. Other contents of 'shadow' are an error",
+				},
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "Name of local backup and of backup on s3 instead of time of freeze",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Upload all files even if the same files are already on s3 according to s3.overwrite_strategy, backup with the same --name on s3 is overwritten",
+				},
+				cli.StringFlag{
+					Name:  "diff-from",
+					Usage: "Upload incremental backup against backup on s3, parts unchanged since it aren't uploaded again and are downloaded from it on restore. Only for tree strategy with timestamped layout",
+				},
+				cli.BoolFlag{
+					Name:  "clean-after-upload",
+					Usage: "Remove uploaded local backup after successful upload, it's enabled by backup.clean_after_upload too",
+				},
+				cli.BoolFlag{
+					Name:  "skip-replica",
+					Usage: "Don't copy uploaded backup to replica bucket",
+				},
+			),
 		},
 		{
 			Name:  "upload",
-			Usage: "Upload 'metadata' and 'shadows' directories to s3. Extra files on s3 will be deleted",
+			Usage: "Upload local backup created by freeze to s3, pass its name or the newest one is uploaded. Extra files on s3 will be deleted",
 			Action: func(c *cli.Context) error {
-				return upload(*config, c.Bool("dry-run") || c.GlobalBool("dry-run"))
+				dryRun := c.Bool("dry-run") || c.GlobalBool("dry-run")
+				hookName := c.Args().First()
+				if c.String("name") != "" {
+					hookName = c.String("name")
+				}
+				return runCommand(ctx, metricsPushGateway(c), config.Notifications, c.Bool("json-summary"), "upload", func(ctx context.Context) error {
+					return withHooks(ctx, config.Hooks, "backup", hookName, dryRun, func(ctx context.Context) error {
+						return upload(ctx, *config, newUploadOptions(c), dryRun)
+					})
+				})
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags,
+				jsonSummaryFlag,
+				cli.BoolFlag{
+					Name:  "schema-only",
+					Usage: "Upload only 'metadata' directory, backup can be used to create empty tables",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Upload all files even if the same files are already on s3 according to s3.overwrite_strategy, backup with the same --name on s3 is overwritten",
+				},
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "Name of backup on s3 instead of name of local backup or time of upload, local backup with this name is uploaded if it isn't passed as argument",
+				},
+				cli.StringFlag{
+					Name:  "diff-from",
+					Usage: "Upload incremental backup against backup on s3, parts unchanged since it aren't uploaded again and are downloaded from it on restore. Only for tree strategy with timestamped layout",
+				},
+				cli.BoolFlag{
+					Name:  "clean-after-upload",
+					Usage: "Remove uploaded local backup or contents of 'shadow' after successful upload, it's enabled by backup.clean_after_upload too",
+				},
+				cli.BoolFlag{
+					Name:  "skip-replica",
+					Usage: "Don't copy uploaded backup to replica bucket",
+				},
+			),
 		},
 		{
 			Name:  "download",
-			Usage: "Download 'metadata' and 'shadows' from s3 to backup folder",
+			Usage: "Download 'metadata' and 'shadows' from s3 to backup folder. Pass filename for archive strategy or backup name for tree strategy (the newest by default) and optionally [db].[table] patterns to download only these tables",
+			Action: func(c *cli.Context) error {
+				return runCommand(ctx, metricsPushGateway(c), config.Notifications, c.Bool("json-summary"), "download", func(ctx context.Context) error {
+					return download(ctx, *config, c.Args(), c.Bool("dry-run") || c.GlobalBool("dry-run"), c.String("chown"))
+				})
+			},
+			Flags: append(cliapp.Flags,
+				jsonSummaryFlag,
+				cli.StringFlag{
+					Name:  "chown",
+					Usage: "Set `user:group` owner of files extracted from archive instead of owner stored in archive, for tree strategy owner of the whole downloaded tree is changed",
+				},
+			),
+		},
+		{
+			Name:  "list",
+			Usage: "Print list of backups on s3 from newest to oldest and exit",
 			Action: func(c *cli.Context) error {
-				return download(*config, c.Args(), c.Bool("dry-run") || c.GlobalBool("dry-run"))
+				return list(*config)
+			},
+			Flags: cliapp.Flags,
+		},
+		{
+			Name:  "size",
+			Usage: "Print size of 'metadata' and 'shadows' which will be uploaded, hard links are counted once, and size of all objects on s3",
+			Action: func(c *cli.Context) error {
+				return backupSize(*config)
+			},
+			Flags: cliapp.Flags,
+		},
+		{
+			Name:  "delete",
+			Usage: "Delete specific backup from s3",
+			Action: func(c *cli.Context) error {
+				return deleteBackup(*config, c.Args(), c.Bool("dry-run") || c.GlobalBool("dry-run"))
+			},
+			Flags: cliapp.Flags,
+		},
+		{
+			Name:  "verify",
+			Usage: "Verify checksums of backup on s3 without restoring. Pass filename for archive strategy",
+			Action: func(c *cli.Context) error {
+				return verify(ctx, *config, c.Args())
 			},
 			Flags: cliapp.Flags,
 		},
@@ -95,7 +336,36 @@ func main() {
 			Name:  "create-tables",
 			Usage: "Create databases and tables from backup metadata",
 			Action: func(c *cli.Context) error {
-				return createTables(*config, c.Args(), c.Bool("dry-run") || c.GlobalBool("dry-run"))
+				return createTables(*config, c.Args(), c.Bool("dry-run") || c.GlobalBool("dry-run"), c.StringSlice("restore-database-mapping"), c.StringSlice("restore-table-mapping"), c.Bool("force"), c.Bool("fail-fast"), c.String("target-data-path"))
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringSliceFlag{
+					Name:  "restore-database-mapping",
+					Usage: "Create tables of database 'old' in database 'new', format is old=new. Can be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "restore-table-mapping",
+					Usage: "Create table 'old_db.old_table' as 'new_db.new_table', format is old_db.old_table=new_db.new_table. Can be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Keep existing tables which tables are mapped to instead of failing",
+				},
+				cli.BoolFlag{
+					Name:  "fail-fast",
+					Usage: "Stop on the first database or table which can't be created, by default all failed ones are reported at the end",
+				},
+				cli.StringFlag{
+					Name:  "target-data-path",
+					Usage: "Use this data path of recovery instance instead of data path of connected clickhouse, backup is read from its backup directory",
+				},
+			),
+		},
+		{
+			Name:  "restore-access",
+			Usage: "Create users, roles and row policies and add grants from downloaded backup, existing ones are kept",
+			Action: func(c *cli.Context) error {
+				return restoreAccess(*config, c.Bool("dry-run") || c.GlobalBool("dry-run"))
 			},
 			Flags: cliapp.Flags,
 		},
@@ -103,13 +373,28 @@ func main() {
 			Name:  "restore",
 			Usage: "Copy data from 'backup' to 'detached' folder and execute ATTACH. You can specify tables [db].[table] and increments via -i flag",
 			Action: func(c *cli.Context) error {
-				return restore(*config, c.Args(), c.Bool("dry-run") || c.GlobalBool("dry-run"), c.IntSlice("i"), c.Bool("m"))
+				dryRun := c.Bool("dry-run") || c.GlobalBool("dry-run")
+				return runCommand(ctx, metricsPushGateway(c), config.Notifications, c.Bool("json-summary"), "restore", func(ctx context.Context) error {
+					opts := newRestoreOptions(c)
+					return withHooks(ctx, config.Hooks, "restore", restoreBackupName(*config, opts.TargetDataPath), dryRun, func(ctx context.Context) error {
+						return restore(*config, opts, dryRun)
+					})
+				})
 			},
 			Flags: append(cliapp.Flags,
+				jsonSummaryFlag,
 				cli.IntSliceFlag{
 					Name:   "increments, i",
 					Hidden: false,
 				},
+				cli.BoolFlag{
+					Name:  "latest-increment",
+					Usage: "Restore only the increment with the highest number of every selected table",
+				},
+				cli.StringSliceFlag{
+					Name:  "table",
+					Usage: "Select tables by [db].[table] pattern, the same as argument. Can be repeated and combined with arguments",
+				},
 				cli.BoolFlag{
 					Name:   "deprecated, d",
 					Hidden: false,
@@ -120,8 +405,69 @@ func main() {
 					Hidden: false,
 					Usage:  "Set this flag to move backup data during partition attach instead of copy. This will reduce disk usage.",
 				},
+				cli.StringSliceFlag{
+					Name:  "restore-database-mapping",
+					Usage: "Restore tables of database 'old' into database 'new', format is old=new. Can be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "restore-table-mapping",
+					Usage: "Restore table 'old_db.old_table' into 'new_db.new_table', format is old_db.old_table=new_db.new_table. Can be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Restore into tables which tables are mapped to even if they already have rows",
+				},
+				cli.BoolFlag{
+					Name:  "regex",
+					Usage: "Treat arguments as regular expressions which must match the whole [db].[table] name instead of glob patterns",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude",
+					Usage: "Skip tables matched by [db].[table] glob pattern even if they are matched by arguments. Can be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "data-only",
+					Usage: "Restore only data into existing tables, all tables are checked before copying any data",
+				},
+				cli.StringSliceFlag{
+					Name:  "partition",
+					Usage: "Restore only partition with specified ID as in system.parts, for example 201901 or 20190125. Can be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "verify",
+					Usage: "Compare rows count of restored tables with rows count of frozen parts from backup manifest",
+				},
+				cli.StringFlag{
+					Name:  "replica-restore-mode",
+					Value: "single",
+					Usage: "'single' restores data of replicated tables only on active replica with the first name in ZooKeeper, other replicas fetch it, 'all' restores data on every replica",
+				},
+				cli.BoolFlag{
+					Name:  "zero-copy",
+					Usage: "Write parts of remote disks (s3, hdfs, azure_blob_storage) to detached directly, they reference objects in object storage of disk which must still exist",
+				},
+				cli.StringFlag{
+					Name:  "target-data-path",
+					Usage: "Use this data path of recovery instance instead of data path of connected clickhouse, backup is read from its backup directory",
+				},
 			),
 		},
+		{
+			Name:  "server",
+			Usage: "Run freeze, upload and clean by backup.schedule until SIGINT or SIGTERM",
+			Action: func(c *cli.Context) error {
+				return server(ctx, *config, metricsPushGateway(c), c.Bool("dry-run") || c.GlobalBool("dry-run"))
+			},
+			Flags: cliapp.Flags,
+		},
+		{
+			Name:  "config-check",
+			Usage: "Check config, connection to clickhouse and access to s3 bucket without changing anything, exit code is not zero if any check fails",
+			Action: func(c *cli.Context) error {
+				return configCheck(ctx, *config)
+			},
+			Flags: cliapp.Flags,
+		},
 		{
 			Name:  "default-config",
 			Usage: "Print default config and exit",
@@ -132,251 +478,1999 @@ func main() {
 		},
 		{
 			Name:  "clean",
-			Usage: "Clean backup data from shadow folder",
+			Usage: "Clean backup data from shadow folder and remove local backups, pass timestamps to remove only specified local backups",
 			Action: func(c *cli.Context) error {
-				return clean(*config, c.Bool("dry-run") || c.GlobalBool("dry-run"))
+				dryRun := c.Bool("dry-run") || c.GlobalBool("dry-run")
+				if !dryRun && !c.Bool("yes") {
+					return fmt.Errorf("clean removes shadow and local backups which may be not uploaded yet, pass --yes to confirm or --dry-run to see what will be removed")
+				}
+				return clean(*config, c.Args(), dryRun)
 			},
-			Flags: cliapp.Flags,
+			Flags: append(cliapp.Flags,
+				cli.BoolFlag{
+					Name:   "yes, y",
+					Usage:  "Confirm removal, clean without --dry-run fails without it",
+					EnvVar: "CLICKHOUSE_BACKUP_CLEAN_YES",
+				},
+			),
 		},
 	}
 	if err := cliapp.Run(os.Args); err != nil {
-		log.Fatal(err)
+		if ctx.Err() != nil {
+			logger.Infof("%v: %v", errCanceled, err)
+			os.Exit(exitCodeCanceled)
+		}
+		code := exitCode(err)
+		if code == exitCodeNothingToDo {
+			logger.Info(err)
+		} else {
+			logger.Error(err)
+		}
+		os.Exit(code)
 	}
 }
 
-func parseArgsForFreeze(tables []Table, args []string) ([]Table, error) {
-	if len(args) == 0 {
-		return tables, nil
-	}
-	var result []Table
-	for _, arg := range args {
-		for _, t := range tables {
-			if matched, _ := filepath.Match(arg, fmt.Sprintf("%s.%s", t.Database, t.Name)); matched {
-				result = append(result, t)
-			}
-		}
-	}
-	return result, nil
+// tableArgs - [db].[table] patterns passed as arguments and by --table flags
+func tableArgs(c *cli.Context) []string {
+	return append(append([]string{}, c.Args()...), c.StringSlice("table")...)
 }
 
-func parseArgsForRestore(tables map[string]BackupTable, args []string, increments []int) ([]BackupTable, error) {
-	if len(args) == 0 {
-		args = []string{"*"}
+// jsonSummaryFlag - flag of commands which can print JSON summary of run
+var jsonSummaryFlag = cli.BoolFlag{
+	Name:  "json-summary",
+	Usage: "Print JSON object {command, backup_name, status, bytes, files, duration, error} to stdout when command is finished, also on failure",
+}
+
+// newFreezeOptions - options of freeze and of freeze part of backup by flags of command
+func newFreezeOptions(c *cli.Context) freezeOptions {
+	return freezeOptions{
+		Tables:           tableArgs(c),
+		Excludes:         c.StringSlice("exclude"),
+		UseRegex:         c.Bool("regex"),
+		SchemaOnly:       c.Bool("schema-only"),
+		Partitions:       c.StringSlice("partition"),
+		Access:           config.Backup.Access || c.Bool("access"),
+		Name:             c.String("name"),
+		AllEngines:       c.Bool("all-engines"),
+		CleanupOnFailure: c.BoolT("cleanup-on-failure"),
+		ReuseShadow:      c.Bool("reuse-shadow"),
 	}
-	result := []BackupTable{}
-	for _, arg := range args {
-		for _, t := range tables {
-			tableName := fmt.Sprintf("%s.%s", t.Database, t.Name)
-			if matched, _ := filepath.Match(arg, tableName); matched {
-				if len(increments) == 0 {
-					result = append(result, t)
-					continue
-				}
-				for _, n := range increments {
-					if n == t.Increment {
-						result = append(result, t)
-						break
-					}
-				}
-			}
-		}
+}
+
+// newUploadOptions - options of upload and of upload part of backup by flags of command,
+// arguments are names of local backups
+func newUploadOptions(c *cli.Context) uploadOptions {
+	return uploadOptions{
+		Backups:          c.Args(),
+		SchemaOnly:       c.Bool("schema-only"),
+		Force:            c.Bool("force"),
+		CleanAfterUpload: config.Backup.CleanAfterUpload || c.Bool("clean-after-upload"),
+		SkipReplica:      c.Bool("skip-replica"),
+		Name:             c.String("name"),
+		DiffFrom:         c.String("diff-from"),
 	}
-	return result, nil
 }
 
-func parseArgsForDownload(args []string) (filename string) {
-	if len(args) == 1 {
-		filename = args[0]
+// newRestoreOptions - options of restore by flags of command
+func newRestoreOptions(c *cli.Context) restoreOptions {
+	return restoreOptions{
+		Tables:             tableArgs(c),
+		Increments:         c.IntSlice("i"),
+		LatestIncrement:    c.Bool("latest-increment"),
+		Move:               c.Bool("m"),
+		DatabaseMapping:    c.StringSlice("restore-database-mapping"),
+		TableMapping:       c.StringSlice("restore-table-mapping"),
+		Excludes:           c.StringSlice("exclude"),
+		UseRegex:           c.Bool("regex"),
+		DataOnly:           c.Bool("data-only"),
+		Partitions:         c.StringSlice("partition"),
+		Verify:             c.Bool("verify"),
+		Force:              c.Bool("force"),
+		ReplicaRestoreMode: c.String("replica-restore-mode"),
+		ZeroCopy:           c.Bool("zero-copy"),
+		TargetDataPath:     c.String("target-data-path"),
 	}
-	return
 }
 
-func getTables(config Config, args []string) error {
-	ch := &ClickHouse{
-		Config: &config.ClickHouse,
+// metricsPushGateway - return url of Prometheus Pushgateway from command or global flag
+func metricsPushGateway(c *cli.Context) string {
+	if gateway := c.String("metrics-push-gateway"); gateway != "" {
+		return gateway
 	}
+	return c.GlobalString("metrics-push-gateway")
+}
 
-	if err := ch.Connect(); err != nil {
-		return fmt.Errorf("can't connect to clickouse with: %v", err)
+// tableMatcher - matches [db].[table] names against glob or regexp patterns
+type tableMatcher struct {
+	globs   []string
+	regexps []*regexp.Regexp
+}
+
+// newTableMatcher - compile patterns, regexps must match the whole [db].[table] name
+func newTableMatcher(patterns []string, useRegex bool) (*tableMatcher, error) {
+	m := &tableMatcher{}
+	for _, pattern := range patterns {
+		if useRegex {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid table regexp '%s': %v", pattern, err)
+			}
+			m.regexps = append(m.regexps, re)
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid table pattern '%s': %v", pattern, err)
+		}
+		m.globs = append(m.globs, pattern)
 	}
-	defer ch.Close()
+	return m, nil
+}
 
-	allTables, err := ch.GetTables()
-	if err != nil {
-		return fmt.Errorf("can't get tables with: %v", err)
+// Match - check if [db].[table] name matches any of patterns
+func (m *tableMatcher) Match(database string, table string) bool {
+	name := fmt.Sprintf("%s.%s", database, table)
+	for _, glob := range m.globs {
+		if matched, _ := filepath.Match(glob, name); matched {
+			return true
+		}
 	}
-	for _, table := range allTables {
-		fmt.Printf("%s.%s\n", table.Database, table.Name)
+	for _, re := range m.regexps {
+		if re.MatchString(name) {
+			return true
+		}
 	}
-	return nil
+	return false
 }
 
-func createTables(config Config, args []string, dryRun bool) error {
-	ch := &ClickHouse{
-		DryRun: dryRun,
-		Config: &config.ClickHouse,
+// newTableFilter - return include and exclude matchers, excludes are always glob patterns
+func newTableFilter(args []string, excludes []string, useRegex bool) (*tableMatcher, *tableMatcher, error) {
+	include, err := newTableMatcher(args, useRegex)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	if err := ch.Connect(); err != nil {
-		return fmt.Errorf("can't connect to clickouse with: %v", err)
+	exclude, err := newTableMatcher(excludes, false)
+	if err != nil {
+		return nil, nil, err
 	}
-	defer ch.Close()
+	return include, exclude, nil
+}
 
-	dataPath, err := ch.GetDataPath()
-	if err != nil || dataPath == "" {
-		return fmt.Errorf("can't get data path from clickhouse with: %v\nyou can set data_path in config file", err)
+// parseArgsForFreeze - select tables to freeze, tables of skipDatabases are selected only
+// if their database is named explicitly by one of patterns
+func parseArgsForFreeze(tables []Table, args []string, excludes []string, useRegex bool, skipDatabases []string) ([]Table, error) {
+	if len(args) == 0 {
+		args = []string{"*"}
+		useRegex = false
 	}
-	log.Printf("Found clickhouse data path: %s", dataPath)
-
-	metadataPath := path.Join(dataPath, "backup", "metadata")
-	log.Printf("Will analyze restored metadata from here: %s", metadataPath)
-
-	// for each dir in metadataPath (database name)
-	// except system execute scripts
-	files, err := ioutil.ReadDir(metadataPath)
+	include, exclude, err := newTableFilter(args, excludes, useRegex)
 	if err != nil {
-		return fmt.Errorf("can't read metadata directory for creating tables: %v", err)
+		return nil, err
 	}
+	var result []Table
+	for _, t := range tables {
+		if isSkippedDatabase(skipDatabases, t.Database) && !isDatabaseNamed(args, t.Database, useRegex) {
+			continue
+		}
+		if include.Match(t.Database, t.Name) && !exclude.Match(t.Database, t.Name) {
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
 
-	var distributedTables []RestoreTable
-	for _, file := range files {
-		if file.IsDir() {
-			databaseName := file.Name()
-			if databaseName == "system" {
-				// do not touch system database
-				continue
-			}
-			log.Printf("Found metadata files for database: %s", databaseName)
-			ch.CreateDatabase(databaseName)
-			databaseDir := path.Join(metadataPath, databaseName)
-			log.Printf("Will analyze table information from here: %s", databaseDir)
-			tableFiles, err := ioutil.ReadDir(databaseDir)
-			if err != nil {
-				return fmt.Errorf("can't read database directory in metadata dir: %v", err)
-			}
-			for _, table := range tableFiles {
-				if strings.HasSuffix(table.Name(), "sql") {
-					tablePath := path.Join(databaseDir, table.Name())
-					log.Printf("Found table: %s", tablePath)
-					dat, err := ioutil.ReadFile(tablePath)
-					if err != nil {
-						return fmt.Errorf("can't read file %s: %v", tablePath, err)
-					}
-					tableCreateQuery := strings.Replace(string(dat), "ATTACH", "CREATE", 1)
-
-					if strings.Contains(tableCreateQuery, "ENGINE = Distributed") {
-						// distributed engine tables should be created last
-						// because they are based on real tables
-						log.Printf("This is a distributed table, saving for later")
-						distributedTables = append(distributedTables, RestoreTable{
-							Database: databaseName,
-							Query:    tableCreateQuery,
-						})
-					} else {
-						if err := ch.CreateTable(RestoreTable{
-							Database: databaseName,
-							Query:    tableCreateQuery,
-						}); err != nil {
-							log.Printf("ERROR Table creation failed: %v", err)
-							// continue to other tables
-						}
-					}
-				}
-			}
+// filterFreezableTables - split tables into MergeTree family tables which data can be frozen and other tables
+// like Kafka, Dictionary, View or Memory, table with unknown engine is considered freezable
+func filterFreezableTables(tables []Table) (freezable []Table, skipped []Table) {
+	for _, t := range tables {
+		if t.Engine == "" || strings.HasSuffix(t.Engine, "MergeTree") {
+			freezable = append(freezable, t)
+			continue
 		}
+		skipped = append(skipped, t)
 	}
-	log.Printf("Creating distributed tables")
-	for _, table := range distributedTables {
-		if err := ch.CreateTable(table); err != nil {
-			log.Printf("ERROR Table creation failed: %v", err) // continue to other tables
+	return freezable, skipped
+}
+
+// withoutTables - tables except excluded ones
+func withoutTables(tables []Table, excluded []Table) []Table {
+	skip := make(map[string]bool)
+	for _, t := range excluded {
+		skip[t.Database+"."+t.Name] = true
+	}
+	var result []Table
+	for _, t := range tables {
+		if !skip[t.Database+"."+t.Name] {
+			result = append(result, t)
 		}
 	}
-	return nil
+	return result
 }
 
-func freeze(config Config, args []string, dryRun bool) error {
-	ch := &ClickHouse{
-		DryRun: dryRun,
-		Config: &config.ClickHouse,
+// isSkippedDatabase - check if database is in clickhouse.skip_databases
+func isSkippedDatabase(skipDatabases []string, database string) bool {
+	for _, name := range skipDatabases {
+		if name == database {
+			return true
+		}
 	}
+	return false
+}
 
-	if err := ch.Connect(); err != nil {
-		return fmt.Errorf("can't connect to clickouse with: %v", err)
+// isDatabaseNamed - check if any of patterns starts with literal database name
+func isDatabaseNamed(patterns []string, database string, useRegex bool) bool {
+	prefix := database + "."
+	if useRegex {
+		prefix = regexp.QuoteMeta(database) + "\\."
+	}
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseArgsForRestore - select tables and increments to restore, only the newest increment of every table is kept
+// if latestIncrement is set. Only specified partitions are kept if partitions are passed and every of them must be found
+// in selected tables
+func parseArgsForRestore(tables map[string]BackupTable, args []string, excludes []string, increments []int, latestIncrement bool, useRegex bool, partitions []string) ([]BackupTable, error) {
+	if len(args) == 0 {
+		args = []string{"*"}
+		useRegex = false
+	}
+	include, exclude, err := newTableFilter(args, excludes, useRegex)
+	if err != nil {
+		return nil, err
+	}
+	result := []BackupTable{}
+	for _, t := range tables {
+		if !include.Match(t.Database, t.Name) || exclude.Match(t.Database, t.Name) {
+			continue
+		}
+		if len(increments) == 0 {
+			result = append(result, t)
+			continue
+		}
+		for _, n := range increments {
+			if n == t.Increment {
+				result = append(result, t)
+				break
+			}
+		}
+	}
+	if latestIncrement {
+		result = latestIncrements(result)
+	}
+	if len(partitions) > 0 {
+		if result, err = filterPartitions(result, partitions); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// latestIncrements - keep only increment with the highest number of every table
+func latestIncrements(tables []BackupTable) []BackupTable {
+	latest := make(map[string]BackupTable)
+	for _, t := range tables {
+		name := t.Database + "." + t.Name
+		if l, ok := latest[name]; !ok || t.Increment > l.Increment {
+			latest[name] = t
+		}
+	}
+	result := make([]BackupTable, 0, len(latest))
+	for _, t := range tables {
+		if latest[t.Database+"."+t.Name].Increment == t.Increment {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// filterPartitions - keep only parts of specified partition IDs, tables without such parts are dropped
+func filterPartitions(tables []BackupTable, partitions []string) ([]BackupTable, error) {
+	wanted := make(map[string]bool)
+	for _, id := range partitions {
+		wanted[id] = false
+	}
+	result := []BackupTable{}
+	for _, t := range tables {
+		var parts []BackupPartition
+		for _, partition := range t.Partitions {
+			id := partitionID(partition.Name)
+			if _, ok := wanted[id]; ok {
+				wanted[id] = true
+				parts = append(parts, partition)
+			}
+		}
+		if len(parts) > 0 {
+			t.Partitions = parts
+			result = append(result, t)
+		}
+	}
+	for _, id := range partitions {
+		if !wanted[id] {
+			return nil, fmt.Errorf("partition '%s' is not found in backup of selected tables", id)
+		}
+	}
+	return result, nil
+}
+
+// parseDatabaseMapping - parse old=new pairs and check that every old database is present in backup
+func parseDatabaseMapping(values []string, databases map[string]bool) (map[string]string, error) {
+	mapping := make(map[string]string)
+	targets := make(map[string]string)
+	for _, value := range values {
+		pair := strings.SplitN(value, "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, fmt.Errorf("invalid database mapping '%s', format is old=new", value)
+		}
+		oldName, newName := pair[0], pair[1]
+		if !databases[oldName] {
+			return nil, fmt.Errorf("database '%s' from mapping '%s' is not present in backup", oldName, value)
+		}
+		if target, ok := mapping[oldName]; ok && target != newName {
+			return nil, fmt.Errorf("database '%s' is mapped to both '%s' and '%s'", oldName, target, newName)
+		}
+		if source, ok := targets[newName]; ok && source != oldName {
+			return nil, fmt.Errorf("databases '%s' and '%s' are both mapped to '%s'", source, oldName, newName)
+		}
+		mapping[oldName] = newName
+		targets[newName] = oldName
+	}
+	for newName, oldName := range targets {
+		if _, ok := mapping[newName]; databases[newName] && !ok {
+			return nil, fmt.Errorf("database '%s' is mapped to '%s' which is also present in backup", oldName, newName)
+		}
+	}
+	return mapping, nil
+}
+
+// setTargetDataPath - use targetDataPath instead of data path of clickhouse, backup is read from backup directory
+// of this path and data is copied to detached directories of default disk in it, so backup can be restored
+// into separate recovery instance
+func setTargetDataPath(config *Config, targetDataPath string) error {
+	if targetDataPath == "" {
+		return nil
+	}
+	if err := checkWritableDir("--target-data-path", targetDataPath); err != nil {
+		return err
+	}
+	logger.Infof("Use %s instead of data path of clickhouse", targetDataPath)
+	config.ClickHouse.DataPath = strings.TrimSuffix(targetDataPath, "/")
+	return nil
+}
+
+// restoreBackupName - name of backup which is downloaded to backup directory and is restored from it,
+// it's empty if backup isn't downloaded by download command. Errors are reported by restore itself
+func restoreBackupName(config Config, targetDataPath string) string {
+	dataPath := strings.TrimSuffix(targetDataPath, "/")
+	if dataPath == "" {
+		ch := &ClickHouse{Config: &config.ClickHouse}
+		if err := ch.Connect(); err != nil {
+			return ""
+		}
+		defer ch.Close()
+		var err error
+		if dataPath, err = ch.GetDataPath(); err != nil {
+			return ""
+		}
+	}
+	manifest, err := LoadBackupManifest(path.Join(dataPath, config.ClickHouse.BackupDir, manifestName))
+	if err != nil || manifest == nil {
+		return ""
+	}
+	return manifest.Name
+}
+
+// tableTarget - database and name of table which backup table is restored into
+type tableTarget struct {
+	Database string
+	Name     string
+}
+
+// restoreMapping - databases and tables which are restored under other names
+type restoreMapping struct {
+	databases map[string]string
+	tables    map[string]tableTarget
+}
+
+// parseRestoreMapping - parse database and table mappings, tables are keyed by <db>.<table> in backup
+func parseRestoreMapping(databaseValues []string, tableValues []string, tables map[string]bool) (restoreMapping, error) {
+	databases := make(map[string]bool)
+	for table := range tables {
+		databases[strings.SplitN(table, ".", 2)[0]] = true
+	}
+	databaseMapping, err := parseDatabaseMapping(databaseValues, databases)
+	if err != nil {
+		return restoreMapping{}, err
+	}
+	tableMapping, err := parseTableMapping(tableValues, tables)
+	if err != nil {
+		return restoreMapping{}, err
+	}
+	return restoreMapping{databases: databaseMapping, tables: tableMapping}, nil
+}
+
+// parseTableMapping - parse old_db.old_table=new_db.new_table pairs and check that every old table is present in backup
+func parseTableMapping(values []string, tables map[string]bool) (map[string]tableTarget, error) {
+	mapping := make(map[string]tableTarget)
+	targets := make(map[string]string)
+	for _, value := range values {
+		pair := strings.SplitN(value, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid table mapping '%s', format is old_db.old_table=new_db.new_table", value)
+		}
+		oldName, newName := strings.SplitN(pair[0], ".", 2), strings.SplitN(pair[1], ".", 2)
+		if len(oldName) != 2 || len(newName) != 2 || oldName[0] == "" || oldName[1] == "" || newName[0] == "" || newName[1] == "" {
+			return nil, fmt.Errorf("invalid table mapping '%s', format is old_db.old_table=new_db.new_table", value)
+		}
+		source, target := pair[0], tableTarget{Database: newName[0], Name: newName[1]}
+		if !tables[source] {
+			return nil, fmt.Errorf("table '%s' from mapping '%s' is not present in backup", source, value)
+		}
+		if existing, ok := mapping[source]; ok && existing != target {
+			return nil, fmt.Errorf("table '%s' is mapped to both '%s.%s' and '%s'", source, existing.Database, existing.Name, pair[1])
+		}
+		if existing, ok := targets[pair[1]]; ok && existing != source {
+			return nil, fmt.Errorf("tables '%s' and '%s' are both mapped to '%s'", existing, source, pair[1])
+		}
+		mapping[source] = target
+		targets[pair[1]] = source
+	}
+	for newName, oldName := range targets {
+		if _, ok := mapping[newName]; tables[newName] && !ok {
+			return nil, fmt.Errorf("table '%s' is mapped to '%s' which is also present in backup", oldName, newName)
+		}
+	}
+	return mapping, nil
+}
+
+// target - database and name of table to restore into, table mapping takes precedence over database mapping
+func (m restoreMapping) target(database string, name string) (string, string) {
+	if target, ok := m.tables[database+"."+name]; ok {
+		return target.Database, target.Name
+	}
+	return mapDatabase(m.databases, database), name
+}
+
+// mapDatabase - return name of database to restore into
+func mapDatabase(mapping map[string]string, database string) string {
+	if newName, ok := mapping[database]; ok {
+		return newName
+	}
+	return database
+}
+
+// mapDatabaseInQuery - replace references to tables in oldName database with newName in create query
+func mapDatabaseInQuery(query string, oldName string, newName string) string {
+	qualified := regexp.MustCompile("(^|[^\\w.`])(`?)" + regexp.QuoteMeta(oldName) + "(`?)\\.")
+	query = qualified.ReplaceAllString(query, "${1}${2}"+newName+"${3}.")
+	distributed := regexp.MustCompile("(Distributed\\(\\s*[^,]+,\\s*)(['`]?)" + regexp.QuoteMeta(oldName) + "(['`]?\\s*,)")
+	return distributed.ReplaceAllString(query, "${1}${2}"+newName+"${3}")
+}
+
+// uuidRe - UUID clause of table in Atomic database which must be unique
+var uuidRe = regexp.MustCompile(`^\s+UUID\s+'[^']*'`)
+
+// replicatedPathRe - ZooKeeper path of replicated table which is the first argument of engine
+var replicatedPathRe = regexp.MustCompile(`(Replicated\w*MergeTree\s*\(\s*')([^']*)(')`)
+
+// renameTableInQuery - create table as database.name instead of oldDatabase.oldName, UUID is removed
+// and ZooKeeper path of replicated table is changed, so restored table isn't a replica of the source table
+func renameTableInQuery(query string, oldDatabase string, oldName string, database string, name string) (string, error) {
+	match := createObjectRe.FindStringSubmatchIndex(query)
+	if match == nil {
+		return "", fmt.Errorf("can't find name of table in create query of %s.%s", oldDatabase, oldName)
+	}
+	rest := uuidRe.ReplaceAllString(query[match[1]:], "")
+	query = query[:match[4]] + fmt.Sprintf("`%s`.`%s`", database, name) + rest
+	var pathErr error
+	query = replicatedPathRe.ReplaceAllStringFunc(query, func(engine string) string {
+		parts := replicatedPathRe.FindStringSubmatch(engine)
+		segments := strings.Split(parts[2], "/")
+		renamed := false
+		for i, segment := range segments {
+			switch segment {
+			case oldName:
+				segments[i] = name
+				renamed = true
+			case oldDatabase:
+				segments[i] = database
+			case "{table}", "{uuid}":
+				renamed = true
+			}
+		}
+		if !renamed {
+			pathErr = fmt.Errorf("replication path '%s' of %s.%s doesn't contain name of table, restored table would be its replica", parts[2], oldDatabase, oldName)
+		}
+		return parts[1] + strings.Join(segments, "/") + parts[3]
+	})
+	return query, pathErr
+}
+
+// parseArgsForDownload - backup name and [db].[table] patterns of tables from arguments, empty name means the latest backup,
+// tables can be selected only in backup with archive_granularity table
+func parseArgsForDownload(args []string) (filename string, tables []string) {
+	if len(args) > 0 {
+		return args[0], args[1:]
+	}
+	return "", nil
+}
+
+// parseArgsForDownloadTree - backup name and [db].[table] patterns of tables to download, first argument is
+// backup name for timestamped layout, there is only one backup in flat layout so all arguments are tables
+func parseArgsForDownloadTree(config Config, args []string) (name string, tables []string) {
+	if config.Backup.TreeLayout == "flat" {
+		return "", args
+	}
+	if len(args) > 0 {
+		return args[0], args[1:]
+	}
+	return "", nil
+}
+
+// tableInfo - table in json output of tables command
+type tableInfo struct {
+	Database   string `json:"database"`
+	Name       string `json:"name"`
+	Engine     string `json:"engine"`
+	TotalBytes int64  `json:"total_bytes"`
+}
+
+func getTables(config Config, args []string, output string) error {
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unknown output format '%s' it can be 'text', 'json'", output)
+	}
+	ch := &ClickHouse{
+		Config: &config.ClickHouse,
+	}
+
+	if err := ch.Connect(); err != nil {
+		return connectionError(fmt.Errorf("can't connect to clickouse with: %v", err))
+	}
+	defer ch.Close()
+
+	allTables, err := ch.GetTables()
+	if err != nil {
+		return fmt.Errorf("can't get tables with: %v", err)
+	}
+	if output == "json" {
+		sizes, err := ch.GetTableSizes()
+		if err != nil {
+			return err
+		}
+		result := make([]tableInfo, len(allTables))
+		for i, table := range allTables {
+			result[i] = tableInfo{
+				Database:   table.Database,
+				Name:       table.Name,
+				Engine:     table.Engine,
+				TotalBytes: sizes[table.Database+"."+table.Name],
+			}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	for _, table := range allTables {
+		fmt.Printf("%s.%s\n", table.Database, table.Name)
+	}
+	return nil
+}
+
+func createTables(config Config, args []string, dryRun bool, databaseMappingArgs []string, tableMappingArgs []string, force bool, failFast bool, targetDataPath string) error {
+	if err := setTargetDataPath(&config, targetDataPath); err != nil {
+		return err
+	}
+	ch := &ClickHouse{
+		DryRun: dryRun,
+		Config: &config.ClickHouse,
+	}
+
+	if err := ch.Connect(); err != nil {
+		return connectionError(fmt.Errorf("can't connect to clickouse with: %v", err))
+	}
+	defer ch.Close()
+
+	dataPath, err := ch.GetDataPath()
+	if err != nil || dataPath == "" {
+		return fmt.Errorf("can't get data path from clickhouse with: %v\nyou can set data_path in config file", err)
+	}
+	logger.Infof("Found clickhouse data path: %s", dataPath)
+
+	metadataPath := path.Join(dataPath, config.ClickHouse.BackupDir, "metadata")
+	logger.Infof("Will analyze restored metadata from here: %s", metadataPath)
+	manifest, err := LoadBackupManifest(path.Join(dataPath, config.ClickHouse.BackupDir, manifestName))
+	if err != nil {
+		return fmt.Errorf("can't read backup manifest: %v", err)
+	}
+	if manifest != nil {
+		if err := manifest.ValidateMetadata(metadataPath); err != nil {
+			return fmt.Errorf("backup is incomplete: %v", err)
+		}
+	}
+
+	// for each dir in metadataPath (database name)
+	// except system execute scripts
+	files, err := ioutil.ReadDir(metadataPath)
+	if err != nil {
+		return fmt.Errorf("can't read metadata directory for creating tables: %v", err)
+	}
+	backupDatabases := make(map[string]bool)
+	backupTables := make(map[string]bool)
+	for _, file := range files {
+		if file.IsDir() {
+			backupDatabases[file.Name()] = true
+			tableFiles, err := ioutil.ReadDir(path.Join(metadataPath, file.Name()))
+			if err != nil {
+				return fmt.Errorf("can't read database directory in metadata dir: %v", err)
+			}
+			for _, table := range tableFiles {
+				if strings.HasSuffix(table.Name(), ".sql") {
+					backupTables[file.Name()+"."+strings.TrimSuffix(table.Name(), ".sql")] = true
+				}
+			}
+		}
+	}
+	databaseMapping, err := parseDatabaseMapping(databaseMappingArgs, backupDatabases)
+	if err != nil {
+		return err
+	}
+	tableMapping, err := parseTableMapping(tableMappingArgs, backupTables)
+	if err != nil {
+		return err
+	}
+
+	failures := &createFailures{failFast: failFast}
+	var distributedTables, views []RestoreTable
+	for _, file := range files {
+		if file.IsDir() {
+			databaseName := file.Name()
+			if databaseName == "system" {
+				// do not touch system database
+				continue
+			}
+			logger.Infof("Found metadata files for database: %s", databaseName)
+			targetDatabase := mapDatabase(databaseMapping, databaseName)
+			if targetDatabase != databaseName {
+				logger.Infof("Database %s will be created as %s", databaseName, targetDatabase)
+			}
+			if err := failures.add("Database", targetDatabase, ch.CreateDatabase(targetDatabase)); err != nil {
+				return err
+			}
+			databaseDir := path.Join(metadataPath, databaseName)
+			logger.Infof("Will analyze table information from here: %s", databaseDir)
+			tableFiles, err := ioutil.ReadDir(databaseDir)
+			if err != nil {
+				return fmt.Errorf("can't read database directory in metadata dir: %v", err)
+			}
+			for _, table := range tableFiles {
+				if strings.HasSuffix(table.Name(), "sql") {
+					tablePath := path.Join(databaseDir, table.Name())
+					logger.WithField("path", tablePath).Info("Found table")
+					dat, err := ioutil.ReadFile(tablePath)
+					if err != nil {
+						return fmt.Errorf("can't read file %s: %v", tablePath, err)
+					}
+					tableCreateQuery := strings.Replace(string(dat), "ATTACH", "CREATE", 1)
+					for oldName, newName := range databaseMapping {
+						tableCreateQuery = mapDatabaseInQuery(tableCreateQuery, oldName, newName)
+					}
+					tableDatabase := targetDatabase
+					tableName := strings.TrimSuffix(table.Name(), ".sql")
+					if target, ok := tableMapping[databaseName+"."+tableName]; ok {
+						engine, err := ch.GetTableEngine(target.Database, target.Name)
+						if err != nil {
+							return err
+						}
+						if engine != "" {
+							if !force {
+								return fmt.Errorf("table %s.%s which %s.%s is mapped to already exists, pass --force to keep it", target.Database, target.Name, databaseName, tableName)
+							}
+							logger.Infof("Table %s.%s already exists, skip it", target.Database, target.Name)
+							continue
+						}
+						if tableCreateQuery, err = renameTableInQuery(tableCreateQuery, databaseName, tableName, target.Database, target.Name); err != nil {
+							return err
+						}
+						logger.Infof("Table %s.%s will be created as %s.%s", databaseName, tableName, target.Database, target.Name)
+						tableDatabase = target.Database
+						tableName = target.Name
+						if err := failures.add("Database", tableDatabase, ch.CreateDatabase(tableDatabase)); err != nil {
+							return err
+						}
+					}
+
+					if adapted := ch.AdaptCreateQuery(tableCreateQuery); adapted != tableCreateQuery {
+						logger.Infof("storage_policy is removed from query, clickhouse %s doesn't support it", ch.versionName)
+						tableCreateQuery = adapted
+					}
+					if isView(tableCreateQuery) {
+						// views read from other tables and views so they are created after all tables
+						logger.Infof("This is a view, saving for later")
+						views = append(views, RestoreTable{
+							Database: tableDatabase,
+							Name:     tableDatabase + "." + tableName,
+							Query:    tableCreateQuery,
+						})
+					} else if strings.Contains(tableCreateQuery, "ENGINE = Distributed") {
+						// distributed engine tables should be created last
+						// because they are based on real tables
+						logger.Infof("This is a distributed table, saving for later")
+						distributedTables = append(distributedTables, RestoreTable{
+							Database: tableDatabase,
+							Name:     tableDatabase + "." + tableName,
+							Query:    tableCreateQuery,
+						})
+					} else {
+						if err := failures.add("Table", tableDatabase+"."+tableName, ch.CreateTable(RestoreTable{
+							Database: tableDatabase,
+							Name:     tableDatabase + "." + tableName,
+							Query:    tableCreateQuery,
+						})); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	}
+	logger.Infof("Creating distributed tables")
+	for _, table := range distributedTables {
+		if err := failures.add("Table", table.Name, ch.CreateTable(table)); err != nil {
+			return err
+		}
+	}
+	views = sortViews(views)
+	if len(views) > 0 {
+		order := make([]string, len(views))
+		for i, view := range views {
+			if match := viewRe.FindStringSubmatch(view.Query); match != nil {
+				order[i] = qualifiedName(match[1], view.Database)
+			}
+		}
+		logger.WithField("order", strings.Join(order, ", ")).Info("Creating views")
+	}
+	for _, view := range views {
+		if err := failures.add("View", view.Name, ch.CreateTable(view)); err != nil {
+			return err
+		}
+	}
+	return failures.result()
+}
+
+// createFailures - result of creation of databases, tables and views, failed ones are collected to be reported
+// at the end unless creation is stopped on the first failure by --fail-fast
+type createFailures struct {
+	failFast bool
+	created  int
+	failed   []string
+}
+
+// add - count result of creation of kind ("Database", "Table" or "View") name, error is returned only in fail-fast mode
+func (f *createFailures) add(kind string, name string, err error) error {
+	if err == nil {
+		if kind != "Database" {
+			f.created++
+		}
+		return nil
+	}
+	if f.failFast {
+		return fmt.Errorf("%s %s creation failed: %v", strings.ToLower(kind), name, err)
+	}
+	logger.Errorf("%s %s creation failed: %v", kind, name, err) // continue to other tables
+	f.failed = append(f.failed, name)
+	return nil
+}
+
+// result - log count of created and failed tables, error lists all failed ones
+func (f *createFailures) result() error {
+	logger.Infof("%d tables are created, %d failed", f.created, len(f.failed))
+	if len(f.failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("creation of %d databases and tables failed: %s", len(f.failed), strings.Join(f.failed, ", "))
+}
+
+// freezeOptions - which tables freeze saves into local backup and how failed freeze is handled
+type freezeOptions struct {
+	Tables           []string
+	Excludes         []string
+	UseRegex         bool
+	SchemaOnly       bool
+	Partitions       []string
+	Access           bool
+	Name             string
+	AllEngines       bool
+	CleanupOnFailure bool
+	ReuseShadow      bool
+}
+
+func freeze(ctx context.Context, config Config, opts freezeOptions, dryRun bool) error {
+	if opts.SchemaOnly {
+		logger.Infof("Schema-only mode, tables won't be frozen")
+		return nil
+	}
+	if opts.Name != "" {
+		if err := validateBackupName(opts.Name); err != nil {
+			return err
+		}
+	}
+	ch := &ClickHouse{
+		DryRun: dryRun,
+		Config: &config.ClickHouse,
+	}
+
+	if err := ch.Connect(); err != nil {
+		return connectionError(fmt.Errorf("can't connect to clickouse with: %v", err))
+	}
+	defer ch.Close()
+
+	dataPath, err := ch.GetDataPath()
+	if err != nil || dataPath == "" {
+		return fmt.Errorf("can't get data path from clickhouse with: %v\nyou can set data_path in config file", err)
+	}
+	logger.Infof("Found clickhouse data path: %s", dataPath)
+
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return err
+	}
+	_, err = freezeToDisks(ctx, config, ch, dataPath, disks, opts, dryRun)
+	return err
+}
+
+// freezeToDisks - freeze tables by connected clickhouse into local backup on its disks, partially frozen
+// contents of shadow are removed on failure if cleanupOnFailure is set. Shadow left by complete freeze
+// of the same tables is moved to local backup without freeze if reuseShadow is set. Name of local backup is returned
+func freezeToDisks(ctx context.Context, config Config, ch *ClickHouse, dataPath string, disks []Disk, opts freezeOptions, dryRun bool) (name string, err error) {
+	frozenAt := time.Now().UTC()
+	shadowEmpty := true
+	for _, shadowPath := range diskShadows(disks) {
+		files, err := ioutil.ReadDir(shadowPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return "", fmt.Errorf("can't read %s directory: %v", shadowPath, err)
+			}
+		} else if len(files) > 0 {
+			if !opts.ReuseShadow {
+				return "", fmt.Errorf("%s is not empty, won't execute freeze", shadowPath)
+			}
+			shadowEmpty = false
+		}
+	}
+	var reused *frozenTables
+	if !shadowEmpty {
+		if reused, err = readFrozenTables(disks); err != nil {
+			return "", fmt.Errorf("can't read tables of previous freeze: %v", err)
+		}
+		if reused == nil {
+			return "", fmt.Errorf("shadow is not empty and isn't left by complete freeze, it can't be reused, run 'clean' before freeze")
+		}
+		// backup of reused shadow gets name and time of freeze which left it
+		if opts.Name == "" {
+			opts.Name = reused.Name
+		}
+		if !reused.Frozen.IsZero() {
+			frozenAt = reused.Frozen
+		}
+	}
+	if opts.Name == "" {
+		opts.Name = newBackupName()
+	} else if _, err := os.Stat(localBackup{Name: opts.Name, disks: disks}.path(defaultDisk(disks))); err == nil {
+		return "", fmt.Errorf("local backup '%s' already exists", opts.Name)
+	}
+	// shadow is empty before freeze or is left by complete freeze, so partial contents are left by this freeze
+	localCreated := false
+	defer func() {
+		if err == nil || isNothingToDo(err) {
+			return
+		}
+		if localCreated {
+			// incomplete local backup isn't listed, but it's removed so its name can be used again
+			if removeErr := removeLocalBackup(disks, opts.Name, dryRun); removeErr != nil {
+				logger.Errorf("can't remove incomplete local backup '%s': %v", opts.Name, removeErr)
+			}
+		}
+		if frozen, readErr := readFrozenTables(disks); readErr == nil && frozen != nil {
+			logger.Warnf("shadow is left by complete freeze, it's kept to be reused by freeze --reuse-shadow")
+			return
+		}
+		if !opts.CleanupOnFailure {
+			logger.Warnf("freeze failed, partially frozen data is left in shadow, run 'clean' before the next freeze")
+			return
+		}
+		if cleanErr := cleanShadows(disks, dryRun); cleanErr != nil {
+			logger.Errorf("can't clean shadow after failed freeze: %v, run 'clean' before the next freeze", cleanErr)
+		}
+	}()
+	if opts.Access && reused == nil {
+		if err := freezeAccess(ch, defaultDisk(disks).shadowPath(), config.Backup.AccessSkipUsers); err != nil {
+			return "", fmt.Errorf("can't save access with: %v", err)
+		}
+	}
+
+	allTables, err := ch.GetAllTables()
+	if err != nil {
+		return "", fmt.Errorf("can't get Clickhouse tables with: %v", err)
+	}
+	backupTables, err := parseArgsForFreeze(allTables, opts.Tables, opts.Excludes, opts.UseRegex, config.ClickHouse.SkipDatabases)
+	if err != nil {
+		return "", err
+	}
+	if !opts.AllEngines {
+		var skipped []Table
+		backupTables, skipped = filterFreezableTables(backupTables)
+		for _, table := range skipped {
+			logger.Warnf("skip %s.%s with engine %s which doesn't support freeze, use --all-engines to freeze it anyway", table.Database, table.Name, table.Engine)
+		}
+	}
+	metricsFromContext(ctx).setBackup(opts.Name)
+	var rows map[string]uint64
+	var partRows map[string]map[string]uint64
+	if reused != nil {
+		rows = reused.Rows
+		if err := reused.match(newFrozenTables(backupTables, opts.Partitions, opts.Access)); err != nil {
+			return "", fmt.Errorf("shadow is left by freeze of other tables and can't be reused, run 'clean' before freeze: %v", err)
+		}
+		logger.Infof("Shadow is left by complete freeze of %d tables, it's reused without freeze", len(reused.Tables))
+	} else if len(backupTables) == 0 {
+		if !opts.Access {
+			return "", nothingToDoError(fmt.Errorf("there are no tables in clickhouse to freeze"))
+		}
+		logger.Infof("There are no tables in Clickhouse, only access entities are saved.")
+	} else {
+		var dropped []Table
+		dropped, partRows, err = freezeTables(config, ch, dataPath, backupTables, opts.Partitions, opts.Name)
+		if err != nil {
+			return "", err
+		}
+		if len(dropped) > 0 {
+			if err := removeDroppedShadows(diskShadows(disks), dropped, dryRun); err != nil {
+				return "", err
+			}
+			logger.Infof("%d tables are frozen, %d tables dropped during freeze are skipped", len(backupTables)-len(dropped), len(dropped))
+			backupTables = withoutTables(backupTables, dropped)
+		}
+	}
+	if len(backupTables) > 0 && partRows != nil {
+		if rows, err = frozenRows(diskShadows(disks), partRows); err != nil {
+			return "", err
+		}
+	}
+	if reused == nil {
+		frozen := newFrozenTables(backupTables, opts.Partitions, opts.Access)
+		frozen.Name, frozen.Frozen, frozen.Rows = opts.Name, frozenAt, rows
+		if err := writeFrozenTables(disks, frozen, dryRun); err != nil {
+			return "", fmt.Errorf("can't save tables of freeze with: %v", err)
+		}
+	}
+	if err := createLocalBackup(disks, opts.Name, dryRun); err != nil {
+		// part of shadow can be moved already, so it isn't left by complete freeze anymore
+		if removeErr := removeFrozenTables(disks, dryRun); removeErr != nil {
+			logger.Errorf("can't remove %s with: %v", frozenTablesName, removeErr)
+		}
+		return "", err
+	}
+	localCreated = true
+	if err := removeFrozenTables(disks, dryRun); err != nil {
+		return "", fmt.Errorf("can't remove %s with: %v", frozenTablesName, err)
+	}
+	if err := writeLocalBackupRows(disks, opts.Name, rows, dryRun); err != nil {
+		return "", fmt.Errorf("can't save rows count of tables with: %v", err)
+	}
+	if err := writeLocalBackupInfo(disks, opts.Name, localBackupInfo{Created: frozenAt}, dryRun); err != nil {
+		return "", fmt.Errorf("can't complete local backup with: %v", err)
+	}
+	return opts.Name, nil
+}
+
+// freezeTables - freeze tables or only partitions of them to shadow/<name> if there is enough free space,
+// tables which are dropped during freeze are skipped with warning and returned. Rows of parts of every table
+// by <db>.<table> are recorded right after its freeze, while merged parts are still in system.parts
+func freezeTables(config Config, ch *ClickHouse, dataPath string, backupTables []Table, partitions []string, name string) ([]Table, map[string]map[string]uint64, error) {
+	var err error
+	tablePartitions := make([][]string, len(backupTables))
+	if len(partitions) > 0 {
+		if backupTables, tablePartitions, err = selectFreezePartitions(ch, backupTables, partitions); err != nil {
+			return nil, nil, err
+		}
+	}
+	var estimated int64
+	for _, table := range backupTables {
+		size, err := ch.GetTableSize(table)
+		if err != nil {
+			return nil, nil, err
+		}
+		estimated += size
+	}
+	if err := checkFreeSpace(dataPath, estimated, config.ClickHouse.FreeSpaceMargin); err != nil {
+		return nil, nil, err
+	}
+	dropped := make([]bool, len(backupTables))
+	tableRows := make([]map[string]uint64, len(backupTables))
+	if err := runParallel(config.ClickHouse.FreezeConcurrency, len(backupTables), func(i int) error {
+		err := ch.FreezeTable(backupTables[i], tablePartitions[i], name)
+		if isUnknownTableError(err) {
+			logger.Warnf("%s.%s is dropped during freeze, it is skipped: %v", backupTables[i].Database, backupTables[i].Name, err)
+			dropped[i] = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		tableRows[i], err = ch.GetPartRows(backupTables[i])
+		return err
+	}); err != nil {
+		return nil, nil, err
+	}
+	var result []Table
+	partRows := make(map[string]map[string]uint64)
+	for i, table := range backupTables {
+		if dropped[i] {
+			result = append(result, table)
+			continue
+		}
+		partRows[table.Database+"."+table.Name] = tableRows[i]
+	}
+	return result, partRows, nil
+}
+
+// removeDroppedShadows - remove partitions frozen before table was dropped, backup has neither data nor metadata of it
+func removeDroppedShadows(shadows map[string]string, dropped []Table, dryRun bool) error {
+	frozen, err := getDisksBackupTables(shadows)
+	if err != nil {
+		return fmt.Errorf("can't read frozen tables: %v", err)
+	}
+	droppedNames := make(map[string]bool)
+	for _, table := range dropped {
+		droppedNames[table.Database+"."+table.Name] = true
+	}
+	// partitions of table on every disk are in its own directory
+	tablePaths := make(map[string]string)
+	for _, table := range frozen {
+		if !droppedNames[table.Database+"."+table.Name] {
+			continue
+		}
+		for _, partition := range table.Partitions {
+			tablePaths[filepath.Dir(partition.Path)] = table.Database + "." + table.Name
+		}
+	}
+	for tablePath, name := range tablePaths {
+		if dryRun {
+			logger.Infof("DRY-RUN: remove %s", tablePath)
+			continue
+		}
+		logger.Infof("Remove partitions of dropped table %s from %s", name, tablePath)
+		if err := os.RemoveAll(tablePath); err != nil {
+			return fmt.Errorf("can't remove %s with: %v", tablePath, err)
+		}
+	}
+	return nil
+}
+
+// selectFreezePartitions - keep tables which have some of partitions and return partitions to freeze for every of them,
+// error is returned if a partition isn't found in any table
+func selectFreezePartitions(ch *ClickHouse, tables []Table, partitions []string) ([]Table, [][]string, error) {
+	found := make(map[string]bool)
+	var resultTables []Table
+	var resultPartitions [][]string
+	for _, table := range tables {
+		existing, err := ch.GetPartitions(table)
+		if err != nil {
+			return nil, nil, err
+		}
+		exists := make(map[string]bool)
+		for _, id := range existing {
+			exists[id] = true
+		}
+		var selected []string
+		for _, id := range partitions {
+			if exists[id] {
+				found[id] = true
+				selected = append(selected, id)
+			}
+		}
+		if len(selected) > 0 {
+			resultTables = append(resultTables, table)
+			resultPartitions = append(resultPartitions, selected)
+		}
+	}
+	for _, id := range partitions {
+		if !found[id] {
+			return nil, nil, fmt.Errorf("partition '%s' is not found in system.parts of selected tables", id)
+		}
+	}
+	return resultTables, resultPartitions, nil
+}
+
+// restoreOptions - which tables and increments restore attaches and where
+type restoreOptions struct {
+	Tables             []string
+	Increments         []int
+	LatestIncrement    bool
+	Move               bool
+	DatabaseMapping    []string
+	TableMapping       []string
+	Excludes           []string
+	UseRegex           bool
+	DataOnly           bool
+	Partitions         []string
+	Verify             bool
+	Force              bool
+	ReplicaRestoreMode string
+	ZeroCopy           bool
+	TargetDataPath     string
+}
+
+func restore(config Config, opts restoreOptions, dryRun bool) error {
+	if err := setTargetDataPath(&config, opts.TargetDataPath); err != nil {
+		return err
+	}
+	if opts.Verify && len(opts.Partitions) > 0 {
+		return fmt.Errorf("--verify can't be used with --partition, rows count is known only for whole tables")
+	}
+	if opts.LatestIncrement && len(opts.Increments) > 0 {
+		return fmt.Errorf("--latest-increment can't be used with --increments")
+	}
+	if opts.ReplicaRestoreMode != "single" && opts.ReplicaRestoreMode != "all" {
+		return fmt.Errorf("unknown --replica-restore-mode '%s' it can be 'single', 'all'", opts.ReplicaRestoreMode)
+	}
+	ch := &ClickHouse{
+		DryRun:   dryRun,
+		ZeroCopy: opts.ZeroCopy,
+		Config:   &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return connectionError(fmt.Errorf("can't connect to clickouse with: %v", err))
+	}
+	defer ch.Close()
+	if opts.ZeroCopy {
+		if err := checkZeroCopy(ch); err != nil {
+			return err
+		}
+	}
+	if err := ch.CleanRestoreStaging(); err != nil {
+		return err
+	}
+	allTables, err := ch.GetBackupTables()
+	if err != nil {
+		return err
+	}
+	dataPath, err := ch.GetDataPath()
+	if err != nil {
+		return err
+	}
+	manifest, err := LoadBackupManifest(path.Join(dataPath, config.ClickHouse.BackupDir, manifestName))
+	if err != nil {
+		return fmt.Errorf("can't read backup manifest: %v", err)
+	}
+	if manifest != nil {
+		if err := manifest.ValidateTables(allTables); err != nil {
+			return fmt.Errorf("backup is incomplete: %v", err)
+		}
+	} else if opts.Verify {
+		return fmt.Errorf("backup doesn't have manifest, rows count can't be verified")
+	}
+	backupTables := make(map[string]bool)
+	for _, table := range allTables {
+		backupTables[table.Database+"."+table.Name] = true
+	}
+	mapping, err := parseRestoreMapping(opts.DatabaseMapping, opts.TableMapping, backupTables)
+	if err != nil {
+		return err
+	}
+	restoreTables, err := parseArgsForRestore(allTables, opts.Tables, opts.Excludes, opts.Increments, opts.LatestIncrement, opts.UseRegex, opts.Partitions)
+	if err != nil {
+		return err
+	}
+	if len(restoreTables) == 0 {
+		return nothingToDoError(fmt.Errorf("backup doesn't have tables to restore"))
+	}
+	if !opts.Move {
+		// parts are renamed on move so only copy requires space
+		if err := checkRestoreFreeSpace(ch, restoreTables, config.ClickHouse.FreeSpaceMargin); err != nil {
+			return err
+		}
+	}
+	metadataPath := path.Join(dataPath, config.ClickHouse.BackupDir, "metadata")
+	checkedBefore := opts.DataOnly || config.ClickHouse.RestoreConcurrency > 1
+	if checkedBefore {
+		// all tables must be created by create-tables before any of them is restored in parallel
+		logger.Infof("Check tables before restore")
+		for _, table := range restoreTables {
+			if err := checkRestoreTarget(ch, metadataPath, table, mapping); err != nil {
+				return err
+			}
+		}
+	}
+	if err := checkMappedTablesEmpty(ch, restoreTables, mapping, opts.Force); err != nil {
+		return err
+	}
+	groups := groupTableIncrements(restoreTables)
+	var mu sync.Mutex
+	var mismatched []string
+	err = runParallel(config.ClickHouse.RestoreConcurrency, len(groups), func(i int) error {
+		var before uint64
+		var err error
+		database, name := mapping.target(groups[i][0].Database, groups[i][0].Name)
+		restoreReplica, replica, err := ch.IsRestoreReplica(database, name)
+		if err != nil {
+			if opts.ReplicaRestoreMode == "single" {
+				return err
+			}
+			// all mode doesn't need replicas, projections and indexes are built here if elected one isn't known
+			logger.Warnf("can't find replica which builds projections and indexes of %s.%s, they are built here: %v", database, name, err)
+			restoreReplica = true
+		}
+		if !restoreReplica && opts.ReplicaRestoreMode == "single" {
+			logger.WithField("replica", replica).Warnf("Data of %s.%s isn't restored on this replica, it must be restored on replica %s and will be fetched from it, use --replica-restore-mode all to restore it here", database, name, replica)
+			return nil
+		}
+		if opts.Verify && !dryRun {
+			// table may already have rows, so only rows added by restore are compared
+			if before, err = ch.GetRowCount(database, name); err != nil {
+				return err
+			}
+		}
+		if !checkedBefore {
+			// increments of table are restored to the same target, so it is checked once
+			if err := checkRestoreTarget(ch, metadataPath, groups[i][0], mapping); err != nil {
+				return err
+			}
+		}
+		for _, table := range groups[i] {
+			table.Database, table.Name = mapping.target(table.Database, table.Name)
+			// parts are checked before copy, because they are moved by --move
+			extras, err := getTablePartExtras(table)
+			if err != nil {
+				return err
+			}
+			if err := ch.CopyData(table, opts.Move); err != nil {
+				return fmt.Errorf("can't restore %s.%s increment %d with %v", table.Database, table.Name, table.Increment, err)
+			}
+			if err := ch.AttachPatritions(table); err != nil {
+				return fmt.Errorf("can't attach partitions for table %s.%s with %v", table.Database, table.Name, err)
+			}
+			if !restoreReplica {
+				// MATERIALIZE of replicated table is replicated, so only replica elected for single mode executes it
+				logger.Infof("Projections and indexes of %s.%s are built by replica %s", table.Database, table.Name, replica)
+				continue
+			}
+			if err := ch.MaterializeExtras(table, extras); err != nil {
+				return fmt.Errorf("can't build projections and indexes of %s.%s with %v", table.Database, table.Name, err)
+			}
+		}
+		if !opts.Verify || dryRun {
+			return nil
+		}
+		tableIncrements := make([]int, len(groups[i]))
+		for j, table := range groups[i] {
+			tableIncrements[j] = table.Increment
+		}
+		expected, ok := manifest.ExpectedRows(groups[i][0].Database, groups[i][0].Name, tableIncrements)
+		if !ok {
+			logger.Warnf("Backup doesn't have rows count of %s.%s, it isn't verified", database, name)
+			return nil
+		}
+		after, err := ch.GetRowCount(database, name)
+		if err != nil {
+			return err
+		}
+		// rows can be deleted from table during restore, so difference can be negative
+		if restored := int64(after) - int64(before); restored != int64(expected) {
+			logger.Errorf("%s.%s has %d restored rows, expected %d", database, name, restored, expected)
+			mu.Lock()
+			mismatched = append(mismatched, database+"."+name)
+			mu.Unlock()
+			return nil
+		}
+		logger.Infof("%s.%s has %d restored rows as expected", database, name, expected)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(mismatched) > 0 {
+		sort.Strings(mismatched)
+		return fmt.Errorf("rows count of %s differs from backup", strings.Join(mismatched, ", "))
+	}
+	return nil
+}
+
+// checkZeroCopy - zero-copy restore needs type of disks which clickhouse reports since 20.6
+func checkZeroCopy(ch *ClickHouse) error {
+	if ch.olderThan(minVersionDiskType) {
+		return fmt.Errorf("--zero-copy requires clickhouse 20.6 or newer, clickhouse %s doesn't have remote disks", ch.versionName)
+	}
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return err
+	}
+	var remote []string
+	for _, disk := range disks {
+		if disk.IsRemote() {
+			remote = append(remote, disk.Name)
+		}
+	}
+	if len(remote) == 0 {
+		logger.Warnf("There are no remote disks, --zero-copy doesn't change restore")
+		return nil
+	}
+	logger.Infof("Parts of remote disks %s are restored without copy", strings.Join(remote, ", "))
+	return nil
+}
+
+// groupTableIncrements - group increments by table keeping their order, increments of one table are restored sequentially
+func groupTableIncrements(tables []BackupTable) [][]BackupTable {
+	var groups [][]BackupTable
+	index := make(map[string]int)
+	for _, table := range tables {
+		key := table.Database + "." + table.Name
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], table)
+	}
+	return groups
+}
+
+// checkRestoreFreeSpace - check that every disk has enough space for copy of its partitions
+func checkRestoreFreeSpace(ch *ClickHouse, tables []BackupTable, marginPercent int) error {
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return err
+	}
+	estimated := make(map[string]int64)
+	for _, table := range tables {
+		for _, partition := range table.Partitions {
+			size, _, err := partitionStats(partition)
+			if err != nil {
+				return err
+			}
+			estimated[partition.Disk] += size
+		}
+	}
+	for _, disk := range disks {
+		if size, ok := estimated[disk.Name]; ok {
+			if err := checkFreeSpace(path.Join(disk.Path, "data"), size, marginPercent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkRestoreTarget - check that target table exists and is compatible with table in backup
+func checkRestoreTarget(ch *ClickHouse, metadataPath string, table BackupTable, mapping restoreMapping) error {
+	backupEngine, err := GetBackupEngine(metadataPath, table.Database, table.Name)
+	if err != nil {
+		return fmt.Errorf("can't read metadata of %s.%s: %v", table.Database, table.Name, err)
+	}
+	table.Database, table.Name = mapping.target(table.Database, table.Name)
+	return ch.CheckRestoreTarget(table, backupEngine)
+}
+
+// checkMappedTablesEmpty - tables which other tables are mapped to must be empty unless force is set,
+// so data isn't attached to live table by mistake
+func checkMappedTablesEmpty(ch *ClickHouse, tables []BackupTable, mapping restoreMapping, force bool) error {
+	if force {
+		return nil
+	}
+	checked := make(map[string]bool)
+	for _, table := range tables {
+		target, ok := mapping.tables[table.Database+"."+table.Name]
+		if !ok || checked[table.Database+"."+table.Name] {
+			continue
+		}
+		checked[table.Database+"."+table.Name] = true
+		rows, err := ch.GetRowCount(target.Database, target.Name)
+		if err != nil {
+			return err
+		}
+		if rows > 0 {
+			return fmt.Errorf("table %s.%s which %s.%s is mapped to already has %d rows, pass --force to restore into it", target.Database, target.Name, table.Database, table.Name, rows)
+		}
+	}
+	return nil
+}
+
+// backup - freeze tables and upload them as one backup with the same connection to clickhouse
+func backup(ctx context.Context, config Config, freezeOpts freezeOptions, uploadOpts uploadOptions, dryRun bool) error {
+	if err := checkUploadArgs(config, false, uploadOpts.Name, uploadOpts.DiffFrom); err != nil {
+		return err
+	}
+	ch := &ClickHouse{
+		DryRun: dryRun,
+		Config: &config.ClickHouse,
+	}
+	if err := ch.Connect(); err != nil {
+		return connectionError(fmt.Errorf("can't connect to clickouse with: %v", err))
 	}
 	defer ch.Close()
 
-	dataPath, err := ch.GetDataPath()
-	if err != nil || dataPath == "" {
-		return fmt.Errorf("can't get data path from clickhouse with: %v\nyou can set data_path in config file", err)
+	dataPath, err := ch.GetDataPath()
+	if err != nil || dataPath == "" {
+		return fmt.Errorf("can't get data path from clickhouse with: %v\nyou can set data_path in config file", err)
+	}
+	logger.Infof("Found clickhouse data path: %s", dataPath)
+	config.ClickHouse.DataPath = dataPath
+
+	disks, err := ch.GetDisks()
+	if err != nil {
+		return err
+	}
+	name, err := freezeToDisks(ctx, config, ch, dataPath, disks, freezeOpts, dryRun)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		logger.Infof("DRY-RUN: upload of '%s' is skipped, it isn't frozen", name)
+		return nil
+	}
+	uploadOpts.Backups = []string{name}
+	return uploadFromDisks(ctx, config, disks, uploadOpts, dryRun)
+}
+
+// cleanShadows - remove contents of shadow of every disk
+func cleanShadows(disks []Disk, dryRun bool) error {
+	for _, shadowDir := range diskShadows(disks) {
+		if _, err := os.Stat(shadowDir); os.IsNotExist(err) {
+			continue
+		}
+		if dryRun {
+			logger.Infof("DRY-RUN: remove contents from directory %v", shadowDir)
+			continue
+		}
+		logger.Infof("remove contents from directory %v", shadowDir)
+		if err := cleanDir(shadowDir); err != nil {
+			return fmt.Errorf("can't remove contents from directory %v: %v", shadowDir, err)
+		}
+	}
+	return nil
+}
+
+// uploadOptions - which local backup upload sends to s3, under which name and what is done after upload
+type uploadOptions struct {
+	Backups          []string
+	SchemaOnly       bool
+	Force            bool
+	CleanAfterUpload bool
+	SkipReplica      bool
+	Name             string
+	DiffFrom         string
+}
+
+func upload(ctx context.Context, config Config, opts uploadOptions, dryRun bool) error {
+	if err := checkUploadArgs(config, opts.SchemaOnly, opts.Name, opts.DiffFrom); err != nil {
+		return err
+	}
+	disks, err := getDisks(config)
+	if err != nil {
+		return err
+	}
+	return uploadFromDisks(ctx, config, disks, opts, dryRun)
+}
+
+// checkUploadArgs - check --name and --diff-from of upload against strategy of backup
+func checkUploadArgs(config Config, schemaOnly bool, name string, diffFrom string) error {
+	if diffFrom != "" {
+		if config.Backup.Strategy != "tree" || config.Backup.TreeLayout != "timestamped" {
+			return fmt.Errorf("--diff-from is supported only by tree strategy with timestamped layout")
+		}
+		if schemaOnly {
+			return fmt.Errorf("--diff-from can't be used with --schema-only, there are no parts to compare")
+		}
+	}
+	if name != "" {
+		if err := validateBackupName(name); err != nil {
+			return err
+		}
+		if config.Backup.Strategy == "tree" && config.Backup.TreeLayout == "flat" {
+			return fmt.Errorf("--name can't be used with backup.tree_layout flat, there is only one backup on s3")
+		}
+	}
+	return nil
+}
+
+// uploadFromDisks - upload local backup from disks of clickhouse
+func uploadFromDisks(ctx context.Context, config Config, disks []Disk, opts uploadOptions, dryRun bool) error {
+	if len(opts.Backups) == 0 && opts.Name != "" {
+		// local backup frozen with the same --name is uploaded
+		if _, err := os.Stat(localBackup{Name: opts.Name, disks: disks}.path(defaultDisk(disks))); err == nil {
+			opts.Backups = []string{opts.Name}
+		}
+	}
+	local, err := selectLocalBackup(disks, opts.Backups)
+	if err != nil {
+		return err
+	}
+	layout, err := newKeyLayout(config.S3.KeyLayout, config.S3.KeySeparator)
+	if err != nil {
+		return err
+	}
+	s3 := &S3{
+		DryRun: dryRun,
+		Force:  opts.Force,
+		Config: &config.S3,
+		Layout: layout,
+	}
+	if err := s3.Connect(); err != nil {
+		return connectionError(fmt.Errorf("can't connect to s3 with: %v", err))
+	}
+	if opts.Name != "" && !opts.Force {
+		if err := checkRemoteNameIsFree(config, s3, opts.Name); err != nil {
+			return err
+		}
+	}
+	backupStrategy := config.Backup.Strategy
+	var uploadedName string
+	switch backupStrategy {
+	case "tree":
+		backupName := ""
+		if config.Backup.TreeLayout == "timestamped" {
+			backupName = opts.Name
+			if backupName == "" {
+				backupName = local.Name
+			}
+			if backupName == "" {
+				backupName = newBackupName()
+			}
+		}
+		if backupName == "" && !opts.Force {
+			if err := checkRemoteIsOlder(ctx, s3, local); err != nil {
+				return err
+			}
+		}
+		var diff *diffBase
+		if opts.DiffFrom != "" {
+			var err error
+			if diff, err = loadDiffBase(ctx, config, s3, opts.DiffFrom); err != nil {
+				return err
+			}
+			if diff.Name == backupName {
+				return fmt.Errorf("backup '%s' can't be uploaded against itself", backupName)
+			}
+		}
+		metricsFromContext(ctx).setBackup(backupName)
+		if backupName == "" {
+			s3.tagBackup(flatBackupName)
+		} else {
+			s3.tagBackup(backupName)
+		}
+		err := uploadTree(ctx, s3, local, backupName, opts.SchemaOnly, diff)
+		if err != nil {
+			return err
+		}
+		if err := removeOldBackups(ctx, config, s3); err != nil {
+			return fmt.Errorf("can't remove old backups: %v", err)
+		}
+		uploadedName = backupName
+		if uploadedName == "" {
+			uploadedName = flatBackupName
+		}
+	case "archive":
+		var archiveName string
+		var err error
+		if config.Backup.ArchiveGranularity == "table" {
+			archiveName, err = uploadTableArchives(ctx, s3, local, opts.Name, opts.SchemaOnly, config.Backup.SkipSymlinks, config.Backup.TempDir())
+		} else {
+			archiveName, err = uploadArchive(ctx, s3, local, opts.Name, opts.SchemaOnly, config.Backup.SkipSymlinks, config.Backup.TempDir(), config.Backup.MaxArchiveSize)
+		}
+		if err != nil {
+			return err
+		}
+		if err := uploadLatest(ctx, s3, archiveName); err != nil {
+			return err
+		}
+		if err := removeOldBackups(ctx, config, s3); err != nil {
+			return fmt.Errorf("can't remove old backups: %v", err)
+		}
+		uploadedName = archiveName
+	default:
+		return fmt.Errorf("unsupported backup strategy")
+	}
+	if config.Replica.Enabled() {
+		if opts.SkipReplica {
+			logger.Infof("Copy to replica is skipped")
+		} else {
+			replicateBackup(ctx, config, s3, uploadedName)
+		}
+	}
+	if !opts.CleanAfterUpload {
+		return nil
+	}
+	if dryRun || opts.SchemaOnly {
+		logger.Infof("Local backup is kept because data wasn't uploaded")
+		return nil
+	}
+	return cleanUploaded(local)
+}
+
+// checkRemoteIsOlder - refuse to overwrite flat backup on s3 which manifest records freeze later than freeze
+// of local backup. Objects left by interrupted upload of the same backup don't block it
+func checkRemoteIsOlder(ctx context.Context, s3 *S3, local localBackup) error {
+	frozen, err := local.created()
+	if os.IsNotExist(err) {
+		logger.Infof("There is no shadow, time of backup on s3 isn't checked")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't get time of local backup with: %v", err)
+	}
+	content, err := s3.DownloadContent(ctx, manifestName)
+	if isNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't download manifest of backup on s3 with: %v", err)
+	}
+	manifest, err := ParseBackupManifest(content)
+	if err != nil {
+		return fmt.Errorf("can't parse manifest of backup on s3: %v", err)
+	}
+	return checkFrozenIsOlder(manifest, frozen)
+}
+
+// checkFrozenIsOlder - check that backup described by manifest isn't frozen after local backup,
+// backup uploaded without time of freeze can be overwritten
+func checkFrozenIsOlder(manifest *BackupManifest, frozen time.Time) error {
+	if manifest.Frozen.After(frozen) {
+		return fmt.Errorf("backup on s3 is frozen at %s after local backup is frozen at %s, use --force to overwrite it",
+			manifest.Frozen.Format(time.RFC3339), frozen.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkRemoteNameIsFree - refuse to overwrite backup on s3 which has name passed by --name
+func checkRemoteNameIsFree(config Config, s3 *S3, name string) error {
+	remoteName := name
+	if config.Backup.Strategy == "archive" && config.Backup.ArchiveGranularity != "table" {
+		remoteName = name + ".tar"
+	}
+	backups, err := getRemoteBackups(config, s3)
+	if err != nil {
+		return s3RequestError(err, fmt.Errorf("can't list backups on s3 with: %v", err))
+	}
+	for _, backup := range backups {
+		if backup.Name == remoteName {
+			return fmt.Errorf("backup '%s' already exists on s3, use --force to overwrite it", remoteName)
+		}
+	}
+	return nil
+}
+
+// cleanUploaded - remove local backup or contents of shadow of every disk if backup isn't created by freeze
+func cleanUploaded(local localBackup) error {
+	if local.Name != "" {
+		if err := removeLocalBackup(local.disks, local.Name, false); err != nil {
+			return fmt.Errorf("can't clean after upload: %v", err)
+		}
+		logger.Infof("Local backup '%s' is removed after upload", local.Name)
+		return nil
+	}
+	for _, shadowDir := range diskShadows(local.disks) {
+		if _, err := os.Stat(shadowDir); os.IsNotExist(err) {
+			continue
+		}
+		if err := cleanDir(shadowDir); err != nil {
+			return fmt.Errorf("can't clean after upload: can't remove contents from directory %v: %v", shadowDir, err)
+		}
+		logger.Infof("Contents of %s are removed after upload", shadowDir)
+	}
+	return nil
+}
+
+// newBackupName - name for new backup based on current time
+func newBackupName() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// backupSource - local directory which is stored by Key inside backup
+type backupSource struct {
+	Key  string
+	Path string
+}
+
+// uploadTree - upload metadata and shadows to backupName prefix, empty backupName means flat layout.
+// Parts which are unchanged since diff base aren't uploaded, manifest points them to data of base
+func uploadTree(ctx context.Context, s3 *S3, local localBackup, backupName string, schemaOnly bool, diff *diffBase) error {
+	manifest, err := newLocalManifest(local, "tree", schemaOnly)
+	if err != nil {
+		return err
+	}
+	manifest.KeyLayout = s3.Layout.Name()
+	if s3.Layout.Flat {
+		manifest.KeySeparator = s3.Layout.Separator
+	}
+	var unchanged map[string]bool
+	if diff != nil {
+		unchanged = diff.apply(manifest)
+		logger.Infof("%d parts are unchanged since '%s', they aren't uploaded", len(unchanged), diff.Name)
+	}
+	sources := local.sources(schemaOnly)
+	for _, source := range sources {
+		logger.WithField("key", path.Join(backupName, source.Key)).Infof("upload %s", source.Key)
+		if err := s3.UploadDirectoryFiltered(ctx, source.Path, path.Join(backupName, source.Key), skipParts(source.Key, unchanged)); err != nil {
+			return fmt.Errorf("can't upload %s: %v", source.Key, err)
+		}
+	}
+	if schemaOnly {
+		logger.Infof("skip data in schema-only mode")
+	}
+	logger.Infof("upload checksums")
+	// keys of checksums are keys of objects inside backup, so verify finds objects in any layout
+	checksums := make(Checksums)
+	for _, source := range sources {
+		sourceChecksums := make(Checksums)
+		if err := sourceChecksums.AddDirFiltered(source.Path, "", skipParts(source.Key, unchanged)); err != nil {
+			return fmt.Errorf("can't calculate checksums: %v", err)
+		}
+		for key, checksum := range sourceChecksums {
+			remoteKey, err := s3.Layout.encode(key)
+			if err != nil {
+				return err
+			}
+			checksums[path.Join(source.Key, remoteKey)] = checksum
+		}
+	}
+	if err := s3.UploadContent(ctx, checksums.Marshal(), path.Join(backupName, checksumsName)); err != nil {
+		return fmt.Errorf("can't upload checksums: %v", err)
+	}
+	if backupName != "" {
+		if err := uploadBases(ctx, s3, manifest, backupName); err != nil {
+			return err
+		}
+	}
+	return putManifest(ctx, s3, manifest, path.Join(backupName, manifestName))
+}
+
+// uploadStateName - file in temp directory with state of interrupted archive upload
+const uploadStateName = "clickhouse-backup-upload.json"
+
+func uploadArchive(ctx context.Context, s3 *S3, local localBackup, name string, schemaOnly bool, skipSymlinks bool, tmpDir string, maxArchiveSize int64) (string, error) {
+	statePath := filepath.Join(tmpDir, uploadStateName)
+	archivePaths, first, checksums, source, err := unfinishedArchive(statePath, schemaOnly, local.Name, name, s3.Config.Path)
+	if err != nil {
+		return "", err
+	}
+	if len(archivePaths) == 0 {
+		var archiveSum, contentSum string
+		if archivePaths, checksums, archiveSum, contentSum, err = createArchive(ctx, local, schemaOnly, skipSymlinks, tmpDir, maxArchiveSize); err != nil {
+			return "", err
+		}
+		source = uploadSource{Backup: local.Name, ArchiveSHA256: archiveSum, ContentSHA256: contentSum}
+		duplicate := ""
+		if name == "" {
+			// archive with explicit name is always uploaded to be found by its name
+			if duplicate, err = latestWithSum(ctx, s3, contentSum); err != nil {
+				removeFiles(archivePaths)
+				return "", err
+			}
+		}
+		if duplicate != "" {
+			removeFiles(archivePaths)
+			logger.WithField("backup", duplicate).Info("Archive is identical to the latest backup on s3, upload is skipped as duplicate")
+			return duplicate, nil
+		}
+	}
+	logger.Infof("upload data")
+	archiveName := archiveNameOfUpload(archivePaths, name)
+	metricsFromContext(ctx).setBackup(archiveName)
+	s3.tagBackup(archiveName)
+	var parts []string
+	if len(archivePaths) > 1 {
+		for _, archivePath := range archivePaths {
+			parts = append(parts, archivePartKey(archivePaths, name, archivePath))
+		}
+	}
+	// parts are uploaded in order, so parts before the interrupted one are already on s3
+	for _, archivePath := range archivePaths[first:] {
+		if err := s3.UploadFileResumable(ctx, archivePath, archivePartKey(archivePaths, name, archivePath), statePath, source); err != nil {
+			if ctx.Err() != nil {
+				// canceled upload is aborted so there is nothing to resume
+				removeFiles(archivePaths)
+				return "", errCanceled
+			}
+			if _, statErr := os.Stat(statePath); statErr == nil {
+				logger.WithField("path", archivePath).Warn("archive is kept to resume upload on next run")
+			} else {
+				removeFiles(archivePaths)
+			}
+			return "", fmt.Errorf("can't upload archive to s3 with: %v", err)
+		}
+	}
+	removeFiles(archivePaths)
+	logger.Infof("upload checksums")
+	if err := s3.UploadContent(ctx, checksums.Marshal(), archiveName+checksumsSuffix); err != nil {
+		return "", fmt.Errorf("can't upload checksums: %v", err)
+	}
+	return archiveName, uploadManifest(ctx, s3, local, "archive", archiveName+manifestSuffix, schemaOnly, parts, source.ArchiveSHA256, source.ContentSHA256)
+}
+
+// archiveNameOfUpload - name of archive on s3, it's name of temp archive if --name isn't passed
+func archiveNameOfUpload(archivePaths []string, name string) string {
+	if name != "" {
+		return name + ".tar"
+	}
+	return archiveNameOfParts(archivePaths)
+}
+
+// archivePartKey - key of archive part relative to s3.path, parts are named <archive name>.001, <archive name>.002, ...
+func archivePartKey(archivePaths []string, name string, archivePath string) string {
+	return archiveNameOfUpload(archivePaths, name) + strings.TrimPrefix(filepath.Base(archivePath), archiveNameOfParts(archivePaths))
+}
+
+// archivePartRe - suffix of numbered part of archive
+var archivePartRe = regexp.MustCompile(`\.[0-9]{3}$`)
+
+// archiveNameOfParts - name of archive on s3, parts are stored as <name>.001, <name>.002, ...
+func archiveNameOfParts(archivePaths []string) string {
+	name := filepath.Base(archivePaths[0])
+	if len(archivePaths) > 1 {
+		name = archivePartRe.ReplaceAllString(name, "")
+	}
+	return name
+}
+
+// removeFiles - remove files ignoring errors
+func removeFiles(paths []string) {
+	for _, filePath := range paths {
+		os.Remove(filePath)
 	}
-	log.Printf("Found clickhouse data path: %s", dataPath)
+}
 
-	shadowPath := filepath.Join(dataPath, "shadow")
-	files, err := ioutil.ReadDir(shadowPath)
+// createArchive - tar metadata and shadows of all disks to temp file in tmpDir, returns paths and sha256 of archive parts,
+// sha256 of the whole archive and digest of checksums of files embedded into archive, archive is split into numbered
+// parts of maxArchiveSize bytes if it is set
+func createArchive(ctx context.Context, local localBackup, schemaOnly bool, skipSymlinks bool, tmpDir string, maxArchiveSize int64) ([]string, Checksums, string, string, error) {
+	file, err := ioutil.TempFile(tmpDir, "*.tar")
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return fmt.Errorf("can't read %s directory: %v", shadowPath, err)
+		return nil, nil, "", "", err
+	}
+	logger.Infof("archive data")
+	cw := newChunkWriter(file, maxArchiveSize)
+	tw := newTarWriter(cw)
+	for _, source := range local.sources(schemaOnly) {
+		if err = TarDirAs(ctx, tw, source.Path, source.Key, skipSymlinks); err != nil {
+			break
 		}
-	} else if len(files) > 0 {
-		return fmt.Errorf("%s is not empty, won't execute freeze", shadowPath)
 	}
-
-	allTables, err := ch.GetTables()
+	if closeErr := tw.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return fmt.Errorf("can't get Clickhouse tables with: %v", err)
+		cw.Remove()
+		return nil, nil, "", "", fmt.Errorf("error achiving data with: %v", err)
 	}
-	backupTables, err := parseArgsForFreeze(allTables, args)
+	paths, sums, err := cw.Close()
 	if err != nil {
-		return err
+		cw.Remove()
+		return nil, nil, "", "", fmt.Errorf("error achiving data with: %v", err)
 	}
-	if len(backupTables) == 0 {
-		log.Printf("There are no tables in Clickhouse, create something to freeze.")
-		return nil
+	checksums := make(Checksums)
+	for i, archivePath := range paths {
+		checksums[filepath.Base(archivePath)] = sums[i]
 	}
-	for _, table := range backupTables {
-		if err := ch.FreezeTable(table); err != nil {
-			return err
-		}
+	if len(paths) > 1 {
+		logger.Infof("archive is split into %d parts", len(paths))
 	}
-
-	// move shadow to backup/timestamp/
-
-	return nil
+	return paths, checksums, cw.Sum(), tw.Digest(), nil
 }
 
-func restore(config Config, args []string, dryRun bool, increments []int, move bool) error {
-	ch := &ClickHouse{
-		DryRun: dryRun,
-		Config: &config.ClickHouse,
+// unfinishedArchive - return paths and checksums of archive parts which upload was interrupted, index of
+// the interrupted part and source of upload. Archive is resumed only if it's the same archive of the same local backup
+// uploaded under the same key, otherwise it's removed. Schema-only upload always creates new archive because
+// interrupted one may contain data
+func unfinishedArchive(statePath string, schemaOnly bool, backup string, name string, s3Path string) ([]string, int, Checksums, uploadSource, error) {
+	state, err := loadUploadState(statePath)
+	if err != nil {
+		return nil, 0, nil, uploadSource{}, fmt.Errorf("can't read upload state: %v", err)
 	}
-	if err := ch.Connect(); err != nil {
-		return fmt.Errorf("can't connect to clickouse with: %v", err)
+	if state == nil || schemaOnly {
+		return nil, 0, nil, uploadSource{}, nil
 	}
-	defer ch.Close()
-	allTables, err := ch.GetBackupTables()
+	if info, err := os.Stat(state.LocalPath); err != nil || info.Size() != state.Size {
+		logger.Infof("Archive %s from interrupted upload is not found, create new one", state.LocalPath)
+		return nil, 0, nil, uploadSource{}, nil
+	}
+	paths := []string{state.LocalPath}
+	if archivePartRe.MatchString(state.LocalPath) {
+		if paths, err = filepath.Glob(archivePartRe.ReplaceAllString(state.LocalPath, "") + ".[0-9][0-9][0-9]"); err != nil {
+			return nil, 0, nil, uploadSource{}, err
+		}
+		sort.Strings(paths)
+	}
+	if state.Source.Backup != backup || state.Key != path.Join(s3Path, archivePartKey(paths, name, state.LocalPath)) {
+		logger.Infof("Archive %s from interrupted upload is of another backup, create new one", state.LocalPath)
+		removeFiles(paths)
+		return nil, 0, nil, uploadSource{}, nil
+	}
+	logger.Infof("Found archive %s from interrupted upload", state.LocalPath)
+	first := 0
+	checksums := make(Checksums)
+	total := sha256.New()
+	for i, archivePath := range paths {
+		if archivePath == state.LocalPath {
+			first = i
+		}
+		checksum, err := checksumArchivePart(archivePath, total)
+		if err != nil {
+			return nil, 0, nil, uploadSource{}, fmt.Errorf("can't calculate checksum of %s: %v", archivePath, err)
+		}
+		checksums[filepath.Base(archivePath)] = checksum
+	}
+	if archiveSum := fmt.Sprintf("%x", total.Sum(nil)); archiveSum != state.Source.ArchiveSHA256 {
+		logger.Infof("Archive %s from interrupted upload has sha256 %s instead of %s, create new one", state.LocalPath, archiveSum, state.Source.ArchiveSHA256)
+		removeFiles(paths)
+		return nil, 0, nil, uploadSource{}, nil
+	}
+	return paths, first, checksums, state.Source, nil
+}
+
+// checksumArchivePart - sha256 of archive part, part is written to total too
+func checksumArchivePart(archivePath string, total io.Writer) (string, error) {
+	f, err := os.Open(archivePath)
 	if err != nil {
-		return err
+		return "", err
 	}
-	restoreTables, err := parseArgsForRestore(allTables, args, increments)
+	defer f.Close()
+	return checksumReader(io.TeeReader(f, total))
+}
+
+// uploadManifest - describe frozen tables and put manifest to dstPath on s3
+func uploadManifest(ctx context.Context, s3 *S3, local localBackup, strategy string, dstPath string, schemaOnly bool, parts []string, archiveSum string, contentSum string) error {
+	manifest, err := newLocalManifest(local, strategy, schemaOnly)
 	if err != nil {
 		return err
 	}
-	if len(restoreTables) == 0 {
-		log.Printf("Backup doesn't have tables to restore, nothing to do.")
-		return nil
+	manifest.Parts = parts
+	manifest.ArchiveSHA256 = archiveSum
+	manifest.ContentSHA256 = contentSum
+	return putManifest(ctx, s3, manifest, dstPath)
+}
+
+// newLocalManifest - describe frozen tables of local backup
+func newLocalManifest(local localBackup, strategy string, schemaOnly bool) (*BackupManifest, error) {
+	rows, err := local.rows()
+	if err != nil {
+		return nil, fmt.Errorf("can't read rows count of tables: %v", err)
 	}
-	for _, table := range restoreTables {
-		if err := ch.CopyData(table, move); err != nil {
-			return fmt.Errorf("can't restore %s.%s increment %d with %v", table.Database, table.Name, table.Increment, err)
-		}
-		if err := ch.AttachPatritions(table); err != nil {
-			return fmt.Errorf("can't attach partitions for table %s.%s with %v", table.Database, table.Name, err)
-		}
+	manifest, err := NewBackupManifest(local.shadows(), rows, strategy, schemaOnly)
+	if err != nil {
+		return nil, fmt.Errorf("can't create backup manifest: %v", err)
+	}
+	if frozen, err := local.created(); err == nil {
+		manifest.Frozen = frozen.UTC()
+	}
+	return manifest, nil
+}
+
+// putManifest - put manifest to dstPath on s3
+func putManifest(ctx context.Context, s3 *S3, manifest *BackupManifest, dstPath string) error {
+	content, err := manifest.Marshal()
+	if err != nil {
+		return fmt.Errorf("can't create backup manifest: %v", err)
+	}
+	logger.Infof("upload manifest")
+	if err := s3.UploadContent(ctx, content, dstPath); err != nil {
+		return fmt.Errorf("can't upload manifest: %v", err)
 	}
 	return nil
 }
 
-func upload(config Config, dryRun bool) error {
+func download(ctx context.Context, config Config, args []string, dryRun bool, chownValue string) error {
+	var chown *fileOwner
+	if chownValue != "" {
+		var err error
+		if chown, err = parseOwner(chownValue); err != nil {
+			return fmt.Errorf("bad --chown: %v", err)
+		}
+	}
 	dataPath := config.ClickHouse.DataPath
 	if dataPath == "" {
 		ch := &ClickHouse{
@@ -384,7 +2478,7 @@ func upload(config Config, dryRun bool) error {
 			Config: &config.ClickHouse,
 		}
 		if err := ch.Connect(); err != nil {
-			return fmt.Errorf("can't connect to clickhouse to get data path with: %v\nyou can set clickhouse.data_path in config", err)
+			return connectionError(fmt.Errorf("can't connect to clickhouse for get data path with: %v\nyou can set clickhouse.data_path in config", err))
 		}
 		defer ch.Close()
 		var err error
@@ -392,27 +2486,60 @@ func upload(config Config, dryRun bool) error {
 			return fmt.Errorf("can't get data path from clickhouse with: %v\nyou can set data_path in config file", err)
 		}
 	}
+	dirMode, err := parseFileMode("backup.dir_mode", config.Backup.DirMode)
+	if err != nil {
+		return err
+	}
+	fileMode, err := parseFileMode("backup.file_mode", config.Backup.FileMode)
+	if err != nil {
+		return err
+	}
 	s3 := &S3{
-		DryRun: dryRun,
-		Config: &config.S3,
+		DryRun:   dryRun,
+		Config:   &config.S3,
+		DirMode:  dirMode,
+		FileMode: fileMode,
 	}
 	if err := s3.Connect(); err != nil {
-		return fmt.Errorf("can't connect to s3 with: %v", err)
+		return connectionError(fmt.Errorf("can't connect to s3 with: %v", err))
 	}
+	backupPath := path.Join(dataPath, config.ClickHouse.BackupDir)
 	backupStrategy := config.Backup.Strategy
 	switch backupStrategy {
 	case "tree":
-		err := uploadTree(s3, dataPath)
+		name, tables := parseArgsForDownloadTree(config, args)
+		backupName, err := resolveTreeBackup(config, s3, name)
 		if err != nil {
 			return err
 		}
+		metricsFromContext(ctx).setBackup(backupName)
+		if err := downloadTree(ctx, s3, backupPath, backupName, tables); err != nil {
+			return err
+		}
+		if chown != nil && !dryRun {
+			if err := chownTree(backupPath, chown); err != nil {
+				return fmt.Errorf("can't change owner of '%s' with: %v", backupPath, err)
+			}
+			logger.Infof("Owner of '%s' is changed to %s", backupPath, chownValue)
+		}
 	case "archive":
-		err := uploadArchive(s3, dataPath)
+		name, tables := parseArgsForDownload(args)
+		filename, err := resolveArchive(ctx, config, s3, name)
 		if err != nil {
 			return err
 		}
-		if err := removeOldBackups(config, s3); err != nil {
-			return fmt.Errorf("can't remove old backups: %v", err)
+		metricsFromContext(ctx).setBackup(filename)
+		if isArchiveSet(filename) {
+			if err := downloadTableArchives(ctx, s3, backupPath, filename, tables, chown, config.Backup.TempDir()); err != nil {
+				return err
+			}
+			break
+		}
+		if len(tables) > 0 {
+			return fmt.Errorf("tables can be selected only for backup uploaded with backup.archive_granularity table")
+		}
+		if err := downloadArchive(ctx, s3, backupPath, filename, chown, config.Backup.TempDir()); err != nil {
+			return err
 		}
 	default:
 		return fmt.Errorf("unsupported backup strategy")
@@ -420,159 +2547,517 @@ func upload(config Config, dryRun bool) error {
 	return nil
 }
 
-func uploadTree(s3 *S3, dataPath string) error {
-	log.Printf("upload metadata")
-	if err := s3.UploadDirectory(path.Join(dataPath, "metadata"), "metadata"); err != nil {
-		return fmt.Errorf("can't upload metadata: %v", err)
+// resolveTreeBackup - return prefix of tree backup with specified name on s3, the newest one is used by default
+func resolveTreeBackup(config Config, s3 *S3, name string) (string, error) {
+	if name == "" && config.Backup.TreeLayout == "flat" {
+		return "", nil
+	}
+	backups, err := getRemoteBackups(config, s3)
+	if err != nil {
+		return "", s3RequestError(err, fmt.Errorf("can't list backups on s3 with: %v", err))
+	}
+	if len(backups) == 0 {
+		return "", fmt.Errorf("there are no backups on s3")
+	}
+	backup := backups[0]
+	if name != "" {
+		if backup, err = findRemoteBackup(backups, name); err != nil {
+			return "", err
+		}
+	}
+	logger.Infof("Use backup '%s'", backup.Name)
+	if backup.Name == flatBackupName {
+		return "", nil
+	}
+	return backup.Name, nil
+}
+
+// downloadTree - download metadata and shadows of backup, only tables matched by [db].[table] patterns are downloaded
+// if they are passed
+func downloadTree(ctx context.Context, s3 *S3, backupPath string, backupName string, tables []string) error {
+	// manifest is downloaded first, keys of other files depend on layout stored in it
+	manifest, err := downloadManifest(ctx, s3, path.Join(backupName, manifestName), backupPath, backupName)
+	if err != nil {
+		return err
+	}
+	if manifest != nil {
+		if s3.Layout, err = newKeyLayout(manifest.KeyLayout, manifest.KeySeparator); err != nil {
+			return fmt.Errorf("can't read key layout of backup: %v", err)
+		}
+	}
+	var metadataFilter, shadowFilter func(key string) bool
+	var matcher *tableMatcher
+	if len(tables) > 0 {
+		var err error
+		if matcher, err = newTableMatcher(tables, false); err != nil {
+			return err
+		}
+		matched := 0
+		// metadata/<db>/<table>.sql, files of databases aren't used by create-tables
+		metadataFilter = func(key string) bool {
+			parts := strings.Split(strings.Trim(key, "/"), "/")
+			if len(parts) != 2 || !strings.HasSuffix(parts[1], ".sql") || !matcher.Match(parts[0], strings.TrimSuffix(parts[1], ".sql")) {
+				return false
+			}
+			matched++
+			return true
+		}
+		// shadow/<increment>/data/<db>/<table>/<part>/<file>
+		shadowFilter = func(key string) bool {
+			parts := strings.Split(strings.Trim(key, "/"), "/")
+			return len(parts) > 4 && parts[1] == "data" && matcher.Match(parts[2], parts[3])
+		}
+		if err := s3.DownloadTreeFiltered(ctx, path.Join(backupName, "metadata"), path.Join(backupPath, "metadata"), metadataFilter); err != nil {
+			return fmt.Errorf("cat't download metadata from s3 with %v", err)
+		}
+		if matched == 0 {
+			return fmt.Errorf("there are no tables matched by %s in backup", strings.Join(tables, ", "))
+		}
+		logger.Infof("Download %d tables", matched)
+	} else if err := s3.DownloadTree(ctx, path.Join(backupName, "metadata"), path.Join(backupPath, "metadata")); err != nil {
+		return fmt.Errorf("cat't download metadata from s3 with %v", err)
+	}
+	if manifest != nil && matcher != nil {
+		// manifest must describe only downloaded tables to be validated by restore
+		if err := writeManifestOfTables(manifest, matcher, path.Join(backupPath, manifestName), s3.DryRun); err != nil {
+			return err
+		}
+	}
+	if manifest != nil && manifest.SchemaOnly {
+		logger.Infof("backup is schema-only, there is no data to download")
+		return nil
 	}
-	log.Printf("upload data")
-	if err := s3.UploadDirectory(path.Join(dataPath, "shadow"), "shadow"); err != nil {
-		return fmt.Errorf("can't upload data: %v", err)
+	disks, err := remoteDisks(s3, backupName)
+	if err != nil {
+		return fmt.Errorf("can't list disks of backup on s3 with %v", err)
+	}
+	for _, disk := range disks {
+		shadowKey := diskShadowKey(disk)
+		if err := s3.DownloadTreeFiltered(ctx, path.Join(backupName, shadowKey), path.Join(backupPath, shadowKey), shadowFilter); err != nil {
+			return fmt.Errorf("can't download %s from s3 with %v", shadowKey, err)
+		}
+	}
+	if manifest != nil && manifest.DiffFrom != "" {
+		return downloadBaseParts(ctx, s3, backupPath, manifest)
 	}
 	return nil
 }
 
-func uploadArchive(s3 *S3, dataPath string) error {
-	file, err := ioutil.TempFile("", "*.tar")
+// remoteDisks - return names of disks which shadows are stored in tree backup
+func remoteDisks(s3 *S3, backupName string) ([]string, error) {
+	prefix := path.Join(s3.Config.Path, backupName, "disks") + "/"
+	objects, err := s3.ListObjects(strings.TrimPrefix(prefix, "/"))
+	if err != nil {
+		return nil, err
+	}
+	disks := []string{defaultDiskName}
+	seen := map[string]bool{defaultDiskName: true}
+	for _, object := range objects {
+		parts := strings.SplitN(strings.TrimPrefix(*object.Key, strings.TrimPrefix(prefix, "/")), "/", 2)
+		if len(parts) == 2 && !seen[parts[0]] {
+			seen[parts[0]] = true
+			disks = append(disks, parts[0])
+		}
+	}
+	return disks, nil
+}
+
+// downloadArchive - extract metadata and shadows from archive to backup directory, metadata for create-tables
+// is taken from the same archive
+func downloadArchive(ctx context.Context, s3 *S3, backupPath string, filename string, chown *fileOwner, tmpDir string) error {
+	dstPath := backupPath
+	manifest, err := downloadManifest(ctx, s3, filename+manifestSuffix, dstPath, filename)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(file.Name())
-	log.Printf("archive data")
-	if err = TarDirs(file, path.Join(dataPath, "shadow"), path.Join(dataPath, "metadata")); err != nil {
-		return fmt.Errorf("error achiving data with: %v", err)
+	parts := []string{filename}
+	if manifest != nil && len(manifest.Parts) > 0 {
+		parts = manifest.Parts
+	}
+	if s3.DryRun {
+		logger.Infof("Download and extract '%s' to '%s'", strings.Join(parts, ", "), dstPath)
+		return nil
+	}
+	// metadata and shadows are taken only from archive, so files of previous download must not be mixed with them
+	for _, key := range []string{"metadata", "shadow", "disks"} {
+		if err := os.RemoveAll(path.Join(dstPath, key)); err != nil {
+			return fmt.Errorf("can't remove previously downloaded %s with: %v", key, err)
+		}
+	}
+	return downloadAndUntar(ctx, s3, parts, dstPath, chown, tmpDir, manifest != nil && manifest.ContentSHA256 != "")
+}
+
+// downloadAndUntar - extract archive while it is downloaded, so it isn't stored on disk, or download it to tmpDir
+// by parallel ranges first if s3.archive_concurrency is set. Parts of archive split by backup.max_archive_size
+// are downloaded one after another and are read as single stream. Archive must have embedded checksums
+// if requireChecksums is set, it's set when manifest has content_sha256
+func downloadAndUntar(ctx context.Context, s3 *S3, parts []string, dstPath string, chown *fileOwner, tmpDir string, requireChecksums bool) error {
+	if err := mkdirAllMode(dstPath, s3.dirMode()); err != nil {
+		return fmt.Errorf("can't create '%s' with: %v", dstPath, err)
+	}
+	filename := archivePartRe.ReplaceAllString(parts[0], "")
+	if len(parts) > 1 {
+		logger.Infof("Download %d parts of '%s'", len(parts), filename)
+	}
+	var body io.ReadCloser
+	if s3.Config.ArchiveConcurrency > 0 {
+		files, err := downloadArchiveFiles(ctx, s3, parts, tmpDir)
+		if err != nil {
+			// partially downloaded files are kept, so the next download resumes them
+			return err
+		}
+		defer func() {
+			for _, file := range files {
+				removeDownload(file)
+			}
+		}()
+		if body, err = openFiles(files); err != nil {
+			return err
+		}
+	} else {
+		body = s3.DownloadStreams(ctx, parts)
+	}
+	defer body.Close()
+	archive, err := decompressArchive(body, filename)
+	if err != nil {
+		return err
 	}
-	log.Printf("upload data")
-	if err := s3.UploadFile(file.Name(), filepath.Base(file.Name())); err != nil {
-		return fmt.Errorf("can't upload archive to s3 with: %v", err)
+	defer archive.Close()
+	if err := Untar(ctx, archive, dstPath, chown, s3.dirMode(), requireChecksums); err != nil {
+		return fmt.Errorf("error unarchiving '%s' while downloading: %v", filename, err)
 	}
 	return nil
 }
 
-func download(config Config, args []string, dryRun bool) error {
-	dataPath := config.ClickHouse.DataPath
-	if dataPath == "" {
-		ch := &ClickHouse{
-			DryRun: dryRun,
-			Config: &config.ClickHouse,
+// downloadArchiveFiles - download parts of archive to files in tmpDir, download of part which is interrupted
+// is resumed from its file by the next call
+func downloadArchiveFiles(ctx context.Context, s3 *S3, parts []string, tmpDir string) ([]string, error) {
+	var files []string
+	for _, part := range parts {
+		file := filepath.Join(tmpDir, "clickhouse-backup-"+path.Base(part))
+		files = append(files, file)
+		logger.Infof("Download '%s' to '%s' by %d ranges at the same time", part, file, s3.Config.ArchiveConcurrency)
+		if err := s3.DownloadArchiveFile(ctx, part, file); err != nil {
+			return files, err
 		}
-		if err := ch.Connect(); err != nil {
-			return fmt.Errorf("can't connect to clickhouse for get data path with: %v\nyou can set clickhouse.data_path in config", err)
+	}
+	return files, nil
+}
+
+// multiFileReader - read files one after another, all of them are closed by Close
+type multiFileReader struct {
+	io.Reader
+	files []*os.File
+}
+
+// openFiles - open files for reading as single stream
+func openFiles(paths []string) (io.ReadCloser, error) {
+	r := &multiFileReader{}
+	readers := make([]io.Reader, 0, len(paths))
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("can't open '%s' with: %v", p, err)
 		}
-		defer ch.Close()
-		var err error
-		if dataPath, err = ch.GetDataPath(); err != nil || dataPath == "" {
-			return fmt.Errorf("can't get data path from clickhouse with: %v\nyou can set data_path in config file", err)
+		r.files = append(r.files, f)
+		readers = append(readers, f)
+	}
+	r.Reader = io.MultiReader(readers...)
+	return r, nil
+}
+
+func (r *multiFileReader) Close() error {
+	var err error
+	for _, f := range r.files {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// writeManifestOfTables - keep only tables matched by matcher in manifest and write it to manifestPath
+func writeManifestOfTables(manifest *BackupManifest, matcher *tableMatcher, manifestPath string, dryRun bool) error {
+	tables := []ManifestTable{}
+	for _, table := range manifest.Tables {
+		if matcher.Match(table.Database, table.Name) {
+			tables = append(tables, table)
+		}
+	}
+	manifest.Tables = tables
+	if dryRun {
+		return nil
+	}
+	content, err := manifest.Marshal()
+	if err != nil {
+		return fmt.Errorf("can't create manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(manifestPath, content, 0644); err != nil {
+		return fmt.Errorf("can't write manifest: %v", err)
+	}
+	return nil
+}
+
+// downloadManifest - get manifest from s3Path to backupPath, backups without manifest won't be validated.
+// Name of downloaded backup is kept in manifest for hooks of restore
+func downloadManifest(ctx context.Context, s3 *S3, s3Path string, backupPath string, backupName string) (*BackupManifest, error) {
+	manifestPath := path.Join(backupPath, manifestName)
+	content, err := s3.DownloadContent(ctx, s3Path)
+	if isNotFoundError(err) {
+		logger.Infof("backup doesn't have manifest, it won't be validated before restore")
+		if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("can't remove stale manifest: %v", err)
 		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't download manifest from s3 with %v", err)
+	}
+	manifest, err := ParseBackupManifest(content)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse manifest '%s': %v", s3Path, err)
+	}
+	manifest.Name = backupName
+	if s3.DryRun {
+		logger.Infof("Download '%s' to '%s'", s3Path, manifestPath)
+		return manifest, nil
+	}
+	if content, err = manifest.Marshal(); err != nil {
+		return nil, fmt.Errorf("can't create manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(manifestPath, content, 0644); err != nil {
+		return nil, fmt.Errorf("can't write manifest: %v", err)
 	}
+	return manifest, nil
+}
+
+func verify(ctx context.Context, config Config, args []string) error {
 	s3 := &S3{
-		DryRun: dryRun,
 		Config: &config.S3,
 	}
 	if err := s3.Connect(); err != nil {
-		return fmt.Errorf("can't connect to s3 with: %v", err)
+		return connectionError(fmt.Errorf("can't connect to s3 with: %v", err))
 	}
-	backupStrategy := config.Backup.Strategy
-	switch backupStrategy {
+	checksumsPath := checksumsName
+	backupName := ""
+	switch config.Backup.Strategy {
 	case "tree":
-		err := downloadTree(s3, dataPath)
-		if err != nil {
+		var err error
+		name, _ := parseArgsForDownload(args)
+		if backupName, err = resolveTreeBackup(config, s3, name); err != nil {
 			return err
 		}
+		checksumsPath = path.Join(backupName, checksumsName)
 	case "archive":
-		filename := parseArgsForDownload(args)
-		if filename == "" {
-			return fmt.Errorf("an argument needs to be passed to download with archive strategy")
-		}
-		err := downloadArchive(s3, dataPath, filename)
+		name, _ := parseArgsForDownload(args)
+		filename, err := resolveArchive(ctx, config, s3, name)
 		if err != nil {
 			return err
 		}
+		checksumsPath = filename + checksumsSuffix
+		if isArchiveSet(filename) {
+			// keys of checksums are names of archives inside backup prefix
+			backupName = filename
+			checksumsPath = path.Join(filename, checksumsName)
+		}
 	default:
 		return fmt.Errorf("unsupported backup strategy")
 	}
-	return nil
-}
-
-func downloadTree(s3 *S3, dataPath string) error {
-	if err := s3.DownloadTree("metadata", path.Join(dataPath, "backup", "metadata")); err != nil {
-		return fmt.Errorf("cat't download metadata from s3 with %v", err)
+	content, err := s3.DownloadContent(ctx, checksumsPath)
+	if err != nil {
+		return fmt.Errorf("can't download %s from s3 with %v", checksumsPath, err)
+	}
+	checksums, err := ParseChecksums(content)
+	if err != nil {
+		return fmt.Errorf("can't parse %s: %v", checksumsPath, err)
+	}
+	keys := make([]string, 0, len(checksums))
+	for key := range checksums {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	failed := 0
+	for _, key := range keys {
+		actual, err := checksumObject(ctx, s3, path.Join(backupName, key))
+		if err != nil {
+			logger.WithField("key", key).Errorf("can't read object: %v", err)
+			failed++
+			continue
+		}
+		if actual != checksums[key] {
+			logger.WithFields(Fields{"key": key, "expected": checksums[key], "actual": actual}).Error("checksum mismatch")
+			failed++
+		}
 	}
-	if err := s3.DownloadTree("shadow", path.Join(dataPath, "backup", "shadow")); err != nil {
-		return fmt.Errorf("can't download shadow from s3 with %v", err)
+	if failed > 0 {
+		return fmt.Errorf("verification failed for %d of %d objects", failed, len(keys))
 	}
+	logger.Infof("%d objects are verified", len(keys))
 	return nil
 }
 
-func downloadArchive(s3 *S3, dataPath string, filename string) error {
-	if err := s3.DownloadTree("metadata", path.Join(dataPath, "backup", "metadata")); err != nil {
-		return fmt.Errorf("cat't download metadata from s3 with %v", err)
-	}
-	dstPath := path.Join(dataPath, "backup")
-	err := s3.DownloadArchive(filename, dstPath)
-	if err != nil {
-		return fmt.Errorf("error downloading shadow from s3 with %v", err)
+func checksumObject(ctx context.Context, s3 *S3, s3Path string) (string, error) {
+	body, err := s3.DownloadStream(ctx, s3Path)
+	if isNotFoundError(err) {
+		// file of tree can be compressed on upload by s3.tree_compression
+		return checksumCompressedObject(ctx, s3, s3Path+gzipSuffix)
 	}
-	archivePath := filepath.Join(dstPath, filepath.Base(filename))
-	defer os.Remove(archivePath)
-	archiveFile, err := os.Open(archivePath)
 	if err != nil {
-		return fmt.Errorf("error opening archive: %v", err)
+		return "", err
 	}
-	if err := Untar(archiveFile, dstPath); err != nil {
-		return fmt.Errorf("error unarchiving: %v", err)
-	}
-	return nil
+	defer body.Close()
+	return checksumReader(body)
 }
 
-func clean(config Config, dryRun bool) error {
-	dataPath := config.ClickHouse.DataPath
-	if dataPath == "" {
-		ch := &ClickHouse{
-			DryRun: dryRun,
-			Config: &config.ClickHouse,
+// clean - remove local backups passed in args, without args remove contents of shadow and all local backups
+func clean(config Config, args []string, dryRun bool) error {
+	disks, err := getDisks(config)
+	if err != nil {
+		return err
+	}
+	names := args
+	if len(names) == 0 {
+		if names, err = getLocalBackups(disks); err != nil {
+			return fmt.Errorf("can't list local backups with: %v", err)
 		}
-		if err := ch.Connect(); err != nil {
-			return fmt.Errorf("can't connect to clickhouse to get data path with: %v\nyou can set clickhouse.data_path in config", err)
+	}
+	for _, name := range names {
+		if !isLocalBackupName(name) {
+			return fmt.Errorf("'%s' is not a name of local backup", name)
 		}
-		defer ch.Close()
-		var err error
-		if dataPath, err = ch.GetDataPath(); err != nil || dataPath == "" {
-			return fmt.Errorf("can't get data path from clickhouse with: %v\nyou can set data_path in config file", err)
+		if err := removeLocalBackup(disks, name, dryRun); err != nil {
+			return err
 		}
 	}
-	shadowDir := path.Join(dataPath, "shadow")
-	if _, err := os.Stat(shadowDir); os.IsNotExist(err) {
-		log.Printf("%s directory does not exist, nothing to do", shadowDir)
+	if len(args) > 0 {
 		return nil
 	}
-	log.Printf("remove contents from directory %v", shadowDir)
-	if !dryRun {
+	var entries []string
+	for _, disk := range disks {
+		shadowDir := disk.shadowPath()
+		if _, err := os.Stat(shadowDir); os.IsNotExist(err) {
+			logger.Infof("%s directory does not exist, nothing to do", shadowDir)
+			continue
+		}
+		logger.Infof("remove contents from directory %v", shadowDir)
+		if dryRun {
+			dirEntries, err := logShadowEntries(shadowDir)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, dirEntries...)
+			continue
+		}
 		if err := cleanDir(shadowDir); err != nil {
 			return fmt.Errorf("can't remove contents from directory %v: %v", shadowDir, err)
 		}
 	}
+	if !dryRun || len(entries) == 0 {
+		return nil
+	}
+	reclaimed, err := reclaimableSize(entries)
+	if err != nil {
+		return fmt.Errorf("can't get size of shadow with: %v", err)
+	}
+	logger.Infof("DRY-RUN: %d entries of shadow would be removed, %s would be reclaimed", len(entries), formatBytes(reclaimed))
 	return nil
 }
 
-func removeOldBackups(config Config, s3 *S3) error {
-	if config.Backup.BackupsToKeep < 1 {
-		log.Printf("Cleaning old backups is not enabled.")
+// logShadowEntries - log every top-level entry of shadowDir with its size, hard links inside entry are counted once
+func logShadowEntries(shadowDir string) ([]string, error) {
+	names, err := ioutil.ReadDir(shadowDir)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s with: %v", shadowDir, err)
+	}
+	entries := make([]string, 0, len(names))
+	for _, fi := range names {
+		entry := path.Join(shadowDir, fi.Name())
+		size, err := dirSize(entry, make(map[devino]bool))
+		if err != nil {
+			return nil, fmt.Errorf("can't get size of %s with: %v", entry, err)
+		}
+		logger.Infof("DRY-RUN: remove %s (%s)", entry, formatBytes(size))
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func removeOldBackups(ctx context.Context, config Config, s3 *S3) error {
+	if config.Backup.BackupsToKeep < 1 && config.Backup.KeepDays < 1 {
+		logger.Infof("Cleaning old backups is not enabled.")
 		return nil
 	}
-	objects, err := s3.ListObjects(config.S3.Path)
+	backups, err := getRemoteBackups(config, s3)
 	if err != nil {
 		return err
 	}
-	backupsToDelete := len(objects) - config.Backup.BackupsToKeep
-	if backupsToDelete > 0 {
-		sort.Slice(objects, func(i, j int) bool {
-			return objects[i].LastModified.Sub(*objects[j].LastModified) < 0
-		})
-		log.Printf("Delete %d objects from s3\n", backupsToDelete)
-		if err := s3.DeleteObjects(objects[:backupsToDelete]); err != nil {
+	latest, err := downloadLatest(ctx, s3)
+	if err != nil {
+		return err
+	}
+	latestName := ""
+	if latest != nil {
+		latestName = latest.Name
+	}
+	expired := keepSafeguarded(backups, expiredBackups(backups, config.Backup.BackupsToKeep, config.Backup.KeepDays, time.Now()), latestName)
+	if config.Backup.Strategy == "tree" {
+		if expired, err = keepBases(ctx, s3, backups, expired); err != nil {
+			return err
+		}
+	}
+	if len(expired) > 0 {
+		keys := []string{}
+		for _, backup := range expired {
+			logger.WithFields(Fields{"backup": backup.Name, "bytes": backup.Size}).Info("Delete backup")
+			keys = append(keys, backup.Keys...)
+		}
+		logger.WithField("objects", len(keys)).Info("Delete objects from s3")
+		if err := s3.DeleteObjects(keys); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// keepSafeguarded - remove from expired backups the newest complete backup which has manifest and checksums
+// and backup of latest pointer, so retention never leaves s3 without usable backup
+func keepSafeguarded(backups []RemoteBackup, expired []RemoteBackup, latest string) []RemoteBackup {
+	newestComplete := ""
+	for _, backup := range backups {
+		if backup.complete() {
+			newestComplete = backup.Name
+			break
+		}
+	}
+	var result []RemoteBackup
+	for _, backup := range expired {
+		switch backup.Name {
+		case newestComplete:
+			logger.WithField("backup", backup.Name).Warn("Backup is expired but it isn't deleted, it's the newest complete backup")
+		case latest:
+			logger.WithField("backup", backup.Name).Warn("Backup is expired but it isn't deleted, it's referenced by latest pointer")
+		default:
+			result = append(result, backup)
+		}
+	}
+	return result
+}
+
+// expiredBackups - return backups which are kept neither by backups_to_keep nor by keep_days,
+// backups must be sorted from newest to oldest, rule with value less than 1 is disabled
+func expiredBackups(backups []RemoteBackup, keepCount int, keepDays int, now time.Time) []RemoteBackup {
+	if keepCount < 1 && keepDays < 1 {
+		return nil
+	}
+	threshold := now.AddDate(0, 0, -keepDays)
+	var expired []RemoteBackup
+	for i, backup := range backups {
+		keptByCount := keepCount > 0 && i < keepCount
+		keptByAge := keepDays > 0 && !backup.LastModified.Before(threshold)
+		if !keptByCount && !keptByAge {
+			expired = append(expired, backup)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func restoreTableNames(tables []BackupTable) []string {
+	names := []string{}
+	for _, t := range tables {
+		names = append(names, t.Database+"."+t.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestParseArgsForFreezeExclude(t *testing.T) {
+	tables := []Table{
+		{Database: "db", Name: "events"},
+		{Database: "db", Name: "events_tmp"},
+		{Database: "logs", Name: "raw"},
+	}
+	result, err := parseArgsForFreeze(tables, []string{"db.*"}, []string{"db.*_tmp"}, false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Table{{Database: "db", Name: "events"}}, result)
+
+	result, err = parseArgsForFreeze(tables, nil, []string{"logs.*"}, false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Table{{Database: "db", Name: "events"}, {Database: "db", Name: "events_tmp"}}, result)
+
+	result, err = parseArgsForFreeze(tables, []string{"db.events"}, []string{"db.events"}, false, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+
+	result, err = parseArgsForFreeze(tables, []string{"db\\.events.*"}, []string{"*_tmp"}, true, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Table{{Database: "db", Name: "events"}}, result)
+}
+
+func TestFilterFreezableTables(t *testing.T) {
+	tables := []Table{
+		{Database: "db", Name: "events", Engine: "ReplicatedMergeTree"},
+		{Database: "db", Name: "queue", Engine: "Kafka"},
+		{Database: "db", Name: "daily", Engine: "AggregatingMergeTree"},
+		{Database: "db", Name: "view", Engine: "View"},
+		{Database: "db", Name: "unknown"},
+	}
+	freezable, skipped := filterFreezableTables(tables)
+	assert.Equal(t, []Table{tables[0], tables[2], tables[4]}, freezable)
+	assert.Equal(t, []Table{tables[1], tables[3]}, skipped)
+}
+
+func TestFrozenTablesMatch(t *testing.T) {
+	tables := []Table{
+		{Database: "db", Name: "events"},
+		{Database: "db", Name: "daily"},
+	}
+	frozen := newFrozenTables(tables, []string{"202002", "202001"}, true)
+	assert.Equal(t, []string{"db.daily", "db.events"}, frozen.Tables)
+	assert.Equal(t, []string{"202001", "202002"}, frozen.Partitions)
+
+	assert.NoError(t, frozen.match(newFrozenTables([]Table{tables[1], tables[0]}, []string{"202001", "202002"}, false)))
+	assert.Error(t, frozen.match(newFrozenTables(tables[:1], []string{"202001", "202002"}, true)))
+	assert.Error(t, frozen.match(newFrozenTables(append(tables, Table{Database: "db", Name: "new"}), []string{"202001", "202002"}, true)))
+	assert.Error(t, frozen.match(newFrozenTables(tables, nil, true)))
+	assert.Error(t, newFrozenTables(tables, nil, false).match(newFrozenTables(tables, nil, true)))
+}
+
+func TestParseArgsForFreezeSkipDatabases(t *testing.T) {
+	tables := []Table{
+		{Database: "db", Name: "events"},
+		{Database: "system", Name: "query_log"},
+		{Database: "information_schema", Name: "tables"},
+	}
+	skip := []string{"system", "information_schema"}
+	result, err := parseArgsForFreeze(tables, nil, nil, false, skip)
+	assert.NoError(t, err)
+	assert.Equal(t, []Table{{Database: "db", Name: "events"}}, result)
+
+	result, err = parseArgsForFreeze(tables, []string{"*.*"}, nil, false, skip)
+	assert.NoError(t, err)
+	assert.Equal(t, []Table{{Database: "db", Name: "events"}}, result)
+
+	result, err = parseArgsForFreeze(tables, []string{"system.*"}, nil, false, skip)
+	assert.NoError(t, err)
+	assert.Equal(t, []Table{{Database: "system", Name: "query_log"}}, result)
+
+	result, err = parseArgsForFreeze(tables, []string{"system\\.query_.*"}, nil, true, skip)
+	assert.NoError(t, err)
+	assert.Equal(t, []Table{{Database: "system", Name: "query_log"}}, result)
+}
+
+func TestParseArgsForRestoreExclude(t *testing.T) {
+	tables := map[string]BackupTable{
+		"db.events-0":     {Database: "db", Name: "events", Increment: 0},
+		"db.events_tmp-0": {Database: "db", Name: "events_tmp", Increment: 0},
+		"logs.raw-0":      {Database: "logs", Name: "raw", Increment: 0},
+	}
+	result, err := parseArgsForRestore(tables, nil, []string{"*_tmp"}, nil, false, false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db.events", "logs.raw"}, restoreTableNames(result))
+
+	result, err = parseArgsForRestore(tables, []string{"db.events_tmp"}, []string{"db.*"}, nil, false, false, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+
+	result, err = parseArgsForRestore(tables, []string{"*"}, []string{"logs.raw", "db.events"}, nil, false, false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db.events_tmp"}, restoreTableNames(result))
+}
+
+func TestParseArgsInvalidPattern(t *testing.T) {
+	_, err := parseArgsForFreeze([]Table{{Database: "db", Name: "t"}}, []string{"db.("}, nil, true, nil)
+	assert.Error(t, err)
+	_, err = parseArgsForRestore(map[string]BackupTable{}, nil, []string{"db.["}, nil, false, false, nil)
+	assert.Error(t, err)
+}
+
+func TestExpiredBackups(t *testing.T) {
+	now := time.Date(2019, 5, 31, 12, 0, 0, 0, time.UTC)
+	backups := []RemoteBackup{
+		{Name: "1", LastModified: now.AddDate(0, 0, -1)},
+		{Name: "2", LastModified: now.AddDate(0, 0, -10)},
+		{Name: "3", LastModified: now.AddDate(0, 0, -20)},
+		{Name: "4", LastModified: now.AddDate(0, 0, -40)},
+		{Name: "5", LastModified: now.AddDate(0, 0, -50)},
+	}
+	names := func(backups []RemoteBackup) []string {
+		result := []string{}
+		for _, backup := range backups {
+			result = append(result, backup.Name)
+		}
+		return result
+	}
+	assert.Empty(t, expiredBackups(backups, 0, 0, now))
+	assert.Equal(t, []string{"3", "4", "5"}, names(expiredBackups(backups, 2, 0, now)))
+	assert.Equal(t, []string{"4", "5"}, names(expiredBackups(backups, 0, 30, now)))
+	// backup is deleted only if it is kept by neither of rules
+	assert.Equal(t, []string{"4", "5"}, names(expiredBackups(backups, 2, 30, now)))
+	assert.Equal(t, []string{"5"}, names(expiredBackups(backups, 4, 30, now)))
+	assert.Equal(t, []string{"3", "4", "5"}, names(expiredBackups(backups, 1, 15, now)))
+}
+
+func TestKeepSafeguarded(t *testing.T) {
+	complete := []string{"b.tar", "b.tar.manifest.json", "b.tar.checksums.txt"}
+	backups := []RemoteBackup{
+		{Name: "c.tar", Keys: []string{"c.tar"}},
+		{Name: "b.tar", Keys: complete},
+		{Name: "a.tar", Keys: []string{"a.tar", "a.tar.manifest.json", "a.tar.checksums.txt"}},
+	}
+	names := func(backups []RemoteBackup) []string {
+		result := []string{}
+		for _, backup := range backups {
+			result = append(result, backup.Name)
+		}
+		return result
+	}
+	// incomplete backup isn't protected, the newest complete one is kept
+	assert.Equal(t, []string{"c.tar", "a.tar"}, names(keepSafeguarded(backups, backups, "")))
+	assert.Equal(t, []string{"c.tar"}, names(keepSafeguarded(backups, backups, "a.tar")))
+	assert.Equal(t, []string{"a.tar"}, names(keepSafeguarded(backups, backups[2:], "")))
+}
+
+func TestParseArgsForRestorePartitions(t *testing.T) {
+	tables := map[string]BackupTable{
+		"db.events-0": {Database: "db", Name: "events", Increment: 0, Partitions: []BackupPartition{
+			{Name: "20190125_1_1_0"}, {Name: "20190125_2_2_0"}, {Name: "20190126_3_3_0"},
+		}},
+		"db.events-1": {Database: "db", Name: "events", Increment: 1, Partitions: []BackupPartition{
+			{Name: "20190126_4_4_0"},
+		}},
+		"db.legacy-0": {Database: "db", Name: "legacy", Increment: 0, Partitions: []BackupPartition{
+			{Name: "20190101_20190131_1_1_0"},
+		}},
+	}
+	result, err := parseArgsForRestore(tables, []string{"db.events"}, nil, []int{0}, false, false, []string{"20190125"})
+	assert.NoError(t, err)
+	assert.Len(t, result, 1)
+	assert.Equal(t, []BackupPartition{{Name: "20190125_1_1_0"}, {Name: "20190125_2_2_0"}}, result[0].Partitions)
+
+	result, err = parseArgsForRestore(tables, nil, nil, nil, false, false, []string{"20190126", "201901"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db.events", "db.events", "db.legacy"}, restoreTableNames(result))
+
+	_, err = parseArgsForRestore(tables, []string{"db.legacy"}, nil, nil, false, false, []string{"20190125"})
+	assert.Error(t, err)
+
+	result, err = parseArgsForRestore(tables, []string{"db.*"}, []string{"db.legacy"}, nil, true, false, nil)
+	assert.NoError(t, err)
+	assert.Len(t, result, 1)
+	assert.Equal(t, 1, result[0].Increment)
+
+	// partitions are selected from the newest increment only
+	_, err = parseArgsForRestore(tables, []string{"db.events"}, nil, nil, true, false, []string{"20190125"})
+	assert.Error(t, err)
+}
+
+func TestExpandS3Path(t *testing.T) {
+	hostname, err := os.Hostname()
+	assert.NoError(t, err)
+	config := defaultConfig()
+	config.ClickHouse.Cluster = "main"
+	config.S3.Path = "backups/{cluster}/{hostname}/{date}"
+	assert.NoError(t, validateConfig(config))
+	config.S3.PathTemplate = config.S3.Path
+	assert.NoError(t, expandS3Path(config, time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC)))
+	assert.Equal(t, "backups/main/"+hostname+"/2024-03-01", config.S3.Path)
+	assert.Equal(t, "backups/{cluster}/{hostname}/{date}", config.S3.PathTemplate)
+
+	config.S3.Path = "backups/{host}"
+	assert.Error(t, validateConfig(config))
+	config.S3.Path = "backups/{cluster}"
+	config.ClickHouse.Cluster = ""
+	assert.Error(t, validateConfig(config))
+}
+
+func TestOverrideFromEnv(t *testing.T) {
+	env := map[string]string{
+		"CLICKHOUSE_BACKUP_S3_ACCESS_KEY":                  "key",
+		"CLICKHOUSE_BACKUP_S3_SECRET_KEY":                  "secret",
+		"CLICKHOUSE_BACKUP_CLICKHOUSE_PORT":                "9440",
+		"CLICKHOUSE_BACKUP_CLICKHOUSE_SECURE":              "true",
+		"CLICKHOUSE_BACKUP_BACKUP_ACCESS_SKIP_USERS":       "default, admin",
+		"CLICKHOUSE_BACKUP_S3_MAX_UPLOAD_BYTES_PER_SECOND": "1024",
+	}
+	config := defaultConfig()
+	config.S3.AccessKey = "from file"
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	assert.NoError(t, overrideFromEnv(config, lookupEnv))
+	assert.Equal(t, "key", config.S3.AccessKey)
+	assert.Equal(t, "secret", config.S3.SecretKey)
+	assert.Equal(t, uint(9440), config.ClickHouse.Port)
+	assert.True(t, config.ClickHouse.Secure)
+	assert.Equal(t, []string{"default", "admin"}, config.Backup.AccessSkipUsers)
+	assert.Equal(t, int64(1024), config.S3.MaxUploadBytesPerSecond)
+	assert.Equal(t, "localhost", config.ClickHouse.Host)
+
+	env["CLICKHOUSE_BACKUP_CLICKHOUSE_PORT"] = "secure"
+	assert.Error(t, overrideFromEnv(config, lookupEnv))
+}
+
+func TestSelectLocalBackup(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "local-backup")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	for _, dir := range []string{"2020-01-02T00:00:00Z", "2020-01-01T00:00:00Z", "pre-migration", "partial", "metadata", "shadow", "restore_staging"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dataPath, "backup", dir), 0755))
+	}
+	disks := []Disk{{Name: defaultDiskName, Path: dataPath, Dirs: newDirNames(defaultConfig().ClickHouse)}}
+	// backup named by --name is ordered by time of freeze, directory without backup.json isn't a backup
+	named := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for name, created := range map[string]time.Time{
+		"2020-01-02T00:00:00Z": time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		"2020-01-01T00:00:00Z": time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		"pre-migration":        named,
+	} {
+		assert.NoError(t, writeLocalBackupInfo(disks, name, localBackupInfo{Created: created}, false))
+	}
+
+	names, err := getLocalBackups(disks)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2020-01-01T00:00:00Z", "pre-migration", "2020-01-02T00:00:00Z"}, names)
+
+	local, err := selectLocalBackup(disks, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []backupSource{
+		{Key: "metadata", Path: filepath.Join(dataPath, "backup", "2020-01-02T00:00:00Z", "metadata")},
+		{Key: "shadow", Path: filepath.Join(dataPath, "backup", "2020-01-02T00:00:00Z", "shadow")},
+	}, local.sources(false))
+
+	local, err = selectLocalBackup(disks, []string{"2020-01-01T00:00:00Z"})
+	assert.NoError(t, err)
+	assert.Equal(t, "2020-01-01T00:00:00Z", local.Name)
+
+	_, err = selectLocalBackup(disks, []string{"2020-01-03T00:00:00Z"})
+	assert.Error(t, err)
+	_, err = selectLocalBackup(disks, []string{"partial"})
+	assert.Error(t, err)
+
+	local, err = selectLocalBackup(disks, []string{"pre-migration"})
+	assert.NoError(t, err)
+	created, err := local.created()
+	assert.NoError(t, err)
+	assert.True(t, named.Equal(created))
+
+	local, err = selectLocalBackup([]Disk{{Name: defaultDiskName, Path: filepath.Join(dataPath, "missing"), Dirs: newDirNames(defaultConfig().ClickHouse)}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", local.Name)
+}
+
+func TestCreateLocalBackupRemovesIncompleteBackup(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "local-backup")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	partPath := filepath.Join(dataPath, "shadow", "1", "data", "db", "t", "all_1_1_0")
+	assert.NoError(t, os.MkdirAll(partPath, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(partPath, "checksums.txt"), []byte("data"), 0644))
+	disks := []Disk{{Name: defaultDiskName, Path: dataPath, Dirs: newDirNames(defaultConfig().ClickHouse)}}
+
+	// metadata directory is missing, so copy of metadata fails after shadow is moved
+	assert.Error(t, createLocalBackup(disks, "partial", false))
+	_, err = os.Stat(filepath.Join(dataPath, "backup", "partial"))
+	assert.True(t, os.IsNotExist(err))
+	names, err := getLocalBackups(disks)
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+func TestExitCode(t *testing.T) {
+	err := errors.New("can't connect")
+	assert.Equal(t, exitCodeError, exitCode(err))
+	assert.Equal(t, exitCodeConnection, exitCode(connectionError(err)))
+	assert.True(t, isNothingToDo(nothingToDoError(err)))
+	assert.Equal(t, err.Error(), connectionError(err).Error())
+	assert.Equal(t, exitCodeConnection, exitCode(fmt.Errorf("can't upload: %w", connectionError(err))))
+	assert.True(t, isNothingToDo(fmt.Errorf("can't freeze: %w", nothingToDoError(err))))
+}
+
+func TestManifestExpectedRows(t *testing.T) {
+	manifest := &BackupManifest{Tables: []ManifestTable{
+		{Database: "db", Name: "t", Increment: 1, Rows: 10},
+		{Database: "db", Name: "t", Increment: 2, Rows: 5},
+		{Database: "db", Name: "legacy", Increment: 1},
+	}}
+	rows, ok := manifest.ExpectedRows("db", "t", []int{1, 2})
+	assert.True(t, ok)
+	assert.Equal(t, uint64(15), rows)
+	_, ok = manifest.ExpectedRows("db", "t", []int{3})
+	assert.False(t, ok)
+	_, ok = manifest.ExpectedRows("db", "legacy", []int{1})
+	assert.False(t, ok)
+}
+
+func TestDiffBaseApply(t *testing.T) {
+	base := &diffBase{Name: "daily-2", parts: map[string]ManifestPart{}}
+	for _, part := range []ManifestPart{
+		{Name: "all_1_1_0", Disk: "default", Path: "shadow/daily-2/data/db/t/all_1_1_0", Checksum: "a", Base: "daily-1", BasePath: "shadow/daily-1/data/db/t/all_1_1_0"},
+		{Name: "all_2_2_0", Disk: "default", Path: "shadow/daily-2/data/db/t/all_2_2_0", Checksum: "b", Base: "daily-2", BasePath: "shadow/daily-2/data/db/t/all_2_2_0"},
+	} {
+		base.parts[diffPartKey("db", "t", part)] = part
+	}
+	manifest := &BackupManifest{Tables: []ManifestTable{{Database: "db", Name: "t", Parts: []ManifestPart{
+		{Name: "all_1_1_0", Disk: "default", Path: "shadow/daily-3/data/db/t/all_1_1_0", Checksum: "a"},
+		{Name: "all_2_2_0", Disk: "default", Path: "shadow/daily-3/data/db/t/all_2_2_0", Checksum: "changed"},
+		{Name: "all_3_3_0", Disk: "default", Path: "shadow/daily-3/data/db/t/all_3_3_0", Checksum: "c"},
+	}}}}
+	unchanged := base.apply(manifest)
+	assert.Equal(t, "daily-2", manifest.DiffFrom)
+	assert.Equal(t, map[string]bool{"shadow/daily-3/data/db/t/all_1_1_0": true}, unchanged)
+	parts := manifest.Tables[0].Parts
+	assert.Equal(t, "daily-1", parts[0].Base)
+	assert.Equal(t, "shadow/daily-1/data/db/t/all_1_1_0", parts[0].BasePath)
+	assert.Empty(t, parts[1].Base)
+	assert.Empty(t, parts[2].Base)
+
+	skip := skipParts("shadow", unchanged)
+	assert.True(t, skip("daily-3/data/db/t/all_1_1_0/data.bin"))
+	assert.False(t, skip("daily-3/data/db/t/all_3_3_0/data.bin"))
+	assert.Nil(t, skipParts("metadata", nil))
+}
+
+func TestSetTargetDataPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recovery")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := defaultConfig()
+	assert.NoError(t, setTargetDataPath(config, ""))
+	assert.Empty(t, config.ClickHouse.DataPath)
+	assert.NoError(t, setTargetDataPath(config, dir+"/"))
+	assert.Equal(t, dir, config.ClickHouse.DataPath)
+	assert.Error(t, setTargetDataPath(config, filepath.Join(dir, "missing")))
+}
+
+func TestOpenFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-parts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var paths []string
+	for i, content := range []string{"first ", "second"} {
+		p := filepath.Join(dir, fmt.Sprintf("x.tar.%03d", i+1))
+		assert.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+		paths = append(paths, p)
+	}
+	r, err := openFiles(paths)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "first second", string(data))
+	assert.NoError(t, r.Close())
+
+	_, err = openFiles([]string{paths[0], filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+}
+
+func TestRenameTableInQuery(t *testing.T) {
+	query := "CREATE TABLE events UUID 'a7c0c3a1-0b5f-4a4e-8f1d-1f1f1f1f1f1f' (date Date) " +
+		"ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/db/events', '{replica}') ORDER BY date"
+	renamed, err := renameTableInQuery(query, "db", "events", "old", "events_copy")
+	assert.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE `old`.`events_copy` (date Date) "+
+		"ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/old/events_copy', '{replica}') ORDER BY date", renamed)
+
+	_, err = renameTableInQuery("CREATE TABLE events (date Date) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/shared', '{replica}') ORDER BY date",
+		"db", "events", "db", "events_copy")
+	assert.Error(t, err)
+}
+
+func TestParseTableMapping(t *testing.T) {
+	tables := map[string]bool{"db.events": true, "db.users": true}
+	mapping, err := parseTableMapping([]string{"db.events=old.events_copy"}, tables)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]tableTarget{"db.events": {Database: "old", Name: "events_copy"}}, mapping)
+	for _, values := range [][]string{
+		{"db.events"},
+		{"events=old.events"},
+		{"db.missing=old.missing"},
+		{"db.events=db.users"},
+		{"db.events=old.t", "db.users=old.t"},
+	} {
+		_, err := parseTableMapping(values, tables)
+		assert.Error(t, err, strings.Join(values, " "))
+	}
+}
+
+func TestServerStateReady(t *testing.T) {
+	state := newServerState(time.Hour)
+	assert.NoError(t, state.ready(time.Now()))
+	assert.Error(t, state.ready(time.Now().Add(2*time.Hour)))
+
+	state.finish(errors.New("upload failed"))
+	assert.Error(t, state.ready(time.Now()))
+
+	state.finish(nil)
+	assert.NoError(t, state.ready(time.Now()))
+	assert.Error(t, state.ready(time.Now().Add(2*time.Hour)))
+}
+
+func TestRemoteBackupNameOfArchive(t *testing.T) {
+	for key, expected := range map[string]string{
+		"2019-05-31T12:00:00Z.tar":               "2019-05-31T12:00:00Z.tar",
+		"2019-05-31T12:00:00Z.tar.gz.002":        "2019-05-31T12:00:00Z.tar.gz",
+		"2019-05-31T12:00:00Z.tar.manifest.json": "2019-05-31T12:00:00Z.tar",
+		"2019-05-31T12:00:00Z/metadata.tar":      "2019-05-31T12:00:00Z",
+		"2019-05-31T12:00:00Z/db.events.tar":     "2019-05-31T12:00:00Z",
+		"2019-05-31T12:00:00Z/manifest.json":     "2019-05-31T12:00:00Z",
+		"2019-05-31T12:00:00Z/checksums.txt":     "2019-05-31T12:00:00Z",
+	} {
+		name, ok := remoteBackupName("archive", key)
+		assert.True(t, ok, key)
+		assert.Equal(t, expected, name, key)
+	}
+	for _, key := range []string{latestName, "notes.txt", "other/notes.txt", "other/dir/db.events.tar"} {
+		_, ok := remoteBackupName("archive", key)
+		assert.False(t, ok, key)
+	}
+}
+
+func TestWithHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "hooks.txt")
+	hooks := HooksConfig{
+		PreBackupCommand:  "echo $CLICKHOUSE_BACKUP_HOOK >> " + output,
+		PostBackupCommand: "echo $CLICKHOUSE_BACKUP_HOOK $CLICKHOUSE_BACKUP_NAME $CLICKHOUSE_BACKUP_STATUS >> " + output,
+	}
+	err = withHooks(context.Background(), hooks, "backup", "", false, func(ctx context.Context) error {
+		metricsFromContext(ctx).setBackup("2019-05-31T12:00:00Z")
+		return nil
+	})
+	assert.NoError(t, err)
+	content, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, "pre_backup\npost_backup 2019-05-31T12:00:00Z success\n", string(content))
+
+	hooks.PreBackupCommand = "exit 1"
+	called := false
+	err = withHooks(context.Background(), hooks, "backup", "", false, func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	assert.Error(t, err)
+	assert.False(t, called)
+
+	hooks = HooksConfig{PostRestoreCommand: "exit 1"}
+	assert.NoError(t, withHooks(context.Background(), hooks, "restore", "", false, func(ctx context.Context) error { return nil }))
+	hooks.PostHookFatal = true
+	assert.Error(t, withHooks(context.Background(), hooks, "restore", "", false, func(ctx context.Context) error { return nil }))
+}
+
+func TestRestoreHookBackupName(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "restore-hooks")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	config := defaultConfig()
+	output := filepath.Join(dataPath, "hooks.txt")
+	config.Hooks = HooksConfig{
+		PreRestoreCommand:  "echo $CLICKHOUSE_BACKUP_HOOK $CLICKHOUSE_BACKUP_NAME >> " + output,
+		PostRestoreCommand: "echo $CLICKHOUSE_BACKUP_HOOK $CLICKHOUSE_BACKUP_NAME $CLICKHOUSE_BACKUP_STATUS >> " + output,
+	}
+	backupPath := filepath.Join(dataPath, config.ClickHouse.BackupDir)
+	assert.NoError(t, os.MkdirAll(backupPath, 0755))
+	assert.Equal(t, "", restoreBackupName(*config, dataPath))
+
+	content, err := (&BackupManifest{Strategy: "tree", Name: "2019-05-31T12:00:00Z"}).Marshal()
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(backupPath, manifestName), content, 0644))
+	name := restoreBackupName(*config, dataPath+"/")
+	assert.Equal(t, "2019-05-31T12:00:00Z", name)
+	assert.NoError(t, withHooks(context.Background(), config.Hooks, "restore", name, false, func(ctx context.Context) error {
+		return nil
+	}))
+	content, err = ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, "pre_restore 2019-05-31T12:00:00Z\npost_restore 2019-05-31T12:00:00Z success\n", string(content))
+}
+
+func TestPrintSummary(t *testing.T) {
+	m := &runMetrics{command: "upload", started: time.Now()}
+	m.setBackup("2019-05-31T12:00:00Z")
+	m.addTransfer(2, 1024)
+	var out bytes.Buffer
+	assert.NoError(t, m.printSummary(&out, errors.New("upload failed")))
+	var summary Summary
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &summary))
+	assert.Equal(t, "2019-05-31T12:00:00Z", summary.BackupName)
+	assert.Equal(t, "failure", summary.Status)
+	assert.Equal(t, "upload failed", summary.Error)
+	assert.Equal(t, int64(1024), summary.Bytes)
+	assert.Equal(t, int64(2), summary.Files)
+}
+
+func TestManifestBases(t *testing.T) {
+	manifest := &BackupManifest{DiffFrom: "daily-2", Tables: []ManifestTable{
+		{Database: "db", Name: "t", Parts: []ManifestPart{
+			{Name: "all_1_1_0", Base: "daily-1"},
+			{Name: "all_2_2_0", Base: "daily-2"},
+			{Name: "all_3_3_0"},
+		}},
+		{Database: "db", Name: "logs", Parts: []ManifestPart{{Name: "all_1_1_0", Base: "daily-1"}}},
+	}}
+	assert.Equal(t, []string{"daily-1", "daily-2"}, manifestBases(manifest))
+	assert.Nil(t, manifestBases(&BackupManifest{Tables: manifest.Tables}))
+}
+
+func TestUnfinishedArchive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "upload-state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	statePath := filepath.Join(tmpDir, uploadStateName)
+	archivePath := filepath.Join(tmpDir, "123.tar")
+	sum, err := checksumReader(strings.NewReader("archive"))
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		backup  string
+		name    string
+		sum     string
+		resumed bool
+	}{
+		{backup: "daily", resumed: true},
+		{backup: "weekly"},
+		{backup: "daily", name: "pre-migration"},
+		{backup: "daily", sum: "0000"},
+	}
+	for i, testCase := range testCases {
+		assert.NoError(t, ioutil.WriteFile(archivePath, []byte("archive"), 0600))
+		state := &uploadState{LocalPath: archivePath, Key: "backups/123.tar", Size: 7, UploadID: "id", Source: uploadSource{Backup: "daily", ArchiveSHA256: sum}}
+		if testCase.sum != "" {
+			state.Source.ArchiveSHA256 = testCase.sum
+		}
+		assert.NoError(t, state.save(statePath))
+
+		paths, first, checksums, resumed, err := unfinishedArchive(statePath, false, testCase.backup, testCase.name, "backups")
+		assert.NoError(t, err, i)
+		_, statErr := os.Stat(archivePath)
+		if testCase.resumed {
+			assert.Equal(t, []string{archivePath}, paths, i)
+			assert.Equal(t, 0, first, i)
+			assert.Equal(t, state.Source.ArchiveSHA256, checksums["123.tar"], i)
+			assert.Equal(t, state.Source, resumed, i)
+			assert.NoError(t, statErr, i)
+		} else {
+			assert.Empty(t, paths, i)
+			assert.True(t, os.IsNotExist(statErr), i)
+		}
+	}
+}
+
+func TestCheckFrozenIsOlder(t *testing.T) {
+	frozen := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, checkFrozenIsOlder(&BackupManifest{}, frozen))
+	assert.NoError(t, checkFrozenIsOlder(&BackupManifest{Frozen: frozen}, frozen))
+	assert.NoError(t, checkFrozenIsOlder(&BackupManifest{Frozen: frozen.Add(-time.Hour)}, frozen))
+	assert.Error(t, checkFrozenIsOlder(&BackupManifest{Frozen: frozen.Add(time.Hour)}, frozen))
+}
+
+func TestCreateFailures(t *testing.T) {
+	failures := &createFailures{}
+	assert.NoError(t, failures.add("Database", "db", nil))
+	assert.NoError(t, failures.add("Table", "db.events", nil))
+	assert.NoError(t, failures.add("Table", "db.broken", errors.New("can't create table: syntax error")))
+	assert.NoError(t, failures.add("View", "db.view", nil))
+	assert.Equal(t, 2, failures.created)
+	assert.EqualError(t, failures.result(), "creation of 1 databases and tables failed: db.broken")
+
+	failures = &createFailures{failFast: true}
+	assert.EqualError(t, failures.add("Table", "db.broken", errors.New("can't create table: syntax error")), "table db.broken creation failed: can't create table: syntax error")
+	assert.NoError(t, failures.result())
+}
+
+func TestValidateBackupName(t *testing.T) {
+	for _, name := range []string{"pre-migration-2024", "2020-01-02T03:04:05Z", "db_v1.2+hotfix"} {
+		assert.NoError(t, validateBackupName(name), name)
+	}
+	for _, name := range []string{"", "-x", "a/b", "../x", "a b", "shadow", "restore_staging", "base_staging", "x.tar", "x.tar.gz", "x.001", strings.Repeat("a", 129)} {
+		assert.Error(t, validateBackupName(name), name)
+	}
+}
+
+func TestFrozenRows(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "frozen-rows")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	for _, part := range []string{"1/data/db/t/all_1_1_0", "2/data/db/t/all_2_2_0", "1/data/db/merged/all_1_1_0", "1/data/db/unknown/all_1_1_0"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dataPath, "shadow", part), 0755))
+	}
+	// rows are taken from parts recorded at freeze, db.unknown has frozen part which isn't recorded
+	rows, err := frozenRows(map[string]string{defaultDiskName: filepath.Join(dataPath, "shadow")}, map[string]map[string]uint64{
+		"db.t":       {"all_1_1_0": 10, "all_2_2_0": 5, "all_3_3_0": 100},
+		"db.merged":  {"all_1_1_0": 7},
+		"db.unknown": {"all_2_2_0": 1},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"db.t": 15, "db.merged": 7}, rows)
+}
+
+func TestFrozenTablesKeepFreeze(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "frozen-tables")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dataPath, "shadow"), 0755))
+	disks := []Disk{{Name: defaultDiskName, Path: dataPath, Dirs: newDirNames(defaultConfig().ClickHouse)}}
+	tables := []Table{{Database: "db", Name: "t"}}
+
+	frozen := newFrozenTables(tables, nil, false)
+	frozen.Name, frozen.Frozen, frozen.Rows = "2020-01-01T00:00:00Z", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), map[string]uint64{"db.t": 10}
+	assert.NoError(t, writeFrozenTables(disks, frozen, false))
+	reused, err := readFrozenTables(disks)
+	assert.NoError(t, err)
+	if assert.NotNil(t, reused) {
+		assert.Equal(t, frozen, *reused)
+		assert.NoError(t, reused.match(newFrozenTables(tables, nil, false)))
+	}
+}
+
+func TestTableArchiveName(t *testing.T) {
+	assert.Equal(t, "db.table.tar", tableArchiveName("db", "table"))
+	assert.Equal(t, "a%2Eb.c.tar", tableArchiveName("a.b", "c"))
+	assert.Equal(t, "a.b%2Ec.tar", tableArchiveName("a", "b.c"))
+	assert.Equal(t, "db.my%2Dtable%25.tar", tableArchiveName("db", "my-table%"))
+}
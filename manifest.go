@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	manifestName   = "manifest.json"
+	manifestSuffix = ".manifest.json"
+)
+
+// BackupManifest - description of backup content
+type BackupManifest struct {
+	Version    string          `json:"version"`
+	Strategy   string          `json:"strategy"`
+	Created    time.Time       `json:"created"`
+	SchemaOnly bool            `json:"schema_only,omitempty"`
+	Tables     []ManifestTable `json:"tables"`
+	// Parts - objects of archive in order of concatenation if it is split by backup.max_archive_size
+	Parts []string `json:"parts,omitempty"`
+	// ArchiveSHA256 - sha256 of the whole archive, upload of identical archive is skipped
+	ArchiveSHA256 string `json:"archive_sha256,omitempty"`
+	// ContentSHA256 - sha256 of checksums of files embedded into archive, it doesn't depend on tar headers,
+	// for archive_granularity table it's sha256 of such digests of all archives by their names
+	ContentSHA256 string `json:"content_sha256,omitempty"`
+	// KeyLayout and KeySeparator - layout of keys of files of tree backup, empty layout is nested
+	KeyLayout    string `json:"key_layout,omitempty"`
+	KeySeparator string `json:"key_separator,omitempty"`
+	// DiffFrom - backup which incremental backup is uploaded against, unchanged parts are stored by their Base
+	DiffFrom string `json:"diff_from,omitempty"`
+	// Frozen - time of freeze of uploaded local backup, upload of backup frozen earlier doesn't overwrite flat backup
+	Frozen time.Time `json:"frozen"`
+	// Name - name of backup which is downloaded to backup directory, it's set by download only
+	Name string `json:"name,omitempty"`
+}
+
+// ManifestTable - size and files count of frozen table increment, rows count is captured on freeze
+// and is empty for backups of shadow which is not created by freeze of clickhouse-backup
+type ManifestTable struct {
+	Database  string `json:"database"`
+	Name      string `json:"name"`
+	Increment int    `json:"increment"`
+	Size      int64  `json:"size"`
+	Files     int    `json:"files"`
+	Rows      uint64 `json:"rows,omitempty"`
+	// Parts - frozen parts of increment, Size and Files include parts which are stored by base backup
+	Parts []ManifestPart `json:"parts,omitempty"`
+}
+
+// ManifestPart - frozen part of table, Path is directory of part inside backup. Part which isn't changed since
+// base backup isn't uploaded again, its data is stored by Base backup in BasePath
+type ManifestPart struct {
+	Name     string    `json:"name"`
+	Disk     string    `json:"disk"`
+	Path     string    `json:"path"`
+	Checksum string    `json:"checksum"`
+	Modified time.Time `json:"modified"`
+	Base     string    `json:"base,omitempty"`
+	BasePath string    `json:"base_path,omitempty"`
+}
+
+// NewBackupManifest - describe tables frozen into shadows of disks, schema-only manifest has no tables
+func NewBackupManifest(shadows map[string]string, rows map[string]uint64, strategy string, schemaOnly bool) (*BackupManifest, error) {
+	manifest := &BackupManifest{
+		Version:    version,
+		Strategy:   strategy,
+		Created:    time.Now().UTC(),
+		SchemaOnly: schemaOnly,
+		Tables:     []ManifestTable{},
+	}
+	if schemaOnly {
+		return manifest, nil
+	}
+	tables, err := getDisksBackupTables(shadows)
+	if err != nil {
+		return nil, fmt.Errorf("can't read frozen tables: %v", err)
+	}
+	for _, table := range tables {
+		size, files, err := backupTableStats(table)
+		if err != nil {
+			return nil, err
+		}
+		parts, err := manifestParts(shadows, table)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Tables = append(manifest.Tables, ManifestTable{
+			Database:  table.Database,
+			Name:      table.Name,
+			Increment: table.Increment,
+			Size:      size,
+			Files:     files,
+			Rows:      rows[table.Database+"."+table.Name],
+			Parts:     parts,
+		})
+	}
+	sort.Slice(manifest.Tables, func(i, j int) bool {
+		a, b := manifest.Tables[i], manifest.Tables[j]
+		if a.Database != b.Database {
+			return a.Database < b.Database
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Increment < b.Increment
+	})
+	return manifest, nil
+}
+
+// manifestParts - describe frozen parts of table, checksum of part is sha256 of its checksums.txt
+// which is written by clickhouse for every part and lists checksums of all files of part
+func manifestParts(shadows map[string]string, table BackupTable) ([]ManifestPart, error) {
+	parts := []ManifestPart{}
+	for _, partition := range table.Partitions {
+		info, err := os.Stat(filepath.Join(partition.Path, "checksums.txt"))
+		if os.IsNotExist(err) {
+			// part without checksums.txt is never the same as part of base backup
+			info, err = os.Stat(partition.Path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read part %s: %v", partition.Path, err)
+		}
+		checksum := ""
+		if !info.IsDir() {
+			if checksum, err = checksumFile(filepath.Join(partition.Path, "checksums.txt")); err != nil {
+				return nil, fmt.Errorf("can't read part %s: %v", partition.Path, err)
+			}
+		}
+		relativePath := strings.Trim(strings.TrimPrefix(filepath.ToSlash(partition.Path), filepath.ToSlash(shadows[partition.Disk])), "/")
+		parts = append(parts, ManifestPart{
+			Name:     partition.Name,
+			Disk:     partition.Disk,
+			Path:     path.Join(diskShadowKey(partition.Disk), relativePath),
+			Checksum: checksum,
+			Modified: info.ModTime().UTC(),
+		})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Path < parts[j].Path
+	})
+	return parts, nil
+}
+
+// LoadBackupManifest - read manifest from file, returns nil if file does not exist
+func LoadBackupManifest(filename string) (*BackupManifest, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := ParseBackupManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", filename, err)
+	}
+	return manifest, nil
+}
+
+// ParseBackupManifest - decode manifest from json
+func ParseBackupManifest(data []byte) (*BackupManifest, error) {
+	var manifest BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// Marshal - encode manifest to json
+func (m *BackupManifest) Marshal() ([]byte, error) {
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// ValidateTables - check that all tables described in manifest are present with the same size and files count
+func (m *BackupManifest) ValidateTables(tables map[string]BackupTable) error {
+	for _, expected := range m.Tables {
+		table, ok := tables[fmt.Sprintf("%s.%s-%d", expected.Database, expected.Name, expected.Increment)]
+		if !ok {
+			return fmt.Errorf("%s.%s increment %d is missing in backup", expected.Database, expected.Name, expected.Increment)
+		}
+		size, files, err := backupTableStats(table)
+		if err != nil {
+			return err
+		}
+		if size != expected.Size || files != expected.Files {
+			return fmt.Errorf("%s.%s increment %d is incomplete: got %d files with %d bytes, expected %d files with %d bytes",
+				expected.Database, expected.Name, expected.Increment, files, size, expected.Files, expected.Size)
+		}
+	}
+	return nil
+}
+
+// ExpectedRows - summary rows count of increments of table, false if some of them has no rows count
+func (m *BackupManifest) ExpectedRows(database string, name string, increments []int) (uint64, bool) {
+	var rows uint64
+	for _, increment := range increments {
+		found := false
+		for _, table := range m.Tables {
+			if table.Database == database && table.Name == name && table.Increment == increment && table.Rows > 0 {
+				rows += table.Rows
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	return rows, true
+}
+
+// ValidateMetadata - check that metadata for all tables described in manifest is present
+func (m *BackupManifest) ValidateMetadata(metadataPath string) error {
+	for _, table := range m.Tables {
+		tableMetadata := filepath.Join(metadataPath, table.Database, table.Name+".sql")
+		if _, err := os.Stat(tableMetadata); err != nil {
+			return fmt.Errorf("metadata for %s.%s is missing in backup: %v", table.Database, table.Name, err)
+		}
+	}
+	return nil
+}
+
+// backupTableStats - summary size and count of files for all partitions of table
+func backupTableStats(table BackupTable) (size int64, files int, err error) {
+	for _, partition := range table.Partitions {
+		partitionSize, partitionFiles, err := partitionStats(partition)
+		if err != nil {
+			return 0, 0, err
+		}
+		size += partitionSize
+		files += partitionFiles
+	}
+	return size, files, nil
+}
+
+// partitionStats - summary size and count of files of frozen partition
+func partitionStats(partition BackupPartition) (size int64, files int, err error) {
+	err = filepath.Walk(partition.Path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+			files++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("can't read partition %s: %v", partition.Path, err)
+	}
+	return size, files, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// metricsJob - job name of metrics in Prometheus Pushgateway
+const metricsJob = "clickhouse_backup"
+
+type runMetricsKey struct{}
+
+// runMetrics - metrics of single command run, they are collected only if push gateway or notifications are set
+type runMetrics struct {
+	command string
+	started time.Time
+	files   int64
+	bytes   int64
+	mu      sync.Mutex
+	backup  string
+}
+
+// runCommand - run fn with metrics collection, push metrics to gateway, send notifications and print JSON summary
+// after it, failures of push and notifications don't change result of fn
+func runCommand(ctx context.Context, gateway string, notifications NotificationsConfig, jsonSummary bool, command string, fn func(ctx context.Context) error) error {
+	if gateway == "" && !notifications.Enabled() && !jsonSummary {
+		return fn(ctx)
+	}
+	m := &runMetrics{
+		command: command,
+		started: time.Now(),
+	}
+	err := fn(context.WithValue(ctx, runMetricsKey{}, m))
+	// run can be nested into hooks which need name of backup
+	if parent := metricsFromContext(ctx); parent != nil {
+		m.mu.Lock()
+		parent.setBackup(m.backup)
+		m.mu.Unlock()
+	}
+	if gateway != "" {
+		if pushErr := m.push(gateway, err == nil); pushErr != nil {
+			logger.Warnf("can't push metrics to %s: %v", gateway, pushErr)
+		}
+	}
+	m.notify(notifications, err)
+	if jsonSummary {
+		if summaryErr := m.printSummary(os.Stdout, err); summaryErr != nil {
+			logger.Warnf("can't print summary: %v", summaryErr)
+		}
+	}
+	return err
+}
+
+// metricsFromContext - return metrics of current run, nil if metrics are disabled
+func metricsFromContext(ctx context.Context) *runMetrics {
+	m, _ := ctx.Value(runMetricsKey{}).(*runMetrics)
+	return m
+}
+
+// addTransfer - count transferred files and bytes
+func (m *runMetrics) addTransfer(files int64, bytes int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.files, files)
+	atomic.AddInt64(&m.bytes, bytes)
+}
+
+// setBackup - set name of backup which is uploaded or downloaded
+func (m *runMetrics) setBackup(name string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.backup = name
+	m.mu.Unlock()
+}
+
+// push - add metrics of run to group of command, last success timestamp is kept from previous run on failure
+func (m *runMetrics) push(gateway string, success bool) error {
+	m.mu.Lock()
+	labels := prometheus.Labels{"backup": m.backup}
+	m.mu.Unlock()
+	registry := prometheus.NewRegistry()
+	gauge := func(name string, help string, value float64) {
+		g := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        name,
+			Help:        help,
+			ConstLabels: labels,
+		})
+		g.Set(value)
+		registry.MustRegister(g)
+	}
+	gauge("clickhouse_backup_duration_seconds", "Duration of last run", time.Since(m.started).Seconds())
+	gauge("clickhouse_backup_transferred_bytes", "Bytes transferred to or from s3 in last run", float64(atomic.LoadInt64(&m.bytes)))
+	gauge("clickhouse_backup_transferred_files", "Files transferred to or from s3 in last run", float64(atomic.LoadInt64(&m.files)))
+	if success {
+		gauge("clickhouse_backup_success", "1 if last run succeeded, 0 otherwise", 1)
+		gauge("clickhouse_backup_last_success_timestamp_seconds", "Unix time of last successful run", float64(time.Now().Unix()))
+	} else {
+		gauge("clickhouse_backup_success", "1 if last run succeeded, 0 otherwise", 0)
+	}
+	return push.New(gateway, metricsJob).Gatherer(registry).Grouping("command", m.command).Add()
+}
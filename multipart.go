@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// uploadSource - local backup and archive which are uploaded, saved upload of another backup
+// or of another archive is never resumed
+type uploadSource struct {
+	Backup        string `json:"backup"`
+	ArchiveSHA256 string `json:"archive_sha256"`
+	ContentSHA256 string `json:"content_sha256,omitempty"`
+}
+
+// uploadState - progress of multipart upload which is saved after every part to resume upload after failure
+type uploadState struct {
+	LocalPath string           `json:"local_path"`
+	Key       string           `json:"key"`
+	Size      int64            `json:"size"`
+	PartSize  int64            `json:"part_size"`
+	UploadID  string           `json:"upload_id"`
+	Parts     map[int64]string `json:"parts"`
+	Source    uploadSource     `json:"source"`
+}
+
+// loadUploadState - read state of unfinished upload, returns nil if there is no one
+func loadUploadState(statePath string) (*uploadState, error) {
+	data, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", statePath, err)
+	}
+	return &state, nil
+}
+
+func (state *uploadState) save(statePath string) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath, data, 0600)
+}
+
+// UploadFileResumable - upload localPath to dstPath on s3 by parts, completed parts are saved to statePath
+// so next call for the same file of the same source continues from the first missed part
+func (s *S3) UploadFileResumable(ctx context.Context, localPath string, dstPath string, statePath string, source uploadSource) error {
+	if s.DryRun {
+		return nil
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	partSize := s.Config.PartSize
+	if info.Size() <= partSize {
+		return s.UploadFile(ctx, localPath, dstPath)
+	}
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("error opening file %v: %v", localPath, err)
+	}
+	defer file.Close()
+
+	key := path.Join(s.Config.Path, dstPath)
+	state, err := s.resumeUploadState(ctx, statePath, localPath, key, info.Size(), source)
+	if err != nil {
+		return err
+	}
+	svc := s3.New(s.session)
+	if state == nil {
+		input := &s3.CreateMultipartUploadInput{
+			ACL:          aws.String(s.Config.ACL),
+			Bucket:       aws.String(s.Config.Bucket),
+			Key:          aws.String(key),
+			StorageClass: aws.String(s.Config.StorageClass),
+		}
+		var resp *s3.CreateMultipartUploadOutput
+		if err := s.uploadWithTagging(func(tagging *string) error {
+			input.Tagging = tagging
+			var err error
+			resp, err = svc.CreateMultipartUploadWithContext(ctx, input)
+			return err
+		}); err != nil {
+			return fmt.Errorf("can't create multipart upload for '%s' with: %v", key, err)
+		}
+		state = &uploadState{
+			LocalPath: localPath,
+			Key:       key,
+			Size:      info.Size(),
+			PartSize:  partSize,
+			UploadID:  *resp.UploadId,
+			Parts:     make(map[int64]string),
+			Source:    source,
+		}
+		if err := state.save(statePath); err != nil {
+			return fmt.Errorf("can't save upload state: %v", err)
+		}
+	}
+
+	partsCount := (state.Size + partSize - 1) / partSize
+	var missing []int64
+	for partNumber := int64(1); partNumber <= partsCount; partNumber++ {
+		if _, ok := state.Parts[partNumber]; !ok {
+			missing = append(missing, partNumber)
+		}
+	}
+	// parts are uploaded by s3.concurrency workers, state is saved after every part
+	var stateMu sync.Mutex
+	err = runParallel(s.Config.Concurrency, len(missing), func(i int) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		partNumber := missing[i]
+		offset := (partNumber - 1) * partSize
+		size := partSize
+		if offset+size > state.Size {
+			size = state.Size - offset
+		}
+		content, err := ioutil.ReadAll(s.limiter.Reader(io.NewSectionReader(file, offset, size)))
+		if err != nil {
+			return fmt.Errorf("can't read part %d of %s: %v", partNumber, localPath, err)
+		}
+		partSum := md5.Sum(content)
+		var etag string
+		if err := withRetry(ctx, s.Config.MaxRetries, fmt.Sprintf("%s part %d", key, partNumber), func() error {
+			resp, err := svc.UploadPartWithContext(ctx, &s3.UploadPartInput{
+				Body:       bytes.NewReader(content),
+				Bucket:     aws.String(s.Config.Bucket),
+				Key:        aws.String(key),
+				PartNumber: aws.Int64(partNumber),
+				UploadId:   aws.String(state.UploadID),
+			})
+			if err != nil {
+				return err
+			}
+			etag = *resp.ETag
+			if s.Config.VerifyUploads && strings.Trim(etag, "\"") != hex.EncodeToString(partSum[:]) {
+				return fmt.Errorf("uploaded part is corrupted: ETag %s doesn't match local data", etag)
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("can't upload part %d of '%s' with: %v", partNumber, key, err)
+		}
+		metricsFromContext(ctx).addTransfer(0, size)
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		state.Parts[partNumber] = etag
+		if err := state.save(statePath); err != nil {
+			return fmt.Errorf("can't save upload state: %v", err)
+		}
+		return nil
+	})
+	if ctx.Err() != nil {
+		// canceled upload must not be resumed, so don't leave parts on s3
+		s.abortUpload(state)
+		os.Remove(statePath)
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	parts := make([]*s3.CompletedPart, 0, len(state.Parts))
+	for partNumber, etag := range state.Parts {
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       aws.String(etag),
+			PartNumber: aws.Int64(partNumber),
+		})
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return *parts[i].PartNumber < *parts[j].PartNumber
+	})
+	resp, err := svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.Config.Bucket),
+		Key:             aws.String(key),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		UploadId:        aws.String(state.UploadID),
+	})
+	if err != nil {
+		return fmt.Errorf("can't complete multipart upload for '%s' with: %v", key, err)
+	}
+	if s.Config.VerifyUploads {
+		// every part was checked on upload, so ETag of object must be built from ETags of parts
+		var partSums []byte
+		for _, part := range parts {
+			sum, err := hex.DecodeString(strings.Trim(*part.ETag, "\""))
+			if err != nil {
+				return fmt.Errorf("can't verify '%s': bad ETag %s of part %d", key, *part.ETag, *part.PartNumber)
+			}
+			partSums = append(partSums, sum...)
+		}
+		if etag := strings.Trim(aws.StringValue(resp.ETag), "\""); etag != multipartEtag(partSums, len(parts)) {
+			return fmt.Errorf("uploaded '%s' is corrupted: ETag %s doesn't match uploaded parts", key, etag)
+		}
+	}
+	metricsFromContext(ctx).addTransfer(1, 0)
+	return os.Remove(statePath)
+}
+
+// resumeUploadState - load saved state for the same file and drop parts which are absent on s3,
+// returns nil if upload should be started from scratch
+func (s *S3) resumeUploadState(ctx context.Context, statePath string, localPath string, key string, size int64, source uploadSource) (*uploadState, error) {
+	state, err := loadUploadState(statePath)
+	if err != nil {
+		return nil, fmt.Errorf("can't read upload state: %v", err)
+	}
+	if state == nil {
+		return nil, nil
+	}
+	if state.LocalPath != localPath || state.Key != key || state.Size != size || state.PartSize != s.Config.PartSize || state.Source != source {
+		logger.WithField("key", key).Warn("Saved upload state is for another file, start upload from scratch")
+		s.abortUpload(state)
+		return nil, nil
+	}
+	uploaded := make(map[int64]string)
+	err = s3.New(s.session).ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:   aws.String(s.Config.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(state.UploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			uploaded[*part.PartNumber] = *part.ETag
+		}
+		return true
+	})
+	if err != nil {
+		if e, ok := err.(awserr.Error); ok && e.Code() == s3.ErrCodeNoSuchUpload {
+			logger.WithField("key", key).Warn("Multipart upload has expired, start from scratch")
+			return nil, nil
+		}
+		return nil, fmt.Errorf("can't list uploaded parts of '%s' with: %v", key, err)
+	}
+	for partNumber, etag := range state.Parts {
+		if uploaded[partNumber] != etag {
+			delete(state.Parts, partNumber)
+		}
+	}
+	logger.WithField("key", key).Infof("Resume upload, %d parts are already uploaded", len(state.Parts))
+	return state, nil
+}
+
+func (s *S3) abortUpload(state *uploadState) {
+	if _, err := s3.New(s.session).AbortMultipartUploadWithContext(aws.BackgroundContext(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.Config.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadID),
+	}); err != nil {
+		logger.Warnf("can't abort multipart upload of '%s' with: %v", state.Key, err)
+	}
+}
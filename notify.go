@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// notifyTimeout - timeout of single webhook call
+const notifyTimeout = 10 * time.Second
+
+// Notification - JSON payload which is sent to notifications.webhook_url
+type Notification struct {
+	Command         string  `json:"command"`
+	Status          string  `json:"status"`
+	Backup          string  `json:"backup"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Host            string  `json:"host"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// notify - send result of run to webhooks, failed webhooks are only logged
+func (m *runMetrics) notify(config NotificationsConfig, runErr error) {
+	if !config.Enabled() {
+		return
+	}
+	m.mu.Lock()
+	n := Notification{
+		Command:         m.command,
+		Status:          "success",
+		Backup:          m.backup,
+		DurationSeconds: time.Since(m.started).Seconds(),
+	}
+	m.mu.Unlock()
+	n.Host, _ = os.Hostname()
+	if runErr != nil {
+		n.Status = "failure"
+		n.Error = runErr.Error()
+	}
+	if config.WebhookURL != "" {
+		if err := postJSON(config.WebhookURL, n); err != nil {
+			logger.Warnf("can't send notification to webhook: %v", err)
+		}
+	}
+	if config.SlackWebhookURL != "" {
+		if err := postJSON(config.SlackWebhookURL, map[string]string{"text": n.slackText()}); err != nil {
+			logger.Warnf("can't send notification to slack: %v", err)
+		}
+	}
+}
+
+// Summary - JSON object which is printed by --json-summary after command
+type Summary struct {
+	Command    string  `json:"command"`
+	BackupName string  `json:"backup_name"`
+	Status     string  `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	Files      int64   `json:"files"`
+	Duration   float64 `json:"duration"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// printSummary - write summary of run as single line of JSON, duration is in seconds
+func (m *runMetrics) printSummary(w io.Writer, runErr error) error {
+	m.mu.Lock()
+	s := Summary{
+		Command:    m.command,
+		BackupName: m.backup,
+		Status:     "success",
+		Bytes:      atomic.LoadInt64(&m.bytes),
+		Files:      atomic.LoadInt64(&m.files),
+		Duration:   time.Since(m.started).Seconds(),
+	}
+	m.mu.Unlock()
+	if runErr != nil {
+		s.Status = "failure"
+		s.Error = runErr.Error()
+	}
+	return json.NewEncoder(w).Encode(s)
+}
+
+// slackText - human-readable message for Slack
+func (n Notification) slackText() string {
+	backup := n.Backup
+	if backup == "" {
+		backup = "-"
+	}
+	text := fmt.Sprintf("clickhouse-backup %s of '%s' on %s: *%s* in %s", n.Command, backup, n.Host, n.Status, time.Duration(n.DurationSeconds*float64(time.Second)).Round(time.Second))
+	if n.Error != "" {
+		text += fmt.Sprintf("\n```%s```", n.Error)
+	}
+	return text
+}
+
+// postJSON - send payload as JSON and check response status
+func postJSON(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
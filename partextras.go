@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// projectionSuffix - projection of part is stored in <projection>.proj directory of part
+	projectionSuffix = ".proj"
+	// skipIndexPrefix - data-skipping index of part is stored in skp_idx_<index>.idx file and its marks
+	skipIndexPrefix = "skp_idx_"
+)
+
+// partExtras - projections and data-skipping indexes which are stored in frozen part, they are copied to detached
+// together with part and are attached with it
+type partExtras struct {
+	Projections []string
+	Indexes     []string
+}
+
+// readPartExtras - projections and data-skipping indexes of part, error is returned if some of them are incomplete,
+// clickhouse refuses to attach such part
+func readPartExtras(partPath string) (partExtras, error) {
+	var extras partExtras
+	files, err := ioutil.ReadDir(partPath)
+	if err != nil {
+		return extras, err
+	}
+	// kinds of files of every index, index needs both data and marks
+	indexFiles := make(map[string]map[string]bool)
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() {
+			if !strings.HasSuffix(name, projectionSuffix) {
+				continue
+			}
+			projection := strings.TrimSuffix(name, projectionSuffix)
+			if _, err := os.Stat(filepath.Join(partPath, name, checksumsName)); err != nil {
+				return extras, fmt.Errorf("projection %s of part %s is incomplete: %v", projection, filepath.Base(partPath), err)
+			}
+			extras.Projections = append(extras.Projections, projection)
+			continue
+		}
+		if !strings.HasPrefix(name, skipIndexPrefix) {
+			continue
+		}
+		ext := filepath.Ext(name)
+		index := strings.TrimSuffix(strings.TrimPrefix(name, skipIndexPrefix), ext)
+		if indexFiles[index] == nil {
+			indexFiles[index] = make(map[string]bool)
+		}
+		switch {
+		case strings.HasPrefix(ext, ".idx"):
+			indexFiles[index]["data"] = true
+		case strings.Contains(ext, "mrk"):
+			indexFiles[index]["marks"] = true
+		}
+	}
+	for index, kinds := range indexFiles {
+		if !kinds["data"] || !kinds["marks"] {
+			return extras, fmt.Errorf("data-skipping index %s of part %s is incomplete, it must have both data and marks", index, filepath.Base(partPath))
+		}
+		extras.Indexes = append(extras.Indexes, index)
+	}
+	sort.Strings(extras.Projections)
+	sort.Strings(extras.Indexes)
+	return extras, nil
+}
+
+// hasName - check that name is in sorted names
+func hasName(names []string, name string) bool {
+	i := sort.SearchStrings(names, name)
+	return i < len(names) && names[i] == name
+}
+
+// getTablePartExtras - projections and data-skipping indexes of every frozen part of table by name of part,
+// restore fails before copy if some part has incomplete ones
+func getTablePartExtras(table BackupTable) (map[string]partExtras, error) {
+	result := make(map[string]partExtras, len(table.Partitions))
+	for _, partition := range table.Partitions {
+		extras, err := readPartExtras(partition.Path)
+		if err != nil {
+			return nil, fmt.Errorf("part of %s.%s can't be attached: %v", table.Database, table.Name, err)
+		}
+		result[partition.Name] = extras
+	}
+	return result, nil
+}
+
+var (
+	// skipIndexRe - name of data-skipping index in create query
+	skipIndexRe = regexp.MustCompile("(?i)[(,]\\s*INDEX\\s+(`[^`]+`|\\w+)\\s")
+	// projectionRe - name of projection in create query
+	projectionRe = regexp.MustCompile("(?i)[(,]\\s*PROJECTION\\s+(`[^`]+`|\\w+)\\s*\\(")
+)
+
+// parseTableExtras - projections and data-skipping indexes declared by create query of table
+func parseTableExtras(query string) partExtras {
+	var extras partExtras
+	for _, match := range skipIndexRe.FindAllStringSubmatch(query, -1) {
+		extras.Indexes = append(extras.Indexes, strings.Trim(match[1], "`"))
+	}
+	for _, match := range projectionRe.FindAllStringSubmatch(query, -1) {
+		extras.Projections = append(extras.Projections, strings.Trim(match[1], "`"))
+	}
+	sort.Strings(extras.Indexes)
+	sort.Strings(extras.Projections)
+	return extras
+}
+
+// missingExtras - ALTER commands which build projections and data-skipping indexes of table in partitions
+// which have parts restored without them, so restored data is covered by them as data inserted after restore
+func missingExtras(table partExtras, parts map[string]partExtras) []string {
+	var commands []string
+	add := func(kind string, names []string, has func(extras partExtras, name string) bool) {
+		for _, name := range names {
+			var partitions []string
+			seen := make(map[string]bool)
+			for partName, extras := range parts {
+				partition := convertPartition(partName)
+				if has(extras, name) || seen[partition] {
+					continue
+				}
+				seen[partition] = true
+				partitions = append(partitions, partition)
+			}
+			sort.Strings(partitions)
+			for _, partition := range partitions {
+				commands = append(commands, fmt.Sprintf("MATERIALIZE %s `%s` IN PARTITION %s", kind, name, partition))
+			}
+		}
+	}
+	add("INDEX", table.Indexes, func(extras partExtras, name string) bool {
+		return hasName(extras.Indexes, name)
+	})
+	add("PROJECTION", table.Projections, func(extras partExtras, name string) bool {
+		return hasName(extras.Projections, name)
+	})
+	return commands
+}
+
+// MaterializeExtras - build projections and data-skipping indexes of table in partitions which have parts restored
+// without them, parts are described by extras read before they are copied. Mutations are executed in background
+func (ch *ClickHouse) MaterializeExtras(table BackupTable, parts map[string]partExtras) error {
+	var result []struct {
+		Query string `db:"create_table_query"`
+	}
+	q := fmt.Sprintf("SELECT create_table_query FROM system.tables WHERE database='%v' AND name='%v'", table.Database, table.Name)
+	if err := ch.selectQuery(&result, q); err != nil {
+		return fmt.Errorf("can't get create query of \"%s.%s\" with %v", table.Database, table.Name, err)
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	tableLog := logger.WithField("table", table.Database+"."+table.Name)
+	for _, command := range missingExtras(parseTableExtras(result[0].Query), parts) {
+		query := fmt.Sprintf("ALTER TABLE %v.%v %s", table.Database, table.Name, command)
+		if ch.DryRun {
+			tableLog.Infof("DRY-RUN: %s", query)
+			continue
+		}
+		tableLog.Info(query)
+		if err := ch.execQuery(query, ch.Config.QueryTimeout); err != nil {
+			return fmt.Errorf("can't materialize with: %v", err)
+		}
+	}
+	return nil
+}
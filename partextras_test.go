@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPartExtras(t *testing.T) {
+	testCases := []struct {
+		files    []string
+		expected partExtras
+		err      bool
+	}{
+		{
+			files: []string{"checksums.txt", "data.bin", "data.mrk2"},
+		},
+		{
+			files: []string{
+				"checksums.txt", "data.bin", "data.mrk2",
+				"skp_idx_idx_value.idx", "skp_idx_idx_value.mrk2",
+				"skp_idx_bf.idx2", "skp_idx_bf.cmrk3",
+				"p_sum.proj/checksums.txt", "p_sum.proj/data.bin",
+			},
+			expected: partExtras{Projections: []string{"p_sum"}, Indexes: []string{"bf", "idx_value"}},
+		},
+		{
+			files: []string{"checksums.txt", "skp_idx_idx_value.idx"},
+			err:   true,
+		},
+		{
+			files: []string{"checksums.txt", "skp_idx_idx_value.mrk2"},
+			err:   true,
+		},
+		{
+			files: []string{"checksums.txt", "p_sum.proj/data.bin"},
+			err:   true,
+		},
+	}
+	for i, testCase := range testCases {
+		part, err := ioutil.TempDir("", "all_1_1_0")
+		assert.NoError(t, err)
+		defer os.RemoveAll(part)
+		for _, file := range testCase.files {
+			assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(part, file)), 0755))
+			assert.NoError(t, ioutil.WriteFile(filepath.Join(part, file), []byte(file), 0644))
+		}
+		extras, err := readPartExtras(part)
+		if testCase.err {
+			assert.Error(t, err, i)
+			continue
+		}
+		assert.NoError(t, err, i)
+		assert.Equal(t, testCase.expected, extras, i)
+	}
+}
+
+func TestParseTableExtras(t *testing.T) {
+	query := "CREATE TABLE db.events (`date` Date, `value` UInt64, `name` String, " +
+		"INDEX idx_value value TYPE minmax GRANULARITY 1, INDEX `bf` name TYPE bloom_filter GRANULARITY 4, " +
+		"PROJECTION p_sum (SELECT date, sum(value) GROUP BY date)) " +
+		"ENGINE = MergeTree PARTITION BY toYYYYMM(date) ORDER BY date SETTINGS index_granularity = 8192"
+	assert.Equal(t, partExtras{Projections: []string{"p_sum"}, Indexes: []string{"bf", "idx_value"}}, parseTableExtras(query))
+	assert.Equal(t, partExtras{}, parseTableExtras("CREATE TABLE db.logs (`index` UInt64) ENGINE = Log"))
+}
+
+func TestMissingExtras(t *testing.T) {
+	table := partExtras{Projections: []string{"p_sum"}, Indexes: []string{"idx_value"}}
+	parts := map[string]partExtras{
+		"201901_1_1_0": table,
+		"201902_2_2_0": {Indexes: []string{"idx_value"}},
+		"201902_3_3_0": {},
+		"201903_4_4_0": {Projections: []string{"p_sum"}},
+	}
+	assert.Equal(t, []string{
+		"MATERIALIZE INDEX `idx_value` IN PARTITION ID '201902'",
+		"MATERIALIZE INDEX `idx_value` IN PARTITION ID '201903'",
+		"MATERIALIZE PROJECTION `p_sum` IN PARTITION ID '201902'",
+	}, missingExtras(table, parts))
+	assert.Empty(t, missingExtras(table, map[string]partExtras{"201901_1_1_0": table}))
+	assert.Empty(t, missingExtras(partExtras{}, parts))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// replicateBackup - copy objects of uploaded backup to replica bucket and remove old backups from it,
+// errors are only logged because backup is already in primary bucket
+func replicateBackup(ctx context.Context, config Config, primary *S3, name string) {
+	if err := copyToReplica(ctx, config, primary, name); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		logger.WithField("backup", name).Warnf("can't copy backup to replica: %v", err)
+	}
+}
+
+func copyToReplica(ctx context.Context, config Config, primary *S3, name string) error {
+	replicaConfig := config
+	replicaConfig.S3 = config.Replica.S3Config(config.S3)
+	replica := &S3{
+		DryRun: primary.DryRun,
+		Config: &replicaConfig.S3,
+		// copies are tagged as objects of primary bucket
+		backupName:    name,
+		backupCreated: primary.backupCreated,
+	}
+	if err := replica.Connect(); err != nil {
+		return fmt.Errorf("can't connect to replica with: %v", err)
+	}
+	backups, err := getRemoteBackups(config, primary)
+	if err != nil {
+		return fmt.Errorf("can't list backups on s3 with: %v", err)
+	}
+	backup, err := findRemoteBackup(backups, name)
+	if err != nil {
+		return err
+	}
+	// server-side copy is possible only if both buckets are on the same storage
+	serverSide := replica.Config.Endpoint == primary.Config.Endpoint
+	logger.WithFields(Fields{"backup": backup.Name, "objects": len(backup.Keys), "bucket": replica.Config.Bucket}).Info("Copy backup to replica")
+	for _, key := range backup.Keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		relKey := strings.TrimPrefix(strings.TrimPrefix(key, strings.Trim(primary.Config.Path, "/")), "/")
+		dstKey := path.Join(replica.Config.Path, relKey)
+		if replica.DryRun {
+			logger.Infof("Copy '%s' to '%s'  ...skip dry-run", key, dstKey)
+			continue
+		}
+		if serverSide {
+			err := replica.copyObject(ctx, primary.Config.Bucket, key, dstKey)
+			if err == nil {
+				continue
+			}
+			logger.WithField("key", key).Infof("server-side copy failed, object is downloaded and uploaded: %v", err)
+		}
+		if err := replica.streamObject(ctx, primary, relKey, dstKey); err != nil {
+			return err
+		}
+	}
+	if !config.Replica.RemoveOldBackups {
+		return nil
+	}
+	if err := removeOldBackups(ctx, replicaConfig, replica); err != nil {
+		return fmt.Errorf("can't remove old backups from replica: %v", err)
+	}
+	return nil
+}
+
+// copyObject - copy object from srcBucket to dstKey of bucket by server-side copy, objects larger than 5GB can't be copied
+func (s *S3) copyObject(ctx context.Context, srcBucket string, srcKey string, dstKey string) error {
+	_, err := s3.New(s.session).CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		ACL:          aws.String(s.Config.ACL),
+		Bucket:       aws.String(s.Config.Bucket),
+		CopySource:   aws.String((&url.URL{Path: srcBucket + "/" + srcKey}).EscapedPath()),
+		Key:          aws.String(dstKey),
+		StorageClass: aws.String(s.Config.StorageClass),
+	})
+	return err
+}
+
+// streamObject - download s3Path from src and upload it to dstKey without temp file, object is downloaded again
+// if upload is repeated without tags
+func (s *S3) streamObject(ctx context.Context, src *S3, s3Path string, dstKey string) error {
+	var downloadErr error
+	err := s.uploadWithTagging(func(tagging *string) error {
+		body, err := src.DownloadStream(ctx, s3Path)
+		if err != nil {
+			downloadErr = fmt.Errorf("can't download '%s' with: %v", s3Path, err)
+			return downloadErr
+		}
+		defer body.Close()
+		var metadata map[string]*string
+		if stream, ok := body.(*streamReader); ok {
+			// metadata marks files compressed by s3.tree_compression
+			metadata = stream.metadata
+		}
+		_, err = s.newUploader().UploadWithContext(ctx, &s3manager.UploadInput{
+			ACL:          aws.String(s.Config.ACL),
+			Bucket:       aws.String(s.Config.Bucket),
+			Key:          aws.String(dstKey),
+			Body:         body,
+			Metadata:     metadata,
+			StorageClass: aws.String(s.Config.StorageClass),
+			Tagging:      tagging,
+		})
+		return err
+	})
+	if err != nil && err != downloadErr {
+		return fmt.Errorf("can't upload '%s' to replica with: %v", dstKey, err)
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// withRetry - call fn until it succeeds, fails with non-transient error or maxRetries is exhausted
+func withRetry(ctx context.Context, maxRetries int, key string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= maxRetries || !isTransientError(err) {
+			return err
+		}
+		delay := backoffDelay(attempt)
+		logger.Warnf("retry %d/%d for '%s' in %v: %v", attempt+1, maxRetries, key, delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoffDelay - exponential delay with full jitter for specified attempt
+func backoffDelay(attempt int) time.Duration {
+	delay := retryMaxDelay
+	if attempt < 16 {
+		if d := retryBaseDelay << uint(attempt); d < retryMaxDelay {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isTransientError - network errors and 5xx responses are worth to retry, 4xx are not
+func isTransientError(err error) bool {
+	switch e := err.(type) {
+	case awserr.RequestFailure:
+		if e.StatusCode() >= 500 {
+			return true
+		}
+		if e.StatusCode() >= 400 {
+			return false
+		}
+		return isTransientError(e.OrigErr())
+	case awserr.Error:
+		switch e.Code() {
+		case request.CanceledErrorCode:
+			return false
+		case "RequestError", "RequestTimeout", request.ErrCodeRead, request.ErrCodeResponseTimeout:
+			return true
+		}
+		if e.OrigErr() == nil {
+			return false
+		}
+		return isTransientError(e.OrigErr())
+	case net.Error:
+		return true
+	}
+	return err == io.ErrUnexpectedEOF
+}
+
+// isNotFoundError - object or bucket does not exist
+func isNotFoundError(err error) bool {
+	if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == 404 {
+		return true
+	}
+	if e, ok := err.(awserr.Error); ok {
+		return e.Code() == "NoSuchKey" || e.Code() == "NotFound"
+	}
+	return false
+}
+
+// isArchivedStorageClass - objects in these classes can't be downloaded without restore on s3
+func isArchivedStorageClass(storageClass string) bool {
+	return storageClass == "GLACIER" || storageClass == "DEEP_ARCHIVE"
+}
+
+// archivedObjectError - replace error of download from archived storage class with clear one
+func archivedObjectError(key string, err error) error {
+	if e, ok := err.(awserr.Error); ok && e.Code() == "InvalidObjectState" {
+		return fmt.Errorf("'%s' is stored in GLACIER or DEEP_ARCHIVE class and must be restored on s3 before download", key)
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransientError(t *testing.T) {
+	netErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	testCases := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"500", awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), 500, "id"), true},
+		{"503", awserr.NewRequestFailure(awserr.New("SlowDown", "reduce request rate", nil), 503, "id"), true},
+		{"403", awserr.NewRequestFailure(awserr.New("AccessDenied", "access denied", nil), 403, "id"), false},
+		{"404", awserr.NewRequestFailure(awserr.New("NoSuchKey", "not found", nil), 404, "id"), false},
+		{"400 with network error", awserr.NewRequestFailure(awserr.New("BadRequest", "bad request", netErr), 400, "id"), false},
+		{"no status with network error", awserr.NewRequestFailure(awserr.New("SerializationError", "failed", netErr), 0, "id"), true},
+		{"no status without cause", awserr.NewRequestFailure(awserr.New("SerializationError", "failed", nil), 0, "id"), false},
+		{"request error", awserr.New("RequestError", "send request failed", nil), true},
+		{"request timeout", awserr.New("RequestTimeout", "timeout", nil), true},
+		{"read error", awserr.New(request.ErrCodeRead, "read failed", nil), true},
+		{"response timeout", awserr.New(request.ErrCodeResponseTimeout, "timeout", nil), true},
+		{"canceled", awserr.New(request.CanceledErrorCode, "canceled", netErr), false},
+		{"unknown code", awserr.New("InvalidArgument", "invalid", nil), false},
+		{"unknown code with network error", awserr.New("SerializationError", "failed", netErr), true},
+		{"unknown code with unexpected eof", awserr.New("SerializationError", "failed", io.ErrUnexpectedEOF), true},
+		{"network error", netErr, true},
+		{"unexpected eof", io.ErrUnexpectedEOF, true},
+		{"eof", io.EOF, false},
+		{"other error", errors.New("checksum mismatch"), false},
+	}
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.transient, isTransientError(testCase.err), testCase.name)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	testCases := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, retryBaseDelay},
+		{1, 2 * retryBaseDelay},
+		{2, 4 * retryBaseDelay},
+		{5, 32 * retryBaseDelay},
+		{6, retryMaxDelay},
+		{15, retryMaxDelay},
+		{16, retryMaxDelay},
+		{100, retryMaxDelay},
+	}
+	for _, testCase := range testCases {
+		// delay is jittered between half and full exponential delay
+		for i := 0; i < 100; i++ {
+			delay := backoffDelay(testCase.attempt)
+			assert.True(t, delay >= testCase.max/2, "attempt %d: %v < %v", testCase.attempt, delay, testCase.max/2)
+			assert.True(t, delay <= testCase.max, "attempt %d: %v > %v", testCase.attempt, delay, testCase.max)
+		}
+	}
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"mime"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -22,31 +30,109 @@ import (
 // S3 - presents methods for manipulate data on s3
 type S3 struct {
 	session *session.Session
+	limiter *rateLimiter
 	Config  *S3Config
 	DryRun  bool
+	// Force - upload all files even if the same files are on s3 according to overwrite_strategy
+	Force bool
+	// backupName and backupCreated - uploaded objects are tagged with them, they are set by tagBackup
+	backupName    string
+	backupCreated time.Time
+	// taggingUnsupported - endpoint rejected upload with tags, it is set atomically
+	taggingUnsupported int32
+	// DirMode and FileMode - permissions of directories and files created by download regardless of umask,
+	// directories get 0755 and files get mode limited by umask if they aren't set
+	DirMode  os.FileMode
+	FileMode os.FileMode
+	// Layout - keys of files of directories uploaded and downloaded by tree strategy
+	Layout keyLayout
+}
+
+// dirMode - permissions of directories created by download
+func (s *S3) dirMode() os.FileMode {
+	if s.DirMode == 0 {
+		return 0755
+	}
+	return s.DirMode
+}
+
+// createFile - create file for download with FileMode
+func (s *S3) createFile(filePath string) (*os.File, error) {
+	f, err := os.Create(filePath)
+	if err != nil || s.FileMode == 0 {
+		return f, err
+	}
+	if err := f.Chmod(s.FileMode); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
 }
 
 // Connect - connect to s3
 func (s *S3) Connect() (err error) {
-	s.session, err = session.NewSession(
-		&aws.Config{
-			Credentials:      credentials.NewStaticCredentials(s.Config.AccessKey, s.Config.SecretKey, ""),
-			Region:           aws.String(s.Config.Region),
-			Endpoint:         aws.String(s.Config.Endpoint),
-			DisableSSL:       aws.Bool(s.Config.DisableSSL),
-			S3ForcePathStyle: aws.Bool(s.Config.ForcePathStyle),
-		},
-	)
-	return
+	s.limiter = newRateLimiter(s.Config.MaxUploadBytesPerSecond)
+	awsConfig := aws.Config{
+		Region:           aws.String(s.Config.Region),
+		Endpoint:         aws.String(s.Config.Endpoint),
+		DisableSSL:       aws.Bool(s.Config.DisableSSL),
+		S3ForcePathStyle: aws.Bool(s.Config.ForcePathStyle),
+	}
+	// keys from config take precedence over default credential chain of environment variables,
+	// shared credentials file, web identity token and instance role
+	if s.Config.AccessKey != "" || s.Config.SecretKey != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(s.Config.AccessKey, s.Config.SecretKey, "")
+	}
+	s.session, err = session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		Profile:           s.Config.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return err
+	}
+	if s.Config.RoleARN != "" {
+		s.session = s.session.Copy(&aws.Config{Credentials: stscreds.NewCredentials(s.session, s.Config.RoleARN)})
+	}
+	if _, err := s.session.Config.Credentials.Get(); err != nil {
+		return fmt.Errorf("can't get aws credentials, set s3.access_key and s3.secret_key, s3.profile or use instance role: %v", err)
+	}
+	return nil
+}
+
+// newUploader - uploader with part size and concurrency from config
+func (s *S3) newUploader() *s3manager.Uploader {
+	uploader := s3manager.NewUploader(s.session)
+	uploader.PartSize = s.Config.PartSize
+	uploader.Concurrency = s.Config.Concurrency
+	return uploader
+}
+
+// newDownloader - downloader with part size and concurrency from config
+func (s *S3) newDownloader() *s3manager.Downloader {
+	downloader := s3manager.NewDownloader(s.session)
+	downloader.PartSize = s.Config.PartSize
+	downloader.Concurrency = s.Config.Concurrency
+	return downloader
 }
 
 // UploadDirectory - synchronize localPath to dstPath on s3
-func (s *S3) UploadDirectory(localPath string, dstPath string) error {
+func (s *S3) UploadDirectory(ctx context.Context, localPath string, dstPath string) error {
+	return s.UploadDirectoryFiltered(ctx, localPath, dstPath, nil)
+}
+
+// UploadDirectoryFiltered - synchronize localPath to dstPath on s3 except files which keys relative to localPath
+// are skipped by skip, skipped files are treated as absent locally
+func (s *S3) UploadDirectoryFiltered(ctx context.Context, localPath string, dstPath string, skip func(key string) bool) error {
 	// TODO: it must be refactored like as Download() method
-	iter, filesForDelete, err := s.newSyncFolderIterator(localPath, dstPath)
+	iter, filesForDelete, err := s.newSyncFolderIterator(localPath, dstPath, skip)
 	if err != nil {
 		return err
 	}
+	if s.DryRun {
+		logUploadPlan(iter.fileInfos, iter.s3path, filesForDelete)
+		return nil
+	}
 	var bar *pb.ProgressBar
 	if !s.Config.DisableProgressBar {
 		bar = pb.StartNew(len(iter.fileInfos) + iter.skipFilesCount)
@@ -54,19 +140,51 @@ func (s *S3) UploadDirectory(localPath string, dstPath string) error {
 		defer bar.FinishPrint("Done.")
 	}
 
-	uploader := s3manager.NewUploader(s.session)
-	uploader.PartSize = config.S3.PartSize
+	uploader := s.newUploader()
 	var errs []s3manager.Error
 	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		size := iter.fileInfos[0].size
 		object := iter.UploadObject()
 		if !s.DryRun {
-			if _, err := uploader.UploadWithContext(aws.BackgroundContext(), object.Object); err != nil {
+			h := newEtagHash(uploader.PartSize)
+			if err := withRetry(ctx, s.Config.MaxRetries, *object.Object.Key, func() error {
+				if err := s.uploadWithTagging(func(tagging *string) error {
+					body := object.Object.Body
+					if seeker, ok := body.(io.Seeker); ok {
+						if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+							return err
+						}
+					}
+					h.Reset()
+					input := *object.Object
+					if isCompressedObject(input.Metadata) {
+						compressed := gzipStream(body)
+						defer compressed.Close()
+						body = compressed
+					}
+					input.Body = io.TeeReader(s.limiter.Reader(body), h)
+					input.Tagging = tagging
+					_, err := uploader.UploadWithContext(ctx, &input)
+					return err
+				}); err != nil {
+					return err
+				}
+				if s.Config.VerifyUploads {
+					return s.verifyUpload(ctx, *object.Object.Key, h)
+				}
+				return nil
+			}); err != nil {
 				s3Err := s3manager.Error{
 					OrigErr: err,
 					Bucket:  object.Object.Bucket,
 					Key:     object.Object.Key,
 				}
 				errs = append(errs, s3Err)
+			} else {
+				metricsFromContext(ctx).addTransfer(1, size)
 			}
 		}
 		if !s.Config.DisableProgressBar {
@@ -103,40 +221,89 @@ func (s *S3) UploadDirectory(localPath string, dstPath string) error {
 		})
 	}
 
-	if err := batcher.Delete(aws.BackgroundContext(), &s3manager.DeleteObjectsIterator{Objects: objects}); err != nil {
-		log.Printf("can't delete objects with: %v", err)
+	if err := batcher.Delete(ctx, &s3manager.DeleteObjectsIterator{Objects: objects}); err != nil {
+		logger.Warnf("can't delete objects with: %v", err)
 	}
 	return nil
 }
 
+// logUploadPlan - log every object which would be uploaded and every extra object which would be deleted with totals
+func logUploadPlan(uploads []fileInfo, s3Path string, deletes map[string]fileInfo) {
+	var uploadSize, deleteSize int64
+	for _, file := range uploads {
+		logger.WithFields(Fields{"key": path.Join(s3Path, file.key), "bytes": file.size}).Infof("DRY-RUN: upload (%s)", formatBytes(file.size))
+		uploadSize += file.size
+	}
+	keys := make([]string, 0, len(deletes))
+	for key := range deletes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		file := deletes[key]
+		logger.WithFields(Fields{"key": file.key, "bytes": file.size}).Infof("DRY-RUN: delete (%s)", formatBytes(file.size))
+		deleteSize += file.size
+	}
+	logger.WithFields(Fields{"key": s3Path, "upload_objects": len(uploads), "upload_bytes": uploadSize, "delete_objects": len(deletes), "delete_bytes": deleteSize}).
+		Infof("DRY-RUN: %d objects of %s would be uploaded, %d extra objects of %s would be deleted", len(uploads), formatBytes(uploadSize), len(deletes), formatBytes(deleteSize))
+}
+
 // UploadFile - synchronize localPath to dstPath on s3
-func (s *S3) UploadFile(localPath string, dstPath string) error {
+func (s *S3) UploadFile(ctx context.Context, localPath string, dstPath string) error {
 
-	uploader := s3manager.NewUploader(s.session)
-	uploader.PartSize = config.S3.PartSize
+	uploader := s.newUploader()
 
 	file, err := os.Open(localPath)
 	if err != nil {
 		return fmt.Errorf("error opening file %v: %v", localPath, err)
 	}
+	defer file.Close()
 	if !s.DryRun {
-		_, err := uploader.UploadWithContext(aws.BackgroundContext(), &s3manager.UploadInput{
-			ACL:    aws.String(config.S3.ACL),
-			Bucket: aws.String(config.S3.Bucket),
-			Key:    aws.String(path.Join(s.Config.Path, dstPath)),
-			Body:   file,
+		key := path.Join(s.Config.Path, dstPath)
+		h := newEtagHash(uploader.PartSize)
+		err := withRetry(ctx, s.Config.MaxRetries, key, func() error {
+			if err := s.uploadWithTagging(func(tagging *string) error {
+				if _, err := file.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+				h.Reset()
+				_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+					ACL:          aws.String(s.Config.ACL),
+					Bucket:       aws.String(s.Config.Bucket),
+					Key:          aws.String(key),
+					Body:         io.TeeReader(s.limiter.Reader(file), h),
+					StorageClass: aws.String(s.Config.StorageClass),
+					Tagging:      tagging,
+				})
+				return err
+			}); err != nil {
+				return err
+			}
+			if s.Config.VerifyUploads {
+				return s.verifyUpload(ctx, key, h)
+			}
+			return nil
 		})
 		if err != nil {
 			return err
 		}
+		if info, err := file.Stat(); err == nil {
+			metricsFromContext(ctx).addTransfer(1, info.Size())
+		}
 	}
 
 	return nil
 }
 
 // DownloadTree - download files from s3Path to localPath
-func (s *S3) DownloadTree(s3Path string, localPath string) error {
-	if err := os.MkdirAll(localPath, 0755); err != nil {
+func (s *S3) DownloadTree(ctx context.Context, s3Path string, localPath string) error {
+	return s.DownloadTreeFiltered(ctx, s3Path, localPath, nil)
+}
+
+// DownloadTreeFiltered - download files from s3Path to localPath which keys relative to s3Path are accepted by filter,
+// all files are downloaded if filter is nil
+func (s *S3) DownloadTreeFiltered(ctx context.Context, s3Path string, localPath string, filter func(key string) bool) error {
+	if err := mkdirAllMode(localPath, s.dirMode()); err != nil {
 		return fmt.Errorf("can't create '%s' with: %v", localPath, err)
 	}
 	localFiles, err := s.getLocalFiles(localPath, s3Path)
@@ -147,99 +314,496 @@ func (s *S3) DownloadTree(s3Path string, localPath string) error {
 	if err != nil {
 		return err
 	}
+	if filter != nil {
+		// object with gzipSuffix is probably compressed file, so filter is applied to name of file too
+		for key := range s3Files {
+			if !filter(key) && !(strings.HasSuffix(key, gzipSuffix) && filter(strings.TrimSuffix(key, gzipSuffix))) {
+				delete(s3Files, key)
+			}
+		}
+	}
+	for _, s3File := range s3Files {
+		if isArchivedStorageClass(s3File.storageClass) {
+			return fmt.Errorf("'%s' is stored in %s class and must be restored on s3 before download", s3File.key, s3File.storageClass)
+		}
+	}
+	keys := make([]string, 0, len(s3Files))
+	for key := range s3Files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if !s.DryRun {
+		// directories are created before workers are started, so workers never create the same directory
+		created := make(map[string]bool)
+		for _, key := range keys {
+			dir := filepath.Dir(filepath.Join(localPath, key))
+			if created[dir] {
+				continue
+			}
+			if err := mkdirAllMode(dir, s.dirMode()); err != nil {
+				return fmt.Errorf("can't create '%s' with: %v", dir, err)
+			}
+			created[dir] = true
+		}
+	}
 	var bar *pb.ProgressBar
 	if !s.Config.DisableProgressBar {
 		bar = pb.StartNew(len(s3Files))
 		defer bar.FinishPrint("Done.")
 	}
-	downloader := s3manager.NewDownloader(s.session)
-	for _, s3File := range s3Files {
+	// the first failed worker cancels downloads of other workers, their errors of cancellation are ignored
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		failOnce sync.Once
+		firstErr error
+	)
+	downloader := s.newDownloader()
+	err = runParallel(s.Config.DownloadConcurrency, len(keys), func(i int) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s3File := s3Files[keys[i]]
 		if !s.Config.DisableProgressBar {
 			bar.Increment()
 		}
-		if existsFile, ok := localFiles[s3File.key]; ok {
-			if existsFile.size == s3File.size {
-				switch s.Config.OverwriteStrategy {
-				case "skip":
-					continue
-				case "etag":
-					if s3File.etag == GetEtag(existsFile.fullpath, s.Config.PartSize) {
-						continue
-					}
-				}
-			}
+		if existsFile, ok := localFiles[s3File.key]; ok && s.remoteFileMatches(existsFile.fullpath, existsFile.size, s3File, false) {
+			return nil
+		}
+		gzipCandidate := strings.HasSuffix(s3File.key, gzipSuffix)
+		if existsFile, ok := localFiles[strings.TrimSuffix(s3File.key, gzipSuffix)]; ok && gzipCandidate && s.remoteFileMatches(existsFile.fullpath, existsFile.size, s3File, true) {
+			return nil
 		}
 		params := &s3.GetObjectInput{
 			Bucket: aws.String(s.Config.Bucket),
-			Key:    aws.String(path.Join(s.Config.Path, s3Path, s3File.key)),
+			Key:    aws.String(path.Join(s.Config.Path, s3Path, s3File.remoteKey)),
 		}
 		newFilePath := filepath.Join(localPath, s3File.key)
-		newPath := filepath.Dir(newFilePath)
 		if s.DryRun {
 			log.Printf("Download '%s' to '%s'", s3File.key, newFilePath)
-			continue
+			return nil
 		}
-		if err := os.MkdirAll(newPath, 0755); err != nil {
-			return fmt.Errorf("can't create '%s' with: %v", newPath, err)
+		download := func() error {
+			return s.downloadFile(ctx, downloader, params, newFilePath)
 		}
-		f, err := os.Create(newFilePath)
-		if err != nil {
-			return fmt.Errorf("can't open '%s' with %v", newFilePath, err)
+		if gzipCandidate {
+			// only metadata of object tells if it's compressed file or file with gzipSuffix
+			download = func() error {
+				return s.downloadGzipCandidate(ctx, *params.Key, newFilePath)
+			}
 		}
-		if _, err := downloader.DownloadWithContext(aws.BackgroundContext(), f, params); err != nil {
-			return fmt.Errorf("can't download file '%s' with %v", s3File.key, err)
+		if err := download(); err != nil {
+			err = fmt.Errorf("can't download file '%s' with %v", s3File.key, err)
+			failOnce.Do(func() {
+				firstErr = err
+				cancel()
+			})
+			return err
 		}
+		return nil
+	})
+	if firstErr != nil {
+		return firstErr
 	}
 
 	// TODO: Delete extra files
+	return err
+}
+
+// UploadContent - put content to dstPath on s3, it is always stored in STANDARD class to be available for list and download
+func (s *S3) UploadContent(ctx context.Context, content []byte, dstPath string) error {
+	key := path.Join(s.Config.Path, dstPath)
+	if s.DryRun {
+		log.Printf("Upload '%s'  ...skip dry-run", key)
+		return nil
+	}
+	uploader := s.newUploader()
+	h := newEtagHash(uploader.PartSize)
+	h.Write(content)
+	if err := withRetry(ctx, s.Config.MaxRetries, key, func() error {
+		if err := s.uploadWithTagging(func(tagging *string) error {
+			_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+				ACL:     aws.String(s.Config.ACL),
+				Bucket:  aws.String(s.Config.Bucket),
+				Key:     aws.String(key),
+				Body:    bytes.NewReader(content),
+				Tagging: tagging,
+			})
+			return err
+		}); err != nil {
+			return err
+		}
+		if s.Config.VerifyUploads {
+			return s.verifyUpload(ctx, key, h)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	metricsFromContext(ctx).addTransfer(1, int64(len(content)))
 	return nil
 }
 
-// DownloadArchive - download files from s3Path to localPath
-func (s *S3) DownloadArchive(s3Path string, localPath string) error {
-	if err := os.MkdirAll(localPath, 0755); err != nil {
+// DownloadContent - get content of s3Path from s3
+func (s *S3) DownloadContent(ctx context.Context, s3Path string) ([]byte, error) {
+	key := path.Join(s.Config.Path, s3Path)
+	downloader := s.newDownloader()
+	var content []byte
+	err := withRetry(ctx, s.Config.MaxRetries, key, func() error {
+		buf := aws.NewWriteAtBuffer([]byte{})
+		if _, err := downloader.DownloadWithContext(ctx, buf, &s3.GetObjectInput{
+			Bucket: aws.String(s.Config.Bucket),
+			Key:    aws.String(key),
+		}); err != nil {
+			return err
+		}
+		content = buf.Bytes()
+		return nil
+	})
+	if err == nil {
+		metricsFromContext(ctx).addTransfer(1, int64(len(content)))
+	}
+	return content, err
+}
+
+// DownloadStream - open reader of s3Path content, caller must close it
+func (s *S3) DownloadStream(ctx context.Context, s3Path string) (io.ReadCloser, error) {
+	key := path.Join(s.Config.Path, s3Path)
+	var body io.ReadCloser
+	err := withRetry(ctx, s.Config.MaxRetries, key, func() error {
+		resp, err := s3.New(s.session).GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.Config.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return archivedObjectError(key, err)
+		}
+		size := int64(-1)
+		if resp.ContentLength != nil {
+			size = *resp.ContentLength
+		}
+		body = &streamReader{
+			ReadCloser: resp.Body,
+			s:          s,
+			ctx:        ctx,
+			key:        key,
+			etag:       aws.StringValue(resp.ETag),
+			size:       size,
+			metadata:   resp.Metadata,
+			metrics:    metricsFromContext(ctx),
+		}
+		return nil
+	})
+	return body, err
+}
+
+// DownloadArchiveFile - download s3Path to localPath by s3.archive_concurrency ranges of s3.part_size at the same time,
+// downloaded file is checked against size and ETag of object. Interrupted download is resumed from partial localPath
+// by Range request if ETag of object isn't changed, otherwise object is downloaded again
+func (s *S3) DownloadArchiveFile(ctx context.Context, s3Path string, localPath string) error {
+	key := path.Join(s.Config.Path, s3Path)
+	var head *s3.HeadObjectOutput
+	if err := withRetry(ctx, s.Config.MaxRetries, key, func() error {
+		var err error
+		head, err = s3.New(s.session).HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.Config.Bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	}); err != nil {
+		return fmt.Errorf("can't get size of '%s' with: %v", key, err)
+	}
+	state := &downloadState{Key: key, ETag: aws.StringValue(head.ETag), Size: aws.Int64Value(head.ContentLength)}
+	offset, err := resumeDownloadState(localPath, *state)
+	if err != nil {
+		return err
+	}
+	if offset > 0 && offset < state.Size {
+		logger.Infof("Resume download of '%s' from %d of %d bytes", key, offset, state.Size)
+		err = s.downloadArchiveRest(ctx, state, localPath, offset)
+		if isPreconditionFailed(err) {
+			logger.Warnf("'%s' is changed since partial download to '%s', it's downloaded again", key, localPath)
+			removeDownload(localPath)
+			offset = 0
+		} else if err != nil {
+			return err
+		}
+	}
+	if offset == 0 {
+		if err := s.downloadArchiveRanges(ctx, state, localPath); err != nil {
+			return err
+		}
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != state.Size {
+		removeDownload(localPath)
+		return fmt.Errorf("downloaded '%s' has %d bytes, object has %d bytes", key, info.Size(), state.Size)
+	}
+	h := newEtagHash(s.Config.PartSize)
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("can't read '%s' with: %v", localPath, err)
+	}
+	match, ok := h.Check(state.ETag)
+	if !ok {
+		logger.Warnf("ETag of '%s' can't be calculated with s3.part_size %d, only size of downloaded file is checked", key, s.Config.PartSize)
+	} else if !match {
+		removeDownload(localPath)
+		return fmt.Errorf("downloaded '%s' doesn't match ETag %s of object", key, state.ETag)
+	}
+	// complete file isn't downloaded again if download of the next part of archive is interrupted
+	state.Downloaded = state.Size
+	return state.save(localPath)
+}
+
+// downloadArchiveRanges - download object to new localPath by parallel ranges, prefix of file which is written
+// without gaps is saved to state on failure
+func (s *S3) downloadArchiveRanges(ctx context.Context, state *downloadState, localPath string) error {
+	f, err := os.Create(localPath)
+	if err != nil {
 		return fmt.Errorf("can't create '%s' with: %v", localPath, err)
 	}
-	downloader := s3manager.NewDownloader(s.session)
+	defer f.Close()
+	if err := state.save(localPath); err != nil {
+		return fmt.Errorf("can't save download state: %v", err)
+	}
+	downloader := s.newDownloader()
+	downloader.Concurrency = s.Config.ArchiveConcurrency
 	params := &s3.GetObjectInput{
 		Bucket: aws.String(s.Config.Bucket),
-		Key:    aws.String(path.Join(s.Config.Path, s3Path)),
+		Key:    aws.String(state.Key),
 	}
-	newFilePath := filepath.Join(localPath, filepath.Base(s3Path))
-	newPath := filepath.Dir(newFilePath)
-	if s.DryRun {
-		log.Printf("Download '%s' to '%s'", s3Path, newFilePath)
-		return nil
+	if state.ETag != "" {
+		// ranges of object which is changed during download can't be mixed
+		params.IfMatch = aws.String(state.ETag)
 	}
-	if err := os.MkdirAll(newPath, 0644); err != nil {
-		return fmt.Errorf("can't create '%s' with: %v", newPath, err)
+	w := newPrefixWriterAt(f, 0)
+	// every range is retried by sdk, so error means that range isn't downloaded after all retries
+	n, err := downloader.DownloadWithContext(ctx, w, params)
+	metricsFromContext(ctx).addTransfer(1, n)
+	if err != nil {
+		state.Downloaded = w.Prefix()
+		if saveErr := state.save(localPath); saveErr != nil {
+			logger.Warnf("can't save download state of '%s': %v", localPath, saveErr)
+		}
+		return fmt.Errorf("can't download '%s' by %d ranges of %d bytes at the same time: %v", state.Key, downloader.Concurrency, downloader.PartSize, archivedObjectError(state.Key, err))
 	}
-	f, err := os.Create(newFilePath)
+	return nil
+}
+
+// downloadArchiveRest - append object from offset to partial localPath by Range request, download fails
+// with precondition error if object is changed
+func (s *S3) downloadArchiveRest(ctx context.Context, state *downloadState, localPath string, offset int64) error {
+	f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_APPEND, 0)
 	if err != nil {
-		return fmt.Errorf("can't open '%s' with %v", newFilePath, err)
+		return fmt.Errorf("can't open '%s' with: %v", localPath, err)
 	}
-	if _, err := downloader.DownloadWithContext(aws.BackgroundContext(), f, params); err != nil {
-		return fmt.Errorf("can't download file '%s' with %v", s3Path, err)
+	defer f.Close()
+	resp, err := s3.New(s.session).GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:  aws.String(s.Config.Bucket),
+		Key:     aws.String(state.Key),
+		Range:   aws.String(fmt.Sprintf("bytes=%d-", offset)),
+		IfMatch: aws.String(state.ETag),
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(f, &contextReader{ctx: ctx, r: resp.Body})
+	metricsFromContext(ctx).addTransfer(1, n)
+	if err != nil {
+		state.Downloaded = offset + n
+		if saveErr := state.save(localPath); saveErr != nil {
+			logger.Warnf("can't save download state of '%s': %v", localPath, saveErr)
+		}
+		return fmt.Errorf("can't download '%s' from %d bytes with: %v", state.Key, offset, err)
 	}
+	return nil
+}
+
+// isPreconditionFailed - s3 refused request because object doesn't match If-Match ETag anymore
+func isPreconditionFailed(err error) bool {
+	e, ok := err.(awserr.RequestFailure)
+	return ok && e.StatusCode() == 412
+}
+
+// DownloadStreams - read objects one after another as single stream, the next object is requested
+// when the previous one is read to the end
+func (s *S3) DownloadStreams(ctx context.Context, s3Paths []string) io.ReadCloser {
+	return &multiStreamReader{s: s, ctx: ctx, paths: s3Paths}
+}
+
+type multiStreamReader struct {
+	s       *S3
+	ctx     context.Context
+	paths   []string
+	current io.ReadCloser
+}
+
+func (r *multiStreamReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			body, err := r.s.DownloadStream(r.ctx, r.paths[0])
+			if err != nil {
+				return 0, fmt.Errorf("error downloading '%s' from s3 with %v", r.paths[0], err)
+			}
+			r.current = body
+			r.paths = r.paths[1:]
+		}
+		n, err := r.current.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		err = r.current.Close()
+		r.current = nil
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *multiStreamReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+// streamReader - count downloaded bytes for metrics and add key to read errors, interrupted download
+// is resumed by Range request from the last read byte if ETag of object is not changed
+type streamReader struct {
+	io.ReadCloser
+	s        *S3
+	ctx      context.Context
+	key      string
+	etag     string
+	size     int64
+	metadata map[string]*string
+	metrics  *runMetrics
+	read     int64
+	resumes  int
+	closed   bool
+}
 
+func (r *streamReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.ReadCloser.Read(p)
+		r.read += int64(n)
+		if err == io.EOF && r.size >= 0 && r.read < r.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if r.resumes >= r.s.Config.MaxRetries || !isTransientError(err) || r.ctx.Err() != nil {
+			return n, fmt.Errorf("can't read '%s' after %d bytes with: %v", r.key, r.read, err)
+		}
+		if resumeErr := r.resume(err); resumeErr != nil {
+			return n, fmt.Errorf("can't resume download of '%s' after %d bytes with: %v", r.key, r.read, resumeErr)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume - request the rest of object from the last read byte, download fails if object is changed meanwhile
+func (r *streamReader) resume(cause error) error {
+	delay := backoffDelay(r.resumes)
+	r.resumes++
+	logger.Warnf("resume download of '%s' from %d of %d bytes in %v: %v", r.key, r.read, r.size, delay, cause)
+	r.ReadCloser.Close()
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case <-time.After(delay):
+	}
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(r.s.Config.Bucket),
+		Key:    aws.String(r.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-", r.read)),
+	}
+	if r.etag != "" {
+		params.IfMatch = aws.String(r.etag)
+	}
+	resp, err := s3.New(r.s.session).GetObjectWithContext(r.ctx, params)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			return fmt.Errorf("object is changed since download is started, download it again")
+		}
+		return err
+	}
+	r.ReadCloser = resp.Body
 	return nil
 }
 
+func (r *streamReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.metrics.addTransfer(1, r.read)
+	}
+	return r.ReadCloser.Close()
+}
+
+// downloadFile - download single object to localPath, retrying on transient errors
+// downloadingSuffix - suffix of file which is being downloaded
+const downloadingSuffix = ".downloading"
+
+func (s *S3) downloadFile(ctx context.Context, downloader *s3manager.Downloader, params *s3.GetObjectInput, localPath string) error {
+	// file is downloaded to temp file and renamed, so interrupted download never leaves file of full size
+	// which is skipped by size on the next run
+	tmpPath := localPath + downloadingSuffix
+	return withRetry(ctx, s.Config.MaxRetries, *params.Key, func() error {
+		f, err := s.createFile(tmpPath)
+		if err != nil {
+			return fmt.Errorf("can't open '%s' with %v", tmpPath, err)
+		}
+		n, err := downloader.DownloadWithContext(ctx, f, params)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(tmpPath)
+			return archivedObjectError(*params.Key, err)
+		}
+		if err := os.Rename(tmpPath, localPath); err != nil {
+			return err
+		}
+		metricsFromContext(ctx).addTransfer(1, n)
+		return nil
+	})
+}
+
 // SyncFolderIterator is used to upload a given folder to Amazon S3.
 type SyncFolderIterator struct {
 	bucket         string
 	fileInfos      []fileInfo
 	err            error
 	acl            string
+	storageClass   string
 	s3path         string
 	skipFilesCount int
 }
 
 type fileInfo struct {
-	key      string
-	fullpath string
-	size     int64
-	etag     string
+	key          string
+	fullpath     string
+	size         int64
+	etag         string
+	storageClass string
+	compressed   bool
+	// remoteKey - key of object relative to prefix of directory, key is path of file decoded from it by layout
+	remoteKey string
 }
 
 func (s *S3) getLocalFiles(localPath, s3Path string) (localFiles map[string]fileInfo, err error) {
@@ -267,12 +831,15 @@ func (s *S3) getS3Files(localPath, s3Path string) (s3Files map[string]fileInfo,
 	s.remotePager(s.Config.Path, false, func(page *s3.ListObjectsV2Output) {
 		for _, c := range page.Contents {
 			if strings.HasPrefix(*c.Key, path.Join(s.Config.Path, s3Path)) {
-				key := strings.TrimPrefix(*c.Key, path.Join(s.Config.Path, s3Path))
-				if !strings.HasSuffix(key, "/") {
+				remoteKey := strings.TrimPrefix(*c.Key, path.Join(s.Config.Path, s3Path))
+				if !strings.HasSuffix(remoteKey, "/") {
+					key := s.Layout.decode(remoteKey)
 					s3Files[key] = fileInfo{
-						key:  key,
-						size: *c.Size,
-						etag: *c.ETag,
+						key:          key,
+						remoteKey:    remoteKey,
+						size:         *c.Size,
+						etag:         *c.ETag,
+						storageClass: aws.StringValue(c.StorageClass),
 					}
 				}
 			}
@@ -281,7 +848,7 @@ func (s *S3) getS3Files(localPath, s3Path string) (s3Files map[string]fileInfo,
 	return
 }
 
-func (s *S3) newSyncFolderIterator(localPath, dstPath string) (*SyncFolderIterator, map[string]fileInfo, error) {
+func (s *S3) newSyncFolderIterator(localPath, dstPath string, skip func(key string) bool) (*SyncFolderIterator, map[string]fileInfo, error) {
 	existsFiles := make(map[string]fileInfo)
 	s.remotePager(s.Config.Path, false, func(page *s3.ListObjectsV2Output) {
 		for _, c := range page.Contents {
@@ -306,40 +873,76 @@ func (s *S3) newSyncFolderIterator(localPath, dstPath string) (*SyncFolderIterat
 		if !info.IsDir() {
 			filePath := filepath.ToSlash(filePath) // fix fucking Windows slashes
 			key := strings.TrimPrefix(filePath, localPath)
-			if existFile, ok := existsFiles[key]; ok {
-				delete(existsFiles, key)
-				if existFile.size == info.Size() {
-					switch s.Config.OverwriteStrategy {
-					case "skip":
+			if skip != nil && skip(strings.Trim(key, "/")) {
+				return nil
+			}
+			compressed := s.shouldCompress(key, info.Size())
+			// keys of existing objects are compared in the same layout, so extra files are found by it too
+			key, err := s.Layout.encode(key)
+			if err != nil {
+				return err
+			}
+			// file is kept on s3 both compressed and as is if it's the same, so change of s3.tree_compression
+			// doesn't upload all files again, another form of file is deleted as extra file
+			if !s.Force {
+				for _, remoteKey := range []string{key, key + gzipSuffix} {
+					if existFile, ok := existsFiles[remoteKey]; ok && s.remoteFileMatches(filePath, info.Size(), existFile, remoteKey != key) {
+						delete(existsFiles, remoteKey)
 						skipFilesCount++
 						return nil
-					case "etag":
-						if existFile.etag == GetEtag(filePath, s.Config.PartSize) {
-							// log.Printf("File '%s' already uploaded and has the same size and etag. Skip", key)
-							skipFilesCount++
-							return nil
-						}
 					}
 				}
 			}
+			remoteKey := key
+			if compressed {
+				remoteKey += gzipSuffix
+			}
+			delete(existsFiles, remoteKey)
 			localFiles = append(localFiles, fileInfo{
-				key:      key,
-				fullpath: filePath,
-				size:     info.Size(),
+				key:        remoteKey,
+				fullpath:   filePath,
+				size:       info.Size(),
+				compressed: compressed,
 			})
 		}
 		return nil
 	})
 
+	if skipFilesCount > 0 {
+		log.Printf("%d files are already on s3, skip them", skipFilesCount)
+	}
 	return &SyncFolderIterator{
 		bucket:         s.Config.Bucket,
 		fileInfos:      localFiles,
 		acl:            s.Config.ACL,
+		storageClass:   s.Config.StorageClass,
 		s3path:         path.Join(s.Config.Path, dstPath),
 		skipFilesCount: skipFilesCount,
 	}, existsFiles, err
 }
 
+// remoteFileMatches - check that object is the same as local file according to s3.overwrite_strategy,
+// compressed object is compared with file compressed by gzip
+func (s *S3) remoteFileMatches(filePath string, size int64, remote fileInfo, compressed bool) bool {
+	if compressed {
+		switch s.Config.OverwriteStrategy {
+		case "skip", "etag":
+			return compressedFileMatches(filePath, s.Config.PartSize, remote.size, remote.etag, s.Config.OverwriteStrategy == "etag")
+		}
+		return false
+	}
+	if remote.size != size {
+		return false
+	}
+	switch s.Config.OverwriteStrategy {
+	case "skip":
+		return true
+	case "etag":
+		return fileMatchesEtag(filePath, s.Config.PartSize, remote.etag)
+	}
+	return false
+}
+
 func (s *S3) remotePager(s3Path string, delim bool, pager func(page *s3.ListObjectsV2Output)) error {
 	params := &s3.ListObjectsV2Input{
 		Bucket:  aws.String(s.Config.Bucket), // Required
@@ -384,13 +987,20 @@ func (iter *SyncFolderIterator) UploadObject() s3manager.BatchUploadObject {
 	if mimeType == "" {
 		mimeType = "binary/octet-stream"
 	}
+	var metadata map[string]*string
+	if fi.compressed {
+		// body is compressed while it is uploaded
+		metadata = map[string]*string{compressionMeta: aws.String("gzip")}
+	}
 	return s3manager.BatchUploadObject{
 		Object: &s3manager.UploadInput{
-			ACL:         aws.String(iter.acl),
-			Bucket:      aws.String(iter.bucket),
-			Key:         aws.String(path.Join(iter.s3path, fi.key)),
-			Body:        body,
-			ContentType: aws.String(mimeType),
+			ACL:          aws.String(iter.acl),
+			Bucket:       aws.String(iter.bucket),
+			Key:          aws.String(path.Join(iter.s3path, fi.key)),
+			Body:         body,
+			ContentType:  aws.String(mimeType),
+			Metadata:     metadata,
+			StorageClass: aws.String(iter.storageClass),
 		},
 	}
 }
@@ -423,26 +1033,31 @@ func GetEtag(path string, partSize int64) string {
 	return fmt.Sprintf("\"%x-%d\"", hash, parts)
 }
 
-// ListObjects - get list of objects from s3
+// ListObjects - get list of all objects from s3 with s3Path prefix
 func (s *S3) ListObjects(s3Path string) ([]*s3.Object, error) {
-	params := &s3.ListObjectsInput{
-		Bucket: aws.String(s.Config.Bucket),
-	}
-	resp, err := s3.New(s.session).ListObjects(params)
-	if err != nil {
+	var objects []*s3.Object
+	if err := s.remotePager(s3Path, false, func(page *s3.ListObjectsV2Output) {
+		objects = append(objects, page.Contents...)
+	}); err != nil {
 		return nil, err
 	}
-	return resp.Contents, nil
+	return objects, nil
 }
 
-// DeleteObjects - delete list of objects from s3
-func (s *S3) DeleteObjects(objects []*s3.Object) error {
+// DeleteObjects - delete list of objects with specified keys from s3
+func (s *S3) DeleteObjects(keys []string) error {
+	if s.DryRun {
+		for _, key := range keys {
+			log.Printf("DRY-RUN: delete %s", key)
+		}
+		return nil
+	}
 	batcher := s3manager.NewBatchDelete(s.session)
-	batchObjects := make([]s3manager.BatchDeleteObject, len(objects))
-	for i, obj := range objects {
+	batchObjects := make([]s3manager.BatchDeleteObject, len(keys))
+	for i, key := range keys {
 		batchObjects[i] = s3manager.BatchDeleteObject{
 			Object: &s3.DeleteObjectInput{
-				Key:    obj.Key,
+				Key:    aws.String(key),
 				Bucket: aws.String(s.Config.Bucket),
 			},
 		}
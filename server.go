@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// server - run freeze, upload and clean by backup.schedule until ctx is canceled,
+// current run is finished before exit
+func server(ctx context.Context, config Config, gateway string, dryRun bool) error {
+	if config.Backup.Schedule == "" {
+		return fmt.Errorf("backup.schedule is not set in config")
+	}
+	state := newServerState(time.Duration(config.Backup.ReadyWindowHours) * time.Hour)
+	var running int32
+	scheduler := cron.New()
+	_, err := scheduler.AddFunc(config.Backup.Schedule, func() {
+		if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+			logger.Warnf("Previous backup is still running, skip this one")
+			return
+		}
+		defer atomic.StoreInt32(&running, 0)
+		// run isn't bound to ctx so signal doesn't interrupt it in the middle
+		err := backupCycle(context.Background(), config, gateway, dryRun)
+		if err != nil {
+			logger.Errorf("Backup failed: %v", err)
+		}
+		state.finish(err)
+	})
+	if err != nil {
+		return fmt.Errorf("can't parse backup.schedule with: %v", err)
+	}
+	logger.WithField("schedule", config.Backup.Schedule).Info("Start server")
+	healthErrs := make(chan error, 1)
+	if config.Backup.HTTPListen != "" {
+		logger.WithField("address", config.Backup.HTTPListen).Info("Serve /healthz and /ready")
+		go func() {
+			healthErrs <- serveHealth(ctx, config.Backup.HTTPListen, state.handler(config.Backup.HTTPMetrics))
+		}()
+	}
+	scheduler.Start()
+	select {
+	case <-ctx.Done():
+	case err = <-healthErrs:
+		<-scheduler.Stop().Done()
+		return err
+	}
+	logger.Infof("Stop server, wait for current backup to finish")
+	<-scheduler.Stop().Done()
+	return nil
+}
+
+// backupCycle - freeze all tables into new local backup, upload it with removing of old backups and remove it
+// after successful upload. Local backup which isn't uploaded is kept, failed freeze leaves only shadow which is cleaned
+func backupCycle(ctx context.Context, config Config, gateway string, dryRun bool) error {
+	logger.Infof("Start backup")
+	// {date} of s3.path is date of every backup, not of start of server
+	if err := expandS3Path(&config, time.Now()); err != nil {
+		return err
+	}
+	name := newBackupName()
+	// pre hook is run before freeze, so writers can be stopped before tables are frozen
+	return withHooks(ctx, config.Hooks, "backup", name, dryRun, func(ctx context.Context) error {
+		if err := freeze(ctx, config, freezeOptions{Access: config.Backup.Access, Name: name, CleanupOnFailure: true}, dryRun); err != nil {
+			if disks, disksErr := getDisks(config); disksErr != nil {
+				logger.Errorf("can't clean shadow: %v", disksErr)
+			} else if cleanErr := cleanShadows(disks, dryRun); cleanErr != nil {
+				logger.Errorf("can't clean shadow: %v", cleanErr)
+			}
+			if isNothingToDo(err) {
+				logger.Infof("%v, backup is skipped", err)
+				return nil
+			}
+			return err
+		}
+		if dryRun {
+			logger.Infof("DRY-RUN: upload of '%s' is skipped, it isn't frozen", name)
+			return nil
+		}
+		err := runCommand(ctx, gateway, config.Notifications, false, "upload", func(ctx context.Context) error {
+			return upload(ctx, config, uploadOptions{Backups: []string{name}, CleanAfterUpload: true}, dryRun)
+		})
+		if err != nil {
+			return fmt.Errorf("local backup '%s' is kept: %v", name, err)
+		}
+		logger.Infof("Backup is done")
+		return nil
+	})
+}
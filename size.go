@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"text/tabwriter"
+)
+
+// dirSize - size of regular files in dir, files which are hard links to already counted files are skipped
+func dirSize(dir string, seen map[devino]bool) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		di := devino{Dev: st.Dev, Ino: st.Ino}
+		if seen[di] {
+			return nil
+		}
+		seen[di] = true
+		size += fi.Size()
+		return nil
+	})
+	return size, err
+}
+
+// reclaimableSize - space which is freed by removal of dirs, file is counted only if all its hard links are
+// inside dirs, so parts of shadow which are still linked from data of tables are not counted
+func reclaimableSize(dirs []string) (int64, error) {
+	links := make(map[devino]uint64)
+	sizes := make(map[devino]int64)
+	nlinks := make(map[devino]uint64)
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			st := fi.Sys().(*syscall.Stat_t)
+			di := devino{Dev: st.Dev, Ino: st.Ino}
+			links[di]++
+			sizes[di] = fi.Size()
+			nlinks[di] = uint64(st.Nlink)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	var size int64
+	for di, count := range links {
+		if count >= nlinks[di] {
+			size += sizes[di]
+		}
+	}
+	return size, nil
+}
+
+// backupSize - print size of metadata and shadows which will be uploaded and size of all objects on s3
+func backupSize(config Config) error {
+	disks, err := getDisks(config)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "LOCATION\tPATH\tSIZE\tBYTES\n")
+	var localSize int64
+	seen := make(map[devino]bool)
+	local, err := selectLocalBackup(disks, nil)
+	if err != nil {
+		return err
+	}
+	for _, source := range local.sources(false) {
+		size, err := dirSize(source.Path, seen)
+		if err != nil {
+			return fmt.Errorf("can't get size of '%s' with: %v", source.Path, err)
+		}
+		localSize += size
+		fmt.Fprintf(w, "local\t%s\t%s\t%d\n", source.Path, formatBytes(size), size)
+	}
+	fmt.Fprintf(w, "local\ttotal\t%s\t%d\n", formatBytes(localSize), localSize)
+
+	s3 := &S3{
+		Config: &config.S3,
+	}
+	if err := s3.Connect(); err != nil {
+		return connectionError(fmt.Errorf("can't connect to s3 with: %v", err))
+	}
+	objects, err := s3.ListObjects(config.S3.Path)
+	if err != nil {
+		return fmt.Errorf("can't list objects on s3 with: %v", err)
+	}
+	var remoteSize int64
+	for _, object := range objects {
+		remoteSize += *object.Size
+	}
+	fmt.Fprintf(w, "remote\ts3://%s/%s\t%s\t%d\n", config.S3.Bucket, config.S3.Path, formatBytes(remoteSize), remoteSize)
+	return w.Flush()
+}
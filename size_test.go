@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirSizeCountsHardLinksOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "size")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "1", "data"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "2", "data"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "1", "data", "a.bin"), make([]byte, 100), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "1", "data", "b.bin"), make([]byte, 10), 0644))
+	assert.NoError(t, os.Link(filepath.Join(dir, "1", "data", "a.bin"), filepath.Join(dir, "2", "data", "a.bin")))
+	assert.NoError(t, os.Symlink("a.bin", filepath.Join(dir, "1", "data", "link.bin")))
+
+	seen := make(map[devino]bool)
+	size, err := dirSize(dir, seen)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(110), size)
+
+	size, err = dirSize(filepath.Join(dir, "2"), seen)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+
+	size, err = dirSize(filepath.Join(dir, "missing"), seen)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+}
+
+func TestReclaimableSizeSkipsLinkedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "size")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "data"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "shadow", "1"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "shadow", "2"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "data", "live.bin"), make([]byte, 100), 0644))
+	assert.NoError(t, os.Link(filepath.Join(dir, "data", "live.bin"), filepath.Join(dir, "shadow", "1", "live.bin")))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "shadow", "1", "merged.bin"), make([]byte, 10), 0644))
+	assert.NoError(t, os.Link(filepath.Join(dir, "shadow", "1", "merged.bin"), filepath.Join(dir, "shadow", "2", "merged.bin")))
+
+	size, err := reclaimableSize([]string{filepath.Join(dir, "shadow", "1"), filepath.Join(dir, "shadow", "2")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), size)
+
+	size, err = reclaimableSize([]string{filepath.Join(dir, "shadow", "1")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// metadataArchiveName - archive of backup with archive_granularity table which contains metadata of all tables
+// and access entities
+const metadataArchiveName = "metadata.tar"
+
+// isArchiveSet - backup of archive strategy with archive_granularity table is stored under <name>/ prefix
+// with archive per table, archive of whole backup has suffix of archive
+func isArchiveSet(name string) bool {
+	return !hasArchiveSuffix(name)
+}
+
+// tableArchiveName - archive with all increments and disks of table in backup with archive_granularity table,
+// names are escaped like clickhouse escapes them for directories, so they don't have '.' and name is unambiguous
+func tableArchiveName(database string, table string) string {
+	return escapeFileName(database) + "." + escapeFileName(table) + ".tar"
+}
+
+// escapeFileName - replace every byte except ASCII letters, digits and '_' by %XX
+func escapeFileName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// uploadTableArchives - upload metadata archive and archive of every table under prefix named by name or local backup,
+// checksums and manifest are uploaded last so backup without manifest is incomplete
+func uploadTableArchives(ctx context.Context, s3 *S3, local localBackup, name string, schemaOnly bool, skipSymlinks bool, tmpDir string) (string, error) {
+	setName := name
+	if setName == "" {
+		setName = local.Name
+	}
+	if setName == "" {
+		setName = newBackupName()
+	}
+	metricsFromContext(ctx).setBackup(setName)
+	s3.tagBackup(setName)
+	checksums := make(Checksums)
+	// digests of checksums embedded into every archive by name of archive
+	digests := make(Checksums)
+	upload := func(name string, fill func(tw *tarWriter) error) error {
+		file, err := ioutil.TempFile(tmpDir, "*.tar")
+		if err != nil {
+			return err
+		}
+		cw := newChunkWriter(file, 0)
+		tw := newTarWriter(cw)
+		err = fill(tw)
+		if closeErr := tw.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			cw.Remove()
+			return fmt.Errorf("error achiving %s with: %v", name, err)
+		}
+		paths, sums, err := cw.Close()
+		defer removeFiles(paths)
+		if err != nil {
+			return fmt.Errorf("error achiving %s with: %v", name, err)
+		}
+		checksums[name] = sums[0]
+		digests[name] = tw.Digest()
+		logger.WithField("key", path.Join(setName, name)).Infof("upload %s", name)
+		if err := s3.UploadFile(ctx, paths[0], path.Join(setName, name)); err != nil {
+			return fmt.Errorf("can't upload %s to s3 with: %v", name, err)
+		}
+		return nil
+	}
+	shadows := local.shadows()
+	if err := upload(metadataArchiveName, func(tw *tarWriter) error {
+		for _, source := range local.sources(true) {
+			if err := TarDirAs(ctx, tw, source.Path, source.Key, skipSymlinks); err != nil {
+				return err
+			}
+		}
+		accessPath := filepath.Join(shadows[defaultDiskName], accessDir)
+		if _, err := os.Stat(accessPath); os.IsNotExist(err) {
+			return nil
+		}
+		return TarDirAs(ctx, tw, accessPath, path.Join(diskShadowKey(defaultDiskName), accessDir), skipSymlinks)
+	}); err != nil {
+		return "", err
+	}
+	if schemaOnly {
+		logger.Infof("skip data in schema-only mode")
+	} else {
+		tables, err := getDisksBackupTables(shadows)
+		if err != nil {
+			return "", fmt.Errorf("can't read frozen tables: %v", err)
+		}
+		increments := make(map[string][]BackupTable)
+		for _, table := range tables {
+			name := tableArchiveName(table.Database, table.Name)
+			increments[name] = append(increments[name], table)
+		}
+		names := make([]string, 0, len(increments))
+		for name := range increments {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := upload(name, func(tw *tarWriter) error {
+				for _, table := range increments[name] {
+					for _, partition := range table.Partitions {
+						shadowPath := shadows[partition.Disk]
+						key := path.Join(diskShadowKey(partition.Disk), strings.TrimPrefix(partition.Path, shadowPath+"/"))
+						if err := TarDirAs(ctx, tw, partition.Path, key, skipSymlinks); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			}); err != nil {
+				return "", err
+			}
+		}
+		logger.Infof("%d tables are uploaded", len(names))
+	}
+	logger.Infof("upload checksums")
+	if err := s3.UploadContent(ctx, checksums.Marshal(), path.Join(setName, checksumsName)); err != nil {
+		return "", fmt.Errorf("can't upload checksums: %v", err)
+	}
+	contentSum := fmt.Sprintf("%x", sha256.Sum256(digests.Marshal()))
+	return setName, uploadManifest(ctx, s3, local, "archive", path.Join(setName, manifestName), schemaOnly, nil, "", contentSum)
+}
+
+// downloadTableArchives - download metadata archive and archives of tables matched by patterns, all tables
+// are downloaded if there are no patterns. Metadata of other tables is removed, so create-tables doesn't create them
+func downloadTableArchives(ctx context.Context, s3 *S3, backupPath string, setName string, tables []string, chown *fileOwner, tmpDir string) error {
+	dstPath := backupPath
+	matcher, err := newTableMatcher(tables, false)
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		matcher = nil
+	}
+	manifest, err := downloadManifest(ctx, s3, path.Join(setName, manifestName), dstPath, setName)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		return fmt.Errorf("backup '%s' doesn't have manifest, it's incomplete", setName)
+	}
+	archives := []string{metadataArchiveName}
+	seen := make(map[string]bool)
+	for _, table := range manifest.Tables {
+		name := tableArchiveName(table.Database, table.Name)
+		if seen[name] || (matcher != nil && !matcher.Match(table.Database, table.Name)) {
+			continue
+		}
+		seen[name] = true
+		archives = append(archives, name)
+	}
+	if matcher != nil {
+		if len(archives) == 1 {
+			return fmt.Errorf("there are no tables matched by %s in backup", strings.Join(tables, ", "))
+		}
+		// manifest must describe only downloaded tables to be validated by restore
+		if err := writeManifestOfTables(manifest, matcher, path.Join(dstPath, manifestName), s3.DryRun); err != nil {
+			return err
+		}
+	}
+	if s3.DryRun {
+		logger.Infof("Download and extract '%s' from '%s' to '%s'", strings.Join(archives, ", "), setName, dstPath)
+		return nil
+	}
+	// metadata and shadows are taken only from archives, so files of previous download must not be mixed with them
+	for _, key := range []string{"metadata", "shadow", "disks"} {
+		if err := os.RemoveAll(path.Join(dstPath, key)); err != nil {
+			return fmt.Errorf("can't remove previously downloaded %s with: %v", key, err)
+		}
+	}
+	for _, archive := range archives {
+		if err := downloadAndUntar(ctx, s3, []string{path.Join(setName, archive)}, dstPath, chown, tmpDir, manifest.ContentSHA256 != ""); err != nil {
+			return err
+		}
+	}
+	logger.Infof("%d tables are downloaded", len(archives)-1)
+	if matcher == nil {
+		return nil
+	}
+	return removeUnmatchedMetadata(path.Join(dstPath, "metadata"), matcher)
+}
+
+// removeUnmatchedMetadata - remove metadata/<db>/<table>.sql of tables which aren't matched
+func removeUnmatchedMetadata(metadataPath string, matcher *tableMatcher) error {
+	databases, err := ioutil.ReadDir(metadataPath)
+	if err != nil {
+		return err
+	}
+	for _, database := range databases {
+		if !database.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(path.Join(metadataPath, database.Name()))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), ".sql") || matcher.Match(database.Name(), strings.TrimSuffix(file.Name(), ".sql")) {
+				continue
+			}
+			if err := os.Remove(path.Join(metadataPath, database.Name(), file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const (
+	// backupNameTag - tag of uploaded object with name of backup which object belongs to
+	backupNameTag = "clickhouse-backup-name"
+	// backupCreatedTag - tag of uploaded object with time when upload of backup started
+	backupCreatedTag = "clickhouse-backup-created"
+	// maxObjectTags - s3 allows 10 tags per object, two of them are set by clickhouse-backup
+	maxObjectTags = 8
+)
+
+// tagBackup - tag objects uploaded from now with name of backup and current time
+func (s *S3) tagBackup(name string) {
+	s.backupName = name
+	s.backupCreated = time.Now().UTC()
+}
+
+// tagging - tags of s3.tags and of backup as URL query for Tagging of upload, nil if endpoint doesn't support tagging
+func (s *S3) tagging() *string {
+	if atomic.LoadInt32(&s.taggingUnsupported) == 1 {
+		return nil
+	}
+	tags := url.Values{}
+	for key, value := range s.Config.Tags {
+		tags.Set(key, value)
+	}
+	if s.backupName != "" {
+		tags.Set(backupNameTag, s.backupName)
+		tags.Set(backupCreatedTag, s.backupCreated.Format(time.RFC3339))
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return aws.String(tags.Encode())
+}
+
+// taggingUnsupportedError - upload is rejected because endpoint doesn't support tagging,
+// it is repeated without tags by uploadWithTagging
+type taggingUnsupportedError struct {
+	err error
+}
+
+func (e *taggingUnsupportedError) Error() string {
+	return fmt.Sprintf("endpoint doesn't support tagging: %v", e.err)
+}
+
+// taggingError - disable tagging if upload with tags is rejected as not implemented, so the next uploads
+// are made without tags. Other errors are returned as is
+func (s *S3) taggingError(err error, tagging *string) error {
+	if err == nil || tagging == nil {
+		return err
+	}
+	e, ok := err.(awserr.RequestFailure)
+	if !ok || (e.Code() != "NotImplemented" && e.StatusCode() != 501) {
+		return err
+	}
+	if atomic.CompareAndSwapInt32(&s.taggingUnsupported, 0, 1) {
+		logger.Warnf("s3 endpoint doesn't support tagging, objects are uploaded without tags: %v", err)
+	}
+	return &taggingUnsupportedError{err: err}
+}
+
+// uploadWithTagging - call upload with tags, upload which is rejected because endpoint doesn't support tagging
+// is repeated once without tags at once, it doesn't take attempt of s3.max_retries
+func (s *S3) uploadWithTagging(upload func(tagging *string) error) error {
+	tagging := s.tagging()
+	err := upload(tagging)
+	if _, ok := s.taggingError(err, tagging).(*taggingUnsupportedError); ok {
+		return upload(nil)
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagging(t *testing.T) {
+	s := &S3{Config: &S3Config{}}
+	assert.Nil(t, s.tagging())
+
+	s.Config.Tags = map[string]string{"env": "prod", "cluster": "analytics"}
+	assert.Equal(t, "cluster=analytics&env=prod", aws.StringValue(s.tagging()))
+
+	s.tagBackup("2020-01-02T03:04:05Z")
+	s.backupCreated = time.Date(2020, 1, 2, 3, 4, 6, 0, time.UTC)
+	tags, err := url.ParseQuery(aws.StringValue(s.tagging()))
+	assert.NoError(t, err)
+	assert.Equal(t, url.Values{
+		"env":            {"prod"},
+		"cluster":        {"analytics"},
+		backupNameTag:    {"2020-01-02T03:04:05Z"},
+		backupCreatedTag: {"2020-01-02T03:04:06Z"},
+	}, tags)
+
+	s.taggingUnsupported = 1
+	assert.Nil(t, s.tagging())
+}
+
+func TestUploadWithTagging(t *testing.T) {
+	s := &S3{Config: &S3Config{Tags: map[string]string{"env": "prod"}}}
+	notImplemented := awserr.NewRequestFailure(awserr.New("NotImplemented", "tagging isn't supported", nil), 501, "")
+	var calls []*string
+	err := s.uploadWithTagging(func(tagging *string) error {
+		calls = append(calls, tagging)
+		if tagging != nil {
+			return notImplemented
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, calls, 2) {
+		assert.Equal(t, "env=prod", aws.StringValue(calls[0]))
+		assert.Nil(t, calls[1])
+	}
+	assert.False(t, isTransientError(s.taggingError(notImplemented, calls[0])))
+
+	// endpoint which rejects upload without tags too fails without more attempts
+	calls = nil
+	err = s.uploadWithTagging(func(tagging *string) error {
+		calls = append(calls, tagging)
+		return notImplemented
+	})
+	assert.Equal(t, notImplemented, err)
+	assert.Equal(t, []*string{nil}, calls)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const maxThrottleChunk = 64 * 1024
+
+// rateLimiter - limit summary throughput of all readers created by it
+type rateLimiter struct {
+	mu             sync.Mutex
+	bytesPerSecond int64
+	next           time.Time
+}
+
+// newRateLimiter - returns nil which means unlimited when bytesPerSecond is 0
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// Reader - wrap r to share the limit with other readers
+func (l *rateLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{r: r, limiter: l}
+}
+
+// wait - reserve time slot for n bytes and sleep until it comes
+func (l *rateLimiter) wait(n int) {
+	if n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+func (l *rateLimiter) chunkSize() int {
+	if l.bytesPerSecond < maxThrottleChunk {
+		return int(l.bytesPerSecond)
+	}
+	return maxThrottleChunk
+}
+
+type throttledReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if chunk := t.limiter.chunkSize(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := t.r.Read(p)
+	t.limiter.wait(n)
+	return n, err
+}
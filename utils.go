@@ -1,11 +1,28 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
+	"syscall"
 )
 
+// contextReader - reader which stops with error of ctx when ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
 func copyFile(srcFile string, dstFile string) error {
 	src, err := os.Open(srcFile)
 	if err != nil {
@@ -21,8 +38,50 @@ func copyFile(srcFile string, dstFile string) error {
 	return err
 }
 
+// moveFile - rename file, it is copied and removed if dstFile is on another disk
 func moveFile(srcFile string, dstFile string) error {
-	return os.Rename(srcFile, dstFile)
+	err := os.Rename(srcFile, dstFile)
+	if linkErr, ok := err.(*os.LinkError); ok && linkErr.Err == syscall.EXDEV {
+		if err := copyFile(srcFile, dstFile); err != nil {
+			return err
+		}
+		return os.Remove(srcFile)
+	}
+	return err
+}
+
+// mkdirAllMode - create dir with missing parents and set mode of every created directory,
+// mode of MkdirAll is limited by umask
+func mkdirAllMode(dir string, mode os.FileMode) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); !os.IsNotExist(err) {
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	for _, d := range missing {
+		if err := os.Chmod(d, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chownTree - set owner of dir and everything inside it, symlinks aren't followed
+func chownTree(dir string, owner *fileOwner) error {
+	return filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(filePath, owner.Uid, owner.Gid)
+	})
 }
 
 func cleanDir(dir string) error {
@@ -43,3 +102,58 @@ func cleanDir(dir string) error {
 	}
 	return nil
 }
+
+// formatBytes - human readable size
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// runParallel - call fn for 0..n-1 in at most concurrency goroutines, no new calls are started after the first error,
+// calls which are already running are waited and the first error is returned
+func runParallel(concurrency int, n int, fn func(i int) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	jobs := make(chan int)
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := fn(i); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunParallel(t *testing.T) {
+	var running, maxRunning, calls int32
+	err := runParallel(3, 20, func(i int) error {
+		atomic.AddInt32(&calls, 1)
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(20), calls)
+	assert.True(t, maxRunning <= 3)
+}
+
+func TestRunParallelFirstError(t *testing.T) {
+	var calls int32
+	err := runParallel(2, 100, func(i int) error {
+		atomic.AddInt32(&calls, 1)
+		if i == 1 {
+			return errors.New("table is broken")
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	assert.EqualError(t, err, "table is broken")
+	assert.True(t, calls < 100)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// viewRe - name of view in create query
+	viewRe = regexp.MustCompile("(?is)^\\s*CREATE\\s+(?:MATERIALIZED\\s+)?VIEW\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?([\\w.`\"]+)")
+	// viewDependencyRe - tables which view reads from or writes to
+	viewDependencyRe = regexp.MustCompile("(?i)\\b(?:FROM|JOIN|TO)\\s+([\\w.`\"]+)")
+)
+
+// isView - check if query creates view or materialized view
+func isView(query string) bool {
+	return viewRe.MatchString(query)
+}
+
+// qualifiedName - database.name of table from query, database of view is used if it is omitted
+func qualifiedName(name string, database string) string {
+	name = strings.NewReplacer("`", "", "\"", "").Replace(name)
+	if !strings.Contains(name, ".") {
+		name = database + "." + name
+	}
+	return name
+}
+
+// sortViews - order views so every view is created after views which it reads from or writes to,
+// views with cyclic or unresolved dependencies keep their order at the end
+func sortViews(views []RestoreTable) []RestoreTable {
+	names := make([]string, len(views))
+	index := make(map[string]int)
+	for i, view := range views {
+		if match := viewRe.FindStringSubmatch(view.Query); match != nil {
+			names[i] = qualifiedName(match[1], view.Database)
+			index[names[i]] = i
+		}
+	}
+	dependencies := make([]map[int]bool, len(views))
+	for i, view := range views {
+		dependencies[i] = make(map[int]bool)
+		for _, match := range viewDependencyRe.FindAllStringSubmatch(view.Query, -1) {
+			if j, ok := index[qualifiedName(match[1], view.Database)]; ok && j != i {
+				dependencies[i][j] = true
+			}
+		}
+	}
+	result := make([]RestoreTable, 0, len(views))
+	created := make([]bool, len(views))
+	for len(result) < len(views) {
+		var ready []int
+		for i := range views {
+			if created[i] {
+				continue
+			}
+			isReady := true
+			for j := range dependencies[i] {
+				if !created[j] {
+					isReady = false
+					break
+				}
+			}
+			if isReady {
+				ready = append(ready, i)
+			}
+		}
+		if len(ready) == 0 {
+			// cycle, create the rest in original order and let clickhouse report errors
+			for i := range views {
+				if !created[i] {
+					ready = append(ready, i)
+				}
+			}
+		}
+		sort.Ints(ready)
+		for _, i := range ready {
+			created[i] = true
+			result = append(result, views[i])
+		}
+	}
+	return result
+}
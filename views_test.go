@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortViews(t *testing.T) {
+	views := []RestoreTable{
+		{Database: "db", Query: "CREATE MATERIALIZED VIEW daily_mv TO db.daily AS SELECT day, sum(hits) AS hits FROM db.hourly_view GROUP BY day"},
+		{Database: "db", Query: "CREATE VIEW hourly_view AS SELECT * FROM `db`.`hourly` FINAL"},
+		{Database: "db", Query: "CREATE MATERIALIZED VIEW hourly ENGINE = SummingMergeTree ORDER BY hour AS SELECT hour, count() AS hits FROM db.events GROUP BY hour"},
+		{Database: "other", Query: "CREATE MATERIALIZED VIEW IF NOT EXISTS copy TO other.target AS SELECT * FROM events"},
+	}
+	result := sortViews(views)
+	names := []string{}
+	for _, view := range result {
+		names = append(names, qualifiedName(viewRe.FindStringSubmatch(view.Query)[1], view.Database))
+	}
+	assert.Equal(t, []string{"db.hourly", "other.copy", "db.hourly_view", "db.daily_mv"}, names)
+	assert.False(t, isView("CREATE TABLE db.events (id UInt64) ENGINE = MergeTree ORDER BY id"))
+}
+
+func TestSortViewsCycle(t *testing.T) {
+	views := []RestoreTable{
+		{Database: "db", Query: "CREATE VIEW a AS SELECT * FROM b"},
+		{Database: "db", Query: "CREATE VIEW b AS SELECT * FROM a"},
+		{Database: "db", Query: "CREATE VIEW c AS SELECT * FROM events"},
+	}
+	result := sortViews(views)
+	assert.Len(t, result, 3)
+	assert.Equal(t, views[2], result[0])
+}